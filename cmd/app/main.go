@@ -2,21 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"log/slog"
+	"net"
 	"os"
-	"os/signal"
-	"syscall"
 
 	"github.com/vkrishna03/streamz/internal/config"
 	"github.com/vkrishna03/streamz/internal/database"
 	"github.com/vkrishna03/streamz/internal/modules/auth"
+	"github.com/vkrishna03/streamz/internal/modules/chat"
 	"github.com/vkrishna03/streamz/internal/modules/device"
 	"github.com/vkrishna03/streamz/internal/modules/stream"
+	"github.com/vkrishna03/streamz/internal/modules/transfer"
 	"github.com/vkrishna03/streamz/internal/modules/webrtc"
 	"github.com/vkrishna03/streamz/internal/modules/ws"
 	"github.com/vkrishna03/streamz/internal/server"
+	"github.com/vkrishna03/streamz/internal/turn"
 )
 
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	// Config
 	cfg := config.Load()
@@ -33,42 +39,135 @@ func main() {
 	// Server
 	srv := server.New(cfg)
 
+	// Module routes
+	api := srv.Router().Group("/api/v1")
+
 	// WebSocket hub (must be set up before other routes that might use it)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	hub := ws.Setup(srv.Router(), db, cfg.JWT.Secret)
+	limits := ws.DefaultLimits()
+	limits.ParsePolicies(cfg.WS.RateLimits)
+	limits.MaxViolations = cfg.WS.MaxViolations
+	limits.ViolationWindow = cfg.WS.ViolationWindow
+
+	hub := ws.Setup(srv.Router(), api, db, ws.Config{
+		JWTSecret:          cfg.JWT.Secret,
+		TicketTTL:          cfg.WS.TicketTTL,
+		AllowedOrigins:     cfg.Server.AllowedOrigins,
+		ResumeGrace:        cfg.WS.ResumeGrace,
+		ReplayBufferSize:   cfg.WS.ReplayBufferSize,
+		AwayTimeout:        cfg.WS.AwayTimeout,
+		SlowClientDrops:    cfg.WS.SlowClientDrops,
+		MinProtocolVersion: cfg.WS.MinProtocolVersion,
+		HelloTimeout:       cfg.WS.HelloTimeout,
+		ServerVersion:      version,
+		Limits:             limits,
+		Backplane:          cfg.WS.Backplane,
+		InstanceID:         cfg.WS.InstanceID,
+	})
 	go hub.Run(ctx)
 	slog.Info("websocket hub started")
 
-	// Module routes
-	api := srv.Router().Group("/api/v1")
-
-	// Auth module (public routes)
+	// Auth module (public routes); revoked sessions are disconnected by the hub
 	auth.Setup(api, db, auth.Config{
 		JWTSecret:        cfg.JWT.Secret,
 		JWTExpiry:        cfg.JWT.Expiry,
 		RefreshExpiry:    cfg.JWT.RefreshExpiry,
 		PasswordResetExp: cfg.JWT.PasswordResetExp,
-	})
+	}, hub)
+
+	// Device module (protected routes); changes go out through the hub
+	device.Setup(api, db, cfg.JWT.Secret, hub)
 
-	// Device module (protected routes)
-	device.Setup(api, db, cfg.JWT.Secret)
+	// Stream module (protected routes); lifecycle events go out through the hub
+	streams := stream.Setup(api, db, cfg.JWT.Secret, hub)
+	hub.SetStreams(streams)
 
-	// Stream module (protected routes)
-	stream.Setup(api, db, cfg.JWT.Secret)
+	// Chat module (protected routes); messages are delivered through the hub
+	chatSvc := chat.Setup(api, db, cfg.JWT.Secret, hub)
+	hub.SetChat(chatSvc)
+
+	// Transfer module (protected routes); offers and progress go out through
+	// the hub, which passes answers back
+	transfers, err := transfer.Setup(api, db, transfer.Config{
+		JWTSecret: cfg.JWT.Secret,
+		Dir:       cfg.Transfer.Dir,
+		TTL:       cfg.Transfer.TTL,
+		ChunkSize: int64(cfg.Transfer.ChunkSize),
+	}, hub)
+	if err != nil {
+		slog.Error("failed to set up transfers", "error", err)
+		os.Exit(1)
+	}
+	hub.SetTransfers(transfers)
+	go transfers.RunExpiry(ctx)
+
+	// Embedded STUN/TURN server, if enabled; it relays for users holding
+	// credentials from the ICE servers endpoint
+	var relay *turn.Server
+	if cfg.ICE.TURNListen != "" {
+		var turnTLS *tls.Config
+		if cfg.ICE.TURNListenTLS != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.ICE.TURNTLSCert, cfg.ICE.TURNTLSKey)
+			if err != nil {
+				slog.Error("failed to load TURN TLS certificate", "error", err)
+				os.Exit(1)
+			}
+			turnTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		}
+
+		relay, err = turn.Listen(turn.Config{
+			Listen:         cfg.ICE.TURNListen,
+			ListenTCP:      cfg.ICE.TURNListenTCP,
+			ListenTLS:      cfg.ICE.TURNListenTLS,
+			TLS:            turnTLS,
+			PublicIP:       net.ParseIP(cfg.ICE.TURNPublicIP),
+			Realm:          cfg.ICE.TURNRealm,
+			Secret:         cfg.ICE.TURNSecret,
+			MinPort:        cfg.ICE.TURNMinPort,
+			MaxPort:        cfg.ICE.TURNMaxPort,
+			MaxAllocations: cfg.ICE.TURNMaxAllocations,
+			Bandwidth:      cfg.ICE.TURNBandwidth,
+			AllowedPeers:   cfg.ICE.TURNAllowedPeers,
+		})
+		if err != nil {
+			slog.Error("failed to start TURN server", "error", err)
+			os.Exit(1)
+		}
+		go relay.Serve(ctx)
+		slog.Info("turn server started", "addr", relay.Addr(), "tcp_addr", relay.TCPAddr(), "tls_addr", relay.TLSAddr())
+	}
+
+	// Selective forwarding unit, if enabled; sources of sfu streams publish
+	// to it over the hub's signaling and the user's other devices subscribe
+	if cfg.ICE.SFU {
+		sfu, err := webrtc.NewSFU(webrtc.SFUConfig{
+			PublicIP:       cfg.ICE.SFUPublicIP,
+			MinPort:        cfg.ICE.SFUMinPort,
+			MaxPort:        cfg.ICE.SFUMaxPort,
+			MaxSubscribers: cfg.ICE.SFUMaxSubscribers,
+		}, streams, hub)
+		if err != nil {
+			slog.Error("failed to set up SFU", "error", err)
+			os.Exit(1)
+		}
+		defer sfu.Close()
+		hub.SetSFU(sfu)
+		streams.SetSFU(sfu)
+		slog.Info("sfu started", "public_ip", cfg.ICE.SFUPublicIP)
+	}
 
 	// WebRTC module (ICE server config)
-	webrtc.Setup(api, cfg.ICE, cfg.JWT.Secret)
-
-	// Graceful shutdown
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
-		slog.Info("shutting down...")
-		cancel()
-	}()
+	webrtc.Setup(api, cfg.ICE, cfg.JWT.Secret, relay)
+
+	// Graceful shutdown: close connections and save presence while the hub
+	// and database are still up; the hub stops when Run returns
+	srv.OnShutdown(func() {
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), cfg.WS.DrainTimeout)
+		defer drainCancel()
+		hub.Shutdown(drainCtx)
+	})
 
 	// Run
 	if err := srv.Run(); err != nil {
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Refresh the access token when it is this close to expiring
+const refreshBefore = 2 * time.Minute
+
+// api calls the server's REST endpoints
+type api struct {
+	baseURL string
+	http    *http.Client
+}
+
+// user is a synthetic account owning one device pair. Both devices share
+// its tokens, so refreshes go through one lock.
+type user struct {
+	email string
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiresAt    time.Time
+}
+
+type authResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+func (u *user) setTokens(resp authResponse) {
+	u.accessToken = resp.AccessToken
+	u.refreshToken = resp.RefreshToken
+	u.expiresAt = time.Unix(resp.ExpiresAt, 0)
+}
+
+// token returns the user's access token
+func (u *user) token() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.accessToken
+}
+
+// register creates a user with a unique email
+func (a *api) register(ctx context.Context, email, password string) (*user, error) {
+	var resp authResponse
+	err := a.do(ctx, http.MethodPost, "/api/v1/auth/register", "", map[string]string{
+		"email":      email,
+		"password":   password,
+		"first_name": "wsload",
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &user{email: email}
+	u.setTokens(resp)
+	return u, nil
+}
+
+// refresh returns a fresh access token, refreshing it if the current one is
+// about to expire
+func (a *api) refresh(ctx context.Context, u *user) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if time.Until(u.expiresAt) > refreshBefore {
+		return u.accessToken, nil
+	}
+
+	var resp authResponse
+	err := a.do(ctx, http.MethodPost, "/api/v1/auth/refresh", "", map[string]string{
+		"refresh_token": u.refreshToken,
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	u.setTokens(resp)
+	return u.accessToken, nil
+}
+
+// registerDevice adds a device to the user's account and returns its ID
+func (a *api) registerDevice(ctx context.Context, u *user, name, deviceType string, hasCamera bool) (uuid.UUID, error) {
+	var resp struct {
+		ID uuid.UUID `json:"id"`
+	}
+	err := a.do(ctx, http.MethodPost, "/api/v1/devices", u.token(), map[string]interface{}{
+		"device_id":      uuid.NewString(),
+		"device_name":    name,
+		"device_type":    deviceType,
+		"has_camera":     hasCamera,
+		"has_microphone": hasCamera,
+	}, &resp)
+	return resp.ID, err
+}
+
+func (a *api) do(ctx context.Context, method, path, token string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s %s: %d %s %s", method, path, resp.StatusCode, apiErr.Code, apiErr.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/vkrishna03/streamz/internal/modules/ws"
+)
+
+// device is one synthetic /ws connection. Sources send offers and monitors
+// answer them; both trickle candidates afterwards, like a browser would.
+type device struct {
+	id   uuid.UUID
+	user *user
+	peer *device
+
+	api   *api
+	stats *stats
+	cfg   config
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	nextID  atomic.Uint64
+	closing atomic.Bool
+	done    chan struct{}
+}
+
+// connect opens the WebSocket, says hello and waits for the session message
+func (d *device) connect(ctx context.Context, wsURL string) error {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("device_id", d.id.String())
+	q.Set("hello", "1")
+	u.RawQuery = q.Encode()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+d.user.token())
+
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	start := time.Now()
+
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("dial: %s", resp.Status)
+		}
+		return fmt.Errorf("dial: %w", err)
+	}
+
+	hello, _ := ws.NewMessage(ws.TypeHello, ws.HelloPayload{
+		ProtocolVersion: ws.ProtocolVersion,
+		AppVersion:      "wsload",
+	})
+	if err := conn.WriteJSON(hello); err != nil {
+		conn.Close()
+		return fmt.Errorf("hello: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("waiting for session: %w", err)
+		}
+		var msg ws.Message
+		if json.Unmarshal(data, &msg) == nil && msg.Type == ws.TypeSession {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	d.stats.connected(time.Since(start))
+	d.conn = conn
+	d.done = make(chan struct{})
+	go d.readLoop()
+	return nil
+}
+
+// readLoop handles server messages until the connection closes
+func (d *device) readLoop() {
+	defer close(d.done)
+
+	for {
+		_, data, err := d.conn.ReadMessage()
+		if err != nil {
+			if !d.closing.Load() {
+				d.stats.disconnected(err)
+			}
+			return
+		}
+		received := time.Now()
+
+		var msg ws.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			d.stats.error("UNPARSEABLE")
+			continue
+		}
+
+		switch msg.Type {
+		case ws.TypeAck:
+			d.stats.ack()
+
+		case ws.TypeNack, ws.TypeError:
+			var p ws.ErrorPayload
+			_ = json.Unmarshal(msg.Payload, &p)
+			if msg.Type == ws.TypeNack {
+				d.stats.nack(p.Code)
+			} else {
+				d.stats.error(p.Code)
+			}
+
+		case ws.TypeOffer:
+			var p ws.OfferPayload
+			if json.Unmarshal(msg.Payload, &p) == nil {
+				d.recordLatency(msg.Type, p.SDP, received)
+				d.answer()
+			}
+
+		case ws.TypeAnswer:
+			var p ws.AnswerPayload
+			if json.Unmarshal(msg.Payload, &p) == nil {
+				d.recordLatency(msg.Type, p.SDP, received)
+			}
+
+		case ws.TypeCandidate:
+			var p ws.CandidatePayload
+			if json.Unmarshal(msg.Payload, &p) == nil {
+				d.recordLatency(msg.Type, p.Candidate, received)
+			}
+
+		case ws.TypeAuthExpiring:
+			go d.refresh()
+		}
+	}
+}
+
+// negotiate starts one offer/answer exchange with the peer
+func (d *device) negotiate() {
+	d.send(ws.TypeOffer, ws.OfferPayload{ToDeviceID: d.peer.id, SDP: fakeSDP(time.Now(), d.cfg.sdpSize)})
+	d.trickle()
+}
+
+// answer replies to an offer and trickles the monitor's candidates
+func (d *device) answer() {
+	d.send(ws.TypeAnswer, ws.AnswerPayload{ToDeviceID: d.peer.id, SDP: fakeSDP(time.Now(), d.cfg.sdpSize)})
+	d.trickle()
+}
+
+func (d *device) trickle() {
+	for i := 0; i < d.cfg.candidates; i++ {
+		index := uint16(0)
+		mid := "0"
+		d.send(ws.TypeCandidate, ws.CandidatePayload{
+			ToDeviceID:    d.peer.id,
+			Candidate:     fakeCandidate(time.Now(), i),
+			SDPMLineIndex: &index,
+			SDPMid:        &mid,
+		})
+	}
+}
+
+// send writes a message with an ID so the server acks or nacks it
+func (d *device) send(msgType string, payload interface{}) {
+	msg, err := ws.NewMessage(msgType, payload)
+	if err != nil {
+		return
+	}
+	msg.ID = strconv.FormatUint(d.nextID.Add(1), 10)
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	d.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := d.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		d.stats.error("WRITE_FAILED")
+		return
+	}
+	d.stats.messageSent(msgType)
+}
+
+// refresh hands the connection a new access token before the old one expires
+func (d *device) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token, err := d.api.refresh(ctx, d.user)
+	if err != nil {
+		d.stats.refreshFailed()
+		return
+	}
+
+	msg, _ := ws.NewMessage(ws.TypeAuthRefresh, ws.AuthRefreshPayload{AccessToken: token})
+	data, _ := json.Marshal(msg)
+
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	_ = d.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// recordLatency reads the send time stamped into an SDP or candidate
+func (d *device) recordLatency(msgType, body string, received time.Time) {
+	sent, ok := parseStamp(body)
+	if !ok {
+		d.stats.error("UNSTAMPED_" + strings.ToUpper(msgType))
+		return
+	}
+	d.stats.messageReceived(msgType, received.Sub(sent))
+}
+
+// close ends the connection normally
+func (d *device) close() {
+	if d.conn == nil {
+		return
+	}
+	d.closing.Store(true)
+
+	d.writeMu.Lock()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "load test done")
+	_ = d.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	d.writeMu.Unlock()
+
+	select {
+	case <-d.done:
+	case <-time.After(2 * time.Second):
+	}
+	d.conn.Close()
+}
+
+// Synthetic signaling bodies carry their send time so the receiver can
+// measure latency. SDPs are padded to a realistic size.
+
+const stampPrefix = "wsload-"
+
+func fakeSDP(sent time.Time, size int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\no=%s%d 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n", stampPrefix, sent.UnixNano())
+	b.WriteString("m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\nc=IN IP4 0.0.0.0\r\n")
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "a=rtpmap:%d VP8/90000\r\n", 96+i%32)
+	}
+	return b.String()
+}
+
+func fakeCandidate(sent time.Time, i int) string {
+	return fmt.Sprintf("candidate:%s%d 1 udp 2122260223 192.0.2.1 %d typ host", stampPrefix, sent.UnixNano(), 50000+i)
+}
+
+// parseStamp finds the send time written by fakeSDP or fakeCandidate
+func parseStamp(body string) (time.Time, bool) {
+	i := strings.Index(body, stampPrefix)
+	if i < 0 {
+		return time.Time{}, false
+	}
+	rest := body[i+len(stampPrefix):]
+	end := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if end < 0 {
+		end = len(rest)
+	}
+	nanos, err := strconv.ParseInt(rest[:end], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, nanos), true
+}
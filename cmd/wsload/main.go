@@ -0,0 +1,252 @@
+// Command wsload checks how a local server holds up under many concurrent
+// devices. It registers synthetic users with one source and one monitor
+// device each, opens a /ws connection per device and has every pair run
+// offer/answer/candidate exchanges. It then reports connection times,
+// message latency percentiles, drops and, given the server's pid, its memory.
+//
+//	go run ./cmd/wsload -devices 1000 -duration 1m -pid $(pgrep -n app)
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type config struct {
+	baseURL      string
+	devices      int
+	duration     time.Duration
+	ramp         int
+	interval     time.Duration
+	candidates   int
+	sdpSize      int
+	setupWorkers int
+	settle       time.Duration
+	pid          int
+}
+
+// pair is a user's source and monitor
+type pair struct {
+	source  *device
+	monitor *device
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.baseURL, "url", "http://localhost:8080", "server base URL")
+	flag.IntVar(&cfg.devices, "devices", 1000, "concurrent devices (two per synthetic user)")
+	flag.DurationVar(&cfg.duration, "duration", time.Minute, "how long to run signaling traffic once connected")
+	flag.IntVar(&cfg.ramp, "ramp", 200, "new connections per second")
+	flag.DurationVar(&cfg.interval, "interval", 5*time.Second, "time between negotiations per pair")
+	flag.IntVar(&cfg.candidates, "candidates", 4, "ICE candidates each side sends per negotiation")
+	flag.IntVar(&cfg.sdpSize, "sdp-size", 2048, "size of synthetic SDPs in bytes")
+	flag.IntVar(&cfg.setupWorkers, "setup-workers", 16, "concurrent REST calls while creating users and devices")
+	flag.DurationVar(&cfg.settle, "settle", 2*time.Second, "wait for in-flight messages before reporting")
+	flag.IntVar(&cfg.pid, "pid", 0, "server process ID, to report its memory")
+	flag.Parse()
+
+	if cfg.devices < 2 || cfg.devices%2 != 0 {
+		log.Fatal("-devices must be an even number of at least 2")
+	}
+	if cfg.ramp < 1 {
+		cfg.ramp = 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	client := &api{
+		baseURL: strings.TrimSuffix(cfg.baseURL, "/"),
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+	st := newStats()
+
+	var mem *memorySampler
+	if cfg.pid > 0 {
+		mem = &memorySampler{pid: cfg.pid}
+		if _, err := mem.rss(); err != nil {
+			log.Fatalf("can't read memory of pid %d: %v", cfg.pid, err)
+		}
+	}
+
+	log.Printf("creating %d users with 2 devices each", cfg.devices/2)
+	start := time.Now()
+	pairs, err := setup(ctx, cfg, client, st)
+	if err != nil {
+		log.Fatalf("setup failed: %v", err)
+	}
+	log.Printf("setup done in %v", time.Since(start).Round(time.Millisecond))
+
+	stopSampling := make(chan struct{})
+	if mem != nil {
+		mem.sample()
+		go mem.run(time.Second, stopSampling)
+	}
+
+	log.Printf("opening %d connections at %d/s", cfg.devices, cfg.ramp)
+	start = time.Now()
+	connectAll(ctx, cfg, pairs)
+	log.Printf("connections done in %v", time.Since(start).Round(time.Millisecond))
+
+	log.Printf("running signaling traffic for %v", cfg.duration)
+	runTraffic(ctx, cfg, pairs)
+
+	time.Sleep(cfg.settle)
+	if mem != nil {
+		close(stopSampling)
+		mem.sample()
+	}
+
+	for _, p := range pairs {
+		p.source.close()
+		p.monitor.close()
+	}
+
+	st.report(os.Stdout, cfg.devices, mem)
+}
+
+// setup registers the users and devices through the REST API
+func setup(ctx context.Context, cfg config, client *api, st *stats) ([]*pair, error) {
+	runID := time.Now().UnixNano()
+	pairs := make([]*pair, cfg.devices/2)
+
+	jobs := make(chan int)
+	errs := make(chan error, cfg.setupWorkers)
+	var wg sync.WaitGroup
+
+	for w := 0; w < cfg.setupWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				p, err := setupPair(ctx, cfg, client, st, runID, i)
+				if err != nil {
+					errs <- err
+					return
+				}
+				pairs[i] = p
+			}
+		}()
+	}
+
+	var setupErr error
+feed:
+	for i := range pairs {
+		select {
+		case jobs <- i:
+		case setupErr = <-errs:
+			break feed
+		case <-ctx.Done():
+			setupErr = ctx.Err()
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if setupErr == nil {
+		select {
+		case setupErr = <-errs:
+		default:
+		}
+	}
+	return pairs, setupErr
+}
+
+func setupPair(ctx context.Context, cfg config, client *api, st *stats, runID int64, i int) (*pair, error) {
+	email := fmt.Sprintf("wsload-%d-%d@example.com", runID, i)
+	u, err := client.register(ctx, email, "wsload-password")
+	if err != nil {
+		return nil, err
+	}
+
+	sourceID, err := client.registerDevice(ctx, u, fmt.Sprintf("wsload source %d", i), "phone", true)
+	if err != nil {
+		return nil, err
+	}
+	monitorID, err := client.registerDevice(ctx, u, fmt.Sprintf("wsload monitor %d", i), "desktop", false)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &device{id: sourceID, user: u, api: client, stats: st, cfg: cfg}
+	monitor := &device{id: monitorID, user: u, api: client, stats: st, cfg: cfg}
+	source.peer, monitor.peer = monitor, source
+	return &pair{source: source, monitor: monitor}, nil
+}
+
+// connectAll opens every connection, cfg.ramp per second
+func connectAll(ctx context.Context, cfg config, pairs []*pair) {
+	wsURL := "ws" + strings.TrimPrefix(strings.TrimSuffix(cfg.baseURL, "/"), "http") + "/ws"
+
+	ticker := time.NewTicker(time.Second / time.Duration(cfg.ramp))
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	for _, p := range pairs {
+		for _, d := range []*device{p.monitor, p.source} {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			}
+
+			wg.Add(1)
+			go func(d *device) {
+				defer wg.Done()
+				if err := d.connect(ctx, wsURL); err != nil {
+					d.stats.connectFailed(err)
+				}
+			}(d)
+		}
+	}
+	wg.Wait()
+}
+
+// runTraffic has every connected pair negotiate every cfg.interval, with a
+// random offset so pairs don't fire together
+func runTraffic(ctx context.Context, cfg config, pairs []*pair) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, p := range pairs {
+		if p.source.conn == nil || p.monitor.conn == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(p *pair) {
+			defer wg.Done()
+
+			select {
+			case <-time.After(rand.N(cfg.interval)):
+			case <-ctx.Done():
+				return
+			}
+
+			ticker := time.NewTicker(cfg.interval)
+			defer ticker.Stop()
+			for {
+				p.source.negotiate()
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stats collects results from every device
+type stats struct {
+	mu sync.Mutex
+
+	connectTimes   []time.Duration
+	connectErrors  map[string]int
+	latencies      map[string][]time.Duration
+	sent           map[string]int
+	received       map[string]int
+	acked          int
+	nacks          map[string]int
+	errors         map[string]int
+	disconnects    int
+	refreshErrors  int
+	lastDisconnect string
+}
+
+func newStats() *stats {
+	return &stats{
+		connectErrors: make(map[string]int),
+		latencies:     make(map[string][]time.Duration),
+		sent:          make(map[string]int),
+		received:      make(map[string]int),
+		nacks:         make(map[string]int),
+		errors:        make(map[string]int),
+	}
+}
+
+func (s *stats) connected(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connectTimes = append(s.connectTimes, d)
+}
+
+func (s *stats) connectFailed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connectErrors[err.Error()]++
+}
+
+func (s *stats) messageSent(msgType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[msgType]++
+}
+
+func (s *stats) messageReceived(msgType string, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received[msgType]++
+	s.latencies[msgType] = append(s.latencies[msgType], latency)
+}
+
+func (s *stats) ack() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked++
+}
+
+func (s *stats) nack(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nacks[code]++
+}
+
+func (s *stats) error(code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[code]++
+}
+
+func (s *stats) disconnected(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnects++
+	s.lastDisconnect = err.Error()
+}
+
+func (s *stats) refreshFailed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshErrors++
+}
+
+// report writes the results
+func (s *stats) report(w io.Writer, devices int, mem *memorySampler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Fprintf(w, "\nConnections: %d/%d opened", len(s.connectTimes), devices)
+	if n := devices - len(s.connectTimes); n > 0 {
+		fmt.Fprintf(w, ", %d failed", n)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "  connect time  %s\n", summarize(s.connectTimes))
+	for reason, n := range s.connectErrors {
+		fmt.Fprintf(w, "  failed x%d: %s\n", n, reason)
+	}
+
+	fmt.Fprintln(w, "\nMessage latency (sender to receiver)")
+	types := make([]string, 0, len(s.sent))
+	for t := range s.sent {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(w, "  %-18s sent %-7d received %-7d %s\n", t, s.sent[t], s.received[t], summarize(s.latencies[t]))
+	}
+
+	totalSent, totalReceived := 0, 0
+	for _, t := range types {
+		totalSent += s.sent[t]
+		totalReceived += s.received[t]
+	}
+	dropped := s.acked - totalReceived
+	if dropped < 0 {
+		dropped = 0
+	}
+
+	fmt.Fprintln(w, "\nDelivery")
+	fmt.Fprintf(w, "  sent %d, acked %d, received %d, dropped after ack %d\n", totalSent, s.acked, totalReceived, dropped)
+	for code, n := range s.nacks {
+		fmt.Fprintf(w, "  nack %s x%d\n", code, n)
+	}
+	for code, n := range s.errors {
+		fmt.Fprintf(w, "  error %s x%d\n", code, n)
+	}
+	if s.disconnects > 0 {
+		fmt.Fprintf(w, "  unexpected disconnects %d (last: %s)\n", s.disconnects, s.lastDisconnect)
+	}
+	if s.refreshErrors > 0 {
+		fmt.Fprintf(w, "  token refresh failures %d\n", s.refreshErrors)
+	}
+
+	if mem != nil {
+		mem.report(w)
+	}
+}
+
+// summarize formats percentiles of a sample
+func summarize(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return "(no samples)"
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return fmt.Sprintf("p50 %v  p90 %v  p99 %v  max %v",
+		round(percentile(sorted, 50)),
+		round(percentile(sorted, 90)),
+		round(percentile(sorted, 99)),
+		round(sorted[len(sorted)-1]),
+	)
+}
+
+// percentile returns the pth percentile of sorted samples (nearest rank)
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i < 1 {
+		i = 1
+	}
+	return sorted[i-1]
+}
+
+func round(d time.Duration) time.Duration {
+	if d > time.Millisecond {
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
+
+// memorySampler tracks the resident memory of the server process
+type memorySampler struct {
+	pid int
+
+	mu       sync.Mutex
+	baseline int64 // KB, before any connection
+	peak     int64
+	last     int64
+}
+
+// rss returns the process's resident set size in KB. ps works on both
+// Linux and macOS.
+func (m *memorySampler) rss() (int64, error) {
+	out, err := exec.Command("ps", "-o", "rss=", "-p", strconv.Itoa(m.pid)).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ps: %w", err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// sample records the current memory
+func (m *memorySampler) sample() {
+	kb, err := m.rss()
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.baseline == 0 {
+		m.baseline = kb
+	}
+	if kb > m.peak {
+		m.peak = kb
+	}
+	m.last = kb
+}
+
+// run samples every interval until stop is closed
+func (m *memorySampler) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sample()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (m *memorySampler) report(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "\nServer memory (pid %d, RSS)\n", m.pid)
+	if m.baseline == 0 {
+		fmt.Fprintln(w, "  no samples (is the pid right?)")
+		return
+	}
+	fmt.Fprintf(w, "  baseline %s, peak %s (+%s), end %s\n",
+		mb(m.baseline), mb(m.peak), mb(m.peak-m.baseline), mb(m.last))
+}
+
+func mb(kb int64) string {
+	return fmt.Sprintf("%.1fMB", float64(kb)/1024)
+}
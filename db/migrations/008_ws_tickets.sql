@@ -0,0 +1,11 @@
+CREATE TABLE ws_tickets (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    ticket VARCHAR(255) UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_ws_tickets_ticket ON ws_tickets(ticket);
+CREATE INDEX idx_ws_tickets_expires_at ON ws_tickets(expires_at);
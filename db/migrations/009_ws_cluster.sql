@@ -0,0 +1,20 @@
+-- Cluster-wide registry of which server instance each connected device is on
+CREATE TABLE ws_presence (
+    device_id UUID PRIMARY KEY REFERENCES devices(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    instance_id VARCHAR(255) NOT NULL,
+    connected_at TIMESTAMP DEFAULT NOW(),
+    heartbeat_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_ws_presence_instance_id ON ws_presence(instance_id);
+CREATE INDEX idx_ws_presence_heartbeat_at ON ws_presence(heartbeat_at);
+
+-- Backplane events too large for a NOTIFY payload (8000 bytes)
+CREATE TABLE ws_events (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX idx_ws_events_created_at ON ws_events(created_at);
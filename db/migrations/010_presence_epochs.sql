@@ -0,0 +1,4 @@
+-- Every connection claims the next epoch for its device. Presence writes
+-- carry the epoch so a late disconnect can't mark a reconnected device offline.
+ALTER TABLE devices ADD COLUMN presence_epoch BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE ws_presence ADD COLUMN epoch BIGINT NOT NULL DEFAULT 0;
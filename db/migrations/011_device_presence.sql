@@ -0,0 +1,6 @@
+-- Presence beyond online/offline: away for backgrounded clients and
+-- reconnecting while a dropped connection's session awaits resumption
+CREATE TYPE presence_state AS ENUM ('online', 'away', 'reconnecting', 'offline');
+
+ALTER TABLE devices ADD COLUMN presence presence_state NOT NULL DEFAULT 'offline';
+UPDATE devices SET presence = 'online' WHERE is_online = TRUE;
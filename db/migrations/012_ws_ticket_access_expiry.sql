@@ -0,0 +1,3 @@
+-- Expiry of the access token a ticket was issued with. A connection opened
+-- with the ticket must re-authenticate before then.
+ALTER TABLE ws_tickets ADD COLUMN access_expires_at TIMESTAMP NOT NULL DEFAULT NOW();
@@ -0,0 +1,20 @@
+-- Text messages between a user's devices, optionally about one stream.
+-- A NULL to_device_id addresses every device of the user.
+CREATE TABLE messages (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    from_device_id UUID REFERENCES devices(id) ON DELETE SET NULL,
+    to_device_id UUID REFERENCES devices(id) ON DELETE CASCADE,
+    stream_id UUID REFERENCES streams(id) ON DELETE SET NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_messages_user_created ON messages(user_id, created_at DESC, id DESC);
+CREATE INDEX idx_messages_stream_id ON messages(stream_id);
+
+-- How far each device has read; later messages addressed to it are unread
+CREATE TABLE message_reads (
+    device_id UUID PRIMARY KEY REFERENCES devices(id) ON DELETE CASCADE,
+    read_at TIMESTAMP NOT NULL
+);
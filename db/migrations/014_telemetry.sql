@@ -0,0 +1,15 @@
+-- Periodic health samples reported by connected devices. alerts lists the
+-- thresholds a sample newly crossed, e.g. ["battery_low"].
+CREATE TABLE telemetry_samples (
+    id BIGSERIAL PRIMARY KEY,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    battery_level SMALLINT NOT NULL,
+    charging BOOLEAN NOT NULL,
+    thermal_state VARCHAR(20) NOT NULL,
+    free_storage_mb BIGINT NOT NULL,
+    network_type VARCHAR(20) NOT NULL,
+    alerts JSONB NOT NULL DEFAULT '[]',
+    recorded_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_telemetry_samples_device_recorded ON telemetry_samples(device_id, recorded_at DESC);
@@ -0,0 +1,28 @@
+-- Files sent from one of a user's devices to another, staged on the server
+-- until the receiving device downloads them. received_bytes is how much of
+-- the upload is stored; the receiver may accept before it's complete.
+CREATE TYPE transfer_status AS ENUM ('uploading', 'ready', 'completed', 'declined', 'cancelled', 'expired');
+
+CREATE TABLE transfers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    from_device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    to_device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    file_name VARCHAR(255) NOT NULL,
+    content_type VARCHAR(255) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    received_bytes BIGINT NOT NULL DEFAULT 0,
+    status transfer_status NOT NULL DEFAULT 'uploading',
+    accepted_at TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_transfers_user_status ON transfers(user_id, status);
+CREATE INDEX idx_transfers_expires_at ON transfers(expires_at);
+
+-- Largest single file, and total bytes a user may have staged at once
+ALTER TABLE user_settings
+    ADD COLUMN max_transfer_bytes BIGINT DEFAULT 2147483648,
+    ADD COLUMN transfer_quota_bytes BIGINT DEFAULT 5368709120;
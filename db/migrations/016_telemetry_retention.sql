@@ -0,0 +1,2 @@
+-- Old samples are pruned across all devices by recorded_at
+CREATE INDEX idx_telemetry_samples_recorded_at ON telemetry_samples(recorded_at);
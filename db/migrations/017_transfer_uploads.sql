@@ -0,0 +1,8 @@
+-- The replica storing a transfer's next chunk. A claim is taken before a
+-- chunk is written and released once it's recorded; one left behind by a
+-- replica that died lapses at expires_at.
+CREATE TABLE transfer_uploads (
+    transfer_id UUID PRIMARY KEY REFERENCES transfers(id) ON DELETE CASCADE,
+    claim UUID NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
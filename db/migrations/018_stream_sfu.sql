@@ -0,0 +1,3 @@
+-- Streams forwarded by the server: the source publishes once and any of the
+-- user's devices subscribe, so they have no target device
+ALTER TABLE streams ADD COLUMN sfu BOOLEAN NOT NULL DEFAULT FALSE;
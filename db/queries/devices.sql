@@ -25,7 +25,9 @@ RETURNING *;
 
 -- name: UpdateDeviceOnlineStatus :exec
 UPDATE devices
-SET is_online = $2, last_seen = NOW()
+SET is_online = $2,
+    presence = CASE WHEN $2 THEN 'online'::presence_state ELSE 'offline'::presence_state END,
+    last_seen = NOW()
 WHERE id = $1;
 
 -- name: UpdateDeviceLastSeen :exec
@@ -38,3 +40,28 @@ DELETE FROM devices WHERE id = $1;
 
 -- name: CountUserDevices :one
 SELECT COUNT(*) FROM devices WHERE user_id = $1;
+
+-- name: ClaimDevicePresence :one
+UPDATE devices
+SET is_online = TRUE, presence = 'online', presence_epoch = presence_epoch + 1, last_seen = NOW()
+WHERE id = $1
+RETURNING presence_epoch;
+
+-- name: ReleaseDevicePresence :execrows
+UPDATE devices
+SET is_online = FALSE, presence = 'offline', last_seen = NOW()
+WHERE id = $1 AND presence_epoch = $2;
+
+-- name: SetDevicePresence :execrows
+UPDATE devices
+SET presence = $3, last_seen = NOW()
+WHERE id = $1 AND presence_epoch = $2;
+
+-- name: ResetStaleDevicePresence :execrows
+UPDATE devices
+SET is_online = FALSE, presence = 'offline'
+WHERE is_online = TRUE
+  AND id NOT IN (
+    SELECT device_id FROM ws_presence
+    WHERE heartbeat_at >= NOW() - (sqlc.arg(ttl_seconds)::int * INTERVAL '1 second')
+  );
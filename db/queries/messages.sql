@@ -0,0 +1,39 @@
+-- name: CreateMessage :one
+INSERT INTO messages (user_id, from_device_id, to_device_id, stream_id, body)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *;
+
+-- name: ListMessages :many
+-- Newest first. before is the ID of the oldest message already fetched.
+SELECT * FROM messages
+WHERE user_id = sqlc.arg(user_id)
+  AND (sqlc.narg(stream_id)::uuid IS NULL OR stream_id = sqlc.narg(stream_id))
+  AND (sqlc.narg(before)::uuid IS NULL OR (created_at, id) < (
+    SELECT b.created_at, b.id FROM messages b WHERE b.id = sqlc.narg(before)
+  ))
+ORDER BY created_at DESC, id DESC
+LIMIT sqlc.arg(max_rows);
+
+-- name: CountUnreadMessages :many
+-- Unread messages for a device by sender. Without a read marker, messages
+-- from before the device was registered don't count.
+SELECT from_device_id, COUNT(*) AS unread
+FROM messages
+WHERE user_id = sqlc.arg(user_id)
+  AND from_device_id IS NOT NULL
+  AND from_device_id <> sqlc.arg(device_id)
+  AND (to_device_id IS NULL OR to_device_id = sqlc.arg(device_id))
+  AND created_at > COALESCE(
+    (SELECT read_at FROM message_reads WHERE device_id = sqlc.arg(device_id)),
+    (SELECT created_at FROM devices WHERE id = sqlc.arg(device_id)),
+    '-infinity'::timestamp
+  )
+GROUP BY from_device_id;
+
+-- name: MarkMessagesRead :execrows
+-- Moves the device's read marker up to a message; never backwards
+INSERT INTO message_reads (device_id, read_at)
+SELECT sqlc.arg(device_id)::uuid, created_at FROM messages
+WHERE id = sqlc.arg(message_id) AND user_id = sqlc.arg(user_id)
+ON CONFLICT (device_id) DO UPDATE
+SET read_at = GREATEST(message_reads.read_at, EXCLUDED.read_at);
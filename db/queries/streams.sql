@@ -10,8 +10,8 @@ WHERE user_id = $1 AND status IN ('connecting', 'active', 'paused')
 ORDER BY started_at DESC;
 
 -- name: CreateStream :one
-INSERT INTO streams (user_id, source_device_id, target_device_id, stream_type, quality)
-VALUES ($1, $2, $3, $4, $5)
+INSERT INTO streams (user_id, source_device_id, target_device_id, stream_type, quality, sfu)
+VALUES ($1, $2, $3, $4, $5, $6)
 RETURNING *;
 
 -- name: UpdateStreamStatus :exec
@@ -0,0 +1,15 @@
+-- name: CreateTelemetrySample :one
+INSERT INTO telemetry_samples (device_id, battery_level, charging, thermal_state, free_storage_mb, network_type, alerts)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING *;
+
+-- name: ListTelemetrySamples :many
+-- Newest first
+SELECT * FROM telemetry_samples
+WHERE device_id = sqlc.arg(device_id)
+  AND recorded_at >= sqlc.arg(since)
+ORDER BY recorded_at DESC
+LIMIT sqlc.arg(max_rows);
+
+-- name: DeleteTelemetrySamplesBefore :execrows
+DELETE FROM telemetry_samples WHERE recorded_at < $1;
@@ -0,0 +1,76 @@
+-- name: CreateTransfer :one
+INSERT INTO transfers (user_id, from_device_id, to_device_id, file_name, content_type, size_bytes, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING *;
+
+-- name: GetTransferByID :one
+SELECT * FROM transfers WHERE id = $1;
+
+-- name: ListActiveTransfersByDevice :many
+-- Transfers a device is sending or receiving that haven't finished
+SELECT * FROM transfers
+WHERE user_id = sqlc.arg(user_id)
+  AND (from_device_id = sqlc.arg(device_id) OR to_device_id = sqlc.arg(device_id))
+  AND status IN ('uploading', 'ready')
+ORDER BY created_at DESC;
+
+-- name: SumActiveTransferBytes :one
+-- Bytes the user has staged or is about to
+SELECT COALESCE(SUM(size_bytes), 0)::bigint FROM transfers
+WHERE user_id = $1 AND status IN ('uploading', 'ready');
+
+-- name: AddTransferBytes :one
+-- Records a stored chunk. Only matches if the upload claim is still held
+-- and nobody else stored one at the same offset first; the transfer is
+-- ready once every byte is in.
+UPDATE transfers
+SET received_bytes = received_bytes + sqlc.arg(bytes)::bigint,
+    status = CASE WHEN received_bytes + sqlc.arg(bytes)::bigint = size_bytes THEN 'ready' ELSE status END,
+    updated_at = NOW()
+WHERE id = sqlc.arg(id)
+  AND received_bytes = sqlc.arg(offset_bytes)::bigint
+  AND status = 'uploading'
+  AND EXISTS (
+    SELECT 1 FROM transfer_uploads
+    WHERE transfer_id = sqlc.arg(id) AND claim = sqlc.arg(claim)
+  )
+RETURNING *;
+
+-- name: ClaimTransferUpload :execrows
+-- Claims a transfer's upload for ttl_seconds. Matches nothing while another
+-- claim is live, so one chunk is stored at a time across replicas.
+INSERT INTO transfer_uploads (transfer_id, claim, expires_at)
+VALUES (sqlc.arg(transfer_id), sqlc.arg(claim), NOW() + (sqlc.arg(ttl_seconds)::int * INTERVAL '1 second'))
+ON CONFLICT (transfer_id) DO UPDATE
+SET claim = EXCLUDED.claim, expires_at = EXCLUDED.expires_at
+WHERE transfer_uploads.expires_at < NOW();
+
+-- name: ReleaseTransferUpload :exec
+DELETE FROM transfer_uploads WHERE transfer_id = $1 AND claim = $2;
+
+-- name: AcceptTransfer :one
+UPDATE transfers
+SET accepted_at = COALESCE(accepted_at, NOW()),
+    updated_at = NOW()
+WHERE id = $1 AND status IN ('uploading', 'ready')
+RETURNING *;
+
+-- name: FinishTransfer :one
+-- Moves an unfinished transfer to a final status
+UPDATE transfers
+SET status = $2,
+    updated_at = NOW()
+WHERE id = $1 AND status IN ('uploading', 'ready')
+RETURNING *;
+
+-- name: ExpireTransfers :many
+UPDATE transfers
+SET status = 'expired',
+    updated_at = NOW()
+WHERE expires_at < NOW() AND status IN ('uploading', 'ready')
+RETURNING *;
+
+-- name: DeleteTransfersBefore :exec
+-- Forgets finished transfers that expired before the cutoff
+DELETE FROM transfers
+WHERE expires_at < $1 AND status NOT IN ('uploading', 'ready');
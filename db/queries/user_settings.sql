@@ -1,11 +1,22 @@
 -- name: GetUserSettings :one
 SELECT * FROM user_settings WHERE user_id = $1;
 
+-- name: GetUserSettingsForUpdate :one
+-- Locks the user's settings until the transaction ends, serializing quota
+-- checks
+SELECT * FROM user_settings WHERE user_id = $1 FOR UPDATE;
+
 -- name: CreateUserSettings :one
 INSERT INTO user_settings (user_id)
 VALUES ($1)
 RETURNING *;
 
+-- name: EnsureUserSettings :exec
+-- Creates the user's settings with the defaults if they have none
+INSERT INTO user_settings (user_id)
+VALUES ($1)
+ON CONFLICT (user_id) DO NOTHING;
+
 -- name: UpdateUserSettings :one
 UPDATE user_settings
 SET max_devices = COALESCE($2, max_devices),
@@ -0,0 +1,40 @@
+-- name: UpsertWSPresence :exec
+INSERT INTO ws_presence (device_id, user_id, instance_id, epoch)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (device_id) DO UPDATE
+SET user_id = EXCLUDED.user_id,
+    instance_id = EXCLUDED.instance_id,
+    epoch = EXCLUDED.epoch,
+    connected_at = NOW(),
+    heartbeat_at = NOW();
+
+-- name: DeleteWSPresence :exec
+DELETE FROM ws_presence WHERE device_id = $1 AND instance_id = $2;
+
+-- name: TouchWSPresence :exec
+UPDATE ws_presence SET heartbeat_at = NOW() WHERE instance_id = $1;
+
+-- name: DeleteStaleWSPresence :many
+DELETE FROM ws_presence
+WHERE heartbeat_at < NOW() - (sqlc.arg(ttl_seconds)::int * INTERVAL '1 second')
+RETURNING device_id, user_id, instance_id, epoch;
+
+-- name: ListWSPresence :many
+SELECT p.device_id, p.user_id, p.instance_id, p.epoch,
+       d.device_id AS client_device_id, d.device_name, d.device_type, d.has_camera, d.has_microphone, d.presence
+FROM ws_presence p
+JOIN devices d ON d.id = p.device_id;
+
+-- name: NotifyWSChannel :exec
+SELECT pg_notify(sqlc.arg(channel)::text, sqlc.arg(payload)::text);
+
+-- name: CreateWSEvent :one
+INSERT INTO ws_events (payload)
+VALUES ($1)
+RETURNING id;
+
+-- name: GetWSEvent :one
+SELECT payload FROM ws_events WHERE id = $1;
+
+-- name: DeleteOldWSEvents :exec
+DELETE FROM ws_events WHERE created_at < NOW() - INTERVAL '5 minutes';
@@ -0,0 +1,12 @@
+-- name: CreateWSTicket :one
+INSERT INTO ws_tickets (user_id, device_id, ticket, expires_at, access_expires_at)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *;
+
+-- name: ConsumeWSTicket :one
+DELETE FROM ws_tickets
+WHERE ticket = $1 AND expires_at > NOW()
+RETURNING *;
+
+-- name: DeleteExpiredWSTickets :exec
+DELETE FROM ws_tickets WHERE expires_at < NOW();
@@ -12,6 +12,20 @@ import (
 	"github.com/google/uuid"
 )
 
+const claimDevicePresence = `-- name: ClaimDevicePresence :one
+UPDATE devices
+SET is_online = TRUE, presence = 'online', presence_epoch = presence_epoch + 1, last_seen = NOW()
+WHERE id = $1
+RETURNING presence_epoch
+`
+
+func (q *Queries) ClaimDevicePresence(ctx context.Context, id uuid.UUID) (int64, error) {
+	row := q.db.QueryRowContext(ctx, claimDevicePresence, id)
+	var presence_epoch int64
+	err := row.Scan(&presence_epoch)
+	return presence_epoch, err
+}
+
 const countUserDevices = `-- name: CountUserDevices :one
 SELECT COUNT(*) FROM devices WHERE user_id = $1
 `
@@ -26,7 +40,7 @@ func (q *Queries) CountUserDevices(ctx context.Context, userID uuid.UUID) (int64
 const createDevice = `-- name: CreateDevice :one
 INSERT INTO devices (user_id, device_id, device_name, device_type, has_camera, has_microphone)
 VALUES ($1, $2, $3, $4, $5, $6)
-RETURNING id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at
+RETURNING id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at, presence_epoch, presence
 `
 
 type CreateDeviceParams struct {
@@ -59,6 +73,8 @@ func (q *Queries) CreateDevice(ctx context.Context, arg CreateDeviceParams) (Dev
 		&i.IsOnline,
 		&i.LastSeen,
 		&i.CreatedAt,
+		&i.PresenceEpoch,
+		&i.Presence,
 	)
 	return i, err
 }
@@ -73,7 +89,7 @@ func (q *Queries) DeleteDevice(ctx context.Context, id uuid.UUID) error {
 }
 
 const getDeviceByID = `-- name: GetDeviceByID :one
-SELECT id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at FROM devices WHERE id = $1
+SELECT id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at, presence_epoch, presence FROM devices WHERE id = $1
 `
 
 func (q *Queries) GetDeviceByID(ctx context.Context, id uuid.UUID) (Device, error) {
@@ -90,12 +106,14 @@ func (q *Queries) GetDeviceByID(ctx context.Context, id uuid.UUID) (Device, erro
 		&i.IsOnline,
 		&i.LastSeen,
 		&i.CreatedAt,
+		&i.PresenceEpoch,
+		&i.Presence,
 	)
 	return i, err
 }
 
 const getDeviceByUserAndDeviceID = `-- name: GetDeviceByUserAndDeviceID :one
-SELECT id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at FROM devices WHERE user_id = $1 AND device_id = $2
+SELECT id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at, presence_epoch, presence FROM devices WHERE user_id = $1 AND device_id = $2
 `
 
 type GetDeviceByUserAndDeviceIDParams struct {
@@ -117,12 +135,14 @@ func (q *Queries) GetDeviceByUserAndDeviceID(ctx context.Context, arg GetDeviceB
 		&i.IsOnline,
 		&i.LastSeen,
 		&i.CreatedAt,
+		&i.PresenceEpoch,
+		&i.Presence,
 	)
 	return i, err
 }
 
 const listOnlineUserDevices = `-- name: ListOnlineUserDevices :many
-SELECT id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at FROM devices WHERE user_id = $1 AND is_online = TRUE ORDER BY last_seen DESC
+SELECT id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at, presence_epoch, presence FROM devices WHERE user_id = $1 AND is_online = TRUE ORDER BY last_seen DESC
 `
 
 func (q *Queries) ListOnlineUserDevices(ctx context.Context, userID uuid.UUID) ([]Device, error) {
@@ -145,6 +165,8 @@ func (q *Queries) ListOnlineUserDevices(ctx context.Context, userID uuid.UUID) (
 			&i.IsOnline,
 			&i.LastSeen,
 			&i.CreatedAt,
+			&i.PresenceEpoch,
+			&i.Presence,
 		); err != nil {
 			return nil, err
 		}
@@ -160,7 +182,7 @@ func (q *Queries) ListOnlineUserDevices(ctx context.Context, userID uuid.UUID) (
 }
 
 const listUserDevices = `-- name: ListUserDevices :many
-SELECT id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at FROM devices WHERE user_id = $1 ORDER BY created_at DESC
+SELECT id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at, presence_epoch, presence FROM devices WHERE user_id = $1 ORDER BY created_at DESC
 `
 
 func (q *Queries) ListUserDevices(ctx context.Context, userID uuid.UUID) ([]Device, error) {
@@ -183,6 +205,8 @@ func (q *Queries) ListUserDevices(ctx context.Context, userID uuid.UUID) ([]Devi
 			&i.IsOnline,
 			&i.LastSeen,
 			&i.CreatedAt,
+			&i.PresenceEpoch,
+			&i.Presence,
 		); err != nil {
 			return nil, err
 		}
@@ -197,13 +221,70 @@ func (q *Queries) ListUserDevices(ctx context.Context, userID uuid.UUID) ([]Devi
 	return items, nil
 }
 
+const releaseDevicePresence = `-- name: ReleaseDevicePresence :execrows
+UPDATE devices
+SET is_online = FALSE, presence = 'offline', last_seen = NOW()
+WHERE id = $1 AND presence_epoch = $2
+`
+
+type ReleaseDevicePresenceParams struct {
+	ID            uuid.UUID
+	PresenceEpoch int64
+}
+
+func (q *Queries) ReleaseDevicePresence(ctx context.Context, arg ReleaseDevicePresenceParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, releaseDevicePresence, arg.ID, arg.PresenceEpoch)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const resetStaleDevicePresence = `-- name: ResetStaleDevicePresence :execrows
+UPDATE devices
+SET is_online = FALSE, presence = 'offline'
+WHERE is_online = TRUE
+  AND id NOT IN (
+    SELECT device_id FROM ws_presence
+    WHERE heartbeat_at >= NOW() - ($1::int * INTERVAL '1 second')
+  )
+`
+
+func (q *Queries) ResetStaleDevicePresence(ctx context.Context, ttlSeconds int32) (int64, error) {
+	result, err := q.db.ExecContext(ctx, resetStaleDevicePresence, ttlSeconds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setDevicePresence = `-- name: SetDevicePresence :execrows
+UPDATE devices
+SET presence = $3, last_seen = NOW()
+WHERE id = $1 AND presence_epoch = $2
+`
+
+type SetDevicePresenceParams struct {
+	ID            uuid.UUID
+	PresenceEpoch int64
+	Presence      PresenceState
+}
+
+func (q *Queries) SetDevicePresence(ctx context.Context, arg SetDevicePresenceParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, setDevicePresence, arg.ID, arg.PresenceEpoch, arg.Presence)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const updateDevice = `-- name: UpdateDevice :one
 UPDATE devices
 SET device_name = COALESCE($2, device_name),
     has_camera = COALESCE($3, has_camera),
     has_microphone = COALESCE($4, has_microphone)
 WHERE id = $1
-RETURNING id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at
+RETURNING id, user_id, device_id, device_name, device_type, has_camera, has_microphone, is_online, last_seen, created_at, presence_epoch, presence
 `
 
 type UpdateDeviceParams struct {
@@ -232,6 +313,8 @@ func (q *Queries) UpdateDevice(ctx context.Context, arg UpdateDeviceParams) (Dev
 		&i.IsOnline,
 		&i.LastSeen,
 		&i.CreatedAt,
+		&i.PresenceEpoch,
+		&i.Presence,
 	)
 	return i, err
 }
@@ -249,7 +332,9 @@ func (q *Queries) UpdateDeviceLastSeen(ctx context.Context, id uuid.UUID) error
 
 const updateDeviceOnlineStatus = `-- name: UpdateDeviceOnlineStatus :exec
 UPDATE devices
-SET is_online = $2, last_seen = NOW()
+SET is_online = $2,
+    presence = CASE WHEN $2 THEN 'online'::presence_state ELSE 'offline'::presence_state END,
+    last_seen = NOW()
 WHERE id = $1
 `
 
@@ -7,6 +7,7 @@ package sqlc
 import (
 	"database/sql"
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -98,6 +99,50 @@ func (ns NullDeviceType) Value() (driver.Value, error) {
 	return string(ns.DeviceType), nil
 }
 
+type PresenceState string
+
+const (
+	PresenceStateOnline       PresenceState = "online"
+	PresenceStateAway         PresenceState = "away"
+	PresenceStateReconnecting PresenceState = "reconnecting"
+	PresenceStateOffline      PresenceState = "offline"
+)
+
+func (e *PresenceState) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		*e = PresenceState(s)
+	case string:
+		*e = PresenceState(s)
+	default:
+		return fmt.Errorf("unsupported scan type for PresenceState: %T", src)
+	}
+	return nil
+}
+
+type NullPresenceState struct {
+	PresenceState PresenceState
+	Valid         bool // Valid is true if PresenceState is not NULL
+}
+
+// Scan implements the Scanner interface.
+func (ns *NullPresenceState) Scan(value interface{}) error {
+	if value == nil {
+		ns.PresenceState, ns.Valid = "", false
+		return nil
+	}
+	ns.Valid = true
+	return ns.PresenceState.Scan(value)
+}
+
+// Value implements the driver Valuer interface.
+func (ns NullPresenceState) Value() (driver.Value, error) {
+	if !ns.Valid {
+		return nil, nil
+	}
+	return string(ns.PresenceState), nil
+}
+
 type StreamQuality string
 
 const (
@@ -230,6 +275,52 @@ func (ns NullStreamType) Value() (driver.Value, error) {
 	return string(ns.StreamType), nil
 }
 
+type TransferStatus string
+
+const (
+	TransferStatusUploading TransferStatus = "uploading"
+	TransferStatusReady     TransferStatus = "ready"
+	TransferStatusCompleted TransferStatus = "completed"
+	TransferStatusDeclined  TransferStatus = "declined"
+	TransferStatusCancelled TransferStatus = "cancelled"
+	TransferStatusExpired   TransferStatus = "expired"
+)
+
+func (e *TransferStatus) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		*e = TransferStatus(s)
+	case string:
+		*e = TransferStatus(s)
+	default:
+		return fmt.Errorf("unsupported scan type for TransferStatus: %T", src)
+	}
+	return nil
+}
+
+type NullTransferStatus struct {
+	TransferStatus TransferStatus
+	Valid          bool // Valid is true if TransferStatus is not NULL
+}
+
+// Scan implements the Scanner interface.
+func (ns *NullTransferStatus) Scan(value interface{}) error {
+	if value == nil {
+		ns.TransferStatus, ns.Valid = "", false
+		return nil
+	}
+	ns.Valid = true
+	return ns.TransferStatus.Scan(value)
+}
+
+// Value implements the driver Valuer interface.
+func (ns NullTransferStatus) Value() (driver.Value, error) {
+	if !ns.Valid {
+		return nil, nil
+	}
+	return string(ns.TransferStatus), nil
+}
+
 type Device struct {
 	ID            uuid.UUID
 	UserID        uuid.UUID
@@ -241,6 +332,23 @@ type Device struct {
 	IsOnline      sql.NullBool
 	LastSeen      sql.NullTime
 	CreatedAt     sql.NullTime
+	PresenceEpoch int64
+	Presence      PresenceState
+}
+
+type Message struct {
+	ID           uuid.UUID
+	UserID       uuid.UUID
+	FromDeviceID uuid.NullUUID
+	ToDeviceID   uuid.NullUUID
+	StreamID     uuid.NullUUID
+	Body         string
+	CreatedAt    time.Time
+}
+
+type MessageRead struct {
+	DeviceID uuid.UUID
+	ReadAt   time.Time
 }
 
 type PasswordReset struct {
@@ -273,6 +381,41 @@ type Stream struct {
 	LatencyMs      sql.NullInt32
 	StartedAt      sql.NullTime
 	EndedAt        sql.NullTime
+	Sfu            bool
+}
+
+type TelemetrySample struct {
+	ID            int64
+	DeviceID      uuid.UUID
+	BatteryLevel  int16
+	Charging      bool
+	ThermalState  string
+	FreeStorageMb int64
+	NetworkType   string
+	Alerts        json.RawMessage
+	RecordedAt    time.Time
+}
+
+type Transfer struct {
+	ID            uuid.UUID
+	UserID        uuid.UUID
+	FromDeviceID  uuid.UUID
+	ToDeviceID    uuid.UUID
+	FileName      string
+	ContentType   string
+	SizeBytes     int64
+	ReceivedBytes int64
+	Status        TransferStatus
+	AcceptedAt    sql.NullTime
+	ExpiresAt     time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+type TransferUpload struct {
+	TransferID uuid.UUID
+	Claim      uuid.UUID
+	ExpiresAt  time.Time
 }
 
 type User struct {
@@ -296,4 +439,31 @@ type UserSetting struct {
 	DefaultStreamType    NullStreamType
 	CreatedAt            sql.NullTime
 	UpdatedAt            sql.NullTime
+	MaxTransferBytes     sql.NullInt64
+	TransferQuotaBytes   sql.NullInt64
+}
+
+type WsEvent struct {
+	ID        int64
+	Payload   string
+	CreatedAt sql.NullTime
+}
+
+type WsPresence struct {
+	DeviceID    uuid.UUID
+	UserID      uuid.UUID
+	InstanceID  string
+	ConnectedAt sql.NullTime
+	HeartbeatAt sql.NullTime
+	Epoch       int64
+}
+
+type WsTicket struct {
+	ID              uuid.UUID
+	UserID          uuid.UUID
+	DeviceID        uuid.UUID
+	Ticket          string
+	ExpiresAt       time.Time
+	CreatedAt       sql.NullTime
+	AccessExpiresAt time.Time
 }
@@ -25,9 +25,9 @@ func (q *Queries) CountActiveUserStreams(ctx context.Context, userID uuid.UUID)
 }
 
 const createStream = `-- name: CreateStream :one
-INSERT INTO streams (user_id, source_device_id, target_device_id, stream_type, quality)
-VALUES ($1, $2, $3, $4, $5)
-RETURNING id, user_id, source_device_id, target_device_id, stream_type, status, connection_type, quality, latency_ms, started_at, ended_at
+INSERT INTO streams (user_id, source_device_id, target_device_id, stream_type, quality, sfu)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, user_id, source_device_id, target_device_id, stream_type, status, connection_type, quality, latency_ms, started_at, ended_at, sfu
 `
 
 type CreateStreamParams struct {
@@ -36,6 +36,7 @@ type CreateStreamParams struct {
 	TargetDeviceID uuid.NullUUID
 	StreamType     StreamType
 	Quality        NullStreamQuality
+	Sfu            bool
 }
 
 func (q *Queries) CreateStream(ctx context.Context, arg CreateStreamParams) (Stream, error) {
@@ -45,6 +46,7 @@ func (q *Queries) CreateStream(ctx context.Context, arg CreateStreamParams) (Str
 		arg.TargetDeviceID,
 		arg.StreamType,
 		arg.Quality,
+		arg.Sfu,
 	)
 	var i Stream
 	err := row.Scan(
@@ -59,6 +61,7 @@ func (q *Queries) CreateStream(ctx context.Context, arg CreateStreamParams) (Str
 		&i.LatencyMs,
 		&i.StartedAt,
 		&i.EndedAt,
+		&i.Sfu,
 	)
 	return i, err
 }
@@ -75,7 +78,7 @@ func (q *Queries) EndStream(ctx context.Context, id uuid.UUID) error {
 }
 
 const getStreamByID = `-- name: GetStreamByID :one
-SELECT id, user_id, source_device_id, target_device_id, stream_type, status, connection_type, quality, latency_ms, started_at, ended_at FROM streams WHERE id = $1
+SELECT id, user_id, source_device_id, target_device_id, stream_type, status, connection_type, quality, latency_ms, started_at, ended_at, sfu FROM streams WHERE id = $1
 `
 
 func (q *Queries) GetStreamByID(ctx context.Context, id uuid.UUID) (Stream, error) {
@@ -93,12 +96,13 @@ func (q *Queries) GetStreamByID(ctx context.Context, id uuid.UUID) (Stream, erro
 		&i.LatencyMs,
 		&i.StartedAt,
 		&i.EndedAt,
+		&i.Sfu,
 	)
 	return i, err
 }
 
 const listActiveUserStreams = `-- name: ListActiveUserStreams :many
-SELECT id, user_id, source_device_id, target_device_id, stream_type, status, connection_type, quality, latency_ms, started_at, ended_at FROM streams
+SELECT id, user_id, source_device_id, target_device_id, stream_type, status, connection_type, quality, latency_ms, started_at, ended_at, sfu FROM streams
 WHERE user_id = $1 AND status IN ('connecting', 'active', 'paused')
 ORDER BY started_at DESC
 `
@@ -124,6 +128,7 @@ func (q *Queries) ListActiveUserStreams(ctx context.Context, userID uuid.UUID) (
 			&i.LatencyMs,
 			&i.StartedAt,
 			&i.EndedAt,
+			&i.Sfu,
 		); err != nil {
 			return nil, err
 		}
@@ -139,7 +144,7 @@ func (q *Queries) ListActiveUserStreams(ctx context.Context, userID uuid.UUID) (
 }
 
 const listUserStreams = `-- name: ListUserStreams :many
-SELECT id, user_id, source_device_id, target_device_id, stream_type, status, connection_type, quality, latency_ms, started_at, ended_at FROM streams WHERE user_id = $1 ORDER BY started_at DESC
+SELECT id, user_id, source_device_id, target_device_id, stream_type, status, connection_type, quality, latency_ms, started_at, ended_at, sfu FROM streams WHERE user_id = $1 ORDER BY started_at DESC
 `
 
 func (q *Queries) ListUserStreams(ctx context.Context, userID uuid.UUID) ([]Stream, error) {
@@ -163,6 +168,7 @@ func (q *Queries) ListUserStreams(ctx context.Context, userID uuid.UUID) ([]Stre
 			&i.LatencyMs,
 			&i.StartedAt,
 			&i.EndedAt,
+			&i.Sfu,
 		); err != nil {
 			return nil, err
 		}
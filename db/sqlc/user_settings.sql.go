@@ -15,7 +15,7 @@ import (
 const createUserSettings = `-- name: CreateUserSettings :one
 INSERT INTO user_settings (user_id)
 VALUES ($1)
-RETURNING id, user_id, max_devices, max_concurrent_streams, total_stream_minutes, total_streams_count, default_stream_quality, default_stream_type, created_at, updated_at
+RETURNING id, user_id, max_devices, max_concurrent_streams, total_stream_minutes, total_streams_count, default_stream_quality, default_stream_type, created_at, updated_at, max_transfer_bytes, transfer_quota_bytes
 `
 
 func (q *Queries) CreateUserSettings(ctx context.Context, userID uuid.UUID) (UserSetting, error) {
@@ -32,12 +32,26 @@ func (q *Queries) CreateUserSettings(ctx context.Context, userID uuid.UUID) (Use
 		&i.DefaultStreamType,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.MaxTransferBytes,
+		&i.TransferQuotaBytes,
 	)
 	return i, err
 }
 
+const ensureUserSettings = `-- name: EnsureUserSettings :exec
+INSERT INTO user_settings (user_id)
+VALUES ($1)
+ON CONFLICT (user_id) DO NOTHING
+`
+
+// Creates the user's settings with the defaults if they have none
+func (q *Queries) EnsureUserSettings(ctx context.Context, userID uuid.UUID) error {
+	_, err := q.db.ExecContext(ctx, ensureUserSettings, userID)
+	return err
+}
+
 const getUserSettings = `-- name: GetUserSettings :one
-SELECT id, user_id, max_devices, max_concurrent_streams, total_stream_minutes, total_streams_count, default_stream_quality, default_stream_type, created_at, updated_at FROM user_settings WHERE user_id = $1
+SELECT id, user_id, max_devices, max_concurrent_streams, total_stream_minutes, total_streams_count, default_stream_quality, default_stream_type, created_at, updated_at, max_transfer_bytes, transfer_quota_bytes FROM user_settings WHERE user_id = $1
 `
 
 func (q *Queries) GetUserSettings(ctx context.Context, userID uuid.UUID) (UserSetting, error) {
@@ -54,6 +68,34 @@ func (q *Queries) GetUserSettings(ctx context.Context, userID uuid.UUID) (UserSe
 		&i.DefaultStreamType,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.MaxTransferBytes,
+		&i.TransferQuotaBytes,
+	)
+	return i, err
+}
+
+const getUserSettingsForUpdate = `-- name: GetUserSettingsForUpdate :one
+SELECT id, user_id, max_devices, max_concurrent_streams, total_stream_minutes, total_streams_count, default_stream_quality, default_stream_type, created_at, updated_at, max_transfer_bytes, transfer_quota_bytes FROM user_settings WHERE user_id = $1 FOR UPDATE
+`
+
+// Locks the user's settings until the transaction ends, serializing quota
+// checks
+func (q *Queries) GetUserSettingsForUpdate(ctx context.Context, userID uuid.UUID) (UserSetting, error) {
+	row := q.db.QueryRowContext(ctx, getUserSettingsForUpdate, userID)
+	var i UserSetting
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.MaxDevices,
+		&i.MaxConcurrentStreams,
+		&i.TotalStreamMinutes,
+		&i.TotalStreamsCount,
+		&i.DefaultStreamQuality,
+		&i.DefaultStreamType,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.MaxTransferBytes,
+		&i.TransferQuotaBytes,
 	)
 	return i, err
 }
@@ -95,7 +137,7 @@ SET max_devices = COALESCE($2, max_devices),
     default_stream_type = COALESCE($5, default_stream_type),
     updated_at = NOW()
 WHERE user_id = $1
-RETURNING id, user_id, max_devices, max_concurrent_streams, total_stream_minutes, total_streams_count, default_stream_quality, default_stream_type, created_at, updated_at
+RETURNING id, user_id, max_devices, max_concurrent_streams, total_stream_minutes, total_streams_count, default_stream_quality, default_stream_type, created_at, updated_at, max_transfer_bytes, transfer_quota_bytes
 `
 
 type UpdateUserSettingsParams struct {
@@ -126,6 +168,8 @@ func (q *Queries) UpdateUserSettings(ctx context.Context, arg UpdateUserSettings
 		&i.DefaultStreamType,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.MaxTransferBytes,
+		&i.TransferQuotaBytes,
 	)
 	return i, err
 }
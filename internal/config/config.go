@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -15,11 +16,14 @@ type Config struct {
 	Database DatabaseConfig
 	JWT      JWTConfig
 	ICE      ICEConfig
+	WS       WSConfig
+	Transfer TransferConfig
 }
 
 type ServerConfig struct {
-	Port string
-	Mode string
+	Port           string
+	Mode           string
+	AllowedOrigins []string
 }
 
 type DatabaseConfig struct {
@@ -43,6 +47,75 @@ type ICEConfig struct {
 	TURNServers    []string
 	TURNUsername   string
 	TURNCredential string
+
+	// Secret shared with the TURN server (coturn use-auth-secret). When set,
+	// each user gets credentials valid for TURNCredentialTTL instead of the
+	// static ones above.
+	TURNSecret        string
+	TURNCredentialTTL time.Duration
+
+	// Embedded STUN/TURN server, off unless TURNListen is set. It needs
+	// TURNSecret, and is offered to clients at TURNPublicIP. Relay ports
+	// come from TURNMinPort-TURNMaxPort (0 for any); each user may hold
+	// TURNMaxAllocations relays and relay TURNBandwidth bytes per second.
+	// Private and shared peer addresses are refused unless in
+	// TURNAllowedPeers (CIDRs). Clients may also connect over TCP on
+	// TURNListenTCP and TLS on TURNListenTLS, with the certificate in
+	// TURNTLSCert/TURNTLSKey for TURNTLSHost (default TURNPublicIP).
+	TURNListen         string
+	TURNPublicIP       string
+	TURNRealm          string
+	TURNMinPort        int
+	TURNMaxPort        int
+	TURNMaxAllocations int
+	TURNBandwidth      int
+	TURNAllowedPeers   []string
+	TURNListenTCP      string
+	TURNListenTLS      string
+	TURNTLSCert        string
+	TURNTLSKey         string
+	TURNTLSHost        string
+
+	// Selective forwarding unit for streams started with sfu set, off unless
+	// SFU is true. Its media ports come from SFUMinPort-SFUMaxPort (0 for
+	// any) and are offered to clients at SFUPublicIP, or the host's own
+	// addresses if unset. A stream takes at most SFUMaxSubscribers devices.
+	SFU               bool
+	SFUPublicIP       string
+	SFUMinPort        int
+	SFUMaxPort        int
+	SFUMaxSubscribers int
+}
+
+type WSConfig struct {
+	TicketTTL        time.Duration
+	ResumeGrace      time.Duration
+	ReplayBufferSize int
+	AwayTimeout      time.Duration
+	DrainTimeout     time.Duration
+	Backplane        string
+	InstanceID       string
+
+	// Per-type overrides "type=rate:burst:max_size", and how many rejected
+	// messages within the window get a connection closed
+	RateLimits      []string
+	MaxViolations   int
+	ViolationWindow time.Duration
+
+	// Messages a client may drop before it's disconnected as too slow
+	SlowClientDrops int
+
+	// Oldest protocol version accepted, and how long a client has to send
+	// hello before it's taken to speak version 1
+	MinProtocolVersion int
+	HelloTimeout       time.Duration
+}
+
+type TransferConfig struct {
+	// Where uploads are staged; instances behind one database must share it
+	Dir       string
+	TTL       time.Duration
+	ChunkSize int
 }
 
 func (d *DatabaseConfig) DSN() string {
@@ -60,6 +133,10 @@ func Load() *Config {
 		Server: ServerConfig{
 			Port: getEnv("SERVER_PORT", "3000"),
 			Mode: getEnv("GIN_MODE", "debug"),
+			AllowedOrigins: getEnvSlice("ALLOWED_ORIGINS", []string{
+				"http://localhost:5173",
+				"http://localhost:3000",
+			}),
 		},
 		Database: DatabaseConfig{
 			Host:     getEnv("DB_HOST", "localhost"),
@@ -85,12 +162,63 @@ func Load() *Config {
 				"turn:openrelay.metered.ca:443",
 				"turn:openrelay.metered.ca:443?transport=tcp",
 			}),
-			TURNUsername:   getEnv("ICE_TURN_USERNAME", "openrelayproject"),
-			TURNCredential: getEnv("ICE_TURN_CREDENTIAL", "openrelayproject"),
+			TURNUsername:      getEnv("ICE_TURN_USERNAME", "openrelayproject"),
+			TURNCredential:    getEnv("ICE_TURN_CREDENTIAL", "openrelayproject"),
+			TURNSecret:        getEnv("ICE_TURN_SECRET", ""),
+			TURNCredentialTTL: getEnvDuration("ICE_TURN_CREDENTIAL_TTL", 24*time.Hour),
+
+			TURNListen:         getEnv("ICE_TURN_LISTEN", ""),
+			TURNPublicIP:       getEnv("ICE_TURN_PUBLIC_IP", ""),
+			TURNRealm:          getEnv("ICE_TURN_REALM", "streamz"),
+			TURNMinPort:        getEnvInt("ICE_TURN_MIN_PORT", 0),
+			TURNMaxPort:        getEnvInt("ICE_TURN_MAX_PORT", 0),
+			TURNMaxAllocations: getEnvInt("ICE_TURN_MAX_ALLOCATIONS", 10),
+			TURNBandwidth:      getEnvInt("ICE_TURN_BANDWIDTH", 2<<20),
+			TURNAllowedPeers:   getEnvSlice("ICE_TURN_ALLOWED_PEERS", nil),
+			TURNListenTCP:      getEnv("ICE_TURN_LISTEN_TCP", ""),
+			TURNListenTLS:      getEnv("ICE_TURN_LISTEN_TLS", ""),
+			TURNTLSCert:        getEnv("ICE_TURN_TLS_CERT", ""),
+			TURNTLSKey:         getEnv("ICE_TURN_TLS_KEY", ""),
+			TURNTLSHost:        getEnv("ICE_TURN_TLS_HOST", ""),
+
+			SFU:               getEnvBool("ICE_SFU", false),
+			SFUPublicIP:       getEnv("ICE_SFU_PUBLIC_IP", ""),
+			SFUMinPort:        getEnvInt("ICE_SFU_MIN_PORT", 0),
+			SFUMaxPort:        getEnvInt("ICE_SFU_MAX_PORT", 0),
+			SFUMaxSubscribers: getEnvInt("ICE_SFU_MAX_SUBSCRIBERS", 8),
+		},
+		WS: WSConfig{
+			TicketTTL:          getEnvDuration("WS_TICKET_TTL", 30*time.Second),
+			ResumeGrace:        getEnvDuration("WS_RESUME_GRACE", 30*time.Second),
+			ReplayBufferSize:   getEnvInt("WS_REPLAY_BUFFER_SIZE", 64),
+			AwayTimeout:        getEnvDuration("WS_AWAY_TIMEOUT", 5*time.Minute),
+			DrainTimeout:       getEnvDuration("WS_DRAIN_TIMEOUT", 10*time.Second),
+			RateLimits:         getEnvSlice("WS_RATE_LIMITS", nil),
+			MaxViolations:      getEnvInt("WS_MAX_VIOLATIONS", 20),
+			ViolationWindow:    getEnvDuration("WS_VIOLATION_WINDOW", time.Minute),
+			SlowClientDrops:    getEnvInt("WS_SLOW_CLIENT_DROPS", 32),
+			MinProtocolVersion: getEnvInt("WS_MIN_PROTOCOL_VERSION", 1),
+			HelloTimeout:       getEnvDuration("WS_HELLO_TIMEOUT", 2*time.Second),
+			Backplane:          getEnv("WS_BACKPLANE", ""),
+			InstanceID:         getEnv("WS_INSTANCE_ID", defaultInstanceID()),
+		},
+		Transfer: TransferConfig{
+			Dir:       getEnv("TRANSFER_DIR", filepath.Join(os.TempDir(), "streamz-transfers")),
+			TTL:       getEnvDuration("TRANSFER_TTL", 24*time.Hour),
+			ChunkSize: getEnvInt("TRANSFER_CHUNK_SIZE", 8<<20),
 		},
 	}
 }
 
+// defaultInstanceID identifies this process among replicas
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "streamz"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
 func getEnv(key, fallback string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
@@ -107,6 +235,15 @@ func getEnvInt(key string, fallback int) int {
 	return fallback
 }
 
+func getEnvBool(key string, fallback bool) bool {
+	if val := os.Getenv(key); val != "" {
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+	return fallback
+}
+
 func getEnvDuration(key string, fallback time.Duration) time.Duration {
 	if val := os.Getenv(key); val != "" {
 		if d, err := time.ParseDuration(val); err == nil {
@@ -1,8 +1,10 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
@@ -10,9 +12,24 @@ import (
 )
 
 const (
-	UserIDKey = "user_id"
+	UserIDKey       = "user_id"
+	TokenExpiresKey = "token_expires_at"
 )
 
+// Token validation errors (messages are returned to the client)
+var (
+	ErrInvalidToken   = errors.New("invalid or expired token")
+	ErrInvalidClaims  = errors.New("invalid token claims")
+	ErrInvalidSubject = errors.New("invalid token subject")
+	ErrInvalidUserID  = errors.New("invalid user id in token")
+)
+
+// TokenClaims holds the claims we care about from an access token
+type TokenClaims struct {
+	UserID    uuid.UUID
+	ExpiresAt time.Time
+}
+
 // Auth validates JWT tokens and extracts user information
 func Auth(jwtSecret string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -26,8 +43,8 @@ func Auth(jwtSecret string) gin.HandlerFunc {
 		}
 
 		// Extract token from "Bearer <token>"
-		parts := strings.SplitN(authHeader, " ", 2)
-		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		tokenString, ok := BearerToken(authHeader)
+		if !ok {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"code":    "UNAUTHORIZED",
 				"message": "invalid authorization header format",
@@ -35,57 +52,75 @@ func Auth(jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
-		tokenString := parts[1]
-
-		// Parse and validate token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			return []byte(jwtSecret), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := ParseToken(jwtSecret, tokenString)
+		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"code":    "UNAUTHORIZED",
-				"message": "invalid or expired token",
+				"message": err.Error(),
 			})
 			return
 		}
 
-		// Extract claims
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"code":    "UNAUTHORIZED",
-				"message": "invalid token claims",
-			})
-			return
-		}
+		// Set user ID and token expiry in context
+		c.Set(UserIDKey, claims.UserID)
+		c.Set(TokenExpiresKey, claims.ExpiresAt)
+		c.Next()
+	}
+}
 
-		// Get user ID from claims
-		sub, ok := claims["sub"].(string)
-		if !ok {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"code":    "UNAUTHORIZED",
-				"message": "invalid token subject",
-			})
-			return
-		}
+// BearerToken extracts the token from a "Bearer <token>" header value
+func BearerToken(header string) (string, bool) {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return "", false
+	}
+	return parts[1], true
+}
 
-		userID, err := uuid.Parse(sub)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"code":    "UNAUTHORIZED",
-				"message": "invalid user id in token",
-			})
-			return
+// ParseToken validates a signed access token and returns its claims
+func ParseToken(jwtSecret, tokenString string) (*TokenClaims, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
 		}
+		return []byte(jwtSecret), nil
+	})
 
-		// Set user ID in context
-		c.Set(UserIDKey, userID)
-		c.Next()
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
 	}
+
+	// Extract claims
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrInvalidClaims
+	}
+
+	// Get user ID from claims
+	sub, ok := claims["sub"].(string)
+	if !ok {
+		return nil, ErrInvalidSubject
+	}
+
+	userID, err := uuid.Parse(sub)
+	if err != nil {
+		return nil, ErrInvalidUserID
+	}
+
+	result := &TokenClaims{UserID: userID}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		result.ExpiresAt = exp.Time
+	}
+
+	return result, nil
+}
+
+// GetTokenExpiry retrieves the access token's expiry from the context; zero
+// if the token doesn't expire
+func GetTokenExpiry(c *gin.Context) time.Time {
+	expiresAt, _ := c.Get(TokenExpiresKey)
+	t, _ := expiresAt.(time.Time)
+	return t
 }
 
 // GetUserID retrieves the user ID from the context
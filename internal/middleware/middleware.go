@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"log/slog"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -39,10 +40,35 @@ func Logger() gin.HandlerFunc {
 	}
 }
 
-// CORS handles Cross-Origin Resource Sharing
-func CORS() gin.HandlerFunc {
+// CORS handles Cross-Origin Resource Sharing for allowlisted origins.
+// Allowed origins are echoed back with credentials enabled; "*" allows any
+// origin but never sends credentials.
+func CORS(origins *Origins) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
+		origin := c.GetHeader("Origin")
+		c.Header("Vary", "Origin")
+
+		if origin != "" && !origins.Allowed(origin) {
+			slog.Warn("origin rejected",
+				"origin", origin,
+				"method", c.Request.Method,
+				"path", c.Request.URL.Path,
+				"request_id", c.GetString("request_id"),
+			)
+			if c.Request.Method == "OPTIONS" {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if origins.AllowAny() {
+			c.Header("Access-Control-Allow-Origin", "*")
+		} else if origin != "" {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Authorization, X-Request-ID")
 
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Origins matches request origins against an allowlist shared by CORS and
+// WebSocket upgrades. Patterns are full origins ("https://app.example.com"),
+// wildcard subdomains ("https://*.example.com") or "*" to allow any origin.
+type Origins struct {
+	any       bool
+	exact     map[string]bool
+	wildcards []wildcardOrigin
+}
+
+type wildcardOrigin struct {
+	scheme string
+	suffix string // ".example.com" or ".example.com:8443"
+}
+
+// NewOrigins builds an origin matcher from allowlist patterns
+func NewOrigins(patterns []string) *Origins {
+	o := &Origins{exact: make(map[string]bool)}
+
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimRight(strings.TrimSpace(p), "/"))
+		if p == "" {
+			continue
+		}
+		if p == "*" {
+			o.any = true
+			continue
+		}
+
+		scheme, host, ok := strings.Cut(p, "://")
+		if ok && strings.HasPrefix(host, "*.") {
+			o.wildcards = append(o.wildcards, wildcardOrigin{
+				scheme: scheme,
+				suffix: host[1:],
+			})
+			continue
+		}
+		o.exact[p] = true
+	}
+
+	return o
+}
+
+// AllowAny reports whether the allowlist contains "*"
+func (o *Origins) AllowAny() bool {
+	return o.any
+}
+
+// Allowed reports whether a browser origin may access the API.
+// Requests without an Origin header (native apps, curl) are allowed.
+func (o *Origins) Allowed(origin string) bool {
+	if origin == "" || o.any {
+		return true
+	}
+
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+
+	if o.exact[u.Scheme+"://"+u.Host] {
+		return true
+	}
+
+	for _, w := range o.wildcards {
+		if u.Scheme == w.scheme && len(u.Host) > len(w.suffix) && strings.HasSuffix(u.Host, w.suffix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -107,10 +107,10 @@ func (h *Handler) ResetPassword(c *gin.Context) {
 	c.JSON(http.StatusOK, resp)
 }
 
-// Setup registers auth routes
-func Setup(api *gin.RouterGroup, db *sql.DB, cfg Config) {
+// Setup registers auth routes. Revoked sessions are disconnected through events.
+func Setup(api *gin.RouterGroup, db *sql.DB, cfg Config, events Events) {
 	repo := NewRepository(db)
-	svc := NewService(repo, cfg)
+	svc := NewService(repo, cfg, events)
 	h := NewHandler(svc)
 
 	r := api.Group("/auth")
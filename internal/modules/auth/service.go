@@ -14,12 +14,20 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Events disconnects real-time connections whose sessions were revoked. The
+// WebSocket hub implements it.
+type Events interface {
+	RevokeUser(userID uuid.UUID)
+	RevokeDevice(userID, deviceID uuid.UUID)
+}
+
 type Service struct {
 	repo              *Repository
 	jwtSecret         []byte
 	jwtExpiry         time.Duration
 	refreshExpiry     time.Duration
 	passwordResetExp  time.Duration
+	events            Events
 }
 
 type Config struct {
@@ -29,13 +37,14 @@ type Config struct {
 	PasswordResetExp time.Duration
 }
 
-func NewService(repo *Repository, cfg Config) *Service {
+func NewService(repo *Repository, cfg Config, events Events) *Service {
 	return &Service{
 		repo:             repo,
 		jwtSecret:        []byte(cfg.JWTSecret),
 		jwtExpiry:        cfg.JWTExpiry,
 		refreshExpiry:    cfg.RefreshExpiry,
 		passwordResetExp: cfg.PasswordResetExp,
+		events:           events,
 	}
 }
 
@@ -118,9 +127,25 @@ func (s *Service) Refresh(ctx context.Context, req RefreshRequest) (*AuthRespons
 	return s.generateAuthResponse(ctx, user, deviceID)
 }
 
-// Logout invalidates the refresh token
+// Logout invalidates the refresh token and disconnects the device it was
+// issued to, if any. Other connections end when their access token expires.
 func (s *Service) Logout(ctx context.Context, refreshToken string) error {
-	return s.repo.DeleteSessionByToken(ctx, refreshToken)
+	session, err := s.repo.GetSessionByToken(ctx, refreshToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return apperr.Wrap(apperr.ErrInternal, "failed to get session")
+	}
+
+	if err := s.repo.DeleteSessionByToken(ctx, refreshToken); err != nil {
+		return apperr.Wrap(apperr.ErrInternal, "failed to delete session")
+	}
+
+	if session.DeviceID.Valid {
+		s.events.RevokeDevice(session.UserID, session.DeviceID.UUID)
+	}
+	return nil
 }
 
 // ForgotPassword initiates password reset
@@ -173,8 +198,9 @@ func (s *Service) ResetPassword(ctx context.Context, req ResetPasswordRequest) (
 	// Mark token as used
 	_ = s.repo.MarkPasswordResetUsed(ctx, reset.ID)
 
-	// Invalidate all sessions
+	// Invalidate all sessions and drop live connections
 	_ = s.repo.DeleteUserSessions(ctx, reset.UserID)
+	s.events.RevokeUser(reset.UserID)
 
 	return &MessageResponse{Message: "Password has been reset successfully"}, nil
 }
@@ -0,0 +1,33 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Request DTOs
+
+type HistoryQuery struct {
+	StreamID string `form:"stream_id" binding:"omitempty,uuid"`
+	Before   string `form:"before" binding:"omitempty,uuid"`
+	Limit    int    `form:"limit" binding:"omitempty,min=1,max=100"`
+}
+
+// Response DTOs
+
+type Response struct {
+	ID           uuid.UUID  `json:"id"`
+	FromDeviceID *uuid.UUID `json:"from_device_id,omitempty"`
+	ToDeviceID   *uuid.UUID `json:"to_device_id,omitempty"`
+	StreamID     *uuid.UUID `json:"stream_id,omitempty"`
+	Body         string     `json:"body"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// HistoryResponse is a page of messages, newest first. Pass next_before as
+// ?before= to fetch the next page; it is omitted on the last page.
+type HistoryResponse struct {
+	Messages   []Response `json:"messages"`
+	NextBefore *uuid.UUID `json:"next_before,omitempty"`
+}
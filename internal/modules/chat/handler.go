@@ -0,0 +1,55 @@
+package chat
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+	"github.com/vkrishna03/streamz/internal/middleware"
+)
+
+type Handler struct {
+	svc *Service
+}
+
+func NewHandler(svc *Service) *Handler {
+	return &Handler{svc: svc}
+}
+
+func (h *Handler) History(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	var query HistoryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid request: %s", err.Error()))
+		return
+	}
+
+	resp, err := h.svc.History(c.Request.Context(), userID, query)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Setup registers message routes and returns the service, which handles
+// messages sent over the WebSocket. New messages are delivered through events.
+func Setup(api *gin.RouterGroup, db *sql.DB, jwtSecret string, events Events) *Service {
+	repo := NewRepository(db)
+	svc := NewService(repo, events)
+	h := NewHandler(svc)
+
+	r := api.Group("/messages")
+	r.Use(middleware.Auth(jwtSecret))
+
+	r.GET("", h.History)
+
+	return svc
+}
@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/vkrishna03/streamz/db/sqlc"
+)
+
+type Repository struct {
+	db *sql.DB
+	q  *sqlc.Queries
+}
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db, q: sqlc.New(db)}
+}
+
+func (r *Repository) Create(ctx context.Context, userID, fromDeviceID uuid.UUID, toDeviceID, streamID *uuid.UUID, body string) (sqlc.Message, error) {
+	return r.q.CreateMessage(ctx, sqlc.CreateMessageParams{
+		UserID:       userID,
+		FromDeviceID: uuid.NullUUID{UUID: fromDeviceID, Valid: true},
+		ToDeviceID:   toNullUUID(toDeviceID),
+		StreamID:     toNullUUID(streamID),
+		Body:         body,
+	})
+}
+
+func (r *Repository) List(ctx context.Context, userID uuid.UUID, streamID, before *uuid.UUID, limit int) ([]sqlc.Message, error) {
+	return r.q.ListMessages(ctx, sqlc.ListMessagesParams{
+		UserID:   userID,
+		StreamID: toNullUUID(streamID),
+		Before:   toNullUUID(before),
+		MaxRows:  int32(limit),
+	})
+}
+
+func (r *Repository) CountUnread(ctx context.Context, userID, deviceID uuid.UUID) ([]sqlc.CountUnreadMessagesRow, error) {
+	return r.q.CountUnreadMessages(ctx, sqlc.CountUnreadMessagesParams{
+		UserID:   userID,
+		DeviceID: deviceID,
+	})
+}
+
+func (r *Repository) MarkRead(ctx context.Context, userID, deviceID, messageID uuid.UUID) (int64, error) {
+	return r.q.MarkMessagesRead(ctx, sqlc.MarkMessagesReadParams{
+		DeviceID:  deviceID,
+		MessageID: messageID,
+		UserID:    userID,
+	})
+}
+
+// Ownership checks
+
+func (r *Repository) GetDevice(ctx context.Context, id uuid.UUID) (sqlc.Device, error) {
+	return r.q.GetDeviceByID(ctx, id)
+}
+
+func (r *Repository) GetStream(ctx context.Context, id uuid.UUID) (sqlc.Stream, error) {
+	return r.q.GetStreamByID(ctx, id)
+}
+
+// Helpers
+
+func toNullUUID(id *uuid.UUID) uuid.NullUUID {
+	if id == nil {
+		return uuid.NullUUID{}
+	}
+	return uuid.NullUUID{UUID: *id, Valid: true}
+}
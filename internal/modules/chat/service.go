@@ -0,0 +1,170 @@
+package chat
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/vkrishna03/streamz/db/sqlc"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+)
+
+const (
+	// Longest message body in characters
+	maxBodyLength = 2000
+
+	// Page size for history when no limit is given
+	defaultHistoryLimit = 50
+)
+
+// Events delivers new messages to the user's connected devices. The
+// WebSocket hub implements it.
+type Events interface {
+	DeliverChatMessage(userID, messageID, fromDeviceID uuid.UUID, toDeviceID, streamID *uuid.UUID, body string, sentAt time.Time)
+}
+
+type Service struct {
+	repo   *Repository
+	events Events
+}
+
+func NewService(repo *Repository, events Events) *Service {
+	return &Service{repo: repo, events: events}
+}
+
+// SendMessage stores a message from one of the user's devices and delivers it.
+// A nil toDeviceID addresses all of the user's devices.
+func (s *Service) SendMessage(ctx context.Context, userID, fromDeviceID uuid.UUID, toDeviceID, streamID *uuid.UUID, body string) (uuid.UUID, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return uuid.Nil, apperr.Wrap(apperr.ErrValidation, "message body is required")
+	}
+	if utf8.RuneCountInString(body) > maxBodyLength {
+		return uuid.Nil, apperr.Wrap(apperr.ErrValidation, "message body too long (max %d characters)", maxBodyLength)
+	}
+
+	if toDeviceID != nil {
+		device, err := s.repo.GetDevice(ctx, *toDeviceID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return uuid.Nil, apperr.Wrap(apperr.ErrNotFound, "device not found")
+			}
+			return uuid.Nil, apperr.Wrap(apperr.ErrInternal, "failed to get device")
+		}
+		if device.UserID != userID {
+			return uuid.Nil, apperr.Wrap(apperr.ErrForbidden, "device not owned by user")
+		}
+	}
+
+	if streamID != nil {
+		stream, err := s.repo.GetStream(ctx, *streamID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return uuid.Nil, apperr.Wrap(apperr.ErrNotFound, "stream not found")
+			}
+			return uuid.Nil, apperr.Wrap(apperr.ErrInternal, "failed to get stream")
+		}
+		if stream.UserID != userID {
+			return uuid.Nil, apperr.Wrap(apperr.ErrForbidden, "stream not owned by user")
+		}
+	}
+
+	msg, err := s.repo.Create(ctx, userID, fromDeviceID, toDeviceID, streamID, body)
+	if err != nil {
+		return uuid.Nil, apperr.Wrap(apperr.ErrInternal, "failed to save message")
+	}
+
+	s.events.DeliverChatMessage(userID, msg.ID, fromDeviceID, toDeviceID, streamID, msg.Body, msg.CreatedAt)
+	return msg.ID, nil
+}
+
+// History returns a page of the user's messages, newest first
+func (s *Service) History(ctx context.Context, userID uuid.UUID, query HistoryQuery) (*HistoryResponse, error) {
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+
+	streamID := parseOptionalUUID(query.StreamID)
+	before := parseOptionalUUID(query.Before)
+
+	// Fetch one extra to know whether there is another page
+	messages, err := s.repo.List(ctx, userID, streamID, before, limit+1)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to list messages")
+	}
+
+	resp := &HistoryResponse{Messages: make([]Response, 0, limit)}
+	if len(messages) > limit {
+		messages = messages[:limit]
+		last := messages[limit-1].ID
+		resp.NextBefore = &last
+	}
+	for _, m := range messages {
+		resp.Messages = append(resp.Messages, toResponse(m))
+	}
+
+	return resp, nil
+}
+
+// UnreadCounts returns how many unread messages a device has from each of
+// the user's other devices
+func (s *Service) UnreadCounts(ctx context.Context, userID, deviceID uuid.UUID) (map[uuid.UUID]int, error) {
+	rows, err := s.repo.CountUnread(ctx, userID, deviceID)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to count unread messages")
+	}
+
+	counts := make(map[uuid.UUID]int, len(rows))
+	for _, r := range rows {
+		counts[r.FromDeviceID.UUID] = int(r.Unread)
+	}
+	return counts, nil
+}
+
+// MarkRead marks everything up to and including a message as read on a device
+func (s *Service) MarkRead(ctx context.Context, userID, deviceID, messageID uuid.UUID) error {
+	n, err := s.repo.MarkRead(ctx, userID, deviceID, messageID)
+	if err != nil {
+		return apperr.Wrap(apperr.ErrInternal, "failed to mark messages read")
+	}
+	if n == 0 {
+		return apperr.Wrap(apperr.ErrNotFound, "message not found")
+	}
+	return nil
+}
+
+// Helpers
+
+func toResponse(m sqlc.Message) Response {
+	resp := Response{
+		ID:        m.ID,
+		Body:      m.Body,
+		CreatedAt: m.CreatedAt,
+	}
+	if m.FromDeviceID.Valid {
+		resp.FromDeviceID = &m.FromDeviceID.UUID
+	}
+	if m.ToDeviceID.Valid {
+		resp.ToDeviceID = &m.ToDeviceID.UUID
+	}
+	if m.StreamID.Valid {
+		resp.StreamID = &m.StreamID.UUID
+	}
+	return resp
+}
+
+// parseOptionalUUID parses a query parameter already validated by binding
+func parseOptionalUUID(s string) *uuid.UUID {
+	if s == "" {
+		return nil
+	}
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return nil
+	}
+	return &id
+}
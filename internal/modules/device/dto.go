@@ -26,6 +26,11 @@ type UpdateStatusRequest struct {
 	IsOnline bool `json:"is_online"`
 }
 
+type TelemetryQuery struct {
+	Since time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit int       `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
 // Response DTOs
 
 type Response struct {
@@ -36,10 +41,23 @@ type Response struct {
 	HasCamera     bool      `json:"has_camera"`
 	HasMicrophone bool      `json:"has_microphone"`
 	IsOnline      bool      `json:"is_online"`
+	Presence      string    `json:"presence"`
 	LastSeen      time.Time `json:"last_seen"`
 	CreatedAt     time.Time `json:"created_at"`
 }
 
+// TelemetryResponse is one telemetry sample. Alerts lists the thresholds the
+// sample newly crossed.
+type TelemetryResponse struct {
+	BatteryLevel  int       `json:"battery_level"`
+	Charging      bool      `json:"charging"`
+	ThermalState  string    `json:"thermal_state"`
+	FreeStorageMB int64     `json:"free_storage_mb"`
+	NetworkType   string    `json:"network_type"`
+	Alerts        []string  `json:"alerts"`
+	RecordedAt    time.Time `json:"recorded_at"`
+}
+
 type MessageResponse struct {
 	Message string `json:"message"`
 }
@@ -170,6 +170,34 @@ func (h *Handler) Heartbeat(c *gin.Context) {
 	c.JSON(http.StatusOK, MessageResponse{Message: "heartbeat received"})
 }
 
+func (h *Handler) Telemetry(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	deviceID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid device id"))
+		return
+	}
+
+	var query TelemetryQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid request: %s", err.Error()))
+		return
+	}
+
+	resp, err := h.svc.Telemetry(c.Request.Context(), userID, deviceID, query)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
 func (h *Handler) Delete(c *gin.Context) {
 	userID, ok := middleware.GetUserID(c)
 	if !ok {
@@ -191,10 +219,11 @@ func (h *Handler) Delete(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
 
-// Setup registers device routes
-func Setup(api *gin.RouterGroup, db *sql.DB, jwtSecret string) {
+// Setup registers device routes. Changes are pushed to connected devices
+// through events.
+func Setup(api *gin.RouterGroup, db *sql.DB, jwtSecret string, events Events) {
 	repo := NewRepository(db)
-	svc := NewService(repo)
+	svc := NewService(repo, events)
 	h := NewHandler(svc)
 
 	r := api.Group("/devices")
@@ -207,5 +236,6 @@ func Setup(api *gin.RouterGroup, db *sql.DB, jwtSecret string) {
 	r.PUT("/:id", h.Update)
 	r.PUT("/:id/status", h.UpdateStatus)
 	r.POST("/:id/heartbeat", h.Heartbeat)
+	r.GET("/:id/telemetry", h.Telemetry)
 	r.DELETE("/:id", h.Delete)
 }
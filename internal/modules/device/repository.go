@@ -3,6 +3,7 @@ package device
 import (
 	"context"
 	"database/sql"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/vkrishna03/streamz/db/sqlc"
@@ -36,6 +37,14 @@ func (r *Repository) ListOnlineByUser(ctx context.Context, userID uuid.UUID) ([]
 	return r.q.ListOnlineUserDevices(ctx, userID)
 }
 
+func (r *Repository) ListTelemetry(ctx context.Context, deviceID uuid.UUID, since time.Time, limit int) ([]sqlc.TelemetrySample, error) {
+	return r.q.ListTelemetrySamples(ctx, sqlc.ListTelemetrySamplesParams{
+		DeviceID: deviceID,
+		Since:    since,
+		MaxRows:  int32(limit),
+	})
+}
+
 func (r *Repository) Create(ctx context.Context, userID uuid.UUID, deviceID, deviceName string, deviceType sqlc.DeviceType, hasCamera, hasMic bool) (sqlc.Device, error) {
 	return r.q.CreateDevice(ctx, sqlc.CreateDeviceParams{
 		UserID:        userID,
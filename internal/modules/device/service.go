@@ -3,18 +3,33 @@ package device
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/vkrishna03/streamz/db/sqlc"
 	apperr "github.com/vkrishna03/streamz/internal/errors"
 )
 
+// Events pushes device changes to the user's connected devices. The
+// WebSocket hub implements it.
+type Events interface {
+	UpdateDevice(userID, deviceID uuid.UUID, name string, hasCamera, hasMicrophone bool)
+	RemoveDevice(userID, deviceID uuid.UUID)
+}
+
+const (
+	defaultTelemetryWindow = 24 * time.Hour
+	defaultTelemetryLimit  = 100
+)
+
 type Service struct {
-	repo *Repository
+	repo   *Repository
+	events Events
 }
 
-func NewService(repo *Repository) *Service {
-	return &Service{repo: repo}
+func NewService(repo *Repository, events Events) *Service {
+	return &Service{repo: repo, events: events}
 }
 
 // Register creates a new device for the user
@@ -122,6 +137,8 @@ func (s *Service) Update(ctx context.Context, userID, deviceID uuid.UUID, req Up
 	}
 
 	resp := toResponse(updated)
+	s.events.UpdateDevice(userID, deviceID, resp.DeviceName, resp.HasCamera, resp.HasMicrophone)
+
 	return &resp, nil
 }
 
@@ -161,6 +178,34 @@ func (s *Service) Heartbeat(ctx context.Context, userID, deviceID uuid.UUID) err
 	return s.repo.UpdateLastSeen(ctx, deviceID)
 }
 
+// Telemetry returns a device's telemetry samples, newest first. Without a
+// since time it covers the last day.
+func (s *Service) Telemetry(ctx context.Context, userID, deviceID uuid.UUID, q TelemetryQuery) ([]TelemetryResponse, error) {
+	if _, err := s.GetByID(ctx, userID, deviceID); err != nil {
+		return nil, err
+	}
+
+	since := q.Since
+	if since.IsZero() {
+		since = time.Now().Add(-defaultTelemetryWindow)
+	}
+	limit := q.Limit
+	if limit == 0 {
+		limit = defaultTelemetryLimit
+	}
+
+	samples, err := s.repo.ListTelemetry(ctx, deviceID, since, limit)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to list telemetry")
+	}
+
+	resp := make([]TelemetryResponse, len(samples))
+	for i, t := range samples {
+		resp[i] = toTelemetryResponse(t)
+	}
+	return resp, nil
+}
+
 // Delete removes a device
 func (s *Service) Delete(ctx context.Context, userID, deviceID uuid.UUID) error {
 	// Verify ownership
@@ -176,7 +221,13 @@ func (s *Service) Delete(ctx context.Context, userID, deviceID uuid.UUID) error
 		return apperr.Wrap(apperr.ErrForbidden, "device not owned by user")
 	}
 
-	return s.repo.Delete(ctx, deviceID)
+	if err := s.repo.Delete(ctx, deviceID); err != nil {
+		return apperr.Wrap(apperr.ErrInternal, "failed to delete device")
+	}
+
+	// Disconnect it so it can't keep signaling
+	s.events.RemoveDevice(userID, deviceID)
+	return nil
 }
 
 // Helpers
@@ -187,6 +238,7 @@ func toResponse(d sqlc.Device) Response {
 		DeviceID:   d.DeviceID,
 		DeviceName: d.DeviceName,
 		DeviceType: string(d.DeviceType),
+		Presence:   string(d.Presence),
 		CreatedAt:  d.CreatedAt.Time,
 	}
 	if d.HasCamera.Valid {
@@ -204,6 +256,20 @@ func toResponse(d sqlc.Device) Response {
 	return resp
 }
 
+func toTelemetryResponse(t sqlc.TelemetrySample) TelemetryResponse {
+	resp := TelemetryResponse{
+		BatteryLevel:  int(t.BatteryLevel),
+		Charging:      t.Charging,
+		ThermalState:  t.ThermalState,
+		FreeStorageMB: t.FreeStorageMb,
+		NetworkType:   t.NetworkType,
+		Alerts:        []string{},
+		RecordedAt:    t.RecordedAt,
+	}
+	_ = json.Unmarshal(t.Alerts, &resp.Alerts)
+	return resp
+}
+
 func toResponseList(devices []sqlc.Device) []Response {
 	resp := make([]Response, len(devices))
 	for i, d := range devices {
@@ -8,11 +8,14 @@ import (
 
 // Request DTOs
 
+// StartRequest starts a stream. With sfu set the source publishes to the
+// server once and any of the user's devices subscribe, so there's no target.
 type StartRequest struct {
 	SourceDeviceID uuid.UUID `json:"source_device_id" binding:"required"`
 	TargetDeviceID uuid.UUID `json:"target_device_id"`
 	StreamType     string    `json:"stream_type" binding:"required,oneof=video audio both"`
 	Quality        string    `json:"quality" binding:"omitempty,oneof=low medium high auto"`
+	SFU            bool      `json:"sfu"`
 }
 
 type UpdateStatusRequest struct {
@@ -41,6 +44,7 @@ type Response struct {
 	LatencyMs      *int           `json:"latency_ms,omitempty"`
 	StartedAt      time.Time      `json:"started_at"`
 	EndedAt        *time.Time     `json:"ended_at,omitempty"`
+	SFU            bool           `json:"sfu"`
 }
 
 type MessageResponse struct {
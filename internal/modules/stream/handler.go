@@ -196,10 +196,11 @@ func (h *Handler) End(c *gin.Context) {
 	c.JSON(http.StatusOK, MessageResponse{Message: "stream ended"})
 }
 
-// Setup registers stream routes
-func Setup(api *gin.RouterGroup, db *sql.DB, jwtSecret string) {
+// Setup registers stream routes and returns the service, which also handles
+// stream requests made over the WebSocket
+func Setup(api *gin.RouterGroup, db *sql.DB, jwtSecret string, events Events) *Service {
 	repo := NewRepository(db)
-	svc := NewService(repo)
+	svc := NewService(repo, events)
 	h := NewHandler(svc)
 
 	r := api.Group("/streams")
@@ -213,4 +214,6 @@ func Setup(api *gin.RouterGroup, db *sql.DB, jwtSecret string) {
 	r.PUT("/:id/latency", h.UpdateLatency)
 	r.PUT("/:id/connection-type", h.UpdateConnectionType)
 	r.DELETE("/:id", h.End)
+
+	return svc
 }
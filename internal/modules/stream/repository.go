@@ -29,13 +29,14 @@ func (r *Repository) ListActiveByUser(ctx context.Context, userID uuid.UUID) ([]
 	return r.q.ListActiveUserStreams(ctx, userID)
 }
 
-func (r *Repository) Create(ctx context.Context, userID uuid.UUID, sourceDeviceID, targetDeviceID *uuid.UUID, streamType sqlc.StreamType, quality sqlc.StreamQuality) (sqlc.Stream, error) {
+func (r *Repository) Create(ctx context.Context, userID uuid.UUID, sourceDeviceID, targetDeviceID *uuid.UUID, streamType sqlc.StreamType, quality sqlc.StreamQuality, sfu bool) (sqlc.Stream, error) {
 	return r.q.CreateStream(ctx, sqlc.CreateStreamParams{
 		UserID:         userID,
 		SourceDeviceID: toNullUUID(sourceDeviceID),
 		TargetDeviceID: toNullUUID(targetDeviceID),
 		StreamType:     streamType,
 		Quality:        sqlc.NullStreamQuality{StreamQuality: quality, Valid: true},
+		Sfu:            sfu,
 	})
 }
 
@@ -10,12 +10,35 @@ import (
 	apperr "github.com/vkrishna03/streamz/internal/errors"
 )
 
+// Events publishes stream lifecycle changes to the user's connected devices.
+// The WebSocket hub implements it.
+type Events interface {
+	BroadcastStreamStart(userID uuid.UUID, streamID, sourceDeviceID uuid.UUID, streamType, quality string, sfu bool)
+	BroadcastStreamStatus(userID, streamID uuid.UUID, status string)
+	BroadcastStreamLatency(userID, streamID uuid.UUID, latencyMs int)
+	BroadcastStreamEnd(userID uuid.UUID, streamID uuid.UUID)
+}
+
+// SFU forwards the media of streams started with sfu set. The webrtc module
+// implements it.
+type SFU interface {
+	CloseStream(streamID uuid.UUID)
+}
+
 type Service struct {
-	repo *Repository
+	repo   *Repository
+	events Events
+	sfu    SFU
 }
 
-func NewService(repo *Repository) *Service {
-	return &Service{repo: repo}
+func NewService(repo *Repository, events Events) *Service {
+	return &Service{repo: repo, events: events}
+}
+
+// SetSFU allows streams forwarded by the server, and closes what it holds
+// for them when they end
+func (s *Service) SetSFU(sfu SFU) {
+	s.sfu = sfu
 }
 
 // Start creates a new stream
@@ -51,13 +74,22 @@ func (s *Service) Start(ctx context.Context, userID uuid.UUID, req StartRequest)
 		quality = q
 	}
 
+	if req.SFU {
+		if s.sfu == nil {
+			return nil, apperr.Wrap(apperr.ErrValidation, "streams can't be forwarded by this server")
+		}
+		if req.TargetDeviceID != uuid.Nil {
+			return nil, apperr.Wrap(apperr.ErrValidation, "a forwarded stream has no target device")
+		}
+	}
+
 	// Create stream
 	var targetDeviceID *uuid.UUID
 	if req.TargetDeviceID != uuid.Nil {
 		targetDeviceID = &req.TargetDeviceID
 	}
 
-	stream, err := s.repo.Create(ctx, userID, &req.SourceDeviceID, targetDeviceID, streamType, quality)
+	stream, err := s.repo.Create(ctx, userID, &req.SourceDeviceID, targetDeviceID, streamType, quality, req.SFU)
 	if err != nil {
 		return nil, apperr.Wrap(apperr.ErrInternal, "failed to create stream")
 	}
@@ -66,9 +98,26 @@ func (s *Service) Start(ctx context.Context, userID uuid.UUID, req StartRequest)
 	_ = s.repo.IncrementStreamCount(ctx, userID)
 
 	resp := toResponse(stream)
+	s.events.BroadcastStreamStart(userID, resp.ID, req.SourceDeviceID, resp.StreamType, resp.Quality, resp.SFU)
+
 	return &resp, nil
 }
 
+// StartStream starts a stream on behalf of a WebSocket client and returns its ID
+func (s *Service) StartStream(ctx context.Context, userID, sourceDeviceID, targetDeviceID uuid.UUID, streamType, quality string, sfu bool) (uuid.UUID, error) {
+	resp, err := s.Start(ctx, userID, StartRequest{
+		SourceDeviceID: sourceDeviceID,
+		TargetDeviceID: targetDeviceID,
+		StreamType:     streamType,
+		Quality:        quality,
+		SFU:            sfu,
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return resp.ID, nil
+}
+
 // List returns all streams for the user
 func (s *Service) List(ctx context.Context, userID uuid.UUID) ([]Response, error) {
 	streams, err := s.repo.ListByUser(ctx, userID)
@@ -127,7 +176,15 @@ func (s *Service) UpdateStatus(ctx context.Context, userID, streamID uuid.UUID,
 		return err
 	}
 
-	return s.repo.UpdateStatus(ctx, streamID, status)
+	if err := s.repo.UpdateStatus(ctx, streamID, status); err != nil {
+		return apperr.Wrap(apperr.ErrInternal, "failed to update stream status")
+	}
+	if status == sqlc.StreamStatusEnded || status == sqlc.StreamStatusFailed {
+		s.closeForwarded(stream)
+	}
+
+	s.events.BroadcastStreamStatus(userID, streamID, string(status))
+	return nil
 }
 
 // UpdateLatency updates the stream latency
@@ -144,7 +201,12 @@ func (s *Service) UpdateLatency(ctx context.Context, userID, streamID uuid.UUID,
 		return apperr.Wrap(apperr.ErrForbidden, "stream not owned by user")
 	}
 
-	return s.repo.UpdateLatency(ctx, streamID, latencyMs)
+	if err := s.repo.UpdateLatency(ctx, streamID, latencyMs); err != nil {
+		return apperr.Wrap(apperr.ErrInternal, "failed to update stream latency")
+	}
+
+	s.events.BroadcastStreamLatency(userID, streamID, latencyMs)
+	return nil
 }
 
 // UpdateConnectionType updates the connection type
@@ -192,11 +254,29 @@ func (s *Service) End(ctx context.Context, userID, streamID uuid.UUID) error {
 		}
 	}
 
-	return s.repo.End(ctx, streamID)
+	if err := s.repo.End(ctx, streamID); err != nil {
+		return apperr.Wrap(apperr.ErrInternal, "failed to end stream")
+	}
+	s.closeForwarded(stream)
+
+	s.events.BroadcastStreamEnd(userID, streamID)
+	return nil
+}
+
+// EndStream ends a stream on behalf of a WebSocket client
+func (s *Service) EndStream(ctx context.Context, userID, streamID uuid.UUID) error {
+	return s.End(ctx, userID, streamID)
 }
 
 // Helpers
 
+// closeForwarded drops the SFU's peers of a stream that's over
+func (s *Service) closeForwarded(stream sqlc.Stream) {
+	if stream.Sfu && s.sfu != nil {
+		s.sfu.CloseStream(stream.ID)
+	}
+}
+
 func toResponse(s sqlc.Stream) Response {
 	resp := Response{
 		ID:         s.ID,
@@ -204,6 +284,7 @@ func toResponse(s sqlc.Stream) Response {
 		StreamType: string(s.StreamType),
 		Status:     string(s.Status.StreamStatus),
 		StartedAt:  s.StartedAt.Time,
+		SFU:        s.Sfu,
 	}
 
 	if s.SourceDeviceID.Valid {
@@ -0,0 +1,40 @@
+package transfer
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Request DTOs
+
+type CreateRequest struct {
+	FromDeviceID uuid.UUID `json:"from_device_id" binding:"required"`
+	ToDeviceID   uuid.UUID `json:"to_device_id" binding:"required"`
+	FileName     string    `json:"file_name" binding:"required,max=255"`
+	ContentType  string    `json:"content_type" binding:"omitempty,max=255"`
+	Size         int64     `json:"size" binding:"required,min=1"`
+}
+
+// Response DTOs
+
+// Response describes a transfer. Upload the file in chunks of at most
+// chunk_size bytes, each at offset received_bytes.
+type Response struct {
+	ID            uuid.UUID `json:"id"`
+	FromDeviceID  uuid.UUID `json:"from_device_id"`
+	ToDeviceID    uuid.UUID `json:"to_device_id"`
+	FileName      string    `json:"file_name"`
+	ContentType   string    `json:"content_type"`
+	Size          int64     `json:"size"`
+	ReceivedBytes int64     `json:"received_bytes"`
+	ChunkSize     int64     `json:"chunk_size"`
+	Status        string    `json:"status"`
+	Accepted      bool      `json:"accepted"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type MessageResponse struct {
+	Message string `json:"message"`
+}
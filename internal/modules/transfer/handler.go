@@ -0,0 +1,240 @@
+package transfer
+
+import (
+	"database/sql"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+	"github.com/vkrishna03/streamz/internal/middleware"
+)
+
+// Config holds transfer module settings
+type Config struct {
+	JWTSecret string
+
+	// Where files are staged, how long a transfer may go unclaimed, and the
+	// largest chunk an upload request may carry
+	Dir       string
+	TTL       time.Duration
+	ChunkSize int64
+}
+
+type Handler struct {
+	svc *Service
+}
+
+func NewHandler(svc *Service) *Handler {
+	return &Handler{svc: svc}
+}
+
+func (h *Handler) Create(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	var req CreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid request: %s", err.Error()))
+		return
+	}
+
+	resp, err := h.svc.Create(c.Request.Context(), userID, req)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+func (h *Handler) List(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	deviceID, err := uuid.Parse(c.Query("device_id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid device_id"))
+		return
+	}
+
+	resp, err := h.svc.ListActive(c.Request.Context(), userID, deviceID)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func (h *Handler) Get(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	transferID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid transfer id"))
+		return
+	}
+
+	resp, err := h.svc.Get(c.Request.Context(), userID, transferID)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Upload stores the request body as the chunk starting at the Upload-Offset
+// header. An interrupted upload resumes at received_bytes from Get.
+func (h *Handler) Upload(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	transferID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid transfer id"))
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "Upload-Offset header required"))
+		return
+	}
+
+	resp, err := h.svc.Upload(c.Request.Context(), userID, transferID, offset, c.Request.ContentLength, c.Request.Body)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// Download serves an accepted transfer's file to the receiving device, with
+// Range support for resuming. The file stays until the device confirms it
+// has everything with Complete.
+func (h *Handler) Download(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	transferID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid transfer id"))
+		return
+	}
+
+	deviceID, err := uuid.Parse(c.Query("device_id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid device_id"))
+		return
+	}
+
+	f, t, err := h.svc.Open(c.Request.Context(), userID, deviceID, transferID)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+	defer f.Close()
+
+	c.Header("Content-Type", t.ContentType)
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": t.FileName}))
+	http.ServeContent(c.Writer, c.Request, t.FileName, t.CreatedAt, f)
+}
+
+// Complete is called by the receiving device once it has the whole file,
+// which is then deleted
+func (h *Handler) Complete(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	transferID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid transfer id"))
+		return
+	}
+
+	deviceID, err := uuid.Parse(c.Query("device_id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid device_id"))
+		return
+	}
+
+	if err := h.svc.Complete(c.Request.Context(), userID, deviceID, transferID); err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "transfer completed"})
+}
+
+func (h *Handler) Cancel(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	transferID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid transfer id"))
+		return
+	}
+
+	if err := h.svc.Cancel(c.Request.Context(), userID, transferID); err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, MessageResponse{Message: "transfer cancelled"})
+}
+
+// Setup registers transfer routes and returns the service, which handles
+// transfer:accept over the WebSocket and expires unclaimed transfers once
+// RunExpiry is started. Offers and progress go out through events.
+func Setup(api *gin.RouterGroup, db *sql.DB, cfg Config, events Events) (*Service, error) {
+	store, err := NewStore(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := NewRepository(db)
+	svc := NewService(repo, store, events, cfg.TTL, cfg.ChunkSize)
+	h := NewHandler(svc)
+
+	r := api.Group("/transfers")
+	r.Use(middleware.Auth(cfg.JWTSecret))
+
+	r.POST("", h.Create)
+	r.GET("", h.List)
+	r.GET("/:id", h.Get)
+	r.PATCH("/:id", h.Upload)
+	r.GET("/:id/download", h.Download)
+	r.POST("/:id/complete", h.Complete)
+	r.DELETE("/:id", h.Cancel)
+
+	return svc, nil
+}
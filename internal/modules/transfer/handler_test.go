@@ -0,0 +1,169 @@
+package transfer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/vkrishna03/streamz/db/sqlc"
+	"github.com/vkrishna03/streamz/internal/middleware"
+)
+
+// testServer runs the upload, download and complete endpoints over a test
+// service
+type testServer struct {
+	*httptest.Server
+	*testService
+	token string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	s := newTestService(t)
+	h := NewHandler(s.Service)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	api := r.Group("/transfers", middleware.Auth("secret"))
+	api.PATCH("/:id", h.Upload)
+	api.GET("/:id/download", h.Download)
+	api.POST("/:id/complete", h.Complete)
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": s.userID.String(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{Server: srv, testService: s, token: token}
+}
+
+// do sends an authenticated request and returns the response status and body
+func (s *testServer) do(t *testing.T, method, path string, body io.Reader, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+// readOnly hides the reader's type so the request is sent without a
+// Content-Length
+type readOnly struct {
+	io.Reader
+}
+
+func TestUploadChunked(t *testing.T) {
+	s := newTestServer(t)
+	tr := s.mustCreate(t, 8)
+	path := "/transfers/" + tr.ID.String()
+	offset := http.Header{"Upload-Offset": {"0"}}
+
+	status, _ := s.do(t, http.MethodPatch, path, readOnly{strings.NewReader("abcdef")}, offset)
+	if status != http.StatusBadRequest {
+		t.Fatalf("oversized chunk without Content-Length: status %d, want 400", status)
+	}
+	if got := s.repo.transfer(tr.ID).ReceivedBytes; got != 0 {
+		t.Fatalf("received_bytes = %d, want 0", got)
+	}
+
+	if status, _ := s.do(t, http.MethodPatch, path, readOnly{strings.NewReader("abcd")}, offset); status != http.StatusOK {
+		t.Fatalf("chunk without Content-Length: status %d", status)
+	}
+	if status, _ := s.do(t, http.MethodPatch, path, strings.NewReader("efgh"), offset); status != http.StatusConflict {
+		t.Fatalf("chunk at a recorded offset: status %d, want 409", status)
+	}
+	if status, _ := s.do(t, http.MethodPatch, path, strings.NewReader("efgh"), nil); status != http.StatusBadRequest {
+		t.Fatalf("chunk without Upload-Offset: status %d, want 400", status)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	s := newTestServer(t)
+	tr := s.mustCreate(t, 8)
+	for offset, chunk := range []string{"abcd", "efgh"} {
+		if _, err := s.upload(tr.ID, int64(offset*4), chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	download := "/transfers/" + tr.ID.String() + "/download?device_id=" + s.laptop.String()
+	complete := "/transfers/" + tr.ID.String() + "/complete?device_id="
+
+	if status, _ := s.do(t, http.MethodGet, download, nil, nil); status != http.StatusConflict {
+		t.Fatalf("download before accepting: status %d, want 409", status)
+	}
+	if status, _ := s.do(t, http.MethodPost, complete+s.laptop.String(), nil, nil); status != http.StatusConflict {
+		t.Fatalf("complete before accepting: status %d, want 409", status)
+	}
+	if err := s.AcceptTransfer(context.Background(), s.userID, s.laptop, tr.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, deviceID := range []string{"", "laptop"} {
+		if status, _ := s.do(t, http.MethodGet, "/transfers/"+tr.ID.String()+"/download?device_id="+deviceID, nil, nil); status != http.StatusBadRequest {
+			t.Fatalf("download with device_id %q: status %d, want 400", deviceID, status)
+		}
+		if status, _ := s.do(t, http.MethodPost, complete+deviceID, nil, nil); status != http.StatusBadRequest {
+			t.Fatalf("complete with device_id %q: status %d, want 400", deviceID, status)
+		}
+	}
+
+	if status, _ := s.do(t, http.MethodGet, "/transfers/"+tr.ID.String()+"/download?device_id="+s.phone.String(), nil, nil); status != http.StatusForbidden {
+		t.Fatalf("download by the sender: status %d, want 403", status)
+	}
+
+	// Reading the last byte, with or without a range, doesn't complete it
+	status, body := s.do(t, http.MethodGet, download, nil, http.Header{"Range": {"bytes=6-"}})
+	if status != http.StatusPartialContent || body != "gh" {
+		t.Fatalf("range download: status %d, body %q", status, body)
+	}
+	status, body = s.do(t, http.MethodGet, download, nil, nil)
+	if status != http.StatusOK || body != "abcdefgh" {
+		t.Fatalf("download: status %d, body %q", status, body)
+	}
+	if got := s.repo.transfer(tr.ID).Status; got != sqlc.TransferStatusReady {
+		t.Fatalf("status = %s after download, want ready", got)
+	}
+
+	if status, _ := s.do(t, http.MethodPost, complete+s.phone.String(), nil, nil); status != http.StatusForbidden {
+		t.Fatalf("complete by the sender: status %d, want 403", status)
+	}
+	if status, _ := s.do(t, http.MethodPost, complete+s.laptop.String(), nil, nil); status != http.StatusOK {
+		t.Fatalf("complete: status %d", status)
+	}
+	if got := s.repo.transfer(tr.ID).Status; got != sqlc.TransferStatusCompleted || s.events.last() != string(got) {
+		t.Fatalf("status = %s, want completed", got)
+	}
+	if s.fileSize(t, tr.ID) != -1 {
+		t.Fatal("completed transfer's file not removed")
+	}
+
+	if status, _ := s.do(t, http.MethodGet, download, nil, nil); status != http.StatusConflict {
+		t.Fatalf("download after completing: status %d, want 409", status)
+	}
+	if status, _ := s.do(t, http.MethodPost, complete+s.laptop.String(), nil, nil); status != http.StatusConflict {
+		t.Fatalf("completing twice: status %d, want 409", status)
+	}
+}
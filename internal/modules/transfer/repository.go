@@ -0,0 +1,125 @@
+package transfer
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vkrishna03/streamz/db/sqlc"
+)
+
+type Repository struct {
+	db *sql.DB
+	q  *sqlc.Queries
+}
+
+func NewRepository(db *sql.DB) *Repository {
+	return &Repository{db: db, q: sqlc.New(db)}
+}
+
+// CreateWithinQuota creates a transfer if check passes. check gets the
+// user's settings and the bytes their unfinished transfers take up, and runs
+// with the settings row locked so concurrent creates can't both fit in the
+// same space. A user without settings gets the defaults.
+func (r *Repository) CreateWithinQuota(ctx context.Context, userID uuid.UUID, req CreateRequest, contentType string, expiresAt time.Time, check func(settings sqlc.UserSetting, active int64) error) (sqlc.Transfer, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqlc.Transfer{}, err
+	}
+	defer tx.Rollback()
+	q := r.q.WithTx(tx)
+
+	if err := q.EnsureUserSettings(ctx, userID); err != nil {
+		return sqlc.Transfer{}, err
+	}
+	settings, err := q.GetUserSettingsForUpdate(ctx, userID)
+	if err != nil {
+		return sqlc.Transfer{}, err
+	}
+	active, err := q.SumActiveTransferBytes(ctx, userID)
+	if err != nil {
+		return sqlc.Transfer{}, err
+	}
+	if err := check(settings, active); err != nil {
+		return sqlc.Transfer{}, err
+	}
+
+	t, err := q.CreateTransfer(ctx, sqlc.CreateTransferParams{
+		UserID:       userID,
+		FromDeviceID: req.FromDeviceID,
+		ToDeviceID:   req.ToDeviceID,
+		FileName:     req.FileName,
+		ContentType:  contentType,
+		SizeBytes:    req.Size,
+		ExpiresAt:    expiresAt,
+	})
+	if err != nil {
+		return sqlc.Transfer{}, err
+	}
+	return t, tx.Commit()
+}
+
+func (r *Repository) GetByID(ctx context.Context, id uuid.UUID) (sqlc.Transfer, error) {
+	return r.q.GetTransferByID(ctx, id)
+}
+
+func (r *Repository) ListActiveByDevice(ctx context.Context, userID, deviceID uuid.UUID) ([]sqlc.Transfer, error) {
+	return r.q.ListActiveTransfersByDevice(ctx, sqlc.ListActiveTransfersByDeviceParams{
+		UserID:   userID,
+		DeviceID: deviceID,
+	})
+}
+
+// ClaimUpload claims a transfer's upload for ttl. It reports false while
+// another claim on it hasn't expired.
+func (r *Repository) ClaimUpload(ctx context.Context, id, claim uuid.UUID, ttl time.Duration) (bool, error) {
+	n, err := r.q.ClaimTransferUpload(ctx, sqlc.ClaimTransferUploadParams{
+		TransferID: id,
+		Claim:      claim,
+		TtlSeconds: int32(ttl.Seconds()),
+	})
+	return n > 0, err
+}
+
+func (r *Repository) ReleaseUpload(ctx context.Context, id, claim uuid.UUID) error {
+	return r.q.ReleaseTransferUpload(ctx, sqlc.ReleaseTransferUploadParams{
+		TransferID: id,
+		Claim:      claim,
+	})
+}
+
+// AddBytes records a stored chunk if claim is still held
+func (r *Repository) AddBytes(ctx context.Context, id, claim uuid.UUID, offset, n int64) (sqlc.Transfer, error) {
+	return r.q.AddTransferBytes(ctx, sqlc.AddTransferBytesParams{
+		ID:          id,
+		OffsetBytes: offset,
+		Bytes:       n,
+		Claim:       claim,
+	})
+}
+
+func (r *Repository) Accept(ctx context.Context, id uuid.UUID) (sqlc.Transfer, error) {
+	return r.q.AcceptTransfer(ctx, id)
+}
+
+func (r *Repository) Finish(ctx context.Context, id uuid.UUID, status sqlc.TransferStatus) (sqlc.Transfer, error) {
+	return r.q.FinishTransfer(ctx, sqlc.FinishTransferParams{
+		ID:     id,
+		Status: status,
+	})
+}
+
+func (r *Repository) Expire(ctx context.Context) ([]sqlc.Transfer, error) {
+	return r.q.ExpireTransfers(ctx)
+}
+
+func (r *Repository) DeleteBefore(ctx context.Context, before time.Time) error {
+	return r.q.DeleteTransfersBefore(ctx, before)
+}
+
+// Ownership checks
+
+func (r *Repository) GetDevice(ctx context.Context, id uuid.UUID) (sqlc.Device, error) {
+	return r.q.GetDeviceByID(ctx, id)
+}
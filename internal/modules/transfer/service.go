@@ -0,0 +1,457 @@
+package transfer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vkrishna03/streamz/db/sqlc"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+)
+
+const (
+	// How often expired transfers are swept, and how long finished ones
+	// are kept listed after they expire
+	expirySweep       = time.Minute
+	finishedRetention = 7 * 24 * time.Hour
+
+	// How long an upload claim lasts, and how long a chunk may take to
+	// arrive under it. The difference covers clock skew with the database.
+	uploadClaim  = 10 * time.Minute
+	uploadWindow = 9 * time.Minute
+
+	// Limits for users whose settings leave them unset
+	defaultMaxTransferBytes   = 2 << 30
+	defaultTransferQuotaBytes = 5 << 30
+
+	defaultContentType = "application/octet-stream"
+)
+
+// errUploadWindow ends a chunk that is still arriving when its upload claim
+// is about to lapse
+var errUploadWindow = errors.New("upload window elapsed")
+
+// Events tells the user's devices about transfers. The WebSocket hub
+// implements it.
+type Events interface {
+	DeliverTransferOffer(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, fileName, contentType string, size int64, expiresAt time.Time)
+	DeliverTransferAccept(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, accepted bool)
+	DeliverTransferProgress(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, status string, receivedBytes, size int64)
+}
+
+// repository is the part of *Repository the service uses
+type repository interface {
+	CreateWithinQuota(ctx context.Context, userID uuid.UUID, req CreateRequest, contentType string, expiresAt time.Time, check func(settings sqlc.UserSetting, active int64) error) (sqlc.Transfer, error)
+	GetByID(ctx context.Context, id uuid.UUID) (sqlc.Transfer, error)
+	ListActiveByDevice(ctx context.Context, userID, deviceID uuid.UUID) ([]sqlc.Transfer, error)
+	ClaimUpload(ctx context.Context, id, claim uuid.UUID, ttl time.Duration) (bool, error)
+	ReleaseUpload(ctx context.Context, id, claim uuid.UUID) error
+	AddBytes(ctx context.Context, id, claim uuid.UUID, offset, n int64) (sqlc.Transfer, error)
+	Accept(ctx context.Context, id uuid.UUID) (sqlc.Transfer, error)
+	Finish(ctx context.Context, id uuid.UUID, status sqlc.TransferStatus) (sqlc.Transfer, error)
+	Expire(ctx context.Context) ([]sqlc.Transfer, error)
+	DeleteBefore(ctx context.Context, before time.Time) error
+	GetDevice(ctx context.Context, id uuid.UUID) (sqlc.Device, error)
+}
+
+type Service struct {
+	repo   repository
+	store  *Store
+	events Events
+
+	// How long a transfer may go unclaimed, and the largest chunk accepted
+	ttl       time.Duration
+	chunkSize int64
+}
+
+func NewService(repo *Repository, store *Store, events Events, ttl time.Duration, chunkSize int64) *Service {
+	return &Service{
+		repo:      repo,
+		store:     store,
+		events:    events,
+		ttl:       ttl,
+		chunkSize: chunkSize,
+	}
+}
+
+// Create starts a transfer and offers it to the receiving device. The sender
+// uploads the file afterwards; it counts against the user's quota until it
+// has been downloaded or has expired.
+func (s *Service) Create(ctx context.Context, userID uuid.UUID, req CreateRequest) (*Response, error) {
+	if req.FromDeviceID == req.ToDeviceID {
+		return nil, apperr.Wrap(apperr.ErrValidation, "cannot send a file to the same device")
+	}
+	for _, id := range []uuid.UUID{req.FromDeviceID, req.ToDeviceID} {
+		if err := s.checkDevice(ctx, userID, id); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only the base name is kept, the path stays on the sending device
+	req.FileName = filepath.Base(strings.ReplaceAll(req.FileName, `\`, "/"))
+	if req.FileName == "." || req.FileName == "/" {
+		return nil, apperr.Wrap(apperr.ErrValidation, "invalid file name")
+	}
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	// Check transfer quotas; concurrent creates are checked one at a time
+	t, err := s.repo.CreateWithinQuota(ctx, userID, req, contentType, time.Now().Add(s.ttl), func(settings sqlc.UserSetting, active int64) error {
+		maxBytes, quota := transferLimits(settings)
+		if req.Size > maxBytes {
+			return apperr.Wrap(apperr.ErrValidation, "file too large (max %d bytes)", maxBytes)
+		}
+		if active+req.Size > quota {
+			return apperr.Wrap(apperr.ErrValidation, "transfer quota exceeded (%d of %d bytes in use)", active, quota)
+		}
+		return nil
+	})
+	if err != nil {
+		if apperr.Is(err, apperr.ErrValidation) {
+			return nil, err
+		}
+		slog.Error("failed to create transfer", "error", err, "user_id", userID)
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to create transfer")
+	}
+
+	s.events.DeliverTransferOffer(userID, t.ID, t.FromDeviceID, t.ToDeviceID, t.FileName, t.ContentType, t.SizeBytes, t.ExpiresAt)
+
+	resp := s.toResponse(t)
+	return &resp, nil
+}
+
+// Get returns a transfer, e.g. to find where an interrupted upload resumes
+func (s *Service) Get(ctx context.Context, userID, transferID uuid.UUID) (*Response, error) {
+	t, err := s.get(ctx, userID, transferID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := s.toResponse(t)
+	return &resp, nil
+}
+
+// ListActive returns the transfers a device is sending or receiving that
+// haven't finished, including offers it missed while offline
+func (s *Service) ListActive(ctx context.Context, userID, deviceID uuid.UUID) ([]Response, error) {
+	if err := s.checkDevice(ctx, userID, deviceID); err != nil {
+		return nil, err
+	}
+
+	transfers, err := s.repo.ListActiveByDevice(ctx, userID, deviceID)
+	if err != nil {
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to list transfers")
+	}
+
+	resp := make([]Response, 0, len(transfers))
+	for _, t := range transfers {
+		resp = append(resp, s.toResponse(t))
+	}
+	return resp, nil
+}
+
+// Upload stores a chunk of the file at offset, which must be the number of
+// bytes received so far. size is the chunk's length if known, or -1.
+// Chunks are stored one at a time across instances, keeping the file in
+// line with received_bytes.
+func (s *Service) Upload(ctx context.Context, userID, transferID uuid.UUID, offset, size int64, body io.Reader) (*Response, error) {
+	if _, err := s.get(ctx, userID, transferID); err != nil {
+		return nil, err
+	}
+
+	claim := uuid.New()
+	claimed, err := s.repo.ClaimUpload(ctx, transferID, claim, uploadClaim)
+	if err != nil {
+		slog.Error("failed to claim transfer upload", "error", err, "transfer_id", transferID)
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to store chunk")
+	}
+	if !claimed {
+		return nil, apperr.Wrap(apperr.ErrConflict, "another chunk of this transfer is being uploaded")
+	}
+	defer func() {
+		if err := s.repo.ReleaseUpload(context.WithoutCancel(ctx), transferID, claim); err != nil {
+			slog.Error("failed to release transfer upload", "error", err, "transfer_id", transferID)
+		}
+	}()
+
+	// Checked under the claim, so no other chunk lands in between
+	t, err := s.get(ctx, userID, transferID)
+	if err != nil {
+		return nil, err
+	}
+	if t.Status != sqlc.TransferStatusUploading {
+		return nil, apperr.Wrap(apperr.ErrConflict, "transfer is %s", t.Status)
+	}
+	if offset != t.ReceivedBytes {
+		return nil, apperr.Wrap(apperr.ErrConflict, "upload resumes at offset %d", t.ReceivedBytes)
+	}
+
+	limit := min(s.chunkSize, t.SizeBytes-offset)
+	if size > limit {
+		return nil, apperr.Wrap(apperr.ErrValidation, "chunk too large (max %d bytes)", limit)
+	}
+
+	// Nothing is written once the claim may have passed to another instance
+	window := &deadlineReader{r: io.LimitReader(body, limit), deadline: time.Now().Add(uploadWindow)}
+	n, err := s.store.Write(t.ID, offset, window)
+	if errors.Is(err, errUploadWindow) {
+		return nil, apperr.Wrap(apperr.ErrConflict, "chunk took too long to upload")
+	}
+	if err != nil {
+		slog.Error("failed to store transfer chunk", "error", err, "transfer_id", t.ID)
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to store chunk")
+	}
+	if n == 0 {
+		return nil, apperr.Wrap(apperr.ErrValidation, "empty chunk")
+	}
+	if size < 0 {
+		// Unknown length; anything past the limit is an error
+		if extra, _ := body.Read(make([]byte, 1)); extra > 0 {
+			return nil, apperr.Wrap(apperr.ErrValidation, "chunk too large (max %d bytes)", limit)
+		}
+	}
+
+	t, err = s.repo.AddBytes(ctx, t.ID, claim, offset, n)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Cancelled or expired meanwhile
+			return nil, apperr.Wrap(apperr.ErrConflict, "transfer no longer accepts uploads")
+		}
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to record chunk")
+	}
+
+	s.events.DeliverTransferProgress(userID, t.ID, t.FromDeviceID, t.ToDeviceID, string(t.Status), t.ReceivedBytes, t.SizeBytes)
+
+	resp := s.toResponse(t)
+	return &resp, nil
+}
+
+// Open returns a completely uploaded and accepted transfer's file for the
+// receiving device to download
+func (s *Service) Open(ctx context.Context, userID, deviceID, transferID uuid.UUID) (*os.File, *Response, error) {
+	t, err := s.get(ctx, userID, transferID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if t.ToDeviceID != deviceID {
+		return nil, nil, apperr.Wrap(apperr.ErrForbidden, "transfer not addressed to this device")
+	}
+	if t.Status == sqlc.TransferStatusUploading {
+		return nil, nil, apperr.Wrap(apperr.ErrConflict, "upload not complete")
+	}
+	if t.Status != sqlc.TransferStatusReady {
+		return nil, nil, apperr.Wrap(apperr.ErrConflict, "transfer is %s", t.Status)
+	}
+	if !t.AcceptedAt.Valid {
+		return nil, nil, apperr.Wrap(apperr.ErrConflict, "transfer not accepted")
+	}
+
+	f, err := s.store.Open(t.ID)
+	if err != nil {
+		slog.Error("failed to open transfer file", "error", err, "transfer_id", t.ID)
+		return nil, nil, apperr.Wrap(apperr.ErrInternal, "failed to open file")
+	}
+
+	resp := s.toResponse(t)
+	return f, &resp, nil
+}
+
+// Complete marks a transfer downloaded by the receiving device and frees
+// its space
+func (s *Service) Complete(ctx context.Context, userID, deviceID, transferID uuid.UUID) error {
+	t, err := s.get(ctx, userID, transferID)
+	if err != nil {
+		return err
+	}
+
+	if t.ToDeviceID != deviceID {
+		return apperr.Wrap(apperr.ErrForbidden, "transfer not addressed to this device")
+	}
+	if t.Status == sqlc.TransferStatusUploading {
+		return apperr.Wrap(apperr.ErrConflict, "upload not complete")
+	}
+	if !t.AcceptedAt.Valid {
+		return apperr.Wrap(apperr.ErrConflict, "transfer not accepted")
+	}
+
+	return s.finish(ctx, userID, t.ID, sqlc.TransferStatusCompleted)
+}
+
+// Cancel abandons a transfer from either device
+func (s *Service) Cancel(ctx context.Context, userID, transferID uuid.UUID) error {
+	return s.finish(ctx, userID, transferID, sqlc.TransferStatusCancelled)
+}
+
+// AcceptTransfer records the receiving device's answer to an offer on behalf
+// of a WebSocket client and tells the sender. A declined transfer is
+// discarded.
+func (s *Service) AcceptTransfer(ctx context.Context, userID, deviceID, transferID uuid.UUID, accepted bool) error {
+	t, err := s.get(ctx, userID, transferID)
+	if err != nil {
+		return err
+	}
+	if t.ToDeviceID != deviceID {
+		return apperr.Wrap(apperr.ErrForbidden, "transfer not addressed to this device")
+	}
+
+	if accepted {
+		_, err = s.repo.Accept(ctx, t.ID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return apperr.Wrap(apperr.ErrConflict, "transfer already finished")
+			}
+			return apperr.Wrap(apperr.ErrInternal, "failed to accept transfer")
+		}
+	} else if err := s.finish(ctx, userID, t.ID, sqlc.TransferStatusDeclined); err != nil {
+		return err
+	}
+
+	s.events.DeliverTransferAccept(userID, t.ID, t.FromDeviceID, t.ToDeviceID, accepted)
+	return nil
+}
+
+// RunExpiry expires unclaimed transfers until ctx is cancelled
+func (s *Service) RunExpiry(ctx context.Context) {
+	ticker := time.NewTicker(expirySweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expire(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// expire discards transfers past their expiry and tells both devices
+func (s *Service) expire(ctx context.Context) {
+	expired, err := s.repo.Expire(ctx)
+	if err != nil {
+		slog.Error("failed to expire transfers", "error", err)
+		return
+	}
+
+	for _, t := range expired {
+		if err := s.store.Remove(t.ID); err != nil {
+			slog.Error("failed to remove transfer file", "error", err, "transfer_id", t.ID)
+		}
+		s.events.DeliverTransferProgress(t.UserID, t.ID, t.FromDeviceID, t.ToDeviceID, string(t.Status), t.ReceivedBytes, t.SizeBytes)
+	}
+	if len(expired) > 0 {
+		slog.Info("expired transfers", "count", len(expired))
+	}
+
+	if err := s.repo.DeleteBefore(ctx, time.Now().Add(-finishedRetention)); err != nil {
+		slog.Error("failed to delete old transfers", "error", err)
+	}
+}
+
+// Helpers
+
+// finish moves an unfinished transfer to a final status and deletes its file
+func (s *Service) finish(ctx context.Context, userID, transferID uuid.UUID, status sqlc.TransferStatus) error {
+	if _, err := s.get(ctx, userID, transferID); err != nil {
+		return err
+	}
+
+	t, err := s.repo.Finish(ctx, transferID, status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return apperr.Wrap(apperr.ErrConflict, "transfer already finished")
+		}
+		return apperr.Wrap(apperr.ErrInternal, "failed to update transfer")
+	}
+
+	if err := s.store.Remove(t.ID); err != nil {
+		slog.Error("failed to remove transfer file", "error", err, "transfer_id", t.ID)
+	}
+
+	s.events.DeliverTransferProgress(userID, t.ID, t.FromDeviceID, t.ToDeviceID, string(t.Status), t.ReceivedBytes, t.SizeBytes)
+	return nil
+}
+
+// get returns a transfer of the user's
+func (s *Service) get(ctx context.Context, userID, transferID uuid.UUID) (sqlc.Transfer, error) {
+	t, err := s.repo.GetByID(ctx, transferID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, apperr.Wrap(apperr.ErrNotFound, "transfer not found")
+		}
+		return t, apperr.Wrap(apperr.ErrInternal, "failed to get transfer")
+	}
+
+	if t.UserID != userID {
+		return t, apperr.Wrap(apperr.ErrNotFound, "transfer not found")
+	}
+	return t, nil
+}
+
+// checkDevice checks a device belongs to the user
+func (s *Service) checkDevice(ctx context.Context, userID, deviceID uuid.UUID) error {
+	device, err := s.repo.GetDevice(ctx, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return apperr.Wrap(apperr.ErrNotFound, "device not found")
+		}
+		return apperr.Wrap(apperr.ErrInternal, "failed to get device")
+	}
+	if device.UserID != userID {
+		return apperr.Wrap(apperr.ErrForbidden, "device not owned by user")
+	}
+	return nil
+}
+
+// transferLimits returns the user's largest transfer and total quota, with
+// the defaults for any left unset
+func transferLimits(settings sqlc.UserSetting) (maxBytes, quota int64) {
+	maxBytes, quota = defaultMaxTransferBytes, defaultTransferQuotaBytes
+	if settings.MaxTransferBytes.Valid {
+		maxBytes = settings.MaxTransferBytes.Int64
+	}
+	if settings.TransferQuotaBytes.Valid {
+		quota = settings.TransferQuotaBytes.Int64
+	}
+	return maxBytes, quota
+}
+
+// deadlineReader fails reads after deadline
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(d.deadline) {
+		return 0, errUploadWindow
+	}
+	return d.r.Read(p)
+}
+
+func (s *Service) toResponse(t sqlc.Transfer) Response {
+	return Response{
+		ID:            t.ID,
+		FromDeviceID:  t.FromDeviceID,
+		ToDeviceID:    t.ToDeviceID,
+		FileName:      t.FileName,
+		ContentType:   t.ContentType,
+		Size:          t.SizeBytes,
+		ReceivedBytes: t.ReceivedBytes,
+		ChunkSize:     s.chunkSize,
+		Status:        string(t.Status),
+		Accepted:      t.AcceptedAt.Valid,
+		ExpiresAt:     t.ExpiresAt,
+		CreatedAt:     t.CreatedAt,
+	}
+}
@@ -0,0 +1,632 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vkrishna03/streamz/db/sqlc"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+)
+
+// fakeRepository keeps transfers in memory with the same semantics as the
+// SQL queries
+type fakeRepository struct {
+	mu        sync.Mutex
+	devices   map[uuid.UUID]sqlc.Device
+	settings  map[uuid.UUID]sqlc.UserSetting
+	transfers map[uuid.UUID]sqlc.Transfer
+	uploads   map[uuid.UUID]fakeClaim
+}
+
+type fakeClaim struct {
+	claim     uuid.UUID
+	expiresAt time.Time
+}
+
+func newFakeRepository() *fakeRepository {
+	return &fakeRepository{
+		devices:   make(map[uuid.UUID]sqlc.Device),
+		settings:  make(map[uuid.UUID]sqlc.UserSetting),
+		transfers: make(map[uuid.UUID]sqlc.Transfer),
+		uploads:   make(map[uuid.UUID]fakeClaim),
+	}
+}
+
+func (f *fakeRepository) addUser(maxTransfer, quota int64) uuid.UUID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := uuid.New()
+	f.settings[id] = sqlc.UserSetting{
+		UserID:             id,
+		MaxTransferBytes:   sql.NullInt64{Int64: maxTransfer, Valid: true},
+		TransferQuotaBytes: sql.NullInt64{Int64: quota, Valid: true},
+	}
+	return id
+}
+
+func (f *fakeRepository) addDevice(userID uuid.UUID) uuid.UUID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := uuid.New()
+	f.devices[id] = sqlc.Device{ID: id, UserID: userID, DeviceName: "phone", DeviceType: sqlc.DeviceTypePhone}
+	return id
+}
+
+func (f *fakeRepository) transfer(id uuid.UUID) sqlc.Transfer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.transfers[id]
+}
+
+func active(t sqlc.Transfer) bool {
+	return t.Status == sqlc.TransferStatusUploading || t.Status == sqlc.TransferStatusReady
+}
+
+// CreateWithinQuota holds the lock throughout, as the settings row lock does
+func (f *fakeRepository) CreateWithinQuota(ctx context.Context, userID uuid.UUID, req CreateRequest, contentType string, expiresAt time.Time, check func(settings sqlc.UserSetting, active int64) error) (sqlc.Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	settings, ok := f.settings[userID]
+	if !ok {
+		// As EnsureUserSettings, with the limits left unset
+		settings = sqlc.UserSetting{UserID: userID}
+		f.settings[userID] = settings
+	}
+	var sum int64
+	for _, t := range f.transfers {
+		if t.UserID == userID && active(t) {
+			sum += t.SizeBytes
+		}
+	}
+	if err := check(settings, sum); err != nil {
+		return sqlc.Transfer{}, err
+	}
+
+	t := sqlc.Transfer{
+		ID:           uuid.New(),
+		UserID:       userID,
+		FromDeviceID: req.FromDeviceID,
+		ToDeviceID:   req.ToDeviceID,
+		FileName:     req.FileName,
+		ContentType:  contentType,
+		SizeBytes:    req.Size,
+		Status:       sqlc.TransferStatusUploading,
+		ExpiresAt:    expiresAt,
+		CreatedAt:    time.Now(),
+	}
+	f.transfers[t.ID] = t
+	return t, nil
+}
+
+func (f *fakeRepository) GetByID(ctx context.Context, id uuid.UUID) (sqlc.Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.transfers[id]
+	if !ok {
+		return t, sql.ErrNoRows
+	}
+	return t, nil
+}
+
+func (f *fakeRepository) ListActiveByDevice(ctx context.Context, userID, deviceID uuid.UUID) ([]sqlc.Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []sqlc.Transfer
+	for _, t := range f.transfers {
+		if t.UserID == userID && (t.FromDeviceID == deviceID || t.ToDeviceID == deviceID) && active(t) {
+			list = append(list, t)
+		}
+	}
+	return list, nil
+}
+
+func (f *fakeRepository) ClaimUpload(ctx context.Context, id, claim uuid.UUID, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.uploads[id]; ok && !c.expiresAt.Before(time.Now()) {
+		return false, nil
+	}
+	f.uploads[id] = fakeClaim{claim: claim, expiresAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (f *fakeRepository) ReleaseUpload(ctx context.Context, id, claim uuid.UUID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.uploads[id].claim == claim {
+		delete(f.uploads, id)
+	}
+	return nil
+}
+
+func (f *fakeRepository) AddBytes(ctx context.Context, id, claim uuid.UUID, offset, n int64) (sqlc.Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.transfers[id]
+	if !ok || t.ReceivedBytes != offset || t.Status != sqlc.TransferStatusUploading || f.uploads[id].claim != claim {
+		return sqlc.Transfer{}, sql.ErrNoRows
+	}
+	t.ReceivedBytes += n
+	if t.ReceivedBytes == t.SizeBytes {
+		t.Status = sqlc.TransferStatusReady
+	}
+	f.transfers[id] = t
+	return t, nil
+}
+
+func (f *fakeRepository) Accept(ctx context.Context, id uuid.UUID) (sqlc.Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.transfers[id]
+	if !ok || !active(t) {
+		return sqlc.Transfer{}, sql.ErrNoRows
+	}
+	if !t.AcceptedAt.Valid {
+		t.AcceptedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	f.transfers[id] = t
+	return t, nil
+}
+
+func (f *fakeRepository) Finish(ctx context.Context, id uuid.UUID, status sqlc.TransferStatus) (sqlc.Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.transfers[id]
+	if !ok || !active(t) {
+		return sqlc.Transfer{}, sql.ErrNoRows
+	}
+	t.Status = status
+	f.transfers[id] = t
+	return t, nil
+}
+
+func (f *fakeRepository) Expire(ctx context.Context) ([]sqlc.Transfer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var expired []sqlc.Transfer
+	for id, t := range f.transfers {
+		if t.ExpiresAt.Before(time.Now()) && active(t) {
+			t.Status = sqlc.TransferStatusExpired
+			f.transfers[id] = t
+			expired = append(expired, t)
+		}
+	}
+	return expired, nil
+}
+
+func (f *fakeRepository) DeleteBefore(ctx context.Context, before time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, t := range f.transfers {
+		if t.ExpiresAt.Before(before) && !active(t) {
+			delete(f.transfers, id)
+		}
+	}
+	return nil
+}
+
+func (f *fakeRepository) GetDevice(ctx context.Context, id uuid.UUID) (sqlc.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.devices[id]
+	if !ok {
+		return d, sql.ErrNoRows
+	}
+	return d, nil
+}
+
+// fakeEvents records the progress statuses delivered
+type fakeEvents struct {
+	mu       sync.Mutex
+	progress []string
+}
+
+func (e *fakeEvents) DeliverTransferOffer(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, fileName, contentType string, size int64, expiresAt time.Time) {
+}
+
+func (e *fakeEvents) DeliverTransferAccept(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, accepted bool) {
+}
+
+func (e *fakeEvents) DeliverTransferProgress(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, status string, receivedBytes, size int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.progress = append(e.progress, status)
+}
+
+func (e *fakeEvents) last() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.progress) == 0 {
+		return ""
+	}
+	return e.progress[len(e.progress)-1]
+}
+
+// testService is a service over a fake repository and a temporary store,
+// with one user and their phone and laptop
+type testService struct {
+	*Service
+	repo   *fakeRepository
+	events *fakeEvents
+
+	userID, phone, laptop uuid.UUID
+}
+
+const (
+	testChunkSize   = 4
+	testMaxTransfer = 100
+	testQuota       = 150
+)
+
+func newTestService(t *testing.T) *testService {
+	t.Helper()
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := newFakeRepository()
+	events := &fakeEvents{}
+	svc := NewService(nil, store, events, time.Hour, testChunkSize)
+	svc.repo = repo
+
+	userID := repo.addUser(testMaxTransfer, testQuota)
+	return &testService{
+		Service: svc,
+		repo:    repo,
+		events:  events,
+		userID:  userID,
+		phone:   repo.addDevice(userID),
+		laptop:  repo.addDevice(userID),
+	}
+}
+
+// create offers a file of size bytes from the phone to the laptop
+func (s *testService) create(t *testing.T, size int64) (*Response, error) {
+	t.Helper()
+	return s.Create(context.Background(), s.userID, CreateRequest{
+		FromDeviceID: s.phone,
+		ToDeviceID:   s.laptop,
+		FileName:     "clip.mov",
+		Size:         size,
+	})
+}
+
+func (s *testService) mustCreate(t *testing.T, size int64) *Response {
+	t.Helper()
+	resp, err := s.create(t, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func (s *testService) upload(id uuid.UUID, offset int64, data string) (*Response, error) {
+	return s.Upload(context.Background(), s.userID, id, offset, int64(len(data)), strings.NewReader(data))
+}
+
+// fileSize returns the size of the transfer's staged file, or -1 if there
+// is none
+func (s *testService) fileSize(t *testing.T, id uuid.UUID) int64 {
+	t.Helper()
+	info, err := os.Stat(s.store.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return -1
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestCreateQuota(t *testing.T) {
+	s := newTestService(t)
+
+	if _, err := s.create(t, testMaxTransfer+1); !apperr.Is(err, apperr.ErrValidation) {
+		t.Fatalf("over max_transfer_bytes: err = %v, want validation", err)
+	}
+
+	first := s.mustCreate(t, testMaxTransfer)
+	if _, err := s.create(t, testQuota-testMaxTransfer+1); !apperr.Is(err, apperr.ErrValidation) {
+		t.Fatalf("over transfer_quota_bytes: err = %v, want validation", err)
+	}
+	s.mustCreate(t, testQuota-testMaxTransfer)
+
+	// Finished transfers no longer count
+	if err := s.Cancel(context.Background(), s.userID, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	s.mustCreate(t, testMaxTransfer)
+}
+
+func TestCreateDefaultLimits(t *testing.T) {
+	s := newTestService(t)
+
+	// Settings with the limits unset, and no settings at all
+	s.repo.mu.Lock()
+	s.repo.settings[s.userID] = sqlc.UserSetting{UserID: s.userID}
+	s.repo.mu.Unlock()
+	other := uuid.New()
+	from, to := s.repo.addDevice(other), s.repo.addDevice(other)
+
+	for _, userID := range []uuid.UUID{s.userID, other} {
+		req := CreateRequest{FileName: "clip.mov", Size: defaultMaxTransferBytes}
+		req.FromDeviceID, req.ToDeviceID = s.phone, s.laptop
+		if userID == other {
+			req.FromDeviceID, req.ToDeviceID = from, to
+		}
+		if _, err := s.Create(context.Background(), userID, req); err != nil {
+			t.Fatalf("user %s: %v", userID, err)
+		}
+
+		req.Size = defaultMaxTransferBytes + 1
+		if _, err := s.Create(context.Background(), userID, req); !apperr.Is(err, apperr.ErrValidation) {
+			t.Fatalf("over the default max_transfer_bytes: err = %v, want validation", err)
+		}
+	}
+}
+
+func TestCreateQuotaConcurrent(t *testing.T) {
+	s := newTestService(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.create(t, 50); err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if want := testQuota / 50; created != want {
+		t.Fatalf("created %d transfers, want %d within the quota", created, want)
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	s := newTestService(t)
+	tr := s.mustCreate(t, 10)
+
+	if _, err := s.upload(tr.ID, 2, "abcd"); !apperr.Is(err, apperr.ErrConflict) {
+		t.Fatalf("upload past received_bytes: err = %v, want conflict", err)
+	}
+	if _, err := s.upload(tr.ID, 0, "abcde"); !apperr.Is(err, apperr.ErrValidation) {
+		t.Fatalf("chunk over chunk_size: err = %v, want validation", err)
+	}
+
+	if _, err := s.upload(tr.ID, 0, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A retried chunk that was already recorded
+	if _, err := s.upload(tr.ID, 0, "abcd"); !apperr.Is(err, apperr.ErrConflict) {
+		t.Fatalf("upload at a recorded offset: err = %v, want conflict", err)
+	}
+
+	// Resume where Get says
+	got, err := s.Get(context.Background(), s.userID, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ReceivedBytes != 4 {
+		t.Fatalf("received_bytes = %d, want 4", got.ReceivedBytes)
+	}
+	if _, err := s.upload(tr.ID, got.ReceivedBytes, "efgh"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last chunk may only fill the file
+	if _, err := s.upload(tr.ID, 8, "ijk"); !apperr.Is(err, apperr.ErrValidation) {
+		t.Fatalf("chunk past the end: err = %v, want validation", err)
+	}
+	resp, err := s.upload(tr.ID, 8, "ij")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != string(sqlc.TransferStatusReady) || s.events.last() != string(sqlc.TransferStatusReady) {
+		t.Fatalf("status = %s, want ready", resp.Status)
+	}
+
+	if _, err := s.upload(tr.ID, 10, "k"); !apperr.Is(err, apperr.ErrConflict) {
+		t.Fatalf("upload to a ready transfer: err = %v, want conflict", err)
+	}
+}
+
+func TestUploadConcurrentChunk(t *testing.T) {
+	s := newTestService(t)
+	tr := s.mustCreate(t, 8)
+
+	// Another instance sharing the database and the files
+	replica := NewService(nil, s.store, s.events, time.Hour, testChunkSize)
+	replica.repo = s.repo
+
+	// The first chunk is still arriving when the second starts
+	body, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Upload(context.Background(), s.userID, tr.ID, 0, 4, body)
+		done <- err
+	}()
+	w.Write([]byte("ab"))
+
+	if _, err := s.upload(tr.ID, 0, "wxyz"); !apperr.Is(err, apperr.ErrConflict) {
+		t.Fatalf("concurrent chunk: err = %v, want conflict", err)
+	}
+	_, err := replica.Upload(context.Background(), s.userID, tr.ID, 0, 4, strings.NewReader("wxyz"))
+	if !apperr.Is(err, apperr.ErrConflict) {
+		t.Fatalf("concurrent chunk on another instance: err = %v, want conflict", err)
+	}
+
+	w.Write([]byte("cd"))
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := s.repo.transfer(tr.ID).ReceivedBytes; got != 4 {
+		t.Fatalf("received_bytes = %d, want 4", got)
+	}
+
+	// The claim is released once the chunk is recorded
+	if _, err := replica.Upload(context.Background(), s.userID, tr.ID, 4, 4, strings.NewReader("efgh")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadExpiredClaim(t *testing.T) {
+	s := newTestService(t)
+	tr := s.mustCreate(t, 8)
+
+	// Left behind by an instance that died mid-chunk
+	stale := uuid.New()
+	s.repo.mu.Lock()
+	s.repo.uploads[tr.ID] = fakeClaim{claim: stale, expiresAt: time.Now().Add(-time.Second)}
+	s.repo.mu.Unlock()
+
+	if _, err := s.upload(tr.ID, 0, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale claim can no longer record a chunk
+	if _, err := s.repo.AddBytes(context.Background(), tr.ID, stale, 4, 4); err != sql.ErrNoRows {
+		t.Fatalf("chunk under a lapsed claim: err = %v, want no rows", err)
+	}
+}
+
+// failingReader returns data and then an error, like a dropped connection
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestUploadFailedChunk(t *testing.T) {
+	s := newTestService(t)
+	tr := s.mustCreate(t, 8)
+	if _, err := s.upload(tr.ID, 0, "abcd"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.Upload(context.Background(), s.userID, tr.ID, 4, 4, &failingReader{data: "ef"})
+	if !apperr.Is(err, apperr.ErrInternal) {
+		t.Fatalf("interrupted chunk: err = %v, want internal", err)
+	}
+
+	// Nothing of the failed chunk is kept or recorded
+	if got := s.repo.transfer(tr.ID).ReceivedBytes; got != 4 {
+		t.Fatalf("received_bytes = %d, want 4", got)
+	}
+	if size := s.fileSize(t, tr.ID); size != 4 {
+		t.Fatalf("file has %d bytes after a failed chunk, want 4", size)
+	}
+
+	if _, err := s.upload(tr.ID, 4, "efgh"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := s.store.Open(tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := io.ReadAll(f); string(data) != "abcdefgh" {
+		t.Fatalf("file = %q", data)
+	}
+}
+
+func TestUploadUnknownLength(t *testing.T) {
+	s := newTestService(t)
+	tr := s.mustCreate(t, 8)
+
+	// Without a Content-Length, a chunk over the limit is only noticed once
+	// the limit has been read
+	_, err := s.Upload(context.Background(), s.userID, tr.ID, 0, -1, strings.NewReader("abcdef"))
+	if !apperr.Is(err, apperr.ErrValidation) {
+		t.Fatalf("oversized chunk: err = %v, want validation", err)
+	}
+	if got := s.repo.transfer(tr.ID).ReceivedBytes; got != 0 {
+		t.Fatalf("received_bytes = %d after an oversized chunk, want 0", got)
+	}
+
+	// The unrecorded bytes are overwritten by the retry
+	if _, err := s.Upload(context.Background(), s.userID, tr.ID, 0, -1, strings.NewReader("wxyz")); err != nil {
+		t.Fatal(err)
+	}
+	if size := s.fileSize(t, tr.ID); size != 4 {
+		t.Fatalf("file has %d bytes, want 4", size)
+	}
+
+	if _, err := s.Upload(context.Background(), s.userID, tr.ID, 4, -1, bytes.NewReader(nil)); !apperr.Is(err, apperr.ErrValidation) {
+		t.Fatalf("empty chunk: err = %v, want validation", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := newTestService(t)
+	stale := s.mustCreate(t, 8)
+	fresh := s.mustCreate(t, 8)
+	for _, id := range []uuid.UUID{stale.ID, fresh.ID} {
+		if _, err := s.upload(id, 0, "abcd"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.repo.mu.Lock()
+	tr := s.repo.transfers[stale.ID]
+	tr.ExpiresAt = time.Now().Add(-time.Minute)
+	s.repo.transfers[stale.ID] = tr
+	s.repo.mu.Unlock()
+
+	s.expire(context.Background())
+
+	if got := s.repo.transfer(stale.ID).Status; got != sqlc.TransferStatusExpired {
+		t.Fatalf("stale transfer is %s, want expired", got)
+	}
+	if s.fileSize(t, stale.ID) != -1 {
+		t.Fatal("expired transfer's file not removed")
+	}
+	if s.events.last() != string(sqlc.TransferStatusExpired) {
+		t.Fatalf("last progress = %s, want expired", s.events.last())
+	}
+
+	if got := s.repo.transfer(fresh.ID).Status; got != sqlc.TransferStatusUploading || s.fileSize(t, fresh.ID) != 4 {
+		t.Fatal("unexpired transfer touched")
+	}
+	if _, err := s.upload(stale.ID, 4, "efgh"); !apperr.Is(err, apperr.ErrConflict) {
+		t.Fatalf("upload to an expired transfer: err = %v, want conflict", err)
+	}
+
+	// Long after expiry it's forgotten
+	s.repo.mu.Lock()
+	tr = s.repo.transfers[stale.ID]
+	tr.ExpiresAt = time.Now().Add(-finishedRetention - time.Hour)
+	s.repo.transfers[stale.ID] = tr
+	s.repo.mu.Unlock()
+
+	s.expire(context.Background())
+	if _, err := s.Get(context.Background(), s.userID, stale.ID); !apperr.Is(err, apperr.ErrNotFound) {
+		t.Fatalf("old transfer: err = %v, want not found", err)
+	}
+}
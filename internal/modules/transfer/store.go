@@ -0,0 +1,76 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// Store keeps transfer files on disk, one per transfer named by its ID.
+// Instances sharing a database must share the directory too. Callers
+// serialize writes to the same file.
+type Store struct {
+	dir string
+}
+
+// NewStore creates the store directory if needed
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create transfer dir: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(id uuid.UUID) string {
+	return filepath.Join(s.dir, id.String())
+}
+
+// Write stores data read from r at offset and returns how many bytes were
+// written. Anything past offset left by an earlier write that wasn't
+// recorded is overwritten.
+func (s *Store) Write(id uuid.UUID, offset int64, r io.Reader) (int64, error) {
+	f, err := os.OpenFile(s.path(id), os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < offset {
+		return 0, fmt.Errorf("transfer file has %d bytes, expected at least %d", info.Size(), offset)
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		// Keep the file consistent with what gets recorded
+		_ = f.Truncate(offset)
+		return 0, err
+	}
+	return n, f.Sync()
+}
+
+// Open opens a transfer's file for reading
+func (s *Store) Open(id uuid.UUID) (*os.File, error) {
+	return os.Open(s.path(id))
+}
+
+// Remove deletes a transfer's file; a missing file is not an error
+func (s *Store) Remove(id uuid.UUID) error {
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
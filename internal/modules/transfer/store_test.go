@@ -0,0 +1,59 @@
+package transfer
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func readFile(t *testing.T, s *Store, id uuid.UUID) string {
+	t.Helper()
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStoreWrite(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.New()
+
+	if n, err := s.Write(id, 0, strings.NewReader("abcd")); err != nil || n != 4 {
+		t.Fatalf("write = %d, %v", n, err)
+	}
+
+	// A gap before the offset is refused
+	if _, err := s.Write(id, 6, strings.NewReader("gh")); err == nil {
+		t.Fatal("write past the end of the file succeeded")
+	}
+
+	// A failed write leaves the file as it was before it
+	if _, err := s.Write(id, 4, &failingReader{data: "ef"}); err == nil {
+		t.Fatal("failed write reported success")
+	}
+	if got := readFile(t, s, id); got != "abcd" {
+		t.Fatalf("file = %q after a failed write, want %q", got, "abcd")
+	}
+
+	// Bytes past the offset that were never recorded are replaced
+	if _, err := s.Write(id, 2, io.LimitReader(strings.NewReader("CDEFGH"), 4)); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, s, id); got != "abCDEF" {
+		t.Fatalf("file = %q, want %q", got, "abCDEF")
+	}
+
+	if err := s.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(id); err != nil {
+		t.Fatalf("removing a missing file: %v", err)
+	}
+}
@@ -1,11 +1,17 @@
 package webrtc
 
 import (
+	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/vkrishna03/streamz/internal/config"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
 	"github.com/vkrishna03/streamz/internal/middleware"
+	"github.com/vkrishna03/streamz/internal/turn"
 )
 
 // ICEServer represents a single ICE server configuration for WebRTC
@@ -15,23 +21,43 @@ type ICEServer struct {
 	Credential string   `json:"credential,omitempty"`
 }
 
-// ICEServersResponse is the response for the ice-servers endpoint
+// ICEServersResponse is the response for the ice-servers endpoint. With
+// time-limited TURN credentials, ttl (seconds) and expires_at say when to
+// fetch new ones; a peer connection needs them for ICE restarts.
 type ICEServersResponse struct {
 	ICEServers []ICEServer `json:"ice_servers"`
+	TTL        int64       `json:"ttl,omitempty"`
+	ExpiresAt  *time.Time  `json:"expires_at,omitempty"`
+}
+
+// RelayUsageResponse is the caller's use of the embedded TURN server. A
+// stream reported as relay should show allocations and growing bytes.
+type RelayUsageResponse struct {
+	Allocations  int    `json:"allocations"`
+	RelayedBytes uint64 `json:"relayed_bytes"`
 }
 
 // Handler handles WebRTC configuration endpoints
 type Handler struct {
-	cfg config.ICEConfig
+	cfg   config.ICEConfig
+	relay *turn.Server
 }
 
-// NewHandler creates a new WebRTC handler
-func NewHandler(cfg config.ICEConfig) *Handler {
-	return &Handler{cfg: cfg}
+// NewHandler creates a new WebRTC handler; relay is nil unless the embedded
+// TURN server runs
+func NewHandler(cfg config.ICEConfig, relay *turn.Server) *Handler {
+	return &Handler{cfg: cfg, relay: relay}
 }
 
 // GetICEServers returns ICE server configuration for WebRTC connections
 func (h *Handler) GetICEServers(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	var resp ICEServersResponse
 	servers := make([]ICEServer, 0)
 
 	// Add STUN servers (no credentials needed)
@@ -41,27 +67,70 @@ func (h *Handler) GetICEServers(c *gin.Context) {
 		})
 	}
 
-	// Add TURN servers (with credentials)
+	// Add TURN servers, with credentials issued to this user if there's a
+	// shared secret and the static ones otherwise
+	username, credential := h.cfg.TURNUsername, h.cfg.TURNCredential
+	if h.cfg.TURNSecret != "" && len(h.cfg.TURNServers) > 0 {
+		expiresAt := time.Now().Add(h.cfg.TURNCredentialTTL).UTC().Truncate(time.Second)
+		username, credential = turn.Credentials(h.cfg.TURNSecret, userID.String(), expiresAt)
+		resp.TTL = int64(h.cfg.TURNCredentialTTL / time.Second)
+		resp.ExpiresAt = &expiresAt
+	}
 	for _, turn := range h.cfg.TURNServers {
 		servers = append(servers, ICEServer{
 			URLs:       []string{turn},
-			Username:   h.cfg.TURNUsername,
-			Credential: h.cfg.TURNCredential,
+			Username:   username,
+			Credential: credential,
 		})
 	}
 
-	c.JSON(http.StatusOK, ICEServersResponse{
-		ICEServers: servers,
+	resp.ICEServers = servers
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetRelayUsage returns the caller's use of the embedded TURN server
+func (h *Handler) GetRelayUsage(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	usage := h.relay.Usage(userID.String())
+	c.JSON(http.StatusOK, RelayUsageResponse{
+		Allocations:  usage.Allocations,
+		RelayedBytes: usage.RelayedBytes,
 	})
 }
 
-// Setup registers WebRTC routes
-func Setup(router *gin.RouterGroup, cfg config.ICEConfig, jwtSecret string) {
-	handler := NewHandler(cfg)
+// Setup registers WebRTC routes. With the embedded TURN server (relay not
+// nil), clients are sent to it instead of the configured TURN servers.
+func Setup(router *gin.RouterGroup, cfg config.ICEConfig, jwtSecret string, relay *turn.Server) {
+	if relay != nil {
+		host := net.JoinHostPort(cfg.TURNPublicIP, strconv.Itoa(relay.Addr().Port))
+		cfg.STUNServers = append([]string{"stun:" + host}, cfg.STUNServers...)
+		cfg.TURNServers = []string{"turn:" + host + "?transport=udp"}
+		if addr := relay.TCPAddr(); addr != nil {
+			cfg.TURNServers = append(cfg.TURNServers, "turn:"+net.JoinHostPort(cfg.TURNPublicIP, strconv.Itoa(addr.Port))+"?transport=tcp")
+		}
+		if addr := relay.TLSAddr(); addr != nil {
+			tlsHost := cfg.TURNTLSHost
+			if tlsHost == "" {
+				tlsHost = cfg.TURNPublicIP
+			}
+			cfg.TURNServers = append(cfg.TURNServers, "turns:"+net.JoinHostPort(tlsHost, strconv.Itoa(addr.Port))+"?transport=tcp")
+		}
+	} else if cfg.TURNSecret == "" && len(cfg.TURNServers) > 0 {
+		slog.Warn("TURN servers use static credentials; set ICE_TURN_SECRET to issue time-limited ones")
+	}
+	handler := NewHandler(cfg, relay)
 
 	webrtc := router.Group("/webrtc")
 	webrtc.Use(middleware.Auth(jwtSecret))
 	{
 		webrtc.GET("/ice-servers", handler.GetICEServers)
+		if relay != nil {
+			webrtc.GET("/relay-usage", handler.GetRelayUsage)
+		}
 	}
 }
@@ -0,0 +1,457 @@
+package webrtc
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtcp"
+	pion "github.com/pion/webrtc/v4"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+)
+
+// room is a forwarded stream on this server: the source's peer connection,
+// the tracks it publishes and the peer connections of its subscribers
+type room struct {
+	sfu      *SFU
+	userID   uuid.UUID
+	streamID uuid.UUID
+	sourceID uuid.UUID
+
+	mu          sync.Mutex
+	publisher   *peer
+	subscribers map[uuid.UUID]*peer
+	tracks      map[*track]struct{}
+	active      bool // recorded once the source first connected
+	closed      bool
+}
+
+// track is one of the source's tracks, as sent to subscribers
+type track struct {
+	local *pion.TrackLocalStaticRTP
+	ssrc  pion.SSRC
+	kind  pion.RTPCodecType
+}
+
+// peer is a device's peer connection with the SFU
+type peer struct {
+	room     *room
+	deviceID uuid.UUID
+	pc       *pion.PeerConnection
+
+	// Held through each exchange of descriptions, so the device sees them
+	// in order
+	mu         sync.Mutex
+	candidates []pion.ICECandidateInit // sent before the device's description
+	senders    map[*track]*pion.RTPSender
+	offerDue   bool // tracks changed during an exchange
+}
+
+// join returns the device's peer connection for the stream, making one if
+// it has none or sdp comes from a new one
+func (r *room) join(deviceID uuid.UUID, sdp string) (*peer, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, apperr.Wrap(apperr.ErrValidation, "stream is over")
+	}
+
+	old := r.peerLocked(deviceID)
+	if old != nil {
+		if desc := old.pc.RemoteDescription(); desc != nil && fingerprint(desc.SDP) == fingerprint(sdp) {
+			r.mu.Unlock()
+			return old, nil
+		}
+	} else if deviceID != r.sourceID && r.sfu.maxSubscribers > 0 && len(r.subscribers) >= r.sfu.maxSubscribers {
+		r.mu.Unlock()
+		return nil, apperr.Wrap(apperr.ErrConflict, "stream has %d subscribers already", r.sfu.maxSubscribers)
+	}
+
+	p, err := r.newPeer(deviceID)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	if deviceID == r.sourceID {
+		r.publisher = p
+	} else {
+		r.subscribers[deviceID] = p
+	}
+	r.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	return p, nil
+}
+
+func (r *room) newPeer(deviceID uuid.UUID) (*peer, error) {
+	pc, err := r.sfu.api.NewPeerConnection(pion.Configuration{})
+	if err != nil {
+		slog.Error("failed to create peer connection", "stream_id", r.streamID, "error", err)
+		return nil, apperr.Wrap(apperr.ErrInternal, "failed to create peer connection")
+	}
+
+	p := &peer{room: r, deviceID: deviceID, pc: pc, senders: make(map[*track]*pion.RTPSender)}
+	if deviceID == r.sourceID {
+		pc.OnTrack(func(remote *pion.TrackRemote, _ *pion.RTPReceiver) {
+			r.publish(p, remote)
+		})
+	}
+	pc.OnConnectionStateChange(func(state pion.PeerConnectionState) {
+		r.stateChanged(p, state)
+	})
+	return p, nil
+}
+
+func (r *room) peerLocked(deviceID uuid.UUID) *peer {
+	if deviceID == r.sourceID {
+		return r.publisher
+	}
+	return r.subscribers[deviceID]
+}
+
+// publish forwards one of the source's tracks to every subscriber until it
+// ends
+func (r *room) publish(p *peer, remote *pion.TrackRemote) {
+	local, err := pion.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), r.streamID.String())
+	if err != nil {
+		slog.Error("failed to forward track", "stream_id", r.streamID, "error", err)
+		return
+	}
+	t := &track{local: local, ssrc: remote.SSRC(), kind: remote.Kind()}
+
+	r.mu.Lock()
+	if r.closed || r.publisher != p {
+		r.mu.Unlock()
+		return
+	}
+	r.tracks[t] = struct{}{}
+	subscribers := r.subscriberList()
+	r.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.send(t)
+	}
+
+	for {
+		pkt, _, err := remote.ReadRTP()
+		if err != nil {
+			break
+		}
+		// A subscriber that's gone is dropped by the track, not reported
+		if err := local.WriteRTP(pkt); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			break
+		}
+	}
+
+	r.mu.Lock()
+	delete(r.tracks, t)
+	subscribers = r.subscriberList()
+	r.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.unsend(t)
+	}
+}
+
+// requestKeyframe asks the source for a keyframe of a video track, for a
+// subscriber that can't decode it
+func (r *room) requestKeyframe(t *track) {
+	if t.kind != pion.RTPCodecTypeVideo {
+		return
+	}
+
+	r.mu.Lock()
+	publisher := r.publisher
+	r.mu.Unlock()
+
+	if publisher != nil {
+		_ = publisher.pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(t.ssrc)}})
+	}
+}
+
+// stateChanged records the stream active once its source connects and ends
+// it if the source is lost; a subscriber that's lost is dropped
+func (r *room) stateChanged(p *peer, state pion.PeerConnectionState) {
+	r.mu.Lock()
+	publisher := r.publisher == p
+	current := publisher || r.subscribers[p.deviceID] == p
+	connected := publisher && state == pion.PeerConnectionStateConnected && !r.active
+	if connected {
+		r.active = true
+	}
+	r.mu.Unlock()
+
+	switch {
+	case !current:
+	case connected:
+		r.sfu.setStatus(r, "active")
+	case publisher && state == pion.PeerConnectionStateFailed:
+		slog.Info("forwarded stream lost its source", "stream_id", r.streamID, "device_id", p.deviceID)
+		r.sfu.setStatus(r, "failed")
+		r.sfu.CloseStream(r.streamID)
+	case !publisher && (state == pion.PeerConnectionStateFailed || state == pion.PeerConnectionStateClosed):
+		r.mu.Lock()
+		if r.subscribers[p.deviceID] == p {
+			delete(r.subscribers, p.deviceID)
+		}
+		r.mu.Unlock()
+		p.close()
+	}
+}
+
+func (r *room) subscriberList() []*peer {
+	peers := make([]*peer, 0, len(r.subscribers))
+	for _, p := range r.subscribers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (r *room) trackList() []*track {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tracks := make([]*track, 0, len(r.tracks))
+	for t := range r.tracks {
+		tracks = append(tracks, t)
+	}
+	return tracks
+}
+
+func (r *room) close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	peers := r.subscriberList()
+	if r.publisher != nil {
+		peers = append(peers, r.publisher)
+	}
+	r.publisher = nil
+	r.subscribers = make(map[uuid.UUID]*peer)
+	r.mu.Unlock()
+
+	for _, p := range peers {
+		p.close()
+	}
+}
+
+// answer applies the device's offer and sends the SFU's answer. A
+// subscriber is sent every track the source publishes.
+func (p *peer) answer(sdp string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// When both sides offer at once the device's offer wins, and the SFU
+	// offers again once it's answered
+	if p.pc.SignalingState() == pion.SignalingStateHaveLocalOffer {
+		if err := p.pc.SetLocalDescription(pion.SessionDescription{Type: pion.SDPTypeRollback}); err != nil {
+			return apperr.Wrap(apperr.ErrInternal, "failed to roll back offer")
+		}
+		p.offerDue = true
+	}
+
+	if err := p.pc.SetRemoteDescription(pion.SessionDescription{Type: pion.SDPTypeOffer, SDP: sdp}); err != nil {
+		return apperr.Wrap(apperr.ErrValidation, "invalid offer: %s", err)
+	}
+	p.addCandidatesLocked()
+
+	if p.deviceID != p.room.sourceID {
+		for _, t := range p.room.trackList() {
+			p.addLocked(t)
+		}
+	}
+
+	answer, err := p.pc.CreateAnswer(nil)
+	if err != nil {
+		return apperr.Wrap(apperr.ErrValidation, "can't answer offer: %s", err)
+	}
+	local, err := p.describe(answer)
+	if err != nil {
+		return err
+	}
+	if err := p.room.sfu.signal.SignalAnswer(p.room.userID, p.deviceID, p.room.streamID, local); err != nil {
+		return err
+	}
+
+	p.settleLocked()
+	return nil
+}
+
+// accept applies the device's answer to the SFU's offer
+func (p *peer) accept(sdp string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pc.SignalingState() != pion.SignalingStateHaveLocalOffer {
+		return apperr.Wrap(apperr.ErrConflict, "no offer is waiting for an answer")
+	}
+	if err := p.pc.SetRemoteDescription(pion.SessionDescription{Type: pion.SDPTypeAnswer, SDP: sdp}); err != nil {
+		return apperr.Wrap(apperr.ErrValidation, "invalid answer: %s", err)
+	}
+	p.addCandidatesLocked()
+
+	p.settleLocked()
+	return nil
+}
+
+// candidate adds the device's ICE candidate, or keeps it until the
+// device's description arrives
+func (p *peer) candidate(c pion.ICECandidateInit) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pc.RemoteDescription() == nil {
+		p.candidates = append(p.candidates, c)
+		return nil
+	}
+	if err := p.pc.AddICECandidate(c); err != nil {
+		return apperr.Wrap(apperr.ErrValidation, "invalid candidate: %s", err)
+	}
+	return nil
+}
+
+func (p *peer) addCandidatesLocked() {
+	for _, c := range p.candidates {
+		if err := p.pc.AddICECandidate(c); err != nil {
+			slog.Debug("dropped ICE candidate", "device_id", p.deviceID, "error", err)
+		}
+	}
+	p.candidates = nil
+}
+
+// send adds a track to a subscriber, offering it once any exchange under
+// way is done
+func (p *peer) send(t *track) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.addLocked(t) {
+		p.negotiateLocked()
+	}
+}
+
+// unsend removes a track the source stopped publishing
+func (p *peer) unsend(t *track) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sender, ok := p.senders[t]
+	if !ok {
+		return
+	}
+	delete(p.senders, t)
+	if err := p.pc.RemoveTrack(sender); err == nil {
+		p.negotiateLocked()
+	}
+}
+
+func (p *peer) addLocked(t *track) bool {
+	if _, ok := p.senders[t]; ok {
+		return false
+	}
+	sender, err := p.pc.AddTrack(t.local)
+	if err != nil {
+		slog.Warn("failed to add forwarded track", "stream_id", p.room.streamID, "device_id", p.deviceID, "error", err)
+		return false
+	}
+	p.senders[t] = sender
+
+	go p.readRTCP(sender, t)
+	return true
+}
+
+// readRTCP passes the subscriber's keyframe requests on to the source until
+// the track is removed
+func (p *peer) readRTCP(sender *pion.RTPSender, t *track) {
+	for {
+		pkts, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range pkts {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				p.room.requestKeyframe(t)
+			}
+		}
+	}
+}
+
+// negotiateLocked sends the device an offer for the SFU's current tracks,
+// or leaves it due until the exchange under way is done
+func (p *peer) negotiateLocked() {
+	if p.pc.RemoteDescription() == nil || p.pc.SignalingState() != pion.SignalingStateStable {
+		p.offerDue = true
+		return
+	}
+	p.offerDue = false
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		slog.Warn("failed to create offer", "stream_id", p.room.streamID, "device_id", p.deviceID, "error", err)
+		return
+	}
+	local, err := p.describe(offer)
+	if err != nil {
+		slog.Warn("failed to set offer", "stream_id", p.room.streamID, "device_id", p.deviceID, "error", err)
+		return
+	}
+	if err := p.room.sfu.signal.SignalOffer(p.room.userID, p.deviceID, p.room.streamID, local); err != nil {
+		slog.Debug("failed to send offer", "stream_id", p.room.streamID, "device_id", p.deviceID, "error", err)
+	}
+}
+
+// settleLocked sends an offer that came due during the exchange just
+// finished, or for tracks the device's offer had no room for
+func (p *peer) settleLocked() {
+	due := p.offerDue
+	for _, tr := range p.pc.GetTransceivers() {
+		if tr.Mid() == "" && tr.Sender() != nil {
+			due = true
+		}
+	}
+	if due {
+		p.negotiateLocked()
+	}
+}
+
+// describe sets the SFU's side of the exchange and returns it once it holds
+// all of the SFU's candidates
+func (p *peer) describe(desc pion.SessionDescription) (string, error) {
+	gathered := pion.GatheringCompletePromise(p.pc)
+	if err := p.pc.SetLocalDescription(desc); err != nil {
+		return "", apperr.Wrap(apperr.ErrInternal, "failed to set local description")
+	}
+
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		return "", apperr.Wrap(apperr.ErrInternal, "timed out gathering ICE candidates")
+	}
+	return p.pc.LocalDescription().SDP, nil
+}
+
+func (p *peer) close() {
+	if err := p.pc.Close(); err != nil {
+		slog.Debug("failed to close peer connection", "device_id", p.deviceID, "error", err)
+	}
+}
+
+// fingerprint returns the DTLS fingerprint in a description, which differs
+// for every peer connection
+func fingerprint(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if fp, ok := strings.CutPrefix(strings.TrimSpace(line), "a=fingerprint:"); ok {
+			return fp
+		}
+	}
+	return ""
+}
@@ -0,0 +1,238 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/interceptor"
+	pion "github.com/pion/webrtc/v4"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+	"github.com/vkrishna03/streamz/internal/modules/stream"
+)
+
+// How long the SFU waits for its own ICE candidates before answering, and
+// for a stream's status to be recorded
+const (
+	gatherTimeout = 5 * time.Second
+	statusTimeout = 5 * time.Second
+)
+
+// SFUConfig configures the selective forwarding unit
+type SFUConfig struct {
+	// Address offered in the SFU's candidates instead of the host's own
+	PublicIP string
+
+	// Media ports; any port if both are 0
+	MinPort int
+	MaxPort int
+
+	// Devices that may subscribe to one stream at once, 0 for no limit
+	MaxSubscribers int
+}
+
+// Streams looks up and updates the records of forwarded streams. The stream
+// service implements it.
+type Streams interface {
+	GetByID(ctx context.Context, userID, streamID uuid.UUID) (*stream.Response, error)
+	UpdateStatus(ctx context.Context, userID, streamID uuid.UUID, req stream.UpdateStatusRequest) error
+}
+
+// Signaling sends the SFU's offers and answers to a device. Their SDP holds
+// all of the SFU's candidates, so it trickles none. The WebSocket hub
+// implements it.
+type Signaling interface {
+	SignalOffer(userID, deviceID, streamID uuid.UUID, sdp string) error
+	SignalAnswer(userID, deviceID, streamID uuid.UUID, sdp string) error
+}
+
+// SFU forwards streams started with sfu set. The source device publishes its
+// tracks to the server once and the server sends them on to each of the
+// user's other devices that subscribes, so the source's uplink doesn't grow
+// with the number of viewers. Devices negotiate with it over webrtc:offer,
+// webrtc:answer and webrtc:candidate carrying the stream's ID.
+type SFU struct {
+	api            *pion.API
+	maxSubscribers int
+	streams        Streams
+	signal         Signaling
+
+	mu     sync.Mutex
+	rooms  map[uuid.UUID]*room
+	closed bool
+}
+
+// NewSFU creates an SFU. Close drops all of its peer connections.
+func NewSFU(cfg SFUConfig, streams Streams, signal Signaling) (*SFU, error) {
+	media := &pion.MediaEngine{}
+	if err := media.RegisterDefaultCodecs(); err != nil {
+		return nil, fmt.Errorf("sfu: register codecs: %w", err)
+	}
+	interceptors := &interceptor.Registry{}
+	if err := pion.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		return nil, fmt.Errorf("sfu: register interceptors: %w", err)
+	}
+
+	var settings pion.SettingEngine
+	if cfg.MinPort != 0 || cfg.MaxPort != 0 {
+		if err := settings.SetEphemeralUDPPortRange(uint16(cfg.MinPort), uint16(cfg.MaxPort)); err != nil {
+			return nil, fmt.Errorf("sfu: port range: %w", err)
+		}
+	}
+	if cfg.PublicIP != "" {
+		settings.SetNAT1To1IPs([]string{cfg.PublicIP}, pion.ICECandidateTypeHost)
+	}
+
+	return &SFU{
+		api: pion.NewAPI(
+			pion.WithMediaEngine(media),
+			pion.WithInterceptorRegistry(interceptors),
+			pion.WithSettingEngine(settings),
+		),
+		maxSubscribers: cfg.MaxSubscribers,
+		streams:        streams,
+		signal:         signal,
+		rooms:          make(map[uuid.UUID]*room),
+	}, nil
+}
+
+// Offer answers a device's offer for a stream. The source's offer publishes
+// the stream and any other device's subscribes to it; an offer from a new
+// peer connection replaces the device's old one.
+func (s *SFU) Offer(ctx context.Context, userID, deviceID, streamID uuid.UUID, sdp string) error {
+	r, err := s.open(ctx, userID, streamID)
+	if err != nil {
+		return err
+	}
+	p, err := r.join(deviceID, sdp)
+	if err != nil {
+		return err
+	}
+	return p.answer(sdp)
+}
+
+// Answer takes a device's answer to the SFU's offer for a stream
+func (s *SFU) Answer(ctx context.Context, userID, deviceID, streamID uuid.UUID, sdp string) error {
+	p, err := s.peer(userID, deviceID, streamID)
+	if err != nil {
+		return err
+	}
+	return p.accept(sdp)
+}
+
+// Candidate adds one of a device's ICE candidates for a stream
+func (s *SFU) Candidate(ctx context.Context, userID, deviceID, streamID uuid.UUID, candidate string, sdpMid *string, sdpMLineIndex *uint16) error {
+	p, err := s.peer(userID, deviceID, streamID)
+	if err != nil || candidate == "" {
+		return err
+	}
+	return p.candidate(pion.ICECandidateInit{
+		Candidate:     candidate,
+		SDPMid:        sdpMid,
+		SDPMLineIndex: sdpMLineIndex,
+	})
+}
+
+// CloseStream drops the peer connections of a stream that's over
+func (s *SFU) CloseStream(streamID uuid.UUID) {
+	s.mu.Lock()
+	r := s.rooms[streamID]
+	delete(s.rooms, streamID)
+	s.mu.Unlock()
+
+	if r != nil {
+		r.close()
+	}
+}
+
+// Close drops every stream's peer connections and refuses new ones
+func (s *SFU) Close() {
+	s.mu.Lock()
+	rooms := s.rooms
+	s.rooms = make(map[uuid.UUID]*room)
+	s.closed = true
+	s.mu.Unlock()
+
+	for _, r := range rooms {
+		r.close()
+	}
+}
+
+// open returns the stream's room, making one if the stream is forwarded
+// and not over
+func (s *SFU) open(ctx context.Context, userID, streamID uuid.UUID) (*room, error) {
+	s.mu.Lock()
+	r := s.rooms[streamID]
+	s.mu.Unlock()
+	if r != nil {
+		if r.userID != userID {
+			return nil, apperr.Wrap(apperr.ErrForbidden, "stream not owned by user")
+		}
+		return r, nil
+	}
+
+	st, err := s.streams.GetByID(ctx, userID, streamID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !st.SFU:
+		return nil, apperr.Wrap(apperr.ErrValidation, "stream isn't forwarded by the server")
+	case st.Status == "ended" || st.Status == "failed":
+		return nil, apperr.Wrap(apperr.ErrValidation, "stream is over")
+	case st.SourceDeviceID == nil:
+		return nil, apperr.Wrap(apperr.ErrValidation, "stream's source device was removed")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, apperr.Wrap(apperr.ErrInternal, "SFU is shutting down")
+	}
+	if r := s.rooms[streamID]; r != nil {
+		return r, nil
+	}
+	r = &room{
+		sfu:         s,
+		userID:      userID,
+		streamID:    streamID,
+		sourceID:    *st.SourceDeviceID,
+		subscribers: make(map[uuid.UUID]*peer),
+		tracks:      make(map[*track]struct{}),
+	}
+	s.rooms[streamID] = r
+	return r, nil
+}
+
+// peer returns the device's peer connection for a stream
+func (s *SFU) peer(userID, deviceID, streamID uuid.UUID) (*peer, error) {
+	s.mu.Lock()
+	r := s.rooms[streamID]
+	s.mu.Unlock()
+	if r == nil || r.userID != userID {
+		return nil, apperr.Wrap(apperr.ErrNotFound, "stream isn't forwarded by this server")
+	}
+
+	r.mu.Lock()
+	p := r.peerLocked(deviceID)
+	r.mu.Unlock()
+	if p == nil {
+		return nil, apperr.Wrap(apperr.ErrNotFound, "no peer connection for this device; send an offer first")
+	}
+	return p, nil
+}
+
+// setStatus records a forwarded stream's status, as its source connects or
+// is lost
+func (s *SFU) setStatus(r *room, status string) {
+	ctx, cancel := context.WithTimeout(context.Background(), statusTimeout)
+	defer cancel()
+
+	err := s.streams.UpdateStatus(ctx, r.userID, r.streamID, stream.UpdateStatusRequest{Status: status})
+	if err != nil {
+		slog.Warn("failed to record forwarded stream status", "stream_id", r.streamID, "status", status, "error", err)
+	}
+}
@@ -0,0 +1,264 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pion/rtp"
+	pion "github.com/pion/webrtc/v4"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+	"github.com/vkrishna03/streamz/internal/modules/stream"
+)
+
+// fakeStreams holds one stream and reports the statuses the SFU records
+type fakeStreams struct {
+	stream   stream.Response
+	statuses chan string
+}
+
+func (f *fakeStreams) GetByID(ctx context.Context, userID, streamID uuid.UUID) (*stream.Response, error) {
+	if streamID != f.stream.ID {
+		return nil, apperr.Wrap(apperr.ErrNotFound, "stream not found")
+	}
+	if userID != f.stream.UserID {
+		return nil, apperr.Wrap(apperr.ErrForbidden, "stream not owned by user")
+	}
+	st := f.stream
+	return &st, nil
+}
+
+func (f *fakeStreams) UpdateStatus(ctx context.Context, userID, streamID uuid.UUID, req stream.UpdateStatusRequest) error {
+	f.statuses <- req.Status
+	return nil
+}
+
+// fakeSignaling queues the SFU's descriptions for each device
+type fakeSignaling struct {
+	mu      sync.Mutex
+	devices map[uuid.UUID]chan pion.SessionDescription
+}
+
+func (f *fakeSignaling) inbox(deviceID uuid.UUID) chan pion.SessionDescription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.devices[deviceID] == nil {
+		f.devices[deviceID] = make(chan pion.SessionDescription, 4)
+	}
+	return f.devices[deviceID]
+}
+
+func (f *fakeSignaling) SignalOffer(userID, deviceID, streamID uuid.UUID, sdp string) error {
+	f.inbox(deviceID) <- pion.SessionDescription{Type: pion.SDPTypeOffer, SDP: sdp}
+	return nil
+}
+
+func (f *fakeSignaling) SignalAnswer(userID, deviceID, streamID uuid.UUID, sdp string) error {
+	f.inbox(deviceID) <- pion.SessionDescription{Type: pion.SDPTypeAnswer, SDP: sdp}
+	return nil
+}
+
+func newTestSFU(t *testing.T, cfg SFUConfig, sfu bool) (*SFU, *fakeStreams, *fakeSignaling) {
+	t.Helper()
+	source := uuid.New()
+	streams := &fakeStreams{
+		stream: stream.Response{
+			ID:             uuid.New(),
+			UserID:         uuid.New(),
+			SourceDeviceID: &source,
+			Status:         "connecting",
+			SFU:            sfu,
+		},
+		statuses: make(chan string, 4),
+	}
+	signal := &fakeSignaling{devices: make(map[uuid.UUID]chan pion.SessionDescription)}
+
+	s, err := NewSFU(cfg, streams, signal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s, streams, signal
+}
+
+func newTestPeer(t *testing.T) *pion.PeerConnection {
+	t.Helper()
+	pc, err := pion.NewPeerConnection(pion.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// describe sets a description on a test peer and returns it with all its
+// candidates
+func describe(t *testing.T, pc *pion.PeerConnection, desc pion.SessionDescription, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := pion.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+func receive(t *testing.T, inbox chan pion.SessionDescription, typ pion.SDPType) pion.SessionDescription {
+	t.Helper()
+	select {
+	case desc := <-inbox:
+		if desc.Type != typ {
+			t.Fatalf("got %s, want %s", desc.Type, typ)
+		}
+		return desc
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %s", typ)
+		return pion.SessionDescription{}
+	}
+}
+
+func TestSFUForwardsToSubscribers(t *testing.T) {
+	s, streams, signal := newTestSFU(t, SFUConfig{}, true)
+	ctx := context.Background()
+	userID, streamID, phone, monitor := streams.stream.UserID, streams.stream.ID, *streams.stream.SourceDeviceID, uuid.New()
+
+	// The monitor subscribes before the source publishes anything
+	sub := newTestPeer(t)
+	if _, err := sub.AddTransceiverFromKind(pion.RTPCodecTypeVideo, pion.RTPTransceiverInit{Direction: pion.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *rtp.Packet, 1)
+	sub.OnTrack(func(remote *pion.TrackRemote, _ *pion.RTPReceiver) {
+		if pkt, _, err := remote.ReadRTP(); err == nil {
+			received <- pkt
+		}
+	})
+	offer, err := sub.CreateOffer(nil)
+	if err := s.Offer(ctx, userID, monitor, streamID, describe(t, sub, offer, err)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.SetRemoteDescription(receive(t, signal.inbox(monitor), pion.SDPTypeAnswer)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The phone publishes a video track
+	pub := newTestPeer(t)
+	video, err := pion.NewTrackLocalStaticRTP(pion.RTPCodecCapability{MimeType: pion.MimeTypeVP8}, "camera", "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pub.AddTrack(video); err != nil {
+		t.Fatal(err)
+	}
+	offer, err = pub.CreateOffer(nil)
+	if err := s.Offer(ctx, userID, phone, streamID, describe(t, pub, offer, err)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.SetRemoteDescription(receive(t, signal.inbox(phone), pion.SDPTypeAnswer)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for seq := uint16(0); ; seq++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			video.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * 900}, Payload: []byte{0x10, 0x00, 0x00, 0x00}})
+		}
+	}()
+
+	select {
+	case status := <-streams.statuses:
+		if status != "active" {
+			t.Fatalf("status = %q, want active", status)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("stream never recorded active")
+	}
+
+	// The SFU offers the monitor the phone's track once it arrives
+	if err := sub.SetRemoteDescription(receive(t, signal.inbox(monitor), pion.SDPTypeOffer)); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := sub.CreateAnswer(nil)
+	if err := s.Answer(ctx, userID, monitor, streamID, describe(t, sub, answer, err)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-received:
+		if len(pkt.Payload) == 0 {
+			t.Fatal("forwarded packet has no payload")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("monitor never received the phone's video")
+	}
+
+	// Ending the stream drops its peer connections
+	s.CloseStream(streamID)
+	if err := s.Answer(ctx, userID, monitor, streamID, "v=0"); !errors.Is(err, apperr.ErrNotFound) {
+		t.Fatalf("answer after close = %v, want not found", err)
+	}
+}
+
+func TestSFURefusesOffers(t *testing.T) {
+	ctx := context.Background()
+
+	offer := func(t *testing.T) string {
+		pc := newTestPeer(t)
+		if _, err := pc.AddTransceiverFromKind(pion.RTPCodecTypeVideo, pion.RTPTransceiverInit{Direction: pion.RTPTransceiverDirectionRecvonly}); err != nil {
+			t.Fatal(err)
+		}
+		desc, err := pc.CreateOffer(nil)
+		return describe(t, pc, desc, err)
+	}
+
+	t.Run("not forwarded", func(t *testing.T) {
+		s, streams, _ := newTestSFU(t, SFUConfig{}, false)
+		err := s.Offer(ctx, streams.stream.UserID, uuid.New(), streams.stream.ID, offer(t))
+		if !errors.Is(err, apperr.ErrValidation) {
+			t.Fatalf("err = %v, want validation", err)
+		}
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		s, streams, _ := newTestSFU(t, SFUConfig{}, true)
+		err := s.Offer(ctx, uuid.New(), uuid.New(), streams.stream.ID, offer(t))
+		if !errors.Is(err, apperr.ErrForbidden) {
+			t.Fatalf("err = %v, want forbidden", err)
+		}
+	})
+
+	t.Run("too many subscribers", func(t *testing.T) {
+		s, streams, _ := newTestSFU(t, SFUConfig{MaxSubscribers: 1}, true)
+		userID, streamID := streams.stream.UserID, streams.stream.ID
+		if err := s.Offer(ctx, userID, uuid.New(), streamID, offer(t)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Offer(ctx, userID, uuid.New(), streamID, offer(t)); !errors.Is(err, apperr.ErrConflict) {
+			t.Fatalf("err = %v, want conflict", err)
+		}
+	})
+
+	t.Run("answer from a device that never offered", func(t *testing.T) {
+		s, streams, _ := newTestSFU(t, SFUConfig{}, true)
+		userID, streamID := streams.stream.UserID, streams.stream.ID
+		if err := s.Offer(ctx, userID, uuid.New(), streamID, offer(t)); err != nil {
+			t.Fatal(err)
+		}
+		err := s.Answer(ctx, userID, uuid.New(), streamID, "v=0")
+		if !errors.Is(err, apperr.ErrNotFound) {
+			t.Fatalf("err = %v, want not found", err)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package ws
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vkrishna03/streamz/internal/middleware"
+)
+
+// Close codes for connections the server ends over authentication
+const (
+	// The access token expired without an auth:refresh. Reconnect with
+	// fresh credentials; the session can still be resumed.
+	CloseAuthExpired = 4002
+
+	// The user logged out or reset their password. Don't reconnect without
+	// logging in again.
+	CloseSessionRevoked = 4003
+)
+
+// How long before its access token expires a connection is sent auth:expiring
+const authWarning = 2 * time.Minute
+
+// authTimer tracks a connection's access token expiry for WritePump: it fires
+// once to warn, then again at expiry
+type authTimer struct {
+	expiresAt time.Time
+	warned    bool
+	timer     *time.Timer
+}
+
+func newAuthTimer(expiresAt time.Time) *authTimer {
+	t := &authTimer{timer: time.NewTimer(time.Hour)}
+	t.reset(expiresAt)
+	return t
+}
+
+// C fires when the warning or expiry is due; nil for tokens that don't expire
+func (t *authTimer) C() <-chan time.Time {
+	if t.expiresAt.IsZero() {
+		return nil
+	}
+	return t.timer.C
+}
+
+// reset starts tracking a new expiry
+func (t *authTimer) reset(expiresAt time.Time) {
+	t.expiresAt = expiresAt
+	t.warned = false
+	t.schedule(time.Until(expiresAt) - authWarning)
+}
+
+// fired records that the timer went off and reports whether the token has
+// now expired (otherwise it's time to warn)
+func (t *authTimer) fired() bool {
+	if t.warned {
+		return true
+	}
+	t.warned = true
+	t.schedule(time.Until(t.expiresAt))
+	return false
+}
+
+func (t *authTimer) schedule(d time.Duration) {
+	if !t.timer.Stop() {
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	t.timer.Reset(d)
+}
+
+func (t *authTimer) stop() {
+	t.timer.Stop()
+}
+
+func (c *Client) handleAuthRefresh(msg Message) {
+	var refresh AuthRefreshPayload
+	if err := c.codec.DecodePayload(msg.Payload, &refresh); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid auth refresh payload")
+		return
+	}
+
+	claims, err := middleware.ParseToken(c.hub.jwtSecret, refresh.AccessToken)
+	if err != nil {
+		c.reply(msg.ID, ErrTokenInvalid)
+		return
+	}
+	if claims.UserID != c.userID {
+		slog.Warn("auth refresh for another user", "user_id", c.userID, "token_user_id", claims.UserID)
+		c.reply(msg.ID, ErrTokenUser)
+		return
+	}
+
+	// Hand the new expiry to WritePump, replacing any it hasn't picked up
+	select {
+	case <-c.reauth:
+	default:
+	}
+	c.reauth <- claims.ExpiresAt
+
+	c.reply(msg.ID, nil)
+}
+
+// RevokeUser closes every connection of a user, e.g. after a password reset
+func (h *Hub) RevokeUser(userID uuid.UUID) {
+	h.revoke(userID, uuid.Nil)
+}
+
+// RevokeDevice closes a device's connection, e.g. after it logged out
+func (h *Hub) RevokeDevice(userID, deviceID uuid.UUID) {
+	h.revoke(userID, deviceID)
+}
+
+func (h *Hub) revoke(userID, deviceID uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.revokeLocked(userID, deviceID)
+
+	if h.backplane != nil {
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventRevoked,
+			UserID:   userID,
+			DeviceID: deviceID,
+		})
+	}
+}
+
+// revokeLocked terminates the user's sessions here, or just one device's if
+// deviceID is set (caller must hold lock)
+func (h *Hub) revokeLocked(userID, deviceID uuid.UUID) {
+	for id, s := range h.sessions[userID] {
+		if deviceID != uuid.Nil && id != deviceID {
+			continue
+		}
+		slog.Info("revoking websocket session", "user_id", userID, "device_id", id)
+		h.terminateLocked(s, CloseSessionRevoked, "session revoked")
+	}
+}
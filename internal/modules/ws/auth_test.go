@@ -0,0 +1,113 @@
+package ws
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+func TestAuthTimer(t *testing.T) {
+	// Already inside the warning window, so the warning is immediate
+	expiresAt := time.Now().Add(100 * time.Millisecond)
+	auth := newAuthTimer(expiresAt)
+	defer auth.stop()
+
+	select {
+	case <-auth.C():
+	case <-time.After(time.Second):
+		t.Fatal("no warning")
+	}
+	if auth.fired() {
+		t.Fatal("expired at the warning")
+	}
+
+	select {
+	case <-auth.C():
+	case <-time.After(time.Second):
+		t.Fatal("no expiry")
+	}
+	if time.Now().Before(expiresAt) {
+		t.Fatal("expired early")
+	}
+	if !auth.fired() {
+		t.Fatal("not expired after the warning")
+	}
+
+	if newAuthTimer(time.Time{}).C() != nil {
+		t.Fatal("timer running for a token without expiry")
+	}
+}
+
+func TestAuthRefresh(t *testing.T) {
+	h := NewHub(Config{JWTSecret: "secret"})
+	userID := uuid.New()
+	c := newTestClient(userID, uuid.New())
+	c.hub = h
+
+	token := func(sub uuid.UUID, exp time.Time) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": sub.String(),
+			"exp": exp.Unix(),
+		}).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	exp := time.Now().Add(15 * time.Minute).Truncate(time.Second)
+	c.handleMessage([]byte(`{"id":"1","type":"auth:refresh","payload":{"access_token":"` + token(userID, exp) + `"}}`))
+	if ack := waitFor(t, c, TypeAck); ack.ID != "1" {
+		t.Fatalf("ack id = %q", ack.ID)
+	}
+	if got := <-c.reauth; !got.Equal(exp) {
+		t.Fatalf("new expiry = %v, want %v", got, exp)
+	}
+
+	c.handleMessage([]byte(`{"id":"2","type":"auth:refresh","payload":{"access_token":"` + token(uuid.New(), exp) + `"}}`))
+	assertNack(t, waitFor(t, c, TypeNack), "2", CodeUnauthorized)
+
+	c.handleMessage([]byte(`{"id":"3","type":"auth:refresh","payload":{"access_token":"garbage"}}`))
+	assertNack(t, waitFor(t, c, TypeNack), "3", CodeUnauthorized)
+}
+
+func TestRevokeUser(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := NewHub(Config{ResumeGrace: time.Minute, ReplayBufferSize: 8})
+	go h.Run(ctx)
+
+	userID := uuid.New()
+	phone := newTestClient(userID, uuid.New())
+	tablet := newTestClient(userID, uuid.New())
+	other := newTestClient(uuid.New(), uuid.New())
+	for _, c := range []*Client{phone, tablet, other} {
+		h.register <- c
+	}
+	waitUntil(t, func() bool { return h.IsDeviceOnline(other.userID, other.deviceID) })
+
+	// Disconnected sessions don't wait out the grace window once revoked
+	h.unregister <- phone
+	h.unregister <- tablet
+	waitUntil(t, func() bool {
+		for _, d := range h.GetOnlineDevices(userID) {
+			if d.Presence != PresenceReconnecting {
+				return false
+			}
+		}
+		return true
+	})
+
+	h.RevokeUser(userID)
+
+	if n := len(h.GetOnlineDevices(userID)); n != 0 {
+		t.Fatalf("%d devices still online after revoke", n)
+	}
+	if !h.IsDeviceOnline(other.userID, other.deviceID) {
+		t.Fatal("revoke disconnected another user")
+	}
+}
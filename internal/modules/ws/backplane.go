@@ -0,0 +1,295 @@
+package ws
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/google/uuid"
+)
+
+// Backplane event kinds
+const (
+	eventForward   = "forward"
+	eventBroadcast = "broadcast"
+	eventOnline    = "online"
+	eventOffline   = "offline"
+	eventPresence  = "presence"
+	eventControls  = "controls"
+	eventUpdated   = "updated"
+	eventRemoved   = "removed"
+	eventRevoked   = "revoked"
+	eventTelemetry = "telemetry"
+)
+
+// BackplaneEvent is a hub event relayed between server instances
+type BackplaneEvent struct {
+	// Instance that published the event
+	Origin string `json:"origin"`
+	Kind   string `json:"kind"`
+
+	UserID uuid.UUID `json:"user_id"`
+
+	// Target device for forward, excluded device for broadcast,
+	// subject device for online/offline
+	DeviceID uuid.UUID `json:"device_id"`
+
+	// Instance the device was connected to, for offline events published
+	// on behalf of a dead instance (defaults to Origin)
+	InstanceID string `json:"instance_id,omitempty"`
+
+	// Connection epoch of the device, for online/offline/presence events
+	Epoch int64 `json:"epoch,omitempty"`
+
+	// New presence state, for presence events
+	Presence string `json:"presence,omitempty"`
+
+	// Thresholds newly crossed, for telemetry events
+	Alerts []string `json:"alerts,omitempty"`
+
+	Device  *DeviceInfo `json:"device,omitempty"`
+	Message *Message    `json:"message,omitempty"`
+}
+
+// Member is a device connected to some instance in the cluster
+type Member struct {
+	UserID     uuid.UUID
+	InstanceID string
+	Epoch      int64
+	Device     DeviceInfo
+}
+
+// Backplane connects hubs running on different server instances. It relays
+// forwards and broadcasts, and keeps a cluster-wide registry of which
+// instance each device is connected to.
+type Backplane interface {
+	// Publish queues an event for every other instance (must not block)
+	Publish(ev BackplaneEvent) error
+
+	// Listen delivers events from other instances until ctx is done
+	Listen(ctx context.Context, handle func(BackplaneEvent))
+
+	// Join records a device as connected to this instance. Registry writes
+	// must not block and must not be dropped; they are applied before
+	// events published after them.
+	Join(userID, deviceID uuid.UUID, epoch int64)
+
+	// Leave removes a device from this instance in the registry
+	Leave(deviceID uuid.UUID)
+
+	// Members lists every device connected anywhere in the cluster
+	Members(ctx context.Context) ([]Member, error)
+
+	// Heartbeat marks this instance's devices alive and returns devices of
+	// instances that stopped heartbeating, which it removes
+	Heartbeat(ctx context.Context) ([]Member, error)
+
+	// Flush waits until queued events and registry writes are done, or
+	// until ctx is done
+	Flush(ctx context.Context)
+}
+
+// remoteDevice is a device connected to another instance
+type remoteDevice struct {
+	instanceID string
+	epoch      int64
+	device     DeviceInfo
+}
+
+// handleBackplaneEvent applies an event published by another instance
+func (h *Hub) handleBackplaneEvent(ev BackplaneEvent) {
+	switch ev.Kind {
+	case eventForward:
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+
+		s, ok := h.sessions[ev.UserID][ev.DeviceID]
+		if !ok || ev.Message == nil {
+			slog.Warn("backplane forward target not here", "user_id", ev.UserID, "device_id", ev.DeviceID)
+			return
+		}
+		if err := forwardTo(s, *ev.Message); err != nil {
+			slog.Warn("backplane forward not delivered", "error", err, "user_id", ev.UserID, "device_id", ev.DeviceID)
+		}
+
+	case eventBroadcast:
+		if ev.Message == nil {
+			return
+		}
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		h.deliverToUserLocked(ev.UserID, ev.DeviceID, *ev.Message)
+
+	case eventOnline:
+		if ev.Device == nil {
+			return
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		// The device reconnected elsewhere; drop our stale session quietly.
+		// A session holding a newer epoch means this event is the stale one.
+		if s, ok := h.sessions[ev.UserID][ev.DeviceID]; ok {
+			if s.epoch > ev.Epoch {
+				return
+			}
+			if s.expiry != nil {
+				s.expiry.Stop()
+			}
+			if s.client != nil {
+				s.client.out.close()
+				s.client = nil
+			}
+			h.removeSessionLocked(s)
+		}
+		h.addRemoteLocked(ev.UserID, ev.Origin, ev.Epoch, *ev.Device)
+		h.notifyUserLocked(ev.UserID, ev.DeviceID, TypeDeviceOnline, DeviceOnlinePayload{
+			Device: *ev.Device,
+		})
+
+	case eventPresence:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if rd, ok := h.remote[ev.UserID][ev.DeviceID]; ok && rd.epoch <= ev.Epoch {
+			rd.device.Presence = ev.Presence
+			h.notifyUserLocked(ev.UserID, ev.DeviceID, TypeDevicePresence, DevicePresencePayload{
+				DeviceID: ev.DeviceID,
+				Presence: ev.Presence,
+			})
+		}
+
+	case eventControls:
+		if ev.Device == nil || ev.Device.Controls == nil {
+			return
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if rd, ok := h.remote[ev.UserID][ev.DeviceID]; ok && rd.epoch <= ev.Epoch {
+			rd.device.Controls = ev.Device.Controls
+			h.notifyUserLocked(ev.UserID, ev.DeviceID, TypeControlCapabilities, ControlCapabilitiesPayload{
+				DeviceID: ev.DeviceID,
+				Controls: *ev.Device.Controls,
+			})
+		}
+
+	case eventTelemetry:
+		if ev.Device == nil || ev.Device.Telemetry == nil {
+			return
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.applyTelemetryLocked(ev)
+
+	case eventUpdated:
+		if ev.Device == nil {
+			return
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.applyDeviceUpdateLocked(ev.UserID, *ev.Device)
+
+	case eventRemoved:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.removeDeviceLocked(ev.UserID, ev.DeviceID)
+
+	case eventRevoked:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.revokeLocked(ev.UserID, ev.DeviceID)
+
+	case eventOffline:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		instanceID := ev.InstanceID
+		if instanceID == "" {
+			instanceID = ev.Origin
+		}
+		if rd, ok := h.remote[ev.UserID][ev.DeviceID]; ok && rd.instanceID == instanceID && rd.epoch <= ev.Epoch {
+			h.removeRemoteLocked(ev.UserID, ev.DeviceID)
+			h.notifyUserLocked(ev.UserID, ev.DeviceID, TypeDeviceOffline, DeviceOfflinePayload{
+				DeviceID: ev.DeviceID,
+			})
+		}
+	}
+}
+
+// loadMembers seeds the remote device registry at startup
+func (h *Hub) loadMembers(ctx context.Context) {
+	members, err := h.backplane.Members(ctx)
+	if err != nil {
+		slog.Error("failed to load cluster presence", "error", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, m := range members {
+		if m.InstanceID != h.instanceID {
+			h.addRemoteLocked(m.UserID, m.InstanceID, m.Epoch, m.Device)
+		}
+	}
+	slog.Info("loaded cluster presence", "instance_id", h.instanceID, "devices", len(members))
+}
+
+// heartbeat keeps this instance's registry entries alive and takes over
+// announcing devices of instances that died without cleaning up
+func (h *Hub) heartbeat(ctx context.Context) {
+	stale, err := h.backplane.Heartbeat(ctx)
+	if err != nil {
+		slog.Error("cluster heartbeat failed", "error", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, m := range stale {
+		slog.Warn("reaping device from dead instance", "instance_id", m.InstanceID, "device_id", m.Device.ID)
+
+		if rd, ok := h.remote[m.UserID][m.Device.ID]; ok && rd.instanceID == m.InstanceID {
+			h.removeRemoteLocked(m.UserID, m.Device.ID)
+		}
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:       eventOffline,
+			UserID:     m.UserID,
+			DeviceID:   m.Device.ID,
+			InstanceID: m.InstanceID,
+			Epoch:      m.Epoch,
+		})
+		h.notifyUserLocked(m.UserID, m.Device.ID, TypeDeviceOffline, DeviceOfflinePayload{
+			DeviceID: m.Device.ID,
+		})
+		if h.onOffline != nil {
+			userID, deviceID, epoch := m.UserID, m.Device.ID, m.Epoch
+			h.background(func() { h.onOffline(userID, deviceID, epoch) })
+		}
+	}
+}
+
+// addRemoteLocked records a device connected to another instance (caller must hold lock)
+func (h *Hub) addRemoteLocked(userID uuid.UUID, instanceID string, epoch int64, device DeviceInfo) {
+	if h.remote[userID] == nil {
+		h.remote[userID] = make(map[uuid.UUID]*remoteDevice)
+	}
+	h.remote[userID][device.ID] = &remoteDevice{instanceID: instanceID, epoch: epoch, device: device}
+}
+
+// removeRemoteLocked forgets a device on another instance (caller must hold lock)
+func (h *Hub) removeRemoteLocked(userID, deviceID uuid.UUID) {
+	userRemote, ok := h.remote[userID]
+	if !ok {
+		return
+	}
+	if _, ok := userRemote[deviceID]; !ok {
+		return
+	}
+
+	delete(userRemote, deviceID)
+	if len(userRemote) == 0 {
+		delete(h.remote, userID)
+	}
+}
@@ -0,0 +1,344 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/vkrishna03/streamz/db/sqlc"
+)
+
+const (
+	// NOTIFY channel shared by all instances
+	pgChannel = "streamz_ws"
+
+	// NOTIFY payloads are limited to 8000 bytes; larger events (SDPs) are
+	// stored in ws_events and referenced as "@<id>"
+	pgMaxNotifyPayload = 7900
+
+	// Outbound events queued per instance before Publish starts failing
+	pgPublishQueueSize = 1024
+
+	// How often failed registry writes are retried
+	pgRegistryRetry = 5 * time.Second
+)
+
+// PostgresBackplane relays hub events with LISTEN/NOTIFY and keeps the
+// cluster presence registry in the ws_presence table
+type PostgresBackplane struct {
+	db         *sql.DB
+	q          *sqlc.Queries
+	instanceID string
+	staleAfter time.Duration
+	outbound   chan func(context.Context) error
+
+	// Latest registry write per device, applied by the publisher before the
+	// next queued event and kept until it succeeds. Registry writes are
+	// never dropped, even when the event queue is full.
+	registryMu    sync.Mutex
+	registry      map[uuid.UUID]func(context.Context) error
+	registryReady chan struct{}
+}
+
+// NewPostgresBackplane creates a backplane for this instance. Devices of
+// instances that haven't heartbeated for staleAfter are considered gone.
+func NewPostgresBackplane(db *sql.DB, instanceID string, staleAfter time.Duration) *PostgresBackplane {
+	return &PostgresBackplane{
+		db:         db,
+		q:          sqlc.New(db),
+		instanceID: instanceID,
+		staleAfter: staleAfter,
+		outbound:   make(chan func(context.Context) error, pgPublishQueueSize),
+
+		registry:      make(map[uuid.UUID]func(context.Context) error),
+		registryReady: make(chan struct{}, 1),
+	}
+}
+
+// Publish queues an event; a single writer preserves publish order
+func (b *PostgresBackplane) Publish(ev BackplaneEvent) error {
+	ev.Origin = b.instanceID
+
+	// Marshal now; the event may point at hub state that changes later
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return b.enqueue(func(ctx context.Context) error {
+		return b.publish(ctx, data)
+	})
+}
+
+func (b *PostgresBackplane) enqueue(op func(context.Context) error) error {
+	select {
+	case b.outbound <- op:
+		return nil
+	default:
+		slog.Warn("backplane queue full, dropping event", "instance_id", b.instanceID)
+		return ErrPeerBusy
+	}
+}
+
+// Listen runs the publisher and the LISTEN loop, reconnecting on failure
+func (b *PostgresBackplane) Listen(ctx context.Context, handle func(BackplaneEvent)) {
+	go b.publishLoop(ctx)
+
+	backoff := time.Second
+	for {
+		err := b.listen(ctx, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("backplane listen failed, retrying", "error", err, "retry_in", backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (b *PostgresBackplane) listen(ctx context.Context, handle func(BackplaneEvent)) error {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		pgConn := driverConn.(*stdlib.Conn).Conn()
+
+		if _, err := pgConn.Exec(ctx, "LISTEN "+pgChannel); err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+		slog.Info("backplane listening", "channel", pgChannel, "instance_id", b.instanceID)
+
+		for {
+			n, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+
+			ev, err := b.decode(ctx, n.Payload)
+			if err != nil {
+				slog.Error("failed to decode backplane event", "error", err)
+				continue
+			}
+			if ev.Origin == b.instanceID {
+				continue
+			}
+			handle(ev)
+		}
+	})
+}
+
+func (b *PostgresBackplane) publishLoop(ctx context.Context) {
+	cleanup := time.NewTicker(time.Minute)
+	defer cleanup.Stop()
+	retry := time.NewTicker(pgRegistryRetry)
+	defer retry.Stop()
+
+	for {
+		select {
+		case op := <-b.outbound:
+			// Registry writes made before the event go out first
+			b.writeRegistry(ctx)
+			if err := op(ctx); err != nil {
+				slog.Error("backplane write failed", "error", err)
+			}
+
+		case <-b.registryReady:
+			b.writeRegistry(ctx)
+
+		case <-retry.C:
+			b.writeRegistry(ctx)
+
+		case <-cleanup.C:
+			_ = b.q.DeleteOldWSEvents(ctx)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *PostgresBackplane) publish(ctx context.Context, data []byte) error {
+	payload := string(data)
+	if len(payload) > pgMaxNotifyPayload {
+		id, err := b.q.CreateWSEvent(ctx, payload)
+		if err != nil {
+			return fmt.Errorf("failed to store event: %w", err)
+		}
+		payload = "@" + strconv.FormatInt(id, 10)
+	}
+
+	return b.q.NotifyWSChannel(ctx, sqlc.NotifyWSChannelParams{
+		Channel: pgChannel,
+		Payload: payload,
+	})
+}
+
+func (b *PostgresBackplane) decode(ctx context.Context, payload string) (BackplaneEvent, error) {
+	if ref, ok := strings.CutPrefix(payload, "@"); ok {
+		id, err := strconv.ParseInt(ref, 10, 64)
+		if err != nil {
+			return BackplaneEvent{}, err
+		}
+		payload, err = b.q.GetWSEvent(ctx, id)
+		if err != nil {
+			return BackplaneEvent{}, fmt.Errorf("failed to load event %d: %w", id, err)
+		}
+	}
+
+	var ev BackplaneEvent
+	err := json.Unmarshal([]byte(payload), &ev)
+	return ev, err
+}
+
+// Join records a device as connected to this instance
+func (b *PostgresBackplane) Join(userID, deviceID uuid.UUID, epoch int64) {
+	b.setRegistry(deviceID, func(ctx context.Context) error {
+		return b.q.UpsertWSPresence(ctx, sqlc.UpsertWSPresenceParams{
+			DeviceID:   deviceID,
+			UserID:     userID,
+			InstanceID: b.instanceID,
+			Epoch:      epoch,
+		})
+	})
+}
+
+// Leave removes a device from this instance in the registry
+func (b *PostgresBackplane) Leave(deviceID uuid.UUID) {
+	b.setRegistry(deviceID, func(ctx context.Context) error {
+		return b.q.DeleteWSPresence(ctx, sqlc.DeleteWSPresenceParams{
+			DeviceID:   deviceID,
+			InstanceID: b.instanceID,
+		})
+	})
+}
+
+// setRegistry replaces the device's pending registry write; only the latest
+// one matters
+func (b *PostgresBackplane) setRegistry(deviceID uuid.UUID, op func(context.Context) error) {
+	b.registryMu.Lock()
+	b.registry[deviceID] = op
+	b.registryMu.Unlock()
+
+	select {
+	case b.registryReady <- struct{}{}:
+	default:
+	}
+}
+
+// writeRegistry applies pending registry writes, keeping failed ones for
+// the next retry unless a newer write for the device came in meanwhile
+func (b *PostgresBackplane) writeRegistry(ctx context.Context) {
+	b.registryMu.Lock()
+	pending := b.registry
+	if len(pending) == 0 {
+		b.registryMu.Unlock()
+		return
+	}
+	b.registry = make(map[uuid.UUID]func(context.Context) error)
+	b.registryMu.Unlock()
+
+	for deviceID, op := range pending {
+		if err := op(ctx); err != nil {
+			slog.Error("backplane registry write failed, will retry", "error", err, "device_id", deviceID)
+
+			b.registryMu.Lock()
+			if _, ok := b.registry[deviceID]; !ok {
+				b.registry[deviceID] = op
+			}
+			b.registryMu.Unlock()
+		}
+	}
+}
+
+// Flush waits for the publisher to work through what is queued so far,
+// registry writes included
+func (b *PostgresBackplane) Flush(ctx context.Context) {
+	done := make(chan struct{})
+	flush := func(ctx context.Context) error {
+		b.writeRegistry(ctx)
+		close(done)
+		return nil
+	}
+
+	// Wait for room rather than give up on a full queue
+	select {
+	case b.outbound <- flush:
+	case <-ctx.Done():
+		slog.Warn("backplane flush timed out", "instance_id", b.instanceID)
+		return
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("backplane flush timed out", "instance_id", b.instanceID)
+	}
+}
+
+// Members lists every device connected anywhere in the cluster
+func (b *PostgresBackplane) Members(ctx context.Context) ([]Member, error) {
+	rows, err := b.q.ListWSPresence(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]Member, len(rows))
+	for i, r := range rows {
+		members[i] = Member{
+			UserID:     r.UserID,
+			InstanceID: r.InstanceID,
+			Epoch:      r.Epoch,
+			Device: DeviceInfo{
+				ID:            r.DeviceID,
+				DeviceID:      r.ClientDeviceID,
+				DeviceName:    r.DeviceName,
+				DeviceType:    string(r.DeviceType),
+				HasCamera:     r.HasCamera.Valid && r.HasCamera.Bool,
+				HasMicrophone: r.HasMicrophone.Valid && r.HasMicrophone.Bool,
+				IsOnline:      true,
+				Presence:      string(r.Presence),
+			},
+		}
+	}
+	return members, nil
+}
+
+// Heartbeat marks this instance's devices alive and reaps dead instances
+func (b *PostgresBackplane) Heartbeat(ctx context.Context) ([]Member, error) {
+	if err := b.q.TouchWSPresence(ctx, b.instanceID); err != nil {
+		return nil, err
+	}
+
+	rows, err := b.q.DeleteStaleWSPresence(ctx, int32(b.staleAfter.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+
+	stale := make([]Member, len(rows))
+	for i, r := range rows {
+		stale[i] = Member{
+			UserID:     r.UserID,
+			InstanceID: r.InstanceID,
+			Epoch:      r.Epoch,
+			Device:     DeviceInfo{ID: r.DeviceID},
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,225 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vkrishna03/streamz/db/sqlc"
+)
+
+// testDB connects to the migrated database in TEST_DATABASE_URL, skipping
+// the test when there is none
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Skipf("database unavailable: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		t.Skipf("database unavailable: %v", err)
+	}
+	return db
+}
+
+// instance is a Postgres backplane with the events it received
+type instance struct {
+	*PostgresBackplane
+	events chan BackplaneEvent
+}
+
+func startInstance(ctx context.Context, db *sql.DB, staleAfter time.Duration) *instance {
+	in := &instance{
+		PostgresBackplane: NewPostgresBackplane(db, "test-"+uuid.NewString(), staleAfter),
+		events:            make(chan BackplaneEvent, 4*pgPublishQueueSize),
+	}
+	go in.Listen(ctx, func(ev BackplaneEvent) {
+		select {
+		case in.events <- ev:
+		default:
+		}
+	})
+	return in
+}
+
+// next returns the next event matching the user, skipping others
+func (in *instance) next(t *testing.T, userID uuid.UUID) BackplaneEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-in.events:
+			if ev.UserID == userID {
+				return ev
+			}
+		case <-timeout:
+			t.Fatal("no backplane event received")
+		}
+	}
+}
+
+func members(t *testing.T, b Backplane, ids ...uuid.UUID) map[uuid.UUID]Member {
+	t.Helper()
+	all, err := b.Members(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[uuid.UUID]Member)
+	for _, m := range all {
+		for _, id := range ids {
+			if m.Device.ID == id {
+				found[id] = m
+			}
+		}
+	}
+	return found
+}
+
+func TestPostgresBackplane(t *testing.T) {
+	db := testDB(t)
+	q := sqlc.New(db)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	user, err := q.CreateUser(ctx, sqlc.CreateUserParams{
+		Email:        uuid.NewString() + "@backplane.test",
+		PasswordHash: "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = q.DeleteUser(context.Background(), user.ID) })
+
+	var devices [2]uuid.UUID
+	for i := range devices {
+		d, err := q.CreateDevice(ctx, sqlc.CreateDeviceParams{
+			UserID:     user.ID,
+			DeviceID:   uuid.NewString(),
+			DeviceName: "device",
+			DeviceType: sqlc.DeviceTypePhone,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices[i] = d.ID
+	}
+	phone, tablet := devices[0], devices[1]
+
+	const staleAfter = time.Second
+	a := startInstance(ctx, db, staleAfter)
+	b := startInstance(ctx, db, staleAfter)
+
+	// LISTEN is set up asynchronously; publish until b hears a
+	probe := BackplaneEvent{Kind: eventBroadcast, UserID: user.ID}
+	deadline := time.Now().Add(5 * time.Second)
+	for heard := false; !heard; {
+		if time.Now().After(deadline) {
+			t.Fatal("instances never connected")
+		}
+		_ = a.Publish(probe)
+		select {
+		case ev := <-b.events:
+			heard = ev.UserID == user.ID
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Run("notify", func(t *testing.T) {
+		_ = b.Publish(BackplaneEvent{Kind: eventOnline, UserID: user.ID, DeviceID: tablet, Epoch: 7})
+
+		ev := a.next(t, user.ID)
+		if ev.Origin != b.instanceID || ev.Kind != eventOnline || ev.DeviceID != tablet || ev.Epoch != 7 {
+			t.Fatalf("got %+v", ev)
+		}
+	})
+
+	t.Run("large payload", func(t *testing.T) {
+		sdp := strings.Repeat("a=candidate:1 1 udp 2122260223 10.0.0.1 50000 typ host\r\n", 200)
+		msg, err := NewMessage(TypeOffer, map[string]string{"sdp": sdp})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := BackplaneEvent{Kind: eventForward, UserID: user.ID, DeviceID: phone, Message: &msg}
+		if data, _ := json.Marshal(ev); len(data) <= pgMaxNotifyPayload {
+			t.Fatalf("payload is %d bytes, want over the NOTIFY limit", len(data))
+		}
+		if err := a.Publish(ev); err != nil {
+			t.Fatal(err)
+		}
+
+		got := b.next(t, user.ID)
+		var payload map[string]string
+		if got.Message == nil || json.Unmarshal(got.Message.Payload, &payload) != nil || payload["sdp"] != sdp {
+			t.Fatal("large event not delivered intact")
+		}
+	})
+
+	t.Run("registry write with full queue", func(t *testing.T) {
+		// Not listening yet, so nothing drains the queue
+		c := &instance{
+			PostgresBackplane: NewPostgresBackplane(db, "test-"+uuid.NewString(), staleAfter),
+			events:            make(chan BackplaneEvent, 1),
+		}
+		for err := error(nil); !errors.Is(err, ErrPeerBusy); {
+			err = c.Publish(BackplaneEvent{Kind: eventBroadcast})
+		}
+		c.Join(user.ID, phone, 1)
+
+		go c.Listen(ctx, func(BackplaneEvent) {})
+		flushCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		c.Flush(flushCtx)
+
+		m, ok := members(t, a, phone)[phone]
+		if !ok || m.InstanceID != c.instanceID || m.Epoch != 1 {
+			t.Fatalf("registry has %+v, want phone on %s", m, c.instanceID)
+		}
+	})
+
+	t.Run("heartbeat reaping", func(t *testing.T) {
+		b.Join(user.ID, tablet, 2)
+		b.Flush(ctx)
+		time.Sleep(staleAfter + 500*time.Millisecond)
+
+		// b is alive; the instance that registered the phone is not
+		stale, err := b.Heartbeat(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reaped := make(map[uuid.UUID]bool)
+		for _, m := range stale {
+			reaped[m.Device.ID] = true
+		}
+		if !reaped[phone] || reaped[tablet] {
+			t.Fatalf("reaped %v, want the phone only", reaped)
+		}
+
+		found := members(t, a, phone, tablet)
+		if _, ok := found[phone]; ok {
+			t.Fatal("reaped phone still registered")
+		}
+		if m, ok := found[tablet]; !ok || m.InstanceID != b.instanceID {
+			t.Fatal("live tablet missing from registry")
+		}
+
+		b.Leave(tablet)
+		b.Flush(ctx)
+		if _, ok := members(t, a, tablet)[tablet]; ok {
+			t.Fatal("tablet still registered after leave")
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryBus connects in-process hubs the way Postgres connects replicas
+type memoryBus struct {
+	mu   sync.Mutex
+	subs []*memoryBackplane
+}
+
+type memoryBackplane struct {
+	bus        *memoryBus
+	instanceID string
+	events     chan BackplaneEvent
+}
+
+func (b *memoryBus) join(instanceID string) *memoryBackplane {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bp := &memoryBackplane{bus: b, instanceID: instanceID, events: make(chan BackplaneEvent, 64)}
+	b.subs = append(b.subs, bp)
+	return bp
+}
+
+func (b *memoryBackplane) Publish(ev BackplaneEvent) error {
+	ev.Origin = b.instanceID
+	b.bus.mu.Lock()
+	defer b.bus.mu.Unlock()
+	for _, sub := range b.bus.subs {
+		if sub != b {
+			sub.events <- ev
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackplane) Listen(ctx context.Context, handle func(BackplaneEvent)) {
+	for {
+		select {
+		case ev := <-b.events:
+			handle(ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *memoryBackplane) Join(userID, deviceID uuid.UUID, epoch int64)    {}
+func (b *memoryBackplane) Leave(deviceID uuid.UUID)                        {}
+func (b *memoryBackplane) Members(ctx context.Context) ([]Member, error)   { return nil, nil }
+func (b *memoryBackplane) Heartbeat(ctx context.Context) ([]Member, error) { return nil, nil }
+func (b *memoryBackplane) Flush(ctx context.Context)                       {}
+
+func newClusterHub(bus *memoryBus, instanceID string) *Hub {
+	h := NewHub(Config{InstanceID: instanceID, ResumeGrace: time.Minute, ReplayBufferSize: 16})
+	h.backplane = bus.join(instanceID)
+	return h
+}
+
+func TestBackplaneSignalingAcrossInstances(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	userID := uuid.New()
+	phone := newTestClient(userID, uuid.New())
+	mac := newTestClient(userID, uuid.New())
+	stranger := newTestClient(uuid.New(), uuid.New())
+
+	bus := &memoryBus{}
+	replica1 := newClusterHub(bus, "replica-1")
+	replica2 := newClusterHub(bus, "replica-2")
+	replica1.deviceOwner = ownersOf(phone, mac, stranger)
+	replica2.deviceOwner = replica1.deviceOwner
+	go replica1.Run(ctx)
+	go replica2.Run(ctx)
+
+	replica1.register <- phone
+	replica2.register <- mac
+
+	// The phone hears about the mac coming online on the other replica
+	online := waitFor(t, phone, TypeDeviceOnline)
+	var onlinePayload DeviceOnlinePayload
+	_ = json.Unmarshal(online.Payload, &onlinePayload)
+	if onlinePayload.Device.ID != mac.deviceID {
+		t.Fatalf("device:online for %s, want %s", onlinePayload.Device.ID, mac.deviceID)
+	}
+	if !replica1.IsDeviceOnline(userID, mac.deviceID) {
+		t.Fatalf("replica-1 does not see the mac as online")
+	}
+
+	// Offer from the phone reaches the mac through replica-1's backplane
+	err := replica1.ForwardToDevice(userID, mac.deviceID, TypeOffer, OfferPayload{
+		FromDeviceID: phone.deviceID,
+		ToDeviceID:   mac.deviceID,
+		SDP:          "v=0",
+	})
+	if err != nil {
+		t.Fatalf("ForwardToDevice: %v", err)
+	}
+
+	offer := waitFor(t, mac, TypeOffer)
+	var offerPayload OfferPayload
+	_ = json.Unmarshal(offer.Payload, &offerPayload)
+	if offerPayload.FromDeviceID != phone.deviceID || offerPayload.SDP != "v=0" {
+		t.Errorf("unexpected offer payload: %+v", offerPayload)
+	}
+
+	// Devices of another account on the other replica are off limits
+	replica2.register <- stranger
+	waitUntil(t, func() bool { return replica1.IsDeviceOnline(stranger.userID, stranger.deviceID) })
+
+	if err := replica1.ForwardToDevice(userID, stranger.deviceID, TypeOffer, OfferPayload{}); err != ErrForbidden {
+		t.Errorf("forward to other account: got %v, want %v", err, ErrForbidden)
+	}
+}
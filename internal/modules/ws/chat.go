@@ -0,0 +1,89 @@
+package ws
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Chat stores and delivers text messages between a user's devices. The chat
+// service implements it and delivers new messages back through the hub.
+type Chat interface {
+	SendMessage(ctx context.Context, userID, fromDeviceID uuid.UUID, toDeviceID, streamID *uuid.UUID, body string) (uuid.UUID, error)
+	MarkRead(ctx context.Context, userID, deviceID, messageID uuid.UUID) error
+	UnreadCounts(ctx context.Context, userID, deviceID uuid.UUID) (map[uuid.UUID]int, error)
+}
+
+// SetChat enables chat:message and chat:read, and unread counts in
+// device:list. Call it before clients connect.
+func (h *Hub) SetChat(chat Chat) {
+	h.chat = chat
+}
+
+// DeliverChatMessage sends a stored message to its recipient, or to all of
+// the user's other devices if it has none. Recipients that are offline see
+// it in their unread counts when they connect.
+func (h *Hub) DeliverChatMessage(userID, messageID, fromDeviceID uuid.UUID, toDeviceID, streamID *uuid.UUID, body string, sentAt time.Time) {
+	payload := ChatMessagePayload{
+		MessageID:    messageID,
+		FromDeviceID: fromDeviceID,
+		ToDeviceID:   toDeviceID,
+		StreamID:     streamID,
+		Body:         body,
+		SentAt:       sentAt.UnixMilli(),
+	}
+
+	if toDeviceID == nil {
+		h.broadcastToUser(userID, fromDeviceID, TypeChatMessage, payload)
+		return
+	}
+
+	if err := h.ForwardToDevice(userID, *toDeviceID, TypeChatMessage, payload); err != nil && err != ErrPeerOffline {
+		slog.Warn("failed to deliver chat message", "error", err, "message_id", messageID, "device_id", *toDeviceID)
+	}
+}
+
+func (c *Client) handleChatMessage(msg Message) {
+	if c.hub.chat == nil {
+		c.sendError(msg.ID, CodeUnknownType, "unknown message type: "+msg.Type)
+		return
+	}
+
+	var req ChatMessageRequest
+	if err := c.codec.DecodePayload(msg.Payload, &req); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid chat message payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamRequestTimeout)
+	defer cancel()
+
+	messageID, err := c.hub.chat.SendMessage(ctx, c.userID, c.deviceID, req.ToDeviceID, req.StreamID, req.Body)
+	if err != nil || msg.ID == "" {
+		c.reply(msg.ID, err)
+		return
+	}
+
+	ack, _ := NewAckMessageWith(msg.ID, ChatSentPayload{MessageID: messageID})
+	c.Send(ack)
+}
+
+func (c *Client) handleChatRead(msg Message) {
+	if c.hub.chat == nil {
+		c.sendError(msg.ID, CodeUnknownType, "unknown message type: "+msg.Type)
+		return
+	}
+
+	var req ChatReadPayload
+	if err := c.codec.DecodePayload(msg.Payload, &req); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid chat read payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamRequestTimeout)
+	defer cancel()
+
+	c.reply(msg.ID, c.hub.chat.MarkRead(ctx, c.userID, c.deviceID, req.MessageID))
+}
@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fakeChat delivers messages straight back through the hub like the chat service
+type fakeChat struct {
+	hub *Hub
+}
+
+func (f *fakeChat) SendMessage(ctx context.Context, userID, fromDeviceID uuid.UUID, toDeviceID, streamID *uuid.UUID, body string) (uuid.UUID, error) {
+	id := uuid.New()
+	f.hub.DeliverChatMessage(userID, id, fromDeviceID, toDeviceID, streamID, body, time.Now())
+	return id, nil
+}
+
+func (f *fakeChat) MarkRead(ctx context.Context, userID, deviceID, messageID uuid.UUID) error {
+	return nil
+}
+
+func (f *fakeChat) UnreadCounts(ctx context.Context, userID, deviceID uuid.UUID) (map[uuid.UUID]int, error) {
+	return nil, nil
+}
+
+func TestChatMessages(t *testing.T) {
+	h := newTestHub(t, Config{ReplayBufferSize: 8}, func(h *Hub) { h.SetChat(&fakeChat{hub: h}) })
+	userID := uuid.New()
+	monitor := h.device(userID)
+	phone := h.device(userID)
+	tablet := h.device(userID)
+
+	// Unread counts loaded at connect go out with the device list
+	monitor.unread = map[uuid.UUID]int{phone.deviceID: 3}
+	h.register <- monitor
+
+	var list DeviceListPayload
+	if err := json.Unmarshal(waitFor(t, monitor, TypeDeviceList).Payload, &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Unread[phone.deviceID] != 3 {
+		t.Fatalf("unread = %v, want 3 from phone", list.Unread)
+	}
+
+	h.connect(t, phone, tablet)
+
+	// Direct message reaches only its recipient
+	monitor.handleMessage([]byte(`{"id":"1","type":"chat:message","payload":{"to_device_id":"` + phone.deviceID.String() + `","body":"you're out of frame"}}`))
+
+	var got ChatMessagePayload
+	if err := json.Unmarshal(waitFor(t, phone, TypeChatMessage).Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.FromDeviceID != monitor.deviceID || got.Body != "you're out of frame" {
+		t.Fatalf("chat:message = %+v", got)
+	}
+
+	var sent ChatSentPayload
+	if err := json.Unmarshal(waitFor(t, monitor, TypeAck).Payload, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.MessageID != got.MessageID {
+		t.Fatalf("ack message_id = %s, want %s", sent.MessageID, got.MessageID)
+	}
+	if msgs := drain(t, tablet); len(msgs) != 0 {
+		t.Fatalf("direct message leaked to another device: %+v", msgs)
+	}
+
+	// Without a recipient it goes to every other device
+	monitor.handleMessage([]byte(`{"type":"chat:message","payload":{"body":"battery low"}}`))
+	waitFor(t, phone, TypeChatMessage)
+	waitFor(t, tablet, TypeChatMessage)
+	for _, m := range drain(t, monitor) {
+		if m.Type == TypeChatMessage {
+			t.Fatal("broadcast echoed to sender")
+		}
+	}
+}
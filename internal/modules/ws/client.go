@@ -1,9 +1,9 @@
 package ws
 
 import (
-	"encoding/json"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -20,7 +20,7 @@ const (
 	// Send pings to peer with this period (must be less than pongWait)
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer
+	// Maximum message size allowed from peer (per-type limits are smaller)
 	maxMessageSize = 512 * 1024 // 512KB
 )
 
@@ -28,22 +28,77 @@ const (
 type Client struct {
 	hub      *Hub
 	conn     *websocket.Conn
-	send     chan []byte
 	userID   uuid.UUID
 	deviceID uuid.UUID
 	device   *DeviceInfo
-	mu       sync.RWMutex
+	resume   resumeRequest
+
+	// Outbound messages waiting for WritePump (or the event stream)
+	out *outbox
+
+	// Wire format negotiated at upgrade
+	codec Codec
+
+	// Set by the hello handshake. features is nil for clients that didn't
+	// send hello, which get every event.
+	protocolVersion int
+	appVersion      string
+	features        map[string]bool
+	helloID         string
+
+	// ReadPump hands the first frame to the handshake on hello, then waits
+	// for ready before reading on; accepted is set before ready closes if
+	// the client was registered. pending is a first frame that wasn't a
+	// hello. Unused for Server-Sent Events clients, which skip the handshake.
+	hello    chan []byte
+	ready    chan struct{}
+	accepted bool
+	pending  []byte
+
+	// Presence epoch claimed by this connection; a newer connection of the
+	// same device always holds a higher one
+	epoch int64
+
+	// Set while the client reports being in the background
+	away atomic.Bool
+
+	// Per-type rate and size limits; nil means unlimited
+	limiter *messageLimiter
+
+	// Expiry of the access token the connection was opened with (zero if
+	// it doesn't expire), and new expiries from auth:refresh for WritePump
+	authExpiry time.Time
+	reauth     chan time.Time
+
+	// Unread chat messages by sender when the client connected
+	unread map[uuid.UUID]int
+
+	// Set for Server-Sent Events clients, which have no conn; closeWith
+	// hands the close to the event stream instead
+	closing chan closeFrame
+
+	// Serializes messages posted by Server-Sent Events clients
+	mu sync.RWMutex
 }
 
 // NewClient creates a new WebSocket client
 func NewClient(hub *Hub, conn *websocket.Conn, userID, deviceID uuid.UUID, device *DeviceInfo) *Client {
+	maxDrops := 0
+	if hub != nil {
+		maxDrops = hub.slowClientDrops
+	}
+
 	return &Client{
 		hub:      hub,
 		conn:     conn,
-		send:     make(chan []byte, 256),
+		out:      newOutbox(maxDrops),
 		userID:   userID,
 		deviceID: deviceID,
 		device:   device,
+		codec:    jsonCodec{},
+		reauth:   make(chan time.Time, 1),
+
+		protocolVersion: ProtocolVersion,
 	}
 }
 
@@ -55,51 +110,124 @@ func (c *Client) ReadPump() {
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadDeadline(time.Now().Add(c.readWait()))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(time.Now().Add(c.readWait()))
 		return nil
 	})
 
+	handshaking := c.hello != nil
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				slog.Error("websocket read error", "error", err, "user_id", c.userID, "device_id", c.deviceID)
 			}
+			if handshaking {
+				// Gone before saying anything; wait for the handler to give up
+				close(c.hello)
+				<-c.ready
+			}
 			break
 		}
 
+		if handshaking {
+			handshaking = false
+			c.hello <- message
+			<-c.ready
+			if !c.accepted {
+				break
+			}
+			c.handleFirstFrame()
+			continue
+		}
+
 		c.handleMessage(message)
 	}
 }
 
-// WritePump pumps messages from the hub to the WebSocket connection
+// handleFirstFrame handles a legacy client's first message once it's
+// registered. That's the frame the handshake kept, or one it missed by
+// timing out first.
+func (c *Client) handleFirstFrame() {
+	if c.pending != nil {
+		c.handleMessage(c.pending)
+		return
+	}
+	select {
+	case data := <-c.hello:
+		c.handleMessage(data)
+	default:
+	}
+}
+
+// readWait is how long the connection may stay silent before it's considered
+// dead. Backgrounded clients get longer since browsers throttle them.
+func (c *Client) readWait() time.Duration {
+	if c.away.Load() && c.hub.awayTimeout > pongWait {
+		return c.hub.awayTimeout
+	}
+	return pongWait
+}
+
+// WritePump pumps messages from the hub to the WebSocket connection. It also
+// warns the client before its access token expires and closes the
+// connection if it does.
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
+	auth := newAuthTimer(c.authExpiry)
 	defer func() {
 		ticker.Stop()
+		auth.stop()
 		c.conn.Close()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.out.ready:
+			for {
+				message, done := c.out.next()
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if done {
+					// Hub closed the outbox
+					c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+					return
+				}
+				if message == nil {
+					break
+				}
+
+				if err := c.conn.WriteMessage(c.codec.FrameType(), message); err != nil {
+					slog.Error("websocket write error", "error", err, "user_id", c.userID)
+					return
+				}
+			}
+
+		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// Hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				slog.Error("websocket write error", "error", err, "user_id", c.userID)
+		case expiresAt := <-c.reauth:
+			auth.reset(expiresAt)
+
+		case <-auth.C():
+			if auth.fired() {
+				slog.Info("websocket token expired", "user_id", c.userID, "device_id", c.deviceID)
+				msg := websocket.FormatCloseMessage(CloseAuthExpired, "token expired")
+				c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
 				return
 			}
 
-		case <-ticker.C:
+			warning, _ := NewMessage(TypeAuthExpiring, AuthExpiringPayload{ExpiresAt: auth.expiresAt.Unix()})
+			data, err := c.codec.Encode(warning)
+			if err != nil {
+				slog.Error("failed to encode message", "error", err, "type", warning.Type, "codec", c.codec.Name())
+				continue
+			}
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := c.conn.WriteMessage(c.codec.FrameType(), data); err != nil {
 				return
 			}
 		}
@@ -108,41 +236,104 @@ func (c *Client) WritePump() {
 
 // handleMessage processes incoming WebSocket messages
 func (c *Client) handleMessage(data []byte) {
-	var msg Message
-	if err := json.Unmarshal(data, &msg); err != nil {
-		slog.Error("failed to unmarshal message", "error", err)
-		c.sendError("INVALID_MESSAGE", "failed to parse message")
+	msg, err := c.codec.Decode(data)
+	if err != nil {
+		slog.Error("failed to decode message", "error", err, "codec", c.codec.Name())
+		c.sendError("", CodeInvalidMessage, "failed to parse message")
+		return
+	}
+
+	if c.limiter != nil {
+		if err := c.limiter.allow(msg.Type, len(data)); err != nil {
+			slog.Warn("message rejected by policy",
+				"error", err,
+				"type", msg.Type,
+				"size", len(data),
+				"user_id", c.userID,
+				"device_id", c.deviceID,
+			)
+			c.reply(msg.ID, err)
+			if c.limiter.exhausted() {
+				c.closeWith(closePolicyViolation, "message limits exceeded")
+			}
+			return
+		}
+	}
+
+	if err := c.validatePayload(msg); err != nil {
+		c.reply(msg.ID, err)
 		return
 	}
 
 	switch msg.Type {
 	case TypePing:
-		c.handlePing()
+		c.handlePing(msg)
+
+	case TypeHello:
+		c.reply(msg.ID, ErrUnexpectedHello)
 
 	case TypeOffer:
-		c.handleOffer(msg.Payload)
+		c.handleOffer(msg)
 
 	case TypeAnswer:
-		c.handleAnswer(msg.Payload)
+		c.handleAnswer(msg)
 
 	case TypeCandidate:
-		c.handleCandidate(msg.Payload)
+		c.handleCandidate(msg)
+
+	case TypeVisibility:
+		c.handleVisibility(msg)
+
+	case TypeControlCapabilities:
+		c.handleControlCapabilities(msg)
+
+	case TypeControlCamera, TypeControlTorch, TypeControlZoom, TypeControlMic, TypeControlExposure:
+		c.handleControl(msg)
+
+	case TypeTelemetry:
+		c.handleTelemetry(msg)
+
+	case TypeAuthRefresh:
+		c.handleAuthRefresh(msg)
+
+	case TypeChatMessage:
+		c.handleChatMessage(msg)
+
+	case TypeChatRead:
+		c.handleChatRead(msg)
+
+	case TypeStreamStart:
+		c.handleStreamStart(msg)
+
+	case TypeStreamEnd:
+		c.handleStreamEnd(msg)
+
+	case TypeTransferAccept:
+		c.handleTransferAccept(msg)
 
 	default:
 		slog.Warn("unknown message type", "type", msg.Type)
-		c.sendError("UNKNOWN_TYPE", "unknown message type: "+msg.Type)
+		c.sendError(msg.ID, CodeUnknownType, "unknown message type: "+msg.Type)
 	}
 }
 
-func (c *Client) handlePing() {
-	msg, _ := NewPongMessage()
-	c.send <- msg
+func (c *Client) handlePing(msg Message) {
+	pong, _ := NewPongMessage(msg.ID)
+	c.Send(pong)
 }
 
-func (c *Client) handleOffer(payload json.RawMessage) {
+func (c *Client) handleOffer(msg Message) {
 	var offer OfferPayload
-	if err := json.Unmarshal(payload, &offer); err != nil {
-		c.sendError("INVALID_PAYLOAD", "invalid offer payload")
+	if err := c.codec.DecodePayload(msg.Payload, &offer); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid offer payload")
+		return
+	}
+	if offer.StreamID != nil {
+		c.handleSFUOffer(msg, *offer.StreamID, offer.SDP)
+		return
+	}
+	if offer.ToDeviceID == uuid.Nil {
+		c.reply(msg.ID, errNoTarget)
 		return
 	}
 
@@ -150,46 +341,154 @@ func (c *Client) handleOffer(payload json.RawMessage) {
 	offer.FromDeviceID = c.deviceID
 
 	// Forward to target device
-	c.hub.ForwardToDevice(c.userID, offer.ToDeviceID, TypeOffer, offer)
+	c.reply(msg.ID, c.hub.ForwardToDevice(c.userID, offer.ToDeviceID, TypeOffer, offer))
 }
 
-func (c *Client) handleAnswer(payload json.RawMessage) {
+func (c *Client) handleAnswer(msg Message) {
 	var answer AnswerPayload
-	if err := json.Unmarshal(payload, &answer); err != nil {
-		c.sendError("INVALID_PAYLOAD", "invalid answer payload")
+	if err := c.codec.DecodePayload(msg.Payload, &answer); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid answer payload")
+		return
+	}
+	if answer.StreamID != nil {
+		c.handleSFUAnswer(msg, *answer.StreamID, answer.SDP)
+		return
+	}
+	if answer.ToDeviceID == uuid.Nil {
+		c.reply(msg.ID, errNoTarget)
 		return
 	}
 
 	answer.FromDeviceID = c.deviceID
 
 	// Forward to target device
-	c.hub.ForwardToDevice(c.userID, answer.ToDeviceID, TypeAnswer, answer)
+	c.reply(msg.ID, c.hub.ForwardToDevice(c.userID, answer.ToDeviceID, TypeAnswer, answer))
 }
 
-func (c *Client) handleCandidate(payload json.RawMessage) {
+func (c *Client) handleCandidate(msg Message) {
 	var candidate CandidatePayload
-	if err := json.Unmarshal(payload, &candidate); err != nil {
-		c.sendError("INVALID_PAYLOAD", "invalid candidate payload")
+	if err := c.codec.DecodePayload(msg.Payload, &candidate); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid candidate payload")
+		return
+	}
+	if candidate.StreamID != nil {
+		c.handleSFUCandidate(msg, candidate)
+		return
+	}
+	if candidate.ToDeviceID == uuid.Nil {
+		c.reply(msg.ID, errNoTarget)
 		return
 	}
 
 	candidate.FromDeviceID = c.deviceID
 
 	// Forward to target device
-	c.hub.ForwardToDevice(c.userID, candidate.ToDeviceID, TypeCandidate, candidate)
+	c.reply(msg.ID, c.hub.ForwardToDevice(c.userID, candidate.ToDeviceID, TypeCandidate, candidate))
 }
 
-func (c *Client) sendError(code, message string) {
-	msg, _ := NewErrorMessage(code, message)
-	c.send <- msg
+func (c *Client) handleVisibility(msg Message) {
+	var visibility VisibilityPayload
+	if err := c.codec.DecodePayload(msg.Payload, &visibility); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid visibility payload")
+		return
+	}
+
+	c.away.Store(!visibility.Visible)
+	if c.conn != nil {
+		c.conn.SetReadDeadline(time.Now().Add(c.readWait()))
+	}
+	c.hub.SetVisibility(c, visibility.Visible)
+	c.reply(msg.ID, nil)
 }
 
-// Send sends a message to the client
-func (c *Client) Send(data []byte) {
-	select {
-	case c.send <- data:
+func (c *Client) handleControlCapabilities(msg Message) {
+	var controls ControlCapabilities
+	if err := c.codec.DecodePayload(msg.Payload, &controls); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid capabilities payload")
+		return
+	}
+
+	c.hub.SetControls(c, controls)
+	c.reply(msg.ID, nil)
+}
+
+func (c *Client) handleControl(msg Message) {
+	cmd, _ := newControlCommand(msg.Type)
+	if err := c.codec.DecodePayload(msg.Payload, cmd); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid control payload")
+		return
+	}
+
+	cmd.setSender(c.deviceID)
+
+	// Validate against the target's capabilities and forward
+	c.reply(msg.ID, c.hub.ForwardControl(c.userID, msg.Type, cmd))
+}
+
+// reply reports the outcome of a request. Requests with an ID get an ack or
+// nack; failed requests without one get a plain error.
+func (c *Client) reply(id string, err error) {
+	var msg Message
+	switch {
+	case err == nil && id == "":
+		return
+	case err == nil:
+		msg, _ = NewAckMessage(id)
+	case id == "":
+		msg, _ = NewErrorMessage("", errorCode(err), err.Error())
 	default:
-		// Channel full, client is slow
-		slog.Warn("client send buffer full", "user_id", c.userID, "device_id", c.deviceID)
+		msg, _ = NewNackMessage(id, errorCode(err), err.Error())
+	}
+	c.Send(msg)
+}
+
+func (c *Client) sendError(id, code, message string) {
+	msg, _ := NewErrorMessage(id, code, message)
+	c.Send(msg)
+}
+
+// closeWith sends a close frame and drops the connection; ReadPump then
+// unregisters the client
+func (c *Client) closeWith(code int, reason string) {
+	slog.Warn("closing websocket", "code", code, "reason", reason, "user_id", c.userID, "device_id", c.deviceID)
+
+	if c.closing != nil {
+		select {
+		case c.closing <- closeFrame{Code: code, Reason: reason}:
+		default:
+		}
+		return
+	}
+
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+// Send encodes a message with the client's codec and queues it in its lane,
+// reporting false if it was dropped. It never blocks and is safe to call
+// after the client has gone. A client that keeps dropping messages without
+// catching up is disconnected. Events of features the client didn't ask for
+// are skipped as if sent.
+func (c *Client) Send(msg Message) bool {
+	if !c.wants(msg.Type) {
+		return true
+	}
+
+	data, err := c.codec.Encode(msg)
+	if err != nil {
+		slog.Error("failed to encode message", "error", err, "type", msg.Type, "codec", c.codec.Name())
+		return false
+	}
+
+	queued, drops := c.out.push(laneFor(msg), coalesceKey(msg), data)
+	if drops > 0 {
+		// Lane full, client is slow
+		slog.Warn("client send buffer full", "type", msg.Type, "drops", drops, "user_id", c.userID, "device_id", c.deviceID)
+		if c.out.tooSlow(drops) {
+			// Callers may hold the hub lock and closing can block on the write
+			go c.closeWith(CloseSlowConsumer, "too slow to keep up")
+		}
 	}
+	return queued
 }
@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols a client can negotiate with Sec-WebSocket-Protocol. Clients
+// that don't ask for one get JSON.
+const (
+	ProtocolJSON    = "streamz.json.v1"
+	ProtocolMsgpack = "streamz.msgpack.v1"
+)
+
+// Codec encodes message envelopes for one wire format
+type Codec interface {
+	// Subprotocol name negotiated at upgrade
+	Name() string
+
+	// WebSocket frame type the format is sent in
+	FrameType() int
+
+	// Encode serializes an outbound message
+	Encode(msg Message) ([]byte, error)
+
+	// Decode parses an inbound envelope. The payload is left in the codec's
+	// format for DecodePayload.
+	Decode(data []byte) (Message, error)
+
+	// DecodePayload unmarshals a payload returned by Decode
+	DecodePayload(payload []byte, v interface{}) error
+}
+
+// codecFor returns the codec for a negotiated subprotocol
+func codecFor(subprotocol string) Codec {
+	if subprotocol == ProtocolMsgpack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string   { return ProtocolJSON }
+func (jsonCodec) FrameType() int { return websocket.TextMessage }
+
+func (jsonCodec) Encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Decode(data []byte) (Message, error) {
+	var msg Message
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+func (jsonCodec) DecodePayload(payload []byte, v interface{}) error {
+	return json.Unmarshal(payload, v)
+}
+
+// msgpackCodec frames messages as MessagePack maps with the same keys as the
+// JSON protocol. UUIDs are sent as strings so both formats carry the same values.
+type msgpackCodec struct{}
+
+// msgpackEnvelope is the wire form of Message
+type msgpackEnvelope struct {
+	ID      string             `msgpack:"id,omitempty"`
+	Seq     uint64             `msgpack:"seq,omitempty"`
+	Type    string             `msgpack:"type"`
+	Payload msgpack.RawMessage `msgpack:"payload,omitempty"`
+}
+
+func init() {
+	msgpack.Register(uuid.UUID{},
+		func(e *msgpack.Encoder, v reflect.Value) error {
+			return e.EncodeString(v.Interface().(uuid.UUID).String())
+		},
+		func(d *msgpack.Decoder, v reflect.Value) error {
+			s, err := d.DecodeString()
+			if err != nil {
+				return err
+			}
+			id, err := uuid.Parse(s)
+			if err != nil {
+				return err
+			}
+			v.Set(reflect.ValueOf(id))
+			return nil
+		},
+	)
+}
+
+func (msgpackCodec) Name() string   { return ProtocolMsgpack }
+func (msgpackCodec) FrameType() int { return websocket.BinaryMessage }
+
+func (c msgpackCodec) Encode(msg Message) ([]byte, error) {
+	env := msgpackEnvelope{ID: msg.ID, Seq: msg.Seq, Type: msg.Type}
+
+	// Encode the original payload value when we have it; payloads that
+	// arrived as JSON (e.g. over the backplane) are converted
+	var payload interface{} = msg.value
+	if payload == nil && len(msg.Payload) > 0 {
+		var err error
+		if payload, err = jsonValue(msg.Payload); err != nil {
+			return nil, err
+		}
+	}
+	if payload != nil {
+		raw, err := c.marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = raw
+	}
+
+	return c.marshal(env)
+}
+
+func (msgpackCodec) Decode(data []byte) (Message, error) {
+	var env msgpackEnvelope
+	if err := msgpack.Unmarshal(data, &env); err != nil {
+		return Message{}, err
+	}
+	return Message{ID: env.ID, Seq: env.Seq, Type: env.Type, Payload: []byte(env.Payload)}, nil
+}
+
+func (msgpackCodec) DecodePayload(payload []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(payload))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// marshal encodes using json struct tags so payload structs need no msgpack tags
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonValue decodes JSON into generic values, keeping integers as integers
+func jsonValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return convertNumbers(v), nil
+}
+
+func convertNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = convertNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = convertNumbers(e)
+		}
+	}
+	return v
+}
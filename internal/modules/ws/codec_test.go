@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func testOffer() OfferPayload {
+	return OfferPayload{
+		FromDeviceID: uuid.New(),
+		ToDeviceID:   uuid.New(),
+		SDP:          "v=0\r\n" + strings.Repeat("a=candidate:1 1 udp 2122260223 192.168.1.2 54321 typ host\r\n", 20),
+	}
+}
+
+func TestMsgpackCodecRoundTrip(t *testing.T) {
+	codec := codecFor(ProtocolMsgpack)
+	offer := testOffer()
+
+	msg, err := newMessage("42", TypeOffer, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Seq = 7
+
+	// Messages relayed over the backplane only carry the JSON payload
+	var relayed Message
+	data, _ := json.Marshal(msg)
+	_ = json.Unmarshal(data, &relayed)
+
+	for name, m := range map[string]Message{"local": msg, "relayed": relayed} {
+		t.Run(name, func(t *testing.T) {
+			frame, err := codec.Encode(m)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+
+			decoded, err := codec.Decode(frame)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if decoded.ID != "42" || decoded.Seq != 7 || decoded.Type != TypeOffer {
+				t.Errorf("envelope = %+v", decoded)
+			}
+
+			var got OfferPayload
+			if err := codec.DecodePayload(decoded.Payload, &got); err != nil {
+				t.Fatalf("decode payload: %v", err)
+			}
+			if got != offer {
+				t.Errorf("payload = %+v, want %+v", got, offer)
+			}
+		})
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	if codecFor(ProtocolMsgpack).Name() != ProtocolMsgpack {
+		t.Errorf("msgpack not selected")
+	}
+	for _, p := range []string{"", ProtocolJSON, bearerProtocol} {
+		if codecFor(p).Name() != ProtocolJSON {
+			t.Errorf("subprotocol %q did not fall back to JSON", p)
+		}
+	}
+}
+
+func BenchmarkEncodeOffer(b *testing.B) {
+	msg, _ := NewMessage(TypeOffer, testOffer())
+	for _, codec := range []Codec{jsonCodec{}, msgpackCodec{}} {
+		b.Run(codec.Name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Encode(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
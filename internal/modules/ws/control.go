@@ -0,0 +1,202 @@
+package ws
+
+import (
+	"log/slog"
+
+	"github.com/google/uuid"
+)
+
+// Camera facings a source can advertise
+const (
+	FacingFront = "front"
+	FacingBack  = "back"
+)
+
+// ControlCapabilities are the remote controls a source device supports.
+// Sources advertise them with control:capabilities after connecting.
+type ControlCapabilities struct {
+	Cameras      []string `json:"cameras,omitempty" binding:"omitempty,dive,oneof=front back"`
+	Torch        bool     `json:"torch"`
+	MinZoom      float64  `json:"min_zoom,omitempty" binding:"omitempty,min=0"`
+	MaxZoom      float64  `json:"max_zoom,omitempty" binding:"omitempty,min=0"`
+	ExposureLock bool     `json:"exposure_lock"`
+}
+
+// ControlCapabilitiesPayload is broadcast when a device advertises its controls
+type ControlCapabilitiesPayload struct {
+	DeviceID uuid.UUID           `json:"device_id"`
+	Controls ControlCapabilities `json:"controls"`
+}
+
+// Remote control commands, sent from a monitor to a source device
+
+type ControlCameraPayload struct {
+	FromDeviceID uuid.UUID `json:"from_device_id"`
+	ToDeviceID   uuid.UUID `json:"to_device_id" binding:"required"`
+	Facing       string    `json:"facing" binding:"required,oneof=front back"`
+}
+
+type ControlTorchPayload struct {
+	FromDeviceID uuid.UUID `json:"from_device_id"`
+	ToDeviceID   uuid.UUID `json:"to_device_id" binding:"required"`
+	On           bool      `json:"on" binding:"required"`
+}
+
+type ControlZoomPayload struct {
+	FromDeviceID uuid.UUID `json:"from_device_id"`
+	ToDeviceID   uuid.UUID `json:"to_device_id" binding:"required"`
+	Factor       float64   `json:"factor" binding:"required"`
+}
+
+type ControlMicPayload struct {
+	FromDeviceID uuid.UUID `json:"from_device_id"`
+	ToDeviceID   uuid.UUID `json:"to_device_id" binding:"required"`
+	Muted        bool      `json:"muted" binding:"required"`
+}
+
+type ControlExposurePayload struct {
+	FromDeviceID uuid.UUID `json:"from_device_id"`
+	ToDeviceID   uuid.UUID `json:"to_device_id" binding:"required"`
+	Locked       bool      `json:"locked" binding:"required"`
+}
+
+// controlCommand is implemented by every control payload
+type controlCommand interface {
+	target() uuid.UUID
+	setSender(deviceID uuid.UUID)
+
+	// validate checks the command against the target's advertised controls
+	validate(device DeviceInfo) error
+}
+
+// newControlCommand returns an empty payload for a control message type
+func newControlCommand(msgType string) (controlCommand, bool) {
+	switch msgType {
+	case TypeControlCamera:
+		return &ControlCameraPayload{}, true
+	case TypeControlTorch:
+		return &ControlTorchPayload{}, true
+	case TypeControlZoom:
+		return &ControlZoomPayload{}, true
+	case TypeControlMic:
+		return &ControlMicPayload{}, true
+	case TypeControlExposure:
+		return &ControlExposurePayload{}, true
+	default:
+		return nil, false
+	}
+}
+
+func (p *ControlCameraPayload) target() uuid.UUID        { return p.ToDeviceID }
+func (p *ControlTorchPayload) target() uuid.UUID         { return p.ToDeviceID }
+func (p *ControlZoomPayload) target() uuid.UUID          { return p.ToDeviceID }
+func (p *ControlMicPayload) target() uuid.UUID           { return p.ToDeviceID }
+func (p *ControlExposurePayload) target() uuid.UUID      { return p.ToDeviceID }
+func (p *ControlCameraPayload) setSender(id uuid.UUID)   { p.FromDeviceID = id }
+func (p *ControlTorchPayload) setSender(id uuid.UUID)    { p.FromDeviceID = id }
+func (p *ControlZoomPayload) setSender(id uuid.UUID)     { p.FromDeviceID = id }
+func (p *ControlMicPayload) setSender(id uuid.UUID)      { p.FromDeviceID = id }
+func (p *ControlExposurePayload) setSender(id uuid.UUID) { p.FromDeviceID = id }
+
+func (p *ControlCameraPayload) validate(d DeviceInfo) error {
+	if !d.HasCamera || d.Controls == nil {
+		return ErrUnsupportedControl
+	}
+	for _, facing := range d.Controls.Cameras {
+		if facing == p.Facing {
+			return nil
+		}
+	}
+	return ErrUnsupportedControl
+}
+
+func (p *ControlTorchPayload) validate(d DeviceInfo) error {
+	if !d.HasCamera || d.Controls == nil || !d.Controls.Torch {
+		return ErrUnsupportedControl
+	}
+	return nil
+}
+
+func (p *ControlZoomPayload) validate(d DeviceInfo) error {
+	if !d.HasCamera || d.Controls == nil || d.Controls.MaxZoom <= 0 {
+		return ErrUnsupportedControl
+	}
+	if p.Factor < d.Controls.MinZoom || p.Factor > d.Controls.MaxZoom {
+		return ErrControlOutOfRange
+	}
+	return nil
+}
+
+func (p *ControlMicPayload) validate(d DeviceInfo) error {
+	if !d.HasMicrophone {
+		return ErrUnsupportedControl
+	}
+	return nil
+}
+
+func (p *ControlExposurePayload) validate(d DeviceInfo) error {
+	if !d.HasCamera || d.Controls == nil || !d.Controls.ExposureLock {
+		return ErrUnsupportedControl
+	}
+	return nil
+}
+
+// SetControls records the remote controls a connected device supports and
+// tells the user's other devices
+func (h *Hub) SetControls(client *Client, controls ControlCapabilities) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sessions[client.userID][client.deviceID]
+	if !ok || s.client != client {
+		return
+	}
+
+	// Replace rather than mutate; device list snapshots share the pointer
+	s.device.Controls = &controls
+
+	slog.Info("device controls advertised", "user_id", s.userID, "device_id", s.deviceID)
+
+	h.notifyUserLocked(s.userID, s.deviceID, TypeControlCapabilities, ControlCapabilitiesPayload{
+		DeviceID: s.deviceID,
+		Controls: controls,
+	})
+
+	if h.backplane != nil {
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventControls,
+			UserID:   s.userID,
+			DeviceID: s.deviceID,
+			Epoch:    s.epoch,
+			Device:   s.device,
+		})
+	}
+}
+
+// ForwardControl validates a control command against the target device's
+// capabilities and forwards it
+func (h *Hub) ForwardControl(userID uuid.UUID, msgType string, cmd controlCommand) error {
+	target, err := h.deviceInfo(userID, cmd.target())
+	if err != nil {
+		return err
+	}
+	if err := cmd.validate(target); err != nil {
+		return err
+	}
+	return h.ForwardToDevice(userID, cmd.target(), msgType, cmd)
+}
+
+// deviceInfo returns a connected device of the user, local or remote
+func (h *Hub) deviceInfo(userID, deviceID uuid.UUID) (DeviceInfo, error) {
+	h.mu.RLock()
+	if s, ok := h.sessions[userID][deviceID]; ok && s.device != nil {
+		h.mu.RUnlock()
+		return *s.device, nil
+	}
+	rd, ok := h.remote[userID][deviceID]
+	h.mu.RUnlock()
+	if ok {
+		return rd.device, nil
+	}
+	return DeviceInfo{}, h.unreachable(userID, deviceID)
+}
@@ -0,0 +1,93 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestForwardControl(t *testing.T) {
+	h := newTestHub(t, Config{ReplayBufferSize: 8})
+	userID := uuid.New()
+	monitor := h.device(userID)
+	phone := h.device(userID)
+	phone.device.HasCamera = true
+	stranger := h.device(uuid.New())
+	h.connect(t, monitor, phone)
+
+	// Nothing advertised yet
+	err := h.ForwardControl(userID, TypeControlTorch, &ControlTorchPayload{ToDeviceID: phone.deviceID, On: true})
+	if err != ErrUnsupportedControl {
+		t.Fatalf("torch before capabilities: got %v, want %v", err, ErrUnsupportedControl)
+	}
+
+	h.SetControls(phone, ControlCapabilities{
+		Cameras: []string{FacingBack},
+		Torch:   true,
+		MinZoom: 1,
+		MaxZoom: 5,
+	})
+	waitFor(t, monitor, TypeControlCapabilities)
+
+	tests := []struct {
+		name    string
+		msgType string
+		cmd     controlCommand
+		want    error
+	}{
+		{"advertised camera", TypeControlCamera, &ControlCameraPayload{Facing: FacingBack}, nil},
+		{"missing camera", TypeControlCamera, &ControlCameraPayload{Facing: FacingFront}, ErrUnsupportedControl},
+		{"torch", TypeControlTorch, &ControlTorchPayload{On: true}, nil},
+		{"zoom in range", TypeControlZoom, &ControlZoomPayload{Factor: 2.5}, nil},
+		{"zoom out of range", TypeControlZoom, &ControlZoomPayload{Factor: 10}, ErrControlOutOfRange},
+		{"no microphone", TypeControlMic, &ControlMicPayload{Muted: true}, ErrUnsupportedControl},
+		{"exposure not advertised", TypeControlExposure, &ControlExposurePayload{Locked: true}, ErrUnsupportedControl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := tt.cmd
+			cmd.setSender(monitor.deviceID)
+			switch c := cmd.(type) {
+			case *ControlCameraPayload:
+				c.ToDeviceID = phone.deviceID
+			case *ControlTorchPayload:
+				c.ToDeviceID = phone.deviceID
+			case *ControlZoomPayload:
+				c.ToDeviceID = phone.deviceID
+			case *ControlMicPayload:
+				c.ToDeviceID = phone.deviceID
+			case *ControlExposurePayload:
+				c.ToDeviceID = phone.deviceID
+			}
+
+			if err := h.ForwardControl(userID, tt.msgType, cmd); err != tt.want {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				return
+			}
+
+			msg := waitFor(t, phone, tt.msgType)
+			var got struct {
+				FromDeviceID uuid.UUID `json:"from_device_id"`
+			}
+			_ = json.Unmarshal(msg.Payload, &got)
+			if got.FromDeviceID != monitor.deviceID {
+				t.Errorf("from_device_id = %s, want %s", got.FromDeviceID, monitor.deviceID)
+			}
+		})
+	}
+
+	// Devices in another account can't be controlled, connected or not
+	err = h.ForwardControl(stranger.userID, TypeControlTorch, &ControlTorchPayload{ToDeviceID: phone.deviceID, On: true})
+	if err != ErrForbidden {
+		t.Errorf("control from another account: got %v, want %v", err, ErrForbidden)
+	}
+	h.connect(t, stranger)
+
+	err = h.ForwardControl(stranger.userID, TypeControlTorch, &ControlTorchPayload{ToDeviceID: phone.deviceID, On: true})
+	if err != ErrForbidden {
+		t.Errorf("control from another connected account: got %v, want %v", err, ErrForbidden)
+	}
+}
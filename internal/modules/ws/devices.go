@@ -0,0 +1,107 @@
+package ws
+
+import (
+	"log/slog"
+
+	"github.com/google/uuid"
+)
+
+// CloseDeviceRemoved is the close code sent to a device's connection when the
+// device is deleted. Clients should not reconnect after receiving it.
+const CloseDeviceRemoved = 4001
+
+// UpdateDevice applies a change to a device's name or capabilities and tells
+// the user's devices. The device doesn't need to be connected.
+func (h *Hub) UpdateDevice(userID, deviceID uuid.UUID, name string, hasCamera, hasMicrophone bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	update := DeviceInfo{
+		ID:            deviceID,
+		DeviceName:    name,
+		HasCamera:     hasCamera,
+		HasMicrophone: hasMicrophone,
+	}
+	h.applyDeviceUpdateLocked(userID, update)
+
+	if h.backplane != nil {
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventUpdated,
+			UserID:   userID,
+			DeviceID: deviceID,
+			Device:   &update,
+		})
+	}
+}
+
+// applyDeviceUpdateLocked updates whichever copy of the device this instance
+// holds and notifies the user's sessions here (caller must hold lock)
+func (h *Hub) applyDeviceUpdateLocked(userID uuid.UUID, update DeviceInfo) {
+	if s, ok := h.sessions[userID][update.ID]; ok {
+		s.device.DeviceName = update.DeviceName
+		s.device.HasCamera = update.HasCamera
+		s.device.HasMicrophone = update.HasMicrophone
+	}
+	if rd, ok := h.remote[userID][update.ID]; ok {
+		rd.device.DeviceName = update.DeviceName
+		rd.device.HasCamera = update.HasCamera
+		rd.device.HasMicrophone = update.HasMicrophone
+	}
+
+	h.notifyUserLocked(userID, uuid.Nil, TypeDeviceUpdated, DeviceUpdatedPayload{
+		DeviceID:      update.ID,
+		DeviceName:    update.DeviceName,
+		HasCamera:     update.HasCamera,
+		HasMicrophone: update.HasMicrophone,
+	})
+}
+
+// RemoveDevice tells the user's devices a device was deleted and disconnects
+// it, wherever in the cluster it is connected
+func (h *Hub) RemoveDevice(userID, deviceID uuid.UUID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.removeDeviceLocked(userID, deviceID)
+
+	if h.backplane != nil {
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventRemoved,
+			UserID:   userID,
+			DeviceID: deviceID,
+		})
+	}
+}
+
+// removeDeviceLocked notifies the user's sessions here and ends the device's
+// session if it has one here (caller must hold lock)
+func (h *Hub) removeDeviceLocked(userID, deviceID uuid.UUID) {
+	h.notifyUserLocked(userID, deviceID, TypeDeviceRemoved, DeviceRemovedPayload{
+		DeviceID: deviceID,
+	})
+
+	s, ok := h.sessions[userID][deviceID]
+	if !ok {
+		return
+	}
+
+	slog.Info("disconnecting removed device", "user_id", userID, "device_id", deviceID)
+	h.terminateLocked(s, CloseDeviceRemoved, "device removed")
+}
+
+// terminateLocked closes a session's connection with the given code and ends
+// the session without a grace window (caller must hold lock)
+func (h *Hub) terminateLocked(s *session, code int, reason string) {
+	if s.client == nil {
+		// Waiting out the grace window; nothing to close
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+		h.endSessionLocked(s)
+		return
+	}
+
+	// The session ends once ReadPump unregisters the closed connection
+	s.terminated = true
+	go s.client.closeWith(code, reason)
+}
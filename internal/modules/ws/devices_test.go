@@ -0,0 +1,71 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestUpdateDevice(t *testing.T) {
+	h := newTestHub(t, Config{ReplayBufferSize: 8})
+	userID := uuid.New()
+	monitor := h.device(userID)
+	phone := h.device(userID)
+	h.connect(t, monitor, phone)
+
+	h.UpdateDevice(userID, phone.deviceID, "Kitchen", true, false)
+
+	var got DeviceUpdatedPayload
+	if err := json.Unmarshal(waitFor(t, monitor, TypeDeviceUpdated).Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.DeviceID != phone.deviceID || got.DeviceName != "Kitchen" || !got.HasCamera {
+		t.Fatalf("device:updated = %+v", got)
+	}
+
+	// Later device lists carry the new name
+	for _, d := range h.GetOnlineDevices(userID) {
+		if d.ID == phone.deviceID && d.DeviceName != "Kitchen" {
+			t.Fatalf("device list name = %q, want Kitchen", d.DeviceName)
+		}
+	}
+}
+
+func TestRemoveDeviceInGraceWindow(t *testing.T) {
+	offline := make(chan uuid.UUID, 1)
+	h := newTestHub(t, Config{ResumeGrace: time.Minute, ReplayBufferSize: 8}, func(h *Hub) {
+		h.onOffline = func(userID, deviceID uuid.UUID, epoch int64) { offline <- deviceID }
+	})
+	userID := uuid.New()
+	monitor := h.device(userID)
+	phone := h.device(userID)
+	h.connect(t, monitor, phone)
+
+	// Dropped connection; the session waits for a resume
+	h.drop(t, phone)
+	waitFor(t, monitor, TypeDevicePresence)
+
+	h.RemoveDevice(userID, phone.deviceID)
+
+	var removed DeviceRemovedPayload
+	if err := json.Unmarshal(waitFor(t, monitor, TypeDeviceRemoved).Payload, &removed); err != nil {
+		t.Fatal(err)
+	}
+	if removed.DeviceID != phone.deviceID {
+		t.Fatalf("device:removed for %s, want %s", removed.DeviceID, phone.deviceID)
+	}
+	if h.IsDeviceOnline(userID, phone.deviceID) {
+		t.Fatal("removed device still online")
+	}
+
+	select {
+	case id := <-offline:
+		if id != phone.deviceID {
+			t.Fatalf("offline callback for %s", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not end without waiting out the grace window")
+	}
+}
@@ -0,0 +1,16 @@
+package ws
+
+import "github.com/google/uuid"
+
+// Request DTOs
+
+type TicketRequest struct {
+	DeviceID uuid.UUID `json:"device_id" binding:"required"`
+}
+
+// Response DTOs
+
+type TicketResponse struct {
+	Ticket    string `json:"ticket"`
+	ExpiresAt int64  `json:"expires_at"`
+}
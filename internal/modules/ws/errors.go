@@ -0,0 +1,84 @@
+package ws
+
+import (
+	"errors"
+
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+)
+
+// Error codes sent in error and nack payloads
+const (
+	CodeInvalidMessage = "INVALID_MESSAGE"
+	CodeInvalidPayload = "INVALID_PAYLOAD"
+	CodeUnknownType    = "UNKNOWN_TYPE"
+	CodePeerOffline    = "PEER_OFFLINE"
+	CodePeerBusy       = "PEER_BUSY"
+	CodeForbidden      = "FORBIDDEN"
+	CodeUnauthorized   = "UNAUTHORIZED"
+	CodeRateLimited    = "RATE_LIMITED"
+	CodeTooLarge       = "MESSAGE_TOO_LARGE"
+	CodeUnsupported    = "UNSUPPORTED_CONTROL"
+	CodeInternal       = "INTERNAL_ERROR"
+)
+
+// Routing errors returned by the hub
+var (
+	ErrPeerOffline = errors.New("target device is offline")
+	ErrPeerBusy    = errors.New("target device is not keeping up, retry later")
+	ErrForbidden   = errors.New("target device not in account")
+)
+
+// Control command errors
+var (
+	ErrUnsupportedControl = errors.New("target device does not support this control")
+	ErrControlOutOfRange  = errors.New("control value out of range for target device")
+)
+
+// ErrTelemetryInvalid is returned for telemetry with out-of-range values
+var ErrTelemetryInvalid = errors.New("invalid telemetry values")
+
+// ErrPayloadInvalid is wrapped by errors for payloads that don't match their
+// message type's schema
+var ErrPayloadInvalid = errors.New("invalid payload")
+
+// ErrUnexpectedHello is returned for a hello that isn't a connection's first message
+var ErrUnexpectedHello = errors.New("hello must be the first message on a connection")
+
+// Re-authentication errors
+var (
+	ErrTokenInvalid = errors.New("invalid or expired token")
+	ErrTokenUser    = errors.New("token issued for another user")
+)
+
+// Message policy errors
+var (
+	ErrRateLimited     = errors.New("too many messages of this type, slow down")
+	ErrMessageTooLarge = errors.New("message too large for its type")
+)
+
+// errorCode returns the protocol error code for an error
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrPeerOffline):
+		return CodePeerOffline
+	case errors.Is(err, ErrPeerBusy):
+		return CodePeerBusy
+	case errors.Is(err, ErrForbidden):
+		return CodeForbidden
+	case errors.Is(err, ErrUnsupportedControl):
+		return CodeUnsupported
+	case errors.Is(err, ErrControlOutOfRange), errors.Is(err, ErrTelemetryInvalid), errors.Is(err, ErrPayloadInvalid):
+		return CodeInvalidPayload
+	case errors.Is(err, ErrTokenInvalid), errors.Is(err, ErrTokenUser):
+		return CodeUnauthorized
+	case errors.Is(err, ErrUnexpectedHello):
+		return CodeInvalidMessage
+	case errors.Is(err, ErrRateLimited):
+		return CodeRateLimited
+	case errors.Is(err, ErrMessageTooLarge):
+		return CodeTooLarge
+	default:
+		// Errors from services called on the client's behalf use the REST codes
+		return apperr.ErrorCode(err)
+	}
+}
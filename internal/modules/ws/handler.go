@@ -2,136 +2,504 @@ package ws
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/vkrishna03/streamz/db/sqlc"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
 	"github.com/vkrishna03/streamz/internal/middleware"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// TODO: Implement proper origin checking in production
-		return true
-	},
+// Browsers can't set an Authorization header on a WebSocket, so a client may
+// instead offer the subprotocols "bearer" and "<access token>". The server
+// selects "bearer" and never echoes the token back.
+const bearerProtocol = "bearer"
+
+// Config holds WebSocket module settings
+type Config struct {
+	JWTSecret        string
+	TicketTTL        time.Duration
+	AllowedOrigins   []string
+	ResumeGrace      time.Duration
+	ReplayBufferSize int
+
+	// How long a client that reported itself hidden may go without
+	// answering pings (backgrounded mobile tabs are throttled)
+	AwayTimeout time.Duration
+
+	// How many messages a client may drop because it isn't reading fast
+	// enough before it's disconnected; 0 never disconnects
+	SlowClientDrops int
+
+	// Per-type rate and size limits applied to every connection
+	Limits Limits
+
+	// Clients speaking an older protocol version are closed with
+	// CloseUpgradeRequired; clients that connect with ?hello=1 but don't
+	// send hello within HelloTimeout are taken to speak version 1, like
+	// those without the flag. ServerVersion is reported in welcome.
+	MinProtocolVersion int
+	HelloTimeout       time.Duration
+	ServerVersion      string
+
+	// Backplane is "postgres" to share the hub across instances, or empty
+	// to run standalone. InstanceID must be unique per running instance.
+	Backplane  string
+	InstanceID string
+}
+
+// queries is the part of sqlc.Queries the handler uses
+type queries interface {
+	GetDeviceByID(ctx context.Context, id uuid.UUID) (sqlc.Device, error)
+
+	CreateWSTicket(ctx context.Context, arg sqlc.CreateWSTicketParams) (sqlc.WsTicket, error)
+	ConsumeWSTicket(ctx context.Context, ticket string) (sqlc.WsTicket, error)
+	DeleteExpiredWSTickets(ctx context.Context) error
+
+	ClaimDevicePresence(ctx context.Context, id uuid.UUID) (int64, error)
+	ReleaseDevicePresence(ctx context.Context, arg sqlc.ReleaseDevicePresenceParams) (int64, error)
+	SetDevicePresence(ctx context.Context, arg sqlc.SetDevicePresenceParams) (int64, error)
+	ResetStaleDevicePresence(ctx context.Context, ttlSeconds int32) (int64, error)
+
+	CreateTelemetrySample(ctx context.Context, arg sqlc.CreateTelemetrySampleParams) (sqlc.TelemetrySample, error)
+	DeleteTelemetrySamplesBefore(ctx context.Context, recordedAt time.Time) (int64, error)
 }
 
 // Handler handles WebSocket connections
 type Handler struct {
-	hub *Hub
-	db  *sql.DB
-	q   *sqlc.Queries
+	hub      *Hub
+	db       *sql.DB
+	q        queries
+	cfg      Config
+	origins  *middleware.Origins
+	upgrader websocket.Upgrader
 }
 
 // NewHandler creates a new WebSocket handler
-func NewHandler(hub *Hub, db *sql.DB) *Handler {
+func NewHandler(hub *Hub, db *sql.DB, cfg Config) *Handler {
+	if cfg.Limits.Policies == nil {
+		cfg.Limits = DefaultLimits()
+	}
+	if cfg.HelloTimeout <= 0 {
+		cfg.HelloTimeout = defaultHelloTimeout
+	}
+	origins := middleware.NewOrigins(cfg.AllowedOrigins)
+
 	return &Handler{
-		hub: hub,
-		db:  db,
-		q:   sqlc.New(db),
+		hub:     hub,
+		db:      db,
+		q:       sqlc.New(db),
+		cfg:     cfg,
+		origins: origins,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			// In order of preference; the first one the client offers wins
+			Subprotocols: []string{ProtocolMsgpack, ProtocolJSON, bearerProtocol},
+			CheckOrigin: func(r *http.Request) bool {
+				return origins.Allowed(r.Header.Get("Origin"))
+			},
+		},
 	}
 }
 
-// HandleWebSocket handles the WebSocket upgrade and connection
-func (h *Handler) HandleWebSocket(c *gin.Context) {
-	// Get user ID from auth middleware
+// IssueTicket issues a short-lived, single-use ticket for connecting a device to /ws
+func (h *Handler) IssueTicket(c *gin.Context) {
 	userID, ok := middleware.GetUserID(c)
 	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-		return
-	}
-
-	// Get device ID from query param
-	deviceIDStr := c.Query("device_id")
-	if deviceIDStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "device_id query parameter required"})
+		apperr.Response(c, apperr.ErrUnauthorized)
 		return
 	}
 
-	deviceID, err := uuid.Parse(deviceIDStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_id"})
+	var req TicketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid request: %s", err.Error()))
 		return
 	}
 
 	// Verify device belongs to user
-	device, err := h.q.GetDeviceByID(c.Request.Context(), deviceID)
+	device, err := h.q.GetDeviceByID(c.Request.Context(), req.DeviceID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "device not found"})
+			apperr.Response(c, apperr.Wrap(apperr.ErrNotFound, "device not found"))
 			return
 		}
-		slog.Error("failed to get device", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		apperr.Response(c, apperr.Wrap(apperr.ErrInternal, "failed to get device"))
 		return
 	}
 
 	if device.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "device not owned by user"})
+		apperr.Response(c, apperr.Wrap(apperr.ErrForbidden, "device not owned by user"))
+		return
+	}
+
+	ticket, err := generateTicket()
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrInternal, "failed to generate ticket"))
+		return
+	}
+
+	// Opportunistically clear out tickets that were never redeemed
+	_ = h.q.DeleteExpiredWSTickets(c.Request.Context())
+
+	expiresAt := time.Now().Add(h.cfg.TicketTTL)
+	_, err = h.q.CreateWSTicket(c.Request.Context(), sqlc.CreateWSTicketParams{
+		UserID:    userID,
+		DeviceID:  device.ID,
+		Ticket:    ticket,
+		ExpiresAt: expiresAt,
+
+		// The connection inherits the expiry of the token that asked for it
+		AccessExpiresAt: middleware.GetTokenExpiry(c),
+	})
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrInternal, "failed to create ticket"))
+		return
+	}
+
+	c.JSON(http.StatusCreated, TicketResponse{
+		Ticket:    ticket,
+		ExpiresAt: expiresAt.Unix(),
+	})
+}
+
+// HandleWebSocket handles the WebSocket upgrade and connection
+func (h *Handler) HandleWebSocket(c *gin.Context) {
+	// Reject cross-site upgrades before touching credentials
+	// (the CORS middleware has already logged the rejection)
+	if !h.origins.Allowed(c.GetHeader("Origin")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+		return
+	}
+
+	if h.hub.Draining() {
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is restarting"})
+		return
+	}
+
+	userID, deviceID, authExpiry, err := h.authenticate(c)
+	if err != nil {
+		c.JSON(apperr.Code(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceInfo, err := h.loadDevice(c.Request.Context(), userID, deviceID)
+	if err != nil {
+		c.JSON(apperr.Code(err), gin.H{"error": err.Error()})
 		return
 	}
 
 	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		slog.Error("websocket upgrade failed", "error", err)
+		slog.Error("websocket upgrade failed",
+			"error", err,
+			"origin", c.GetHeader("Origin"),
+			"request_id", c.GetString("request_id"),
+		)
+		return
+	}
+
+	// Create client
+	client := NewClient(h.hub, conn, userID, deviceID, deviceInfo)
+	client.codec = codecFor(conn.Subprotocol())
+	client.limiter = newMessageLimiter(h.cfg.Limits)
+	client.authExpiry = authExpiry
+	client.resume = resumeRequest{token: c.Query("resume")}
+	if lastSeq, err := strconv.ParseUint(c.Query("last_seq"), 10, 64); err == nil {
+		client.resume.lastSeq = lastSeq
+	}
+
+	// Start pumps (the hub marks the device offline once its session ends).
+	// ReadPump hands its first frame to the handshake and waits until the
+	// client is registered or turned away.
+	client.hello = make(chan []byte, 1)
+	client.ready = make(chan struct{})
+	defer close(client.ready)
+	go client.WritePump()
+	go client.ReadPump()
+
+	// Only clients that announce hello with ?hello=1 are waited for; the
+	// rest speak version 1 and are registered right away
+	var helloTimeout time.Duration
+	if c.Query("hello") == "1" {
+		helloTimeout = h.cfg.HelloTimeout
+	}
+	if err := client.handshake(helloTimeout, h.cfg.MinProtocolVersion); err != nil {
+		return
+	}
+
+	if err := h.prepareClient(c.Request.Context(), client); err != nil {
+		client.out.close()
+		conn.Close()
 		return
 	}
 
-	// Create device info
-	deviceInfo := &DeviceInfo{
+	// Register client
+	h.hub.register <- client
+	client.accepted = true
+}
+
+// loadDevice checks a device belongs to the user and returns its info for
+// the hub
+func (h *Handler) loadDevice(ctx context.Context, userID, deviceID uuid.UUID) (*DeviceInfo, error) {
+	device, err := h.q.GetDeviceByID(ctx, deviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, apperr.Wrap(apperr.ErrNotFound, "device not found")
+		}
+		slog.Error("failed to get device", "error", err)
+		return nil, apperr.Wrap(apperr.ErrInternal, "internal error")
+	}
+
+	if device.UserID != userID {
+		return nil, apperr.Wrap(apperr.ErrForbidden, "device not owned by user")
+	}
+
+	info := &DeviceInfo{
 		ID:         device.ID,
 		DeviceID:   device.DeviceID,
 		DeviceName: device.DeviceName,
 		DeviceType: string(device.DeviceType),
 		IsOnline:   true,
+		Presence:   PresenceOnline,
 	}
 	if device.HasCamera.Valid {
-		deviceInfo.HasCamera = device.HasCamera.Bool
+		info.HasCamera = device.HasCamera.Bool
 	}
 	if device.HasMicrophone.Valid {
-		deviceInfo.HasMicrophone = device.HasMicrophone.Bool
+		info.HasMicrophone = device.HasMicrophone.Bool
 	}
+	return info, nil
+}
 
-	// Create client
-	client := NewClient(h.hub, conn, userID, deviceID, deviceInfo)
+// prepareClient loads what a new client needs before it is registered
+func (h *Handler) prepareClient(ctx context.Context, client *Client) error {
+	// Unread counts go out with the initial device list
+	if h.hub.chat != nil {
+		var err error
+		client.unread, err = h.hub.chat.UnreadCounts(ctx, client.userID, client.deviceID)
+		if err != nil {
+			slog.Error("failed to count unread messages", "error", err, "device_id", client.deviceID)
+		}
+	}
 
-	// Register client
-	h.hub.register <- client
+	// Mark the device online under a fresh epoch, which orders this
+	// connection's presence writes after those of any earlier one
+	epoch, err := h.q.ClaimDevicePresence(ctx, client.deviceID)
+	if err != nil {
+		slog.Error("failed to claim device presence", "error", err, "device_id", client.deviceID)
+		return err
+	}
+	client.epoch = epoch
+	return nil
+}
 
-	// Update device online status in DB
-	_ = h.q.UpdateDeviceOnlineStatus(c.Request.Context(), sqlc.UpdateDeviceOnlineStatusParams{
-		ID:       deviceID,
-		IsOnline: sql.NullBool{Bool: true, Valid: true},
+// markOffline records that a device's session has ended. The write is a
+// no-op if a newer connection has claimed the device since.
+func (h *Handler) markOffline(userID, deviceID uuid.UUID, epoch int64) {
+	n, err := h.q.ReleaseDevicePresence(context.Background(), sqlc.ReleaseDevicePresenceParams{
+		ID:            deviceID,
+		PresenceEpoch: epoch,
 	})
+	if err != nil {
+		slog.Error("failed to mark device offline", "error", err, "device_id", deviceID)
+		return
+	}
+	if n == 0 {
+		slog.Debug("offline write superseded by newer connection", "device_id", deviceID, "epoch", epoch)
+	}
+}
 
-	// Start pumps
-	go client.WritePump()
-	go func() {
-		client.ReadPump()
-		// When ReadPump exits, mark device offline
-		_ = h.q.UpdateDeviceOnlineStatus(context.Background(), sqlc.UpdateDeviceOnlineStatusParams{
-			ID:       deviceID,
-			IsOnline: sql.NullBool{Bool: false, Valid: true},
-		})
-	}()
+// deviceOwner returns the user a device belongs to, uuid.Nil if it doesn't
+// exist
+func (h *Handler) deviceOwner(ctx context.Context, deviceID uuid.UUID) (uuid.UUID, error) {
+	device, err := h.q.GetDeviceByID(ctx, deviceID)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, nil
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return device.UserID, nil
+}
+
+// savePresence records a connected device's presence state
+func (h *Handler) savePresence(userID, deviceID uuid.UUID, epoch int64, presence string) {
+	_, err := h.q.SetDevicePresence(context.Background(), sqlc.SetDevicePresenceParams{
+		ID:            deviceID,
+		PresenceEpoch: epoch,
+		Presence:      sqlc.PresenceState(presence),
+	})
+	if err != nil {
+		slog.Error("failed to save device presence", "error", err, "device_id", deviceID)
+	}
+}
+
+// saveTelemetry records a telemetry sample
+func (h *Handler) saveTelemetry(deviceID uuid.UUID, t Telemetry, alerts []string) {
+	if alerts == nil {
+		alerts = []string{}
+	}
+	raw, _ := json.Marshal(alerts)
+
+	ctx := context.Background()
+	_, err := h.q.CreateTelemetrySample(ctx, sqlc.CreateTelemetrySampleParams{
+		DeviceID:      deviceID,
+		BatteryLevel:  int16(t.BatteryLevel),
+		Charging:      t.Charging,
+		ThermalState:  t.ThermalState,
+		FreeStorageMb: t.FreeStorageMB,
+		NetworkType:   t.NetworkType,
+		Alerts:        raw,
+	})
+	if err != nil {
+		slog.Error("failed to save telemetry", "error", err, "device_id", deviceID)
+	}
+}
+
+// pruneTelemetry deletes every device's samples recorded before the cutoff
+func (h *Handler) pruneTelemetry(ctx context.Context, before time.Time) {
+	n, err := h.q.DeleteTelemetrySamplesBefore(ctx, before)
+	if err != nil {
+		slog.Error("failed to prune telemetry", "error", err)
+		return
+	}
+	if n > 0 {
+		slog.Info("pruned telemetry samples", "count", n)
+	}
+}
+
+// reconcilePresence clears is_online for devices left online by a previous
+// run (or a crashed instance) that no live instance still holds
+func (h *Handler) reconcilePresence(ctx context.Context) {
+	n, err := h.q.ResetStaleDevicePresence(ctx, int32((3 * backplaneHeartbeat).Seconds()))
+	if err != nil {
+		slog.Error("failed to reconcile device presence", "error", err)
+		return
+	}
+	slog.Info("reconciled device presence", "reset", n)
+}
+
+// authenticate resolves the user and device for an upgrade request, and when
+// the credentials stop being valid. Credentials are checked in order:
+// ?ticket=, Authorization header, then the "bearer" subprotocol.
+func (h *Handler) authenticate(c *gin.Context) (uuid.UUID, uuid.UUID, time.Time, error) {
+	if ticket := c.Query("ticket"); ticket != "" {
+		return h.redeemTicket(c, ticket)
+	}
+
+	tokenString, ok := middleware.BearerToken(c.GetHeader("Authorization"))
+	if !ok {
+		tokenString, ok = subprotocolToken(c.Request)
+	}
+	if !ok {
+		return uuid.Nil, uuid.Nil, time.Time{}, apperr.Wrap(apperr.ErrUnauthorized, "missing credentials")
+	}
+
+	claims, err := middleware.ParseToken(h.cfg.JWTSecret, tokenString)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, time.Time{}, apperr.Wrap(apperr.ErrUnauthorized, "%s", err.Error())
+	}
+
+	// Get device ID from query param
+	deviceIDStr := c.Query("device_id")
+	if deviceIDStr == "" {
+		return uuid.Nil, uuid.Nil, time.Time{}, apperr.Wrap(apperr.ErrValidation, "device_id query parameter required")
+	}
+
+	deviceID, err := uuid.Parse(deviceIDStr)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, time.Time{}, apperr.Wrap(apperr.ErrValidation, "invalid device_id")
+	}
+
+	return claims.UserID, deviceID, claims.ExpiresAt, nil
+}
+
+// redeemTicket consumes a connection ticket. Tickets are bound to the device
+// they were issued for; device_id may be omitted but must match if given.
+func (h *Handler) redeemTicket(c *gin.Context, ticket string) (uuid.UUID, uuid.UUID, time.Time, error) {
+	t, err := h.q.ConsumeWSTicket(c.Request.Context(), ticket)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return uuid.Nil, uuid.Nil, time.Time{}, apperr.Wrap(apperr.ErrUnauthorized, "invalid or expired ticket")
+		}
+		slog.Error("failed to consume ws ticket", "error", err)
+		return uuid.Nil, uuid.Nil, time.Time{}, apperr.Wrap(apperr.ErrInternal, "internal error")
+	}
+
+	if deviceIDStr := c.Query("device_id"); deviceIDStr != "" {
+		deviceID, err := uuid.Parse(deviceIDStr)
+		if err != nil || deviceID != t.DeviceID {
+			return uuid.Nil, uuid.Nil, time.Time{}, apperr.Wrap(apperr.ErrForbidden, "ticket not issued for this device")
+		}
+	}
+
+	return t.UserID, t.DeviceID, t.AccessExpiresAt, nil
+}
+
+// subprotocolToken extracts the access token following "bearer" in Sec-WebSocket-Protocol
+func subprotocolToken(r *http.Request) (string, bool) {
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == bearerProtocol && i+1 < len(protocols) {
+			return protocols[i+1], true
+		}
+	}
+	return "", false
+}
+
+func generateTicket() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
 }
 
 // Setup registers WebSocket routes and returns the hub
-func Setup(router *gin.Engine, db *sql.DB, jwtSecret string) *Hub {
-	hub := NewHub()
-	handler := NewHandler(hub, db)
-
-	// WebSocket endpoint (requires auth via query param token or header)
-	ws := router.Group("/ws")
-	ws.Use(middleware.Auth(jwtSecret))
-	ws.GET("", handler.HandleWebSocket)
+func Setup(router *gin.Engine, api *gin.RouterGroup, db *sql.DB, cfg Config) *Hub {
+	hub := NewHub(cfg)
+	handler := NewHandler(hub, db, cfg)
+	hub.onOffline = handler.markOffline
+	hub.onPresence = handler.savePresence
+	hub.onTelemetry = handler.saveTelemetry
+	hub.onPruneTelemetry = handler.pruneTelemetry
+	hub.deviceOwner = handler.deviceOwner
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	handler.reconcilePresence(ctx)
+	cancel()
+
+	if cfg.Backplane == "postgres" {
+		hub.backplane = NewPostgresBackplane(db, cfg.InstanceID, 3*backplaneHeartbeat)
+		slog.Info("websocket backplane enabled", "backend", cfg.Backplane, "instance_id", cfg.InstanceID)
+	}
+
+	// WebSocket endpoint (authenticates via ticket, header or subprotocol)
+	router.GET("/ws", handler.HandleWebSocket)
+
+	// AsyncAPI description of the protocol
+	api.GET("/ws/spec", handler.Spec)
+
+	// Ticket endpoint for browser clients
+	r := api.Group("/ws")
+	r.Use(middleware.Auth(cfg.JWTSecret))
+	r.POST("/ticket", handler.IssueTicket)
+
+	// Server-Sent Events fallback for clients that can't open a WebSocket
+	api.GET("/events", handler.HandleEvents)
+	api.POST("/events", middleware.Auth(cfg.JWTSecret), handler.PostEvent)
 
 	return hub
 }
@@ -0,0 +1,414 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/vkrishna03/streamz/db/sqlc"
+	"github.com/vkrishna03/streamz/internal/middleware"
+)
+
+const testOrigin = "https://app.streamz.test"
+
+// fakeQueries keeps devices and tickets in memory with the same semantics as
+// the SQL queries
+type fakeQueries struct {
+	mu      sync.Mutex
+	devices map[uuid.UUID]sqlc.Device
+	tickets map[string]sqlc.WsTicket
+	epoch   int64
+}
+
+func newFakeQueries() *fakeQueries {
+	return &fakeQueries{
+		devices: make(map[uuid.UUID]sqlc.Device),
+		tickets: make(map[string]sqlc.WsTicket),
+	}
+}
+
+func (f *fakeQueries) addDevice(userID uuid.UUID) uuid.UUID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := uuid.New()
+	f.devices[id] = sqlc.Device{ID: id, UserID: userID, DeviceName: "phone", DeviceType: sqlc.DeviceTypePhone}
+	return id
+}
+
+func (f *fakeQueries) GetDeviceByID(ctx context.Context, id uuid.UUID) (sqlc.Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.devices[id]
+	if !ok {
+		return sqlc.Device{}, sql.ErrNoRows
+	}
+	return d, nil
+}
+
+func (f *fakeQueries) CreateWSTicket(ctx context.Context, arg sqlc.CreateWSTicketParams) (sqlc.WsTicket, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := sqlc.WsTicket{
+		ID:              uuid.New(),
+		UserID:          arg.UserID,
+		DeviceID:        arg.DeviceID,
+		Ticket:          arg.Ticket,
+		ExpiresAt:       arg.ExpiresAt,
+		AccessExpiresAt: arg.AccessExpiresAt,
+	}
+	f.tickets[arg.Ticket] = t
+	return t, nil
+}
+
+// ConsumeWSTicket deletes and returns an unexpired ticket
+func (f *fakeQueries) ConsumeWSTicket(ctx context.Context, ticket string) (sqlc.WsTicket, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.tickets[ticket]
+	if !ok || !t.ExpiresAt.After(time.Now()) {
+		return sqlc.WsTicket{}, sql.ErrNoRows
+	}
+	delete(f.tickets, ticket)
+	return t, nil
+}
+
+func (f *fakeQueries) DeleteExpiredWSTickets(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeQueries) ClaimDevicePresence(ctx context.Context, id uuid.UUID) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.epoch++
+	return f.epoch, nil
+}
+
+func (f *fakeQueries) ReleaseDevicePresence(ctx context.Context, arg sqlc.ReleaseDevicePresenceParams) (int64, error) {
+	return 1, nil
+}
+
+func (f *fakeQueries) SetDevicePresence(ctx context.Context, arg sqlc.SetDevicePresenceParams) (int64, error) {
+	return 1, nil
+}
+
+func (f *fakeQueries) ResetStaleDevicePresence(ctx context.Context, ttlSeconds int32) (int64, error) {
+	return 0, nil
+}
+
+func (f *fakeQueries) CreateTelemetrySample(ctx context.Context, arg sqlc.CreateTelemetrySampleParams) (sqlc.TelemetrySample, error) {
+	return sqlc.TelemetrySample{}, nil
+}
+
+func (f *fakeQueries) DeleteTelemetrySamplesBefore(ctx context.Context, recordedAt time.Time) (int64, error) {
+	return 0, nil
+}
+
+// testServer runs the WebSocket and ticket endpoints against fake queries
+type testServer struct {
+	*httptest.Server
+	hub *Hub
+	q   *fakeQueries
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	cfg := Config{
+		JWTSecret:      "secret",
+		TicketTTL:      time.Minute,
+		AllowedOrigins: []string{testOrigin},
+		HelloTimeout:   2 * time.Second,
+		ResumeGrace:    time.Minute,
+
+		ReplayBufferSize: 8,
+	}
+	hub := NewHub(cfg)
+	go hub.Run(ctx)
+
+	q := newFakeQueries()
+	h := NewHandler(hub, nil, cfg)
+	h.q = q
+	hub.deviceOwner = h.deviceOwner
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ws", h.HandleWebSocket)
+	r.GET("/events", h.HandleEvents)
+	r.POST("/ws/ticket", middleware.Auth(cfg.JWTSecret), h.IssueTicket)
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return &testServer{Server: srv, hub: hub, q: q}
+}
+
+func testToken(t *testing.T, userID uuid.UUID) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": userID.String(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// issueTicket asks for a ticket and returns it with the response status
+func (s *testServer) issueTicket(t *testing.T, userID, deviceID uuid.UUID) (string, int) {
+	t.Helper()
+	body, _ := json.Marshal(TicketRequest{DeviceID: deviceID})
+	req, _ := http.NewRequest(http.MethodPost, s.URL+"/ws/ticket", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, userID))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var ticket TicketResponse
+	_ = json.NewDecoder(resp.Body).Decode(&ticket)
+	return ticket.Ticket, resp.StatusCode
+}
+
+// dial opens /ws with the query and returns the handshake response; the
+// connection, if any, is closed when the test ends
+func (s *testServer) dial(t *testing.T, query string, header http.Header, subprotocols ...string) *http.Response {
+	t.Helper()
+	dialer := websocket.Dialer{Subprotocols: subprotocols, HandshakeTimeout: 2 * time.Second}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?"+query, header)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	if err != nil && resp == nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// connect opens /ws with the query, failing the test if it's refused
+func (s *testServer) connect(t *testing.T, query string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/ws?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readMessage reads the next message, failing the test if none arrives
+// within the deadline
+func readMessage(t *testing.T, conn *websocket.Conn, within time.Duration) Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(within))
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// connectDevice opens /ws for the device with a fresh ticket
+func (s *testServer) connectDevice(t *testing.T, userID, deviceID uuid.UUID) *websocket.Conn {
+	t.Helper()
+	ticket, status := s.issueTicket(t, userID, deviceID)
+	if status != http.StatusCreated {
+		t.Fatalf("issue ticket: status %d", status)
+	}
+	return s.connect(t, "ticket="+ticket+"&device_id="+deviceID.String())
+}
+
+// readReply skips messages until the reply to the request with the ID
+func readReply(t *testing.T, conn *websocket.Conn, id string) Message {
+	t.Helper()
+	for {
+		if msg := readMessage(t, conn, 2*time.Second); msg.ID == id {
+			return msg
+		}
+	}
+}
+
+func TestSignalingReplies(t *testing.T) {
+	s := newTestServer(t)
+	userID := uuid.New()
+	phone := s.q.addDevice(userID)
+	mac := s.q.addDevice(userID)
+	tablet := s.q.addDevice(userID)
+	strangerID := uuid.New()
+	strangerOnline := s.q.addDevice(strangerID)
+	strangerOffline := s.q.addDevice(strangerID)
+
+	conn := s.connectDevice(t, userID, phone)
+	macConn := s.connectDevice(t, userID, mac)
+	s.connectDevice(t, strangerID, strangerOnline)
+	waitUntil(t, func() bool {
+		return s.hub.IsDeviceOnline(userID, mac) && s.hub.IsDeviceOnline(strangerID, strangerOnline)
+	})
+
+	tests := []struct {
+		name   string
+		target uuid.UUID
+		reply  string
+		code   string
+	}{
+		{"own device", mac, TypeAck, ""},
+		{"own device offline", tablet, TypeNack, CodePeerOffline},
+		// Online or not, another account's device looks the same
+		{"other account online", strangerOnline, TypeNack, CodeForbidden},
+		{"other account offline", strangerOffline, TypeNack, CodeForbidden},
+		{"no such device", uuid.New(), TypeNack, CodeForbidden},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := fmt.Sprintf("offer-%d", i)
+			msg, _ := newMessage(id, TypeOffer, OfferPayload{ToDeviceID: tt.target, SDP: "v=0"})
+			if err := conn.WriteJSON(msg); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := readReply(t, conn, id)
+			if reply.Type != tt.reply {
+				t.Fatalf("reply type = %s, want %s", reply.Type, tt.reply)
+			}
+			if tt.code != "" {
+				var payload ErrorPayload
+				_ = json.Unmarshal(reply.Payload, &payload)
+				if payload.Code != tt.code {
+					t.Fatalf("code = %s, want %s", payload.Code, tt.code)
+				}
+			}
+		})
+	}
+
+	// The acked offer reached the mac
+	for {
+		msg := readMessage(t, macConn, 2*time.Second)
+		if msg.Type == TypeOffer {
+			break
+		}
+	}
+
+	// Unknown types are answered with an error tagged with the request ID
+	if err := conn.WriteJSON(Message{ID: "u1", Type: "webrtc:bogus"}); err != nil {
+		t.Fatal(err)
+	}
+	reply := readReply(t, conn, "u1")
+	var payload ErrorPayload
+	_ = json.Unmarshal(reply.Payload, &payload)
+	if reply.Type != TypeError || payload.Code != CodeUnknownType {
+		t.Fatalf("unknown type: got %s %s, want %s %s", reply.Type, payload.Code, TypeError, CodeUnknownType)
+	}
+}
+
+func TestTicket(t *testing.T) {
+	s := newTestServer(t)
+	userID := uuid.New()
+	phone := s.q.addDevice(userID)
+	mac := s.q.addDevice(userID)
+
+	ticket, status := s.issueTicket(t, userID, phone)
+	if status != http.StatusCreated {
+		t.Fatalf("issue ticket: status %d", status)
+	}
+
+	// Tickets are only issued for the caller's own devices
+	if _, status := s.issueTicket(t, uuid.New(), phone); status != http.StatusForbidden {
+		t.Fatalf("ticket for another user's device: status %d, want 403", status)
+	}
+
+	if resp := s.dial(t, "ticket="+ticket+"&device_id="+phone.String(), nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("connect with ticket: status %d", resp.StatusCode)
+	}
+
+	// Single use
+	if resp := s.dial(t, "ticket="+ticket, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("reused ticket: status %d, want 401", resp.StatusCode)
+	}
+
+	// Bound to the device it was issued for
+	ticket, _ = s.issueTicket(t, userID, phone)
+	if resp := s.dial(t, "ticket="+ticket+"&device_id="+mac.String(), nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("ticket for another device: status %d, want 403", resp.StatusCode)
+	}
+
+	// Expired
+	ticket, _ = s.issueTicket(t, userID, phone)
+	s.q.mu.Lock()
+	expired := s.q.tickets[ticket]
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	s.q.tickets[ticket] = expired
+	s.q.mu.Unlock()
+	if resp := s.dial(t, "ticket="+ticket, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expired ticket: status %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestBearerSubprotocol(t *testing.T) {
+	s := newTestServer(t)
+	userID := uuid.New()
+	phone := s.q.addDevice(userID)
+	token := testToken(t, userID)
+
+	tests := []struct {
+		name     string
+		offered  []string
+		status   int
+		selected string
+	}{
+		{name: "bearer only", offered: []string{"bearer", token}, status: http.StatusSwitchingProtocols, selected: bearerProtocol},
+		{name: "codec preferred", offered: []string{ProtocolJSON, "bearer", token}, status: http.StatusSwitchingProtocols, selected: ProtocolJSON},
+		{name: "bearer without token", offered: []string{"bearer"}, status: http.StatusUnauthorized},
+		{name: "invalid token", offered: []string{"bearer", "garbage"}, status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := s.dial(t, "device_id="+phone.String(), nil, tt.offered...)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			got := resp.Header.Get("Sec-WebSocket-Protocol")
+			if tt.status == http.StatusSwitchingProtocols && got != tt.selected {
+				t.Fatalf("selected subprotocol %q, want %q", got, tt.selected)
+			}
+			if strings.Contains(got, token) {
+				t.Fatal("access token echoed back")
+			}
+		})
+	}
+}
+
+func TestOriginRejected(t *testing.T) {
+	s := newTestServer(t)
+	userID := uuid.New()
+	phone := s.q.addDevice(userID)
+	ticket, _ := s.issueTicket(t, userID, phone)
+
+	resp := s.dial(t, "ticket="+ticket, http.Header{"Origin": {"https://evil.example.com"}})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-site upgrade: status %d, want 403", resp.StatusCode)
+	}
+
+	// The ticket wasn't spent by the rejected request
+	resp = s.dial(t, "ticket="+ticket, http.Header{"Origin": {testOrigin}})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("allowed origin: status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,220 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol versions. Version 2 added the hello/welcome handshake; clients
+// that don't send hello are taken to speak version 1.
+const (
+	ProtocolVersion       = 2
+	legacyProtocolVersion = 1
+)
+
+// How long a new connection has to send hello unless configured
+const defaultHelloTimeout = 2 * time.Second
+
+// CloseUpgradeRequired is sent to clients older than the configured minimum
+// protocol version. The reason names it, e.g.
+// "upgrade required; min_protocol_version=2". Don't reconnect until updated.
+const CloseUpgradeRequired = 4005
+
+// Features a connection can have enabled. Clients that send hello only get
+// the events of the features both sides support; others get everything.
+const (
+	FeaturePresence  = "presence"
+	FeatureControl   = "control"
+	FeatureTelemetry = "telemetry"
+	FeatureChat      = "chat"
+	FeatureStreams   = "streams"
+	FeatureTransfers = "transfers"
+)
+
+// HelloPayload is the first message of a client that speaks version 2 or
+// later. Features lists those the client supports; omitted means all.
+type HelloPayload struct {
+	ProtocolVersion int      `json:"protocol_version" binding:"required,min=1"`
+	AppVersion      string   `json:"app_version" binding:"max=64"`
+	Features        []string `json:"features,omitempty"`
+}
+
+// WelcomePayload answers hello, before the session message. The session ID
+// stays the same when the session is resumed. Intervals are milliseconds:
+// the server pings every ping_interval and drops a connection that hasn't
+// answered within pong_timeout (away_timeout while it's hidden).
+type WelcomePayload struct {
+	ServerVersion   string   `json:"server_version"`
+	ProtocolVersion int      `json:"protocol_version"`
+	SessionID       string   `json:"session_id"`
+	PingInterval    int64    `json:"ping_interval"`
+	PongTimeout     int64    `json:"pong_timeout"`
+	AwayTimeout     int64    `json:"away_timeout"`
+	Features        []string `json:"features"`
+}
+
+// featureOf returns the feature an outbound message type belongs to, or ""
+// if every client gets it
+func featureOf(msgType string) string {
+	switch {
+	case msgType == TypeDevicePresence:
+		return FeaturePresence
+	case msgType == TypeControlCapabilities || strings.HasPrefix(msgType, "control:"):
+		return FeatureControl
+	case msgType == TypeTelemetry || msgType == TypeTelemetryAlert:
+		return FeatureTelemetry
+	case strings.HasPrefix(msgType, "chat:"):
+		return FeatureChat
+	case strings.HasPrefix(msgType, "stream:"):
+		return FeatureStreams
+	case strings.HasPrefix(msgType, "transfer:"):
+		return FeatureTransfers
+	default:
+		return ""
+	}
+}
+
+// features returns the features this server has enabled
+func (h *Hub) features() []string {
+	features := []string{FeaturePresence, FeatureControl, FeatureTelemetry}
+	if h.chat != nil {
+		features = append(features, FeatureChat)
+	}
+	if h.streams != nil {
+		features = append(features, FeatureStreams)
+	}
+	if h.transfers != nil {
+		features = append(features, FeatureTransfers)
+	}
+	return features
+}
+
+// wants reports whether the client negotiated the feature of a message type
+func (c *Client) wants(msgType string) bool {
+	if c.features == nil {
+		return true
+	}
+	feature := featureOf(msgType)
+	return feature == "" || c.features[feature]
+}
+
+// handshake waits up to timeout for the client's hello, which ReadPump hands
+// over as the first frame. A client that sends something else first, or
+// nothing in time, speaks version 1; ReadPump handles its first frame once
+// it's registered. A zero timeout doesn't wait: the client announced no
+// hello, so it's taken to speak version 1 straight away. Clients below
+// minVersion are closed with CloseUpgradeRequired.
+func (c *Client) handshake(timeout time.Duration, minVersion int) error {
+	var hello *HelloPayload
+	if timeout > 0 {
+		var err error
+		if hello, err = c.awaitHello(timeout); err != nil {
+			return err
+		}
+	}
+
+	c.protocolVersion = legacyProtocolVersion
+	if hello != nil {
+		c.protocolVersion = min(hello.ProtocolVersion, ProtocolVersion)
+		c.appVersion = hello.AppVersion
+		c.features = make(map[string]bool)
+		for _, feature := range c.hub.features() {
+			c.features[feature] = hello.Features == nil || slices.Contains(hello.Features, feature)
+		}
+	}
+
+	if c.protocolVersion < minVersion {
+		slog.Info("rejecting outdated client",
+			"user_id", c.userID,
+			"device_id", c.deviceID,
+			"protocol_version", c.protocolVersion,
+			"app_version", c.appVersion,
+		)
+		c.reject(CloseUpgradeRequired, fmt.Sprintf("upgrade required; min_protocol_version=%d", minVersion))
+		return errors.New("protocol version too old")
+	}
+	return nil
+}
+
+// awaitHello returns the client's hello, or nil if its first frame within
+// timeout was something else or there was none
+func (c *Client) awaitHello(timeout time.Duration) (*HelloPayload, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case data, ok := <-c.hello:
+		if !ok {
+			return nil, errors.New("connection closed during handshake")
+		}
+		msg, err := c.codec.Decode(data)
+		if err != nil || msg.Type != TypeHello {
+			c.pending = data
+			return nil, nil
+		}
+
+		if err := c.validatePayload(msg); err != nil {
+			c.reject(websocket.CloseProtocolError, "invalid hello: "+err.Error())
+			return nil, err
+		}
+		hello := &HelloPayload{}
+		_ = c.codec.DecodePayload(msg.Payload, hello)
+		c.helloID = msg.ID
+		return hello, nil
+
+	case <-timer.C:
+		return nil, nil
+	}
+}
+
+// reject closes a connection that failed the handshake
+func (c *Client) reject(code int, reason string) {
+	// Close reasons are limited to 123 bytes
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	// Close frame first, WritePump would send one without the code
+	c.closeWith(code, reason)
+	c.out.close()
+}
+
+// sendWelcome answers the client's hello, if it sent one; it goes out
+// before the session message
+func (h *Hub) sendWelcome(client *Client, s *session) {
+	if client.features == nil {
+		return
+	}
+
+	features := make([]string, 0, len(client.features))
+	for _, feature := range h.features() {
+		if client.features[feature] {
+			features = append(features, feature)
+		}
+	}
+
+	awayTimeout := pongWait
+	if h.awayTimeout > awayTimeout {
+		awayTimeout = h.awayTimeout
+	}
+
+	msg, err := newMessage(client.helloID, TypeWelcome, WelcomePayload{
+		ServerVersion:   h.serverVersion,
+		ProtocolVersion: client.protocolVersion,
+		SessionID:       s.id,
+		PingInterval:    pingPeriod.Milliseconds(),
+		PongTimeout:     pongWait.Milliseconds(),
+		AwayTimeout:     awayTimeout.Milliseconds(),
+		Features:        features,
+	})
+	if err != nil {
+		slog.Error("failed to create welcome message", "error", err)
+		return
+	}
+	client.Send(msg)
+}
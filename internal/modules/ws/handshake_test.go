@@ -0,0 +1,236 @@
+package ws
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newHandshakeClient(h *Hub) *Client {
+	deviceID := uuid.New()
+	c := NewClient(h, nil, uuid.New(), deviceID, &DeviceInfo{ID: deviceID})
+	c.hello = make(chan []byte, 1)
+	c.closing = make(chan closeFrame, 1)
+	return c
+}
+
+func TestHandshake(t *testing.T) {
+	h := NewHub(Config{})
+
+	tests := []struct {
+		name       string
+		first      string // first frame; empty sends nothing
+		minVersion int
+		version    int
+		features   []string // nil means legacy
+		pending    bool
+		closeCode  int
+	}{
+		{
+			name:     "hello",
+			first:    `{"id":"h","type":"hello","payload":{"protocol_version":2,"app_version":"ios/3.1","features":["presence","chat"]}}`,
+			version:  2,
+			features: []string{FeaturePresence},
+		},
+		{
+			name:     "all features",
+			first:    `{"type":"hello","payload":{"protocol_version":2}}`,
+			version:  2,
+			features: []string{FeaturePresence, FeatureControl, FeatureTelemetry},
+		},
+		{
+			name:     "newer client",
+			first:    `{"type":"hello","payload":{"protocol_version":7,"features":[]}}`,
+			version:  ProtocolVersion,
+			features: []string{},
+		},
+		{
+			name:    "legacy first message",
+			first:   `{"type":"ping"}`,
+			version: legacyProtocolVersion,
+			pending: true,
+		},
+		{
+			name:    "legacy silent",
+			version: legacyProtocolVersion,
+		},
+		{
+			name:       "legacy below minimum",
+			first:      `{"type":"ping"}`,
+			minVersion: 2,
+			closeCode:  CloseUpgradeRequired,
+		},
+		{
+			name:       "hello below minimum",
+			first:      `{"type":"hello","payload":{"protocol_version":2}}`,
+			minVersion: 3,
+			closeCode:  CloseUpgradeRequired,
+		},
+		{
+			name:      "invalid hello",
+			first:     `{"type":"hello","payload":{"protocol_version":"2"}}`,
+			closeCode: 1002,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newHandshakeClient(h)
+			if tt.first != "" {
+				c.hello <- []byte(tt.first)
+			}
+
+			err := c.handshake(20*time.Millisecond, tt.minVersion)
+			if tt.closeCode != 0 {
+				if err == nil {
+					t.Fatal("handshake succeeded")
+				}
+				select {
+				case f := <-c.closing:
+					if f.Code != tt.closeCode {
+						t.Errorf("close code = %d, want %d (%s)", f.Code, tt.closeCode, f.Reason)
+					}
+					if f.Code == CloseUpgradeRequired && !strings.Contains(f.Reason, "min_protocol_version=") {
+						t.Errorf("close reason = %q", f.Reason)
+					}
+				default:
+					t.Error("connection not closed")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			if c.protocolVersion != tt.version {
+				t.Errorf("protocol version = %d, want %d", c.protocolVersion, tt.version)
+			}
+			if (c.pending != nil) != tt.pending {
+				t.Errorf("pending = %q", c.pending)
+			}
+			if (c.features == nil) != (tt.features == nil) {
+				t.Fatalf("features = %v, want %v", c.features, tt.features)
+			}
+			for _, f := range tt.features {
+				if !c.features[f] {
+					t.Errorf("feature %s not enabled", f)
+				}
+			}
+		})
+	}
+}
+
+func TestHandshakeWithoutHello(t *testing.T) {
+	c := newHandshakeClient(NewHub(Config{}))
+	c.hello <- []byte(`{"type":"ping"}`)
+
+	// Not waiting leaves the first frame to ReadPump
+	if err := c.handshake(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if c.protocolVersion != legacyProtocolVersion || c.features != nil || c.pending != nil {
+		t.Errorf("version %d, features %v, pending %q; want legacy with the frame unread", c.protocolVersion, c.features, c.pending)
+	}
+	if len(c.hello) != 1 {
+		t.Error("first frame consumed")
+	}
+}
+
+func TestHandshakeOptIn(t *testing.T) {
+	s := newTestServer(t)
+	userID := uuid.New()
+	phone := s.q.addDevice(userID)
+	tablet := s.q.addDevice(userID)
+
+	// Legacy clients get their session without waiting out the hello timeout
+	ticket, _ := s.issueTicket(t, userID, phone)
+	legacy := s.connect(t, "ticket="+ticket)
+	if msg := readMessage(t, legacy, time.Second); msg.Type != TypeSession {
+		t.Fatalf("legacy client got %s first, want session", msg.Type)
+	}
+
+	// Clients that announce hello are waited for and welcomed
+	ticket, _ = s.issueTicket(t, userID, tablet)
+	conn := s.connect(t, "ticket="+ticket+"&hello=1")
+	hello, _ := NewMessage(TypeHello, HelloPayload{ProtocolVersion: ProtocolVersion})
+	hello.ID = "h"
+	if err := conn.WriteJSON(hello); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readMessage(t, conn, time.Second); msg.Type != TypeWelcome || msg.ID != "h" {
+		t.Fatalf("got %s %q first, want welcome h", msg.Type, msg.ID)
+	}
+}
+
+func TestHandshakeConnectionLost(t *testing.T) {
+	c := newHandshakeClient(NewHub(Config{}))
+	close(c.hello)
+	if err := c.handshake(time.Second, 1); err == nil {
+		t.Fatal("handshake succeeded on a closed connection")
+	}
+}
+
+func TestWelcome(t *testing.T) {
+	h := NewHub(Config{ResumeGrace: time.Minute, ReplayBufferSize: 8, ServerVersion: "1.2.3"})
+
+	c := newHandshakeClient(h)
+	c.hello <- []byte(`{"id":"h1","type":"hello","payload":{"protocol_version":2,"features":["presence"]}}`)
+	if err := c.handshake(time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	h.registerClient(c)
+
+	msgs := drain(t, c)
+	if len(msgs) < 2 || msgs[0].Type != TypeWelcome || msgs[1].Type != TypeSession {
+		t.Fatalf("messages = %v, want welcome then session", msgs)
+	}
+	if msgs[0].ID != "h1" {
+		t.Errorf("welcome id = %q, want the hello's", msgs[0].ID)
+	}
+	var welcome WelcomePayload
+	_ = json.Unmarshal(msgs[0].Payload, &welcome)
+	if welcome.ServerVersion != "1.2.3" || welcome.ProtocolVersion != 2 || welcome.SessionID == "" {
+		t.Errorf("welcome = %+v", welcome)
+	}
+	if len(welcome.Features) != 1 || welcome.Features[0] != FeaturePresence {
+		t.Errorf("welcome features = %v", welcome.Features)
+	}
+
+	// Events of features the client left out are skipped
+	alert, _ := NewMessage(TypeTelemetryAlert, TelemetryAlertPayload{})
+	if !c.Send(alert) || len(drain(t, c)) != 0 {
+		t.Error("telemetry event sent to a client without telemetry")
+	}
+
+	// The session keeps its ID when resumed
+	h.unregisterClient(c)
+	s := h.sessions[c.userID][c.deviceID]
+	resumed := NewClient(h, nil, c.userID, c.deviceID, &DeviceInfo{ID: c.deviceID})
+	resumed.hello = make(chan []byte, 1)
+	resumed.hello <- []byte(`{"type":"hello","payload":{"protocol_version":2}}`)
+	if err := resumed.handshake(time.Second, 1); err != nil {
+		t.Fatal(err)
+	}
+	resumed.resume = resumeRequest{token: s.token, lastSeq: s.seq}
+	h.registerClient(resumed)
+
+	msgs = drain(t, resumed)
+	if len(msgs) == 0 || msgs[0].Type != TypeWelcome {
+		t.Fatalf("messages = %v, want welcome first", msgs)
+	}
+	var again WelcomePayload
+	_ = json.Unmarshal(msgs[0].Payload, &again)
+	if again.SessionID != welcome.SessionID {
+		t.Errorf("resumed session id = %q, want %q", again.SessionID, welcome.SessionID)
+	}
+
+	// Legacy clients get no welcome
+	legacy := NewClient(h, nil, uuid.New(), uuid.New(), &DeviceInfo{})
+	h.registerClient(legacy)
+	if msgs := drain(t, legacy); len(msgs) == 0 || msgs[0].Type != TypeSession {
+		t.Errorf("legacy messages = %v, want session first", msgs)
+	}
+}
@@ -0,0 +1,196 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testHub runs a hub until the test ends. Devices made with device belong
+// to their user as far as the hub's owner lookups go.
+type testHub struct {
+	*Hub
+
+	ownersMu sync.Mutex
+	owners   map[uuid.UUID]uuid.UUID
+}
+
+// newTestHub starts a hub with cfg. setup runs before the hub does, for
+// hooks its loop reads.
+func newTestHub(t *testing.T, cfg Config, setup ...func(*Hub)) *testHub {
+	t.Helper()
+	h := &testHub{Hub: NewHub(cfg), owners: make(map[uuid.UUID]uuid.UUID)}
+	h.deviceOwner = h.owner
+	for _, fn := range setup {
+		fn(h.Hub)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go h.Run(ctx)
+	return h
+}
+
+func (h *testHub) owner(ctx context.Context, deviceID uuid.UUID) (uuid.UUID, error) {
+	h.ownersMu.Lock()
+	defer h.ownersMu.Unlock()
+	return h.owners[deviceID], nil
+}
+
+// device returns a client for a new device of the user, not yet connected
+func (h *testHub) device(userID uuid.UUID) *Client {
+	deviceID := uuid.New()
+	h.ownersMu.Lock()
+	h.owners[deviceID] = userID
+	h.ownersMu.Unlock()
+
+	c := newTestClient(userID, deviceID)
+	c.hub = h.Hub
+	return c
+}
+
+// connect registers the clients and waits until they're all online, then
+// discards what they were sent while connecting
+func (h *testHub) connect(t *testing.T, clients ...*Client) {
+	t.Helper()
+	for _, c := range clients {
+		h.register <- c
+	}
+	waitUntil(t, func() bool {
+		for _, c := range clients {
+			if !h.IsDeviceOnline(c.userID, c.deviceID) {
+				return false
+			}
+		}
+		return true
+	})
+	for _, c := range clients {
+		drain(t, c)
+	}
+}
+
+// session returns the device's session, or nil if it has none
+func (h *testHub) session(c *Client) *session {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.sessions[c.userID][c.deviceID]
+}
+
+// drop disconnects the client's connection and waits for its session to
+// start waiting for a resume. It returns how to resume from the last event
+// the client was sent.
+func (h *testHub) drop(t *testing.T, c *Client) resumeRequest {
+	t.Helper()
+	s := h.session(c)
+	if s == nil {
+		t.Fatalf("device %s has no session", c.deviceID)
+	}
+
+	h.unregister <- c
+	waitUntil(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.client == nil
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return resumeRequest{token: s.token, lastSeq: s.seq}
+}
+
+// resume reconnects a dropped device and returns the new connection, once
+// it has been sent its session
+func (h *testHub) resume(t *testing.T, c *Client, req resumeRequest) *Client {
+	t.Helper()
+	resumed := newTestClient(c.userID, c.deviceID)
+	resumed.hub = h.Hub
+	resumed.resume = req
+	h.register <- resumed
+	waitFor(t, resumed, TypeSession)
+	return resumed
+}
+
+func newTestClient(userID, deviceID uuid.UUID) *Client {
+	return NewClient(nil, nil, userID, deviceID, &DeviceInfo{ID: deviceID})
+}
+
+// ownersOf returns a deviceOwner hook that knows the clients' devices, for
+// hubs not made with newTestHub
+func ownersOf(clients ...*Client) func(context.Context, uuid.UUID) (uuid.UUID, error) {
+	owners := make(map[uuid.UUID]uuid.UUID)
+	for _, c := range clients {
+		owners[c.deviceID] = c.userID
+	}
+	return func(ctx context.Context, deviceID uuid.UUID) (uuid.UUID, error) {
+		return owners[deviceID], nil
+	}
+}
+
+// drain returns the messages queued for the client, in the order its writer
+// would send them
+func drain(t *testing.T, c *Client) []Message {
+	t.Helper()
+	var msgs []Message
+	for {
+		data, _ := c.out.next()
+		if data == nil {
+			return msgs
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// waitFor polls the client's queue until a message of the given type arrives
+func waitFor(t *testing.T, c *Client, msgType string) Message {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		data, _ := c.out.next()
+		if data == nil {
+			select {
+			case <-c.out.ready:
+			case <-timeout:
+				t.Fatalf("timed out waiting for %s", msgType)
+			}
+			continue
+		}
+
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func assertNack(t *testing.T, msg Message, id, code string) {
+	t.Helper()
+	var payload ErrorPayload
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != id || payload.Code != code {
+		t.Fatalf("nack = %s %+v, want %s %s", msg.ID, payload, id, code)
+	}
+}
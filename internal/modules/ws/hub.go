@@ -4,15 +4,26 @@ import (
 	"context"
 	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// Hub maintains the set of active clients and broadcasts messages
+// How often the hub heartbeats its devices in the cluster registry
+const backplaneHeartbeat = 15 * time.Second
+
+// Hub maintains the set of device sessions and routes messages between them
 type Hub struct {
-	// Registered clients grouped by user ID
-	// map[userID]map[deviceID]*Client
-	clients map[uuid.UUID]map[uuid.UUID]*Client
+	// Device sessions grouped by user ID. A session stays here through the
+	// resume grace window after its connection drops, so peers keep seeing
+	// the device online and events for it are buffered.
+	// map[userID]map[deviceID]*session
+	sessions map[uuid.UUID]map[uuid.UUID]*session
+
+	// Devices connected to other instances, grouped by user ID
+	// map[userID]map[deviceID]*remoteDevice
+	remote map[uuid.UUID]map[uuid.UUID]*remoteDevice
 
 	// Register requests from clients
 	register chan *Client
@@ -20,21 +31,92 @@ type Hub struct {
 	// Unregister requests from clients
 	unregister chan *Client
 
-	// Mutex for clients map
+	// Relays events to other instances; nil when running standalone
+	backplane  Backplane
+	instanceID string
+
+	// Called outside the lock once a device's session has ended, and when
+	// a connected device changes presence
+	onOffline  func(userID, deviceID uuid.UUID, epoch int64)
+	onPresence func(userID, deviceID uuid.UUID, epoch int64, presence string)
+
+	// Called outside the lock to persist a telemetry sample, and
+	// periodically to delete samples recorded before a cutoff
+	onTelemetry      func(deviceID uuid.UUID, t Telemetry, alerts []string)
+	onPruneTelemetry func(ctx context.Context, before time.Time)
+
+	// Looks up a device's owner, uuid.Nil if there is no such device. Tells
+	// a device in another account from an offline one; nil means every
+	// unreachable target is reported offline.
+	deviceOwner func(ctx context.Context, deviceID uuid.UUID) (uuid.UUID, error)
+
+	// Set once Shutdown starts; writes tracks the callbacks above so
+	// Shutdown can wait for them
+	draining atomic.Bool
+	writes   sync.WaitGroup
+
+	// Handles stream:start and stream:end requests; nil until SetStreams
+	streams Streams
+
+	// Handles chat:message and chat:read; nil until SetChat
+	chat Chat
+
+	// Handles transfer:accept; nil until SetTransfers
+	transfers Transfers
+
+	// Takes signaling with a stream_id; nil until SetSFU
+	sfu SFU
+
+	// Verifies access tokens sent with auth:refresh
+	jwtSecret string
+
+	resumeGrace time.Duration
+	replaySize  int
+	awayTimeout time.Duration
+
+	// Reported to clients in welcome
+	serverVersion string
+
+	// Messages a client may drop without catching up before it's
+	// disconnected; 0 means never
+	slowClientDrops int
+
+	// Mutex for sessions and remote maps
 	mu sync.RWMutex
 }
 
 // NewHub creates a new Hub
-func NewHub() *Hub {
+func NewHub(cfg Config) *Hub {
 	return &Hub{
-		clients:    make(map[uuid.UUID]map[uuid.UUID]*Client),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		sessions:        make(map[uuid.UUID]map[uuid.UUID]*session),
+		remote:          make(map[uuid.UUID]map[uuid.UUID]*remoteDevice),
+		register:        make(chan *Client),
+		unregister:      make(chan *Client),
+		instanceID:      cfg.InstanceID,
+		jwtSecret:       cfg.JWTSecret,
+		resumeGrace:     cfg.ResumeGrace,
+		replaySize:      cfg.ReplayBufferSize,
+		awayTimeout:     cfg.AwayTimeout,
+		slowClientDrops: cfg.SlowClientDrops,
+		serverVersion:   cfg.ServerVersion,
 	}
 }
 
 // Run starts the hub's event loop
 func (h *Hub) Run(ctx context.Context) {
+	var heartbeat <-chan time.Time
+	if h.backplane != nil {
+		h.loadMembers(ctx)
+		go h.backplane.Listen(ctx, h.handleBackplaneEvent)
+
+		ticker := time.NewTicker(backplaneHeartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	if h.onPruneTelemetry != nil {
+		go h.runTelemetryPrune(ctx)
+	}
+
 	for {
 		select {
 		case client := <-h.register:
@@ -43,6 +125,9 @@ func (h *Hub) Run(ctx context.Context) {
 		case client := <-h.unregister:
 			h.unregisterClient(client)
 
+		case <-heartbeat:
+			h.heartbeat(ctx)
+
 		case <-ctx.Done():
 			slog.Info("hub shutting down")
 			return
@@ -55,28 +140,115 @@ func (h *Hub) registerClient(client *Client) {
 	defer h.mu.Unlock()
 
 	// Create user's device map if not exists
-	if h.clients[client.userID] == nil {
-		h.clients[client.userID] = make(map[uuid.UUID]*Client)
+	if h.sessions[client.userID] == nil {
+		h.sessions[client.userID] = make(map[uuid.UUID]*session)
+	}
+
+	existing := h.sessions[client.userID][client.deviceID]
+
+	// The connection lost a race against a newer one for the same device
+	stale := existing != nil && client.epoch < existing.epoch
+	if rd, ok := h.remote[client.userID][client.deviceID]; ok && client.epoch < rd.epoch {
+		stale = true
+	}
+	if stale {
+		slog.Warn("rejecting superseded connection",
+			"user_id", client.userID,
+			"device_id", client.deviceID,
+			"epoch", client.epoch,
+		)
+		client.out.close()
+		return
+	}
+
+	// Shutting down; the client raced the upgrade check
+	if h.draining.Load() {
+		client.out.close()
+		go client.closeWith(CloseServiceRestart, restartReason())
+		if h.onOffline != nil {
+			h.background(func() { h.onOffline(client.userID, client.deviceID, client.epoch) })
+		}
+		return
+	}
+
+	// Resume the existing session if the client can pick up where it left off
+	if existing != nil && existing.canResume(client.resume) {
+		if existing.expiry != nil {
+			existing.expiry.Stop()
+			existing.expiry = nil
+		}
+		if existing.client != nil {
+			// Old connection not noticed dead yet
+			existing.client.out.close()
+		}
+		client.device.Presence = existing.device.Presence
+		h.sendWelcome(client, existing)
+		existing.attach(client, client.resume.lastSeq)
+		if client.away.Load() {
+			h.setPresenceLocked(existing, PresenceAway)
+		} else {
+			h.setPresenceLocked(existing, PresenceOnline)
+		}
+
+		slog.Info("client resumed",
+			"user_id", client.userID,
+			"device_id", client.deviceID,
+			"epoch", client.epoch,
+			"last_seq", client.resume.lastSeq,
+			"seq", existing.seq,
+		)
+		return
 	}
 
 	// Check if device already connected (close old connection)
-	if existing, ok := h.clients[client.userID][client.deviceID]; ok {
-		close(existing.send)
+	if existing != nil {
+		if existing.expiry != nil {
+			existing.expiry.Stop()
+		}
+		if existing.client != nil {
+			existing.client.out.close()
+		}
 	}
 
-	h.clients[client.userID][client.deviceID] = client
+	// The device may have moved here from another instance
+	h.removeRemoteLocked(client.userID, client.deviceID)
+
+	// The client may have reported being hidden before we got here
+	if client.away.Load() {
+		client.device.Presence = PresenceAway
+	}
+
+	s := newSession(client, h.resumeGrace, h.replaySize)
+	h.sessions[client.userID][client.deviceID] = s
 
 	slog.Info("client registered",
 		"user_id", client.userID,
 		"device_id", client.deviceID,
-		"total_user_devices", len(h.clients[client.userID]),
+		"epoch", client.epoch,
+		"total_user_devices", len(h.sessions[client.userID]),
 	)
 
-	// Send device list to newly connected client
+	if h.backplane != nil {
+		h.backplane.Join(client.userID, client.deviceID, client.epoch)
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventOnline,
+			UserID:   client.userID,
+			DeviceID: client.deviceID,
+			Epoch:    client.epoch,
+			Device:   client.device,
+		})
+	}
+
+	// Answer hello, tell the client how to resume, then send the device list
+	h.sendWelcome(client, s)
+	s.mu.Lock()
+	s.sendSessionInfo(false)
+	s.mu.Unlock()
 	h.sendDeviceList(client)
 
-	// Broadcast device online to other user's devices
-	h.broadcastToUser(client.userID, client.deviceID, TypeDeviceOnline, DeviceOnlinePayload{
+	// Tell the user's other devices here; other instances do the same
+	// when they receive the online event
+	h.notifyUserLocked(client.userID, client.deviceID, TypeDeviceOnline, DeviceOnlinePayload{
 		Device: *client.device,
 	})
 }
@@ -85,42 +257,149 @@ func (h *Hub) unregisterClient(client *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if userClients, ok := h.clients[client.userID]; ok {
-		if _, ok := userClients[client.deviceID]; ok {
-			delete(userClients, client.deviceID)
-			close(client.send)
-
-			slog.Info("client unregistered",
-				"user_id", client.userID,
-				"device_id", client.deviceID,
-			)
-
-			// Clean up empty user map
-			if len(userClients) == 0 {
-				delete(h.clients, client.userID)
-			} else {
-				// Broadcast device offline to other user's devices
-				h.broadcastToUserLocked(client.userID, client.deviceID, TypeDeviceOffline, DeviceOfflinePayload{
-					DeviceID: client.deviceID,
-				})
-			}
-		}
+	s, ok := h.sessions[client.userID][client.deviceID]
+	if !ok || s.client != client {
+		// Connection was already replaced by a newer one
+		return
+	}
+
+	s.mu.Lock()
+	s.client = nil
+	s.mu.Unlock()
+	client.out.close()
+
+	slog.Info("client disconnected",
+		"user_id", client.userID,
+		"device_id", client.deviceID,
+		"epoch", client.epoch,
+		"resume_grace", h.resumeGrace,
+	)
+
+	if h.resumeGrace <= 0 || s.terminated {
+		h.endSessionLocked(s)
+		return
 	}
+
+	h.setPresenceLocked(s, PresenceReconnecting)
+
+	s.expiry = time.AfterFunc(h.resumeGrace, func() {
+		h.expireSession(s)
+	})
 }
 
-// sendDeviceList sends the list of online devices to a client
-func (h *Hub) sendDeviceList(client *Client) {
-	devices := make([]DeviceInfo, 0)
+// SetVisibility records a client moving to the background (away) or back
+func (h *Hub) SetVisibility(client *Client, visible bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	if userClients, ok := h.clients[client.userID]; ok {
-		for _, c := range userClients {
-			if c.device != nil {
-				devices = append(devices, *c.device)
-			}
-		}
+	s, ok := h.sessions[client.userID][client.deviceID]
+	if !ok || s.client != client {
+		return
+	}
+
+	presence := PresenceOnline
+	if !visible {
+		presence = PresenceAway
+	}
+	h.setPresenceLocked(s, presence)
+}
+
+// setPresenceLocked moves a device with a session here to a new presence
+// state and tells the user's other devices (caller must hold lock)
+func (h *Hub) setPresenceLocked(s *session, presence string) {
+	if s.device.Presence == presence {
+		return
+	}
+	s.device.Presence = presence
+
+	slog.Info("device presence changed",
+		"user_id", s.userID,
+		"device_id", s.deviceID,
+		"presence", presence,
+	)
+
+	h.notifyUserLocked(s.userID, s.deviceID, TypeDevicePresence, DevicePresencePayload{
+		DeviceID: s.deviceID,
+		Presence: presence,
+	})
+
+	if h.backplane != nil {
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventPresence,
+			UserID:   s.userID,
+			DeviceID: s.deviceID,
+			Epoch:    s.epoch,
+			Presence: presence,
+		})
+	}
+
+	if h.onPresence != nil {
+		userID, deviceID, epoch := s.userID, s.deviceID, s.epoch
+		h.background(func() { h.onPresence(userID, deviceID, epoch, presence) })
+	}
+}
+
+// expireSession ends a session whose grace window passed without a resume
+func (h *Hub) expireSession(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.sessions[s.userID][s.deviceID] != s || s.client != nil {
+		// Resumed or replaced in the meantime
+		return
+	}
+	h.endSessionLocked(s)
+}
+
+// endSessionLocked removes a session and tells peers the device went offline (caller must hold lock)
+func (h *Hub) endSessionLocked(s *session) {
+	h.removeSessionLocked(s)
+
+	slog.Info("client unregistered",
+		"user_id", s.userID,
+		"device_id", s.deviceID,
+	)
+
+	if h.backplane != nil {
+		h.backplane.Leave(s.deviceID)
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventOffline,
+			UserID:   s.userID,
+			DeviceID: s.deviceID,
+			Epoch:    s.epoch,
+		})
 	}
 
-	msg, err := NewMessage(TypeDeviceList, DeviceListPayload{Devices: devices})
+	// Tell the user's other devices here; other instances do the same
+	// when they receive the offline event
+	h.notifyUserLocked(s.userID, s.deviceID, TypeDeviceOffline, DeviceOfflinePayload{
+		DeviceID: s.deviceID,
+	})
+
+	if h.onOffline != nil {
+		userID, deviceID, epoch := s.userID, s.deviceID, s.epoch
+		h.background(func() { h.onOffline(userID, deviceID, epoch) })
+	}
+}
+
+// removeSessionLocked drops a session from the maps (caller must hold lock)
+func (h *Hub) removeSessionLocked(s *session) {
+	userSessions := h.sessions[s.userID]
+	delete(userSessions, s.deviceID)
+
+	// Clean up empty user map
+	if len(userSessions) == 0 {
+		delete(h.sessions, s.userID)
+	}
+}
+
+// sendDeviceList sends the list of online devices to a client, with its
+// unread message counts
+func (h *Hub) sendDeviceList(client *Client) {
+	msg, err := NewMessage(TypeDeviceList, DeviceListPayload{
+		Devices: h.onlineDevicesLocked(client.userID),
+		Unread:  client.unread,
+	})
 	if err != nil {
 		slog.Error("failed to create device list message", "error", err)
 		return
@@ -136,59 +415,136 @@ func (h *Hub) broadcastToUser(userID, excludeDeviceID uuid.UUID, msgType string,
 	h.broadcastToUserLocked(userID, excludeDeviceID, msgType, payload)
 }
 
-// broadcastToUserLocked broadcasts without acquiring lock (caller must hold lock)
+// broadcastToUserLocked broadcasts without acquiring lock (caller must hold lock).
+// Devices on other instances get it through the backplane.
 func (h *Hub) broadcastToUserLocked(userID, excludeDeviceID uuid.UUID, msgType string, payload interface{}) {
-	userClients, ok := h.clients[userID]
-	if !ok {
+	msg, err := NewMessage(msgType, payload)
+	if err != nil {
+		slog.Error("failed to create broadcast message", "error", err)
 		return
 	}
 
+	h.deliverToUserLocked(userID, excludeDeviceID, msg)
+
+	if h.backplane != nil && len(h.remote[userID]) > 0 {
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventBroadcast,
+			UserID:   userID,
+			DeviceID: excludeDeviceID,
+			Message:  &msg,
+		})
+	}
+}
+
+// notifyUserLocked delivers an event to this instance's sessions only, for
+// events every instance derives on its own (caller must hold lock)
+func (h *Hub) notifyUserLocked(userID, excludeDeviceID uuid.UUID, msgType string, payload interface{}) {
 	msg, err := NewMessage(msgType, payload)
 	if err != nil {
 		slog.Error("failed to create broadcast message", "error", err)
 		return
 	}
+	h.deliverToUserLocked(userID, excludeDeviceID, msg)
+}
 
-	for deviceID, client := range userClients {
+// deliverToUserLocked delivers to this instance's sessions only (caller must hold lock)
+func (h *Hub) deliverToUserLocked(userID, excludeDeviceID uuid.UUID, msg Message) {
+	for deviceID, s := range h.sessions[userID] {
 		if deviceID != excludeDeviceID {
-			client.Send(msg)
+			s.deliver(msg)
 		}
 	}
 }
 
-// ForwardToDevice forwards a message to a specific device
-func (h *Hub) ForwardToDevice(userID, targetDeviceID uuid.UUID, msgType string, payload interface{}) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// ForwardToDevice forwards a message to a specific device of the same user.
+// A nil error means the message was queued for the target (or buffered while
+// it is reconnecting, or handed to the backplane), not that the target has
+// processed it.
+func (h *Hub) ForwardToDevice(userID, targetDeviceID uuid.UUID, msgType string, payload interface{}) error {
+	msg, err := NewMessage(msgType, payload)
+	if err != nil {
+		slog.Error("failed to create forward message", "error", err)
+		return err
+	}
 
-	userClients, ok := h.clients[userID]
-	if !ok {
-		slog.Warn("user not found for forwarding", "user_id", userID)
-		return
+	h.mu.RLock()
+	if s, ok := h.sessions[userID][targetDeviceID]; ok {
+		err := forwardTo(s, msg)
+		h.mu.RUnlock()
+		return err
 	}
+	_, remote := h.remote[userID][targetDeviceID]
+	h.mu.RUnlock()
+
+	if remote {
+		return h.backplane.Publish(BackplaneEvent{
+			Kind:     eventForward,
+			UserID:   userID,
+			DeviceID: targetDeviceID,
+			Message:  &msg,
+		})
+	}
+	return h.unreachable(userID, targetDeviceID)
+}
 
-	client, ok := userClients[targetDeviceID]
-	if !ok {
-		slog.Warn("target device not found", "user_id", userID, "device_id", targetDeviceID)
-		return
+// forwardTo hands a forwarded message to a session. Signaling goes straight
+// to the connection; anything else is sequenced like other events.
+func forwardTo(s *session, msg Message) error {
+	if isSignaling(msg.Type) {
+		return s.send(msg)
+	}
+	if !s.deliver(msg) {
+		return ErrPeerBusy
 	}
+	return nil
+}
 
-	msg, err := NewMessage(msgType, payload)
-	if err != nil {
-		slog.Error("failed to create forward message", "error", err)
-		return
+// unreachable returns the error for a target that isn't a connected device
+// of the user. Devices in other accounts (or that don't exist) are forbidden
+// whether or not they're connected, so a user can't probe them.
+func (h *Hub) unreachable(userID, deviceID uuid.UUID) error {
+	if h.deviceOwner != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		owner, err := h.deviceOwner(ctx, deviceID)
+		if err != nil {
+			slog.Error("failed to look up device owner", "error", err, "device_id", deviceID)
+			return ErrPeerOffline
+		}
+		if owner != userID {
+			slog.Warn("target device not in account", "user_id", userID, "device_id", deviceID)
+			return ErrForbidden
+		}
 	}
 
-	client.Send(msg)
+	slog.Warn("target device not found", "user_id", userID, "device_id", deviceID)
+	return ErrPeerOffline
 }
 
 // BroadcastStreamStart notifies all user's devices about a new stream
-func (h *Hub) BroadcastStreamStart(userID uuid.UUID, streamID, sourceDeviceID uuid.UUID, streamType, quality string) {
+func (h *Hub) BroadcastStreamStart(userID uuid.UUID, streamID, sourceDeviceID uuid.UUID, streamType, quality string, sfu bool) {
 	h.broadcastToUser(userID, uuid.Nil, TypeStreamStart, StreamStartPayload{
 		StreamID:       streamID,
 		SourceDeviceID: sourceDeviceID,
 		StreamType:     streamType,
 		Quality:        quality,
+		SFU:            sfu,
+	})
+}
+
+// BroadcastStreamStatus notifies all user's devices about a stream status change
+func (h *Hub) BroadcastStreamStatus(userID, streamID uuid.UUID, status string) {
+	h.broadcastToUser(userID, uuid.Nil, TypeStreamStatus, StreamStatusPayload{
+		StreamID: streamID,
+		Status:   status,
+	})
+}
+
+// BroadcastStreamLatency notifies all user's devices about a stream's measured latency
+func (h *Hub) BroadcastStreamLatency(userID, streamID uuid.UUID, latencyMs int) {
+	h.broadcastToUser(userID, uuid.Nil, TypeStreamLatency, StreamLatencyPayload{
+		StreamID:  streamID,
+		LatencyMs: latencyMs,
 	})
 }
 
@@ -199,19 +555,24 @@ func (h *Hub) BroadcastStreamEnd(userID uuid.UUID, streamID uuid.UUID) {
 	})
 }
 
-// GetOnlineDevices returns the list of online devices for a user
+// GetOnlineDevices returns the list of online devices for a user across the
+// cluster. Devices inside their resume grace window count as online.
 func (h *Hub) GetOnlineDevices(userID uuid.UUID) []DeviceInfo {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
+	return h.onlineDevicesLocked(userID)
+}
 
+func (h *Hub) onlineDevicesLocked(userID uuid.UUID) []DeviceInfo {
 	devices := make([]DeviceInfo, 0)
-	if userClients, ok := h.clients[userID]; ok {
-		for _, c := range userClients {
-			if c.device != nil {
-				devices = append(devices, *c.device)
-			}
+	for _, s := range h.sessions[userID] {
+		if s.device != nil {
+			devices = append(devices, *s.device)
 		}
 	}
+	for _, rd := range h.remote[userID] {
+		devices = append(devices, rd.device)
+	}
 	return devices
 }
 
@@ -220,9 +581,9 @@ func (h *Hub) IsDeviceOnline(userID, deviceID uuid.UUID) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	if userClients, ok := h.clients[userID]; ok {
-		_, online := userClients[deviceID]
-		return online
+	if _, online := h.sessions[userID][deviceID]; online {
+		return true
 	}
-	return false
+	_, online := h.remote[userID][deviceID]
+	return online
 }
@@ -0,0 +1,187 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Old connections' ReadPumps exit after their replacement has registered.
+// Their unregisters must not remove the live connection or mark the device
+// offline. Run with -race.
+func TestRapidReconnects(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var offlineEpochs []int64
+
+	// No grace window, so a wrongly matched unregister ends the session at once
+	h := NewHub(Config{ReplayBufferSize: 8})
+	h.onOffline = func(userID, deviceID uuid.UUID, epoch int64) {
+		mu.Lock()
+		offlineEpochs = append(offlineEpochs, epoch)
+		mu.Unlock()
+	}
+	go h.Run(ctx)
+
+	userID, deviceID := uuid.New(), uuid.New()
+
+	const reconnects = 100
+	var wg sync.WaitGroup
+	var last *Client
+	for i := 1; i <= reconnects; i++ {
+		c := newTestClient(userID, deviceID)
+		c.epoch = int64(i)
+		h.register <- c
+
+		if prev := last; prev != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.unregister <- prev
+			}()
+		}
+		last = c
+
+		// Signaling keeps flowing to the device while it flaps
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = h.ForwardToDevice(userID, deviceID, TypeCandidate, CandidatePayload{})
+			h.IsDeviceOnline(userID, deviceID)
+		}()
+	}
+	wg.Wait()
+
+	// A connection that lost the race registers after the newest one
+	late := newTestClient(userID, deviceID)
+	late.epoch = 1
+	h.register <- late
+	h.unregister <- late
+
+	h.mu.RLock()
+	s := h.sessions[userID][deviceID]
+	h.mu.RUnlock()
+	if s == nil || s.client != last {
+		t.Fatalf("live connection was replaced or removed")
+	}
+	if s.epoch != reconnects {
+		t.Errorf("session epoch = %d, want %d", s.epoch, reconnects)
+	}
+
+	mu.Lock()
+	if len(offlineEpochs) != 0 {
+		t.Errorf("device marked offline %d times while connected", len(offlineEpochs))
+	}
+	mu.Unlock()
+
+	// The live connection's own disconnect does end the session
+	h.unregister <- last
+	waitUntil(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(offlineEpochs) == 1
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if offlineEpochs[0] != reconnects {
+		t.Errorf("offline written with epoch %d, want %d", offlineEpochs[0], reconnects)
+	}
+	if h.IsDeviceOnline(userID, deviceID) {
+		t.Errorf("device still online after its last connection closed")
+	}
+}
+
+func TestPresenceTransitions(t *testing.T) {
+	h := newTestHub(t, Config{ResumeGrace: time.Minute, ReplayBufferSize: 8})
+	userID := uuid.New()
+	monitor := h.device(userID)
+	phone := h.device(userID)
+	h.connect(t, monitor, phone)
+
+	expect := func(want string) {
+		t.Helper()
+		msg := waitFor(t, monitor, TypeDevicePresence)
+		var p DevicePresencePayload
+		_ = json.Unmarshal(msg.Payload, &p)
+		if p.DeviceID != phone.deviceID || p.Presence != want {
+			t.Fatalf("device:presence = %s %q, want %s %q", p.DeviceID, p.Presence, phone.deviceID, want)
+		}
+	}
+
+	// Screen locks
+	h.SetVisibility(phone, false)
+	expect(PresenceAway)
+
+	// Connection drops while backgrounded
+	resume := h.drop(t, phone)
+	expect(PresenceReconnecting)
+
+	// Phone comes back within the grace window
+	h.resume(t, phone, resume)
+	expect(PresenceOnline)
+
+	for _, d := range h.GetOnlineDevices(userID) {
+		if d.ID == phone.deviceID && d.Presence != PresenceOnline {
+			t.Errorf("device list presence = %q, want %q", d.Presence, PresenceOnline)
+		}
+	}
+}
+
+// Devices of another account are never reached through a user's targets,
+// whether they're connected or not, and the user's broadcasts stay within
+// the account
+func TestCrossAccountTargets(t *testing.T) {
+	h := newTestHub(t, Config{ResumeGrace: time.Minute, ReplayBufferSize: 32})
+	userID := uuid.New()
+	monitor := h.device(userID)
+	phone := h.device(userID)
+	stranger := h.device(uuid.New())
+	stranger.device.HasCamera = true
+	offline := h.device(stranger.userID)
+	h.connect(t, monitor, phone, stranger)
+	h.SetControls(stranger, ControlCapabilities{Torch: true})
+
+	for _, target := range []*Client{stranger, offline} {
+		if err := h.ForwardToDevice(userID, target.deviceID, TypeOffer, OfferPayload{FromDeviceID: phone.deviceID, ToDeviceID: target.deviceID}); err != ErrForbidden {
+			t.Errorf("offer: got %v, want %v", err, ErrForbidden)
+		}
+		if err := h.ForwardControl(userID, TypeControlTorch, &ControlTorchPayload{ToDeviceID: target.deviceID, On: true}); err != ErrForbidden {
+			t.Errorf("control: got %v, want %v", err, ErrForbidden)
+		}
+		if err := h.ForwardToDevice(userID, target.deviceID, TypeChatMessage, ChatMessagePayload{Body: "hi"}); err != ErrForbidden {
+			t.Errorf("chat message: got %v, want %v", err, ErrForbidden)
+		}
+
+		h.DeliverChatMessage(userID, uuid.New(), phone.deviceID, &target.deviceID, nil, "hi", time.Now())
+		h.DeliverTransferOffer(userID, uuid.New(), phone.deviceID, target.deviceID, "clip.mov", "video/quicktime", 1, time.Now().Add(time.Hour))
+		h.DeliverTransferProgress(userID, uuid.New(), phone.deviceID, target.deviceID, "uploading", 1, 2)
+
+		// Removing it under the wrong account doesn't disconnect it
+		h.RemoveDevice(userID, target.deviceID)
+	}
+	if !h.IsDeviceOnline(stranger.userID, stranger.deviceID) {
+		t.Fatal("another account's device was disconnected")
+	}
+
+	// Everything the account does, its own devices see
+	h.BroadcastStreamStart(userID, uuid.New(), phone.deviceID, "video", "high", false)
+	h.UpdateDevice(userID, phone.deviceID, "Kitchen", true, false)
+	h.SetControls(phone, ControlCapabilities{Torch: true})
+	h.SetTelemetry(phone, Telemetry{BatteryLevel: 5, ThermalState: ThermalNominal, NetworkType: NetworkWifi})
+	h.DeliverChatMessage(userID, uuid.New(), phone.deviceID, nil, nil, "hi", time.Now())
+	waitFor(t, monitor, TypeChatMessage)
+
+	if msgs := drain(t, stranger); len(msgs) != 0 {
+		t.Fatalf("another account's device got %d messages, first %s", len(msgs), msgs[0].Type)
+	}
+	if s := h.session(stranger); s.seq != 0 || len(s.buffer) != 0 {
+		t.Fatalf("another account's session has %d buffered events", len(s.buffer))
+	}
+}
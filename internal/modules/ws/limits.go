@@ -0,0 +1,177 @@
+package ws
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// closePolicyViolation is sent when a client is disconnected for repeatedly
+// exceeding its message limits
+const closePolicyViolation = websocket.ClosePolicyViolation
+
+// MessagePolicy limits one message type on a single connection
+type MessagePolicy struct {
+	// Sustained messages per second and how many may arrive in a burst
+	Rate  float64
+	Burst int
+
+	// Largest accepted message in bytes, envelope included
+	MaxSize int
+}
+
+// Limits is the message policy applied to every connection
+type Limits struct {
+	// Policies by message type; types not listed use Default
+	Policies map[string]MessagePolicy
+	Default  MessagePolicy
+
+	// A connection is closed once it racks up MaxViolations rejected
+	// messages within ViolationWindow
+	MaxViolations   int
+	ViolationWindow time.Duration
+}
+
+// DefaultLimits returns the built-in message policy. SDPs are large but rare,
+// candidates small but bursty while ICE gathers.
+func DefaultLimits() Limits {
+	return Limits{
+		Policies: map[string]MessagePolicy{
+			TypeOffer:       {Rate: 2, Burst: 10, MaxSize: 64 * 1024},
+			TypeAnswer:      {Rate: 2, Burst: 10, MaxSize: 64 * 1024},
+			TypeCandidate:   {Rate: 20, Burst: 50, MaxSize: 2 * 1024},
+			TypePing:        {Rate: 1, Burst: 5, MaxSize: 256},
+			TypeVisibility:  {Rate: 1, Burst: 5, MaxSize: 256},
+			TypeAuthRefresh: {Rate: 1, Burst: 5, MaxSize: 4 * 1024},
+			TypeTelemetry:   {Rate: 1, Burst: 5, MaxSize: 1024},
+		},
+		Default:         MessagePolicy{Rate: 10, Burst: 20, MaxSize: 16 * 1024},
+		MaxViolations:   20,
+		ViolationWindow: time.Minute,
+	}
+}
+
+// ParsePolicies overrides policies from entries of the form
+// "type=rate:burst:max_size", e.g. "webrtc:candidate=50:100:4096".
+// The type "default" sets the policy for unlisted types. Malformed entries
+// are logged and skipped.
+func (l *Limits) ParsePolicies(entries []string) {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		policy, msgType, ok := parsePolicy(entry)
+		if !ok {
+			slog.Warn("ignoring malformed websocket rate limit", "entry", entry)
+			continue
+		}
+
+		if msgType == "default" {
+			l.Default = policy
+		} else {
+			l.Policies[msgType] = policy
+		}
+	}
+}
+
+func parsePolicy(entry string) (MessagePolicy, string, bool) {
+	// Message types contain ':', so split on the last '='
+	i := strings.LastIndex(entry, "=")
+	if i <= 0 {
+		return MessagePolicy{}, "", false
+	}
+
+	parts := strings.Split(entry[i+1:], ":")
+	if len(parts) != 3 {
+		return MessagePolicy{}, "", false
+	}
+
+	r, err1 := strconv.ParseFloat(parts[0], 64)
+	burst, err2 := strconv.Atoi(parts[1])
+	size, err3 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil || r <= 0 || burst <= 0 || size <= 0 {
+		return MessagePolicy{}, "", false
+	}
+
+	return MessagePolicy{Rate: r, Burst: burst, MaxSize: size}, entry[:i], true
+}
+
+func (l Limits) policy(msgType string) MessagePolicy {
+	if p, ok := l.Policies[msgType]; ok {
+		return p
+	}
+	return l.Default
+}
+
+// messageLimiter enforces Limits for one connection
+type messageLimiter struct {
+	limits   Limits
+	buckets  map[string]*rate.Limiter
+	rejected []time.Time
+	mu       sync.Mutex
+}
+
+func newMessageLimiter(limits Limits) *messageLimiter {
+	return &messageLimiter{
+		limits:  limits,
+		buckets: make(map[string]*rate.Limiter),
+	}
+}
+
+// allow checks a message against its type's size limit and token bucket.
+// Every type in the protocol has its own bucket, so chat can't starve
+// telemetry; unknown types share one so they can't be used to dodge limits.
+func (l *messageLimiter) allow(msgType string, size int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := msgType
+	if _, ok := l.limits.Policies[msgType]; !ok && !protocolTypes[msgType] {
+		key = ""
+	}
+	policy := l.limits.policy(msgType)
+
+	if size > policy.MaxSize {
+		l.reject()
+		return ErrMessageTooLarge
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = rate.NewLimiter(rate.Limit(policy.Rate), policy.Burst)
+		l.buckets[key] = bucket
+	}
+	if !bucket.Allow() {
+		l.reject()
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// reject records a violation (caller must hold l.mu)
+func (l *messageLimiter) reject() {
+	now := time.Now()
+	cutoff := now.Add(-l.limits.ViolationWindow)
+
+	kept := l.rejected[:0]
+	for _, t := range l.rejected {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	l.rejected = append(kept, now)
+}
+
+// exhausted reports whether the connection should be closed
+func (l *messageLimiter) exhausted() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limits.MaxViolations > 0 && len(l.rejected) >= l.limits.MaxViolations
+}
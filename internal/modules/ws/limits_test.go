@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageLimiter(t *testing.T) {
+	limits := DefaultLimits()
+	limits.Policies[TypeCandidate] = MessagePolicy{Rate: 1, Burst: 3, MaxSize: 100}
+	limits.MaxViolations = 3
+	l := newMessageLimiter(limits)
+
+	for i := 0; i < 3; i++ {
+		if err := l.allow(TypeCandidate, 50); err != nil {
+			t.Fatalf("candidate %d within burst rejected: %v", i, err)
+		}
+	}
+	if err := l.allow(TypeCandidate, 50); err != ErrRateLimited {
+		t.Errorf("candidate over burst: got %v, want %v", err, ErrRateLimited)
+	}
+
+	// Other types have their own buckets
+	if err := l.allow(TypeOffer, 10*1024); err != nil {
+		t.Errorf("offer rejected: %v", err)
+	}
+
+	if err := l.allow(TypeCandidate, 101); err != ErrMessageTooLarge {
+		t.Errorf("oversized candidate: got %v, want %v", err, ErrMessageTooLarge)
+	}
+	if l.exhausted() {
+		t.Fatalf("exhausted after 2 violations, limit is 3")
+	}
+
+	_ = l.allow(TypeCandidate, 50)
+	if !l.exhausted() {
+		t.Errorf("not exhausted after 3 violations")
+	}
+}
+
+func TestMessageLimiterBuckets(t *testing.T) {
+	limits := DefaultLimits()
+	limits.Default = MessagePolicy{Rate: 1, Burst: 2, MaxSize: 1024}
+	l := newMessageLimiter(limits)
+
+	for i := 0; i < 2; i++ {
+		if err := l.allow(TypeChatMessage, 10); err != nil {
+			t.Fatalf("chat message %d within burst rejected: %v", i, err)
+		}
+	}
+	if err := l.allow(TypeChatMessage, 10); err != ErrRateLimited {
+		t.Errorf("chat message over burst: got %v, want %v", err, ErrRateLimited)
+	}
+
+	// Protocol types without a policy of their own still get their own bucket
+	if err := l.allow(TypeStreamStart, 10); err != nil {
+		t.Errorf("stream start rejected after chat used its bucket: %v", err)
+	}
+
+	// Unknown types share one
+	if err := l.allow("made:up", 10); err != nil {
+		t.Fatalf("first unknown type rejected: %v", err)
+	}
+	_ = l.allow("made:up", 10)
+	if err := l.allow("also:made:up", 10); err != ErrRateLimited {
+		t.Errorf("unknown type with shared bucket spent: got %v, want %v", err, ErrRateLimited)
+	}
+}
+
+func TestParsePolicies(t *testing.T) {
+	limits := DefaultLimits()
+	limits.ParsePolicies([]string{
+		"webrtc:candidate=50:100:4096",
+		" default=5:5:1024",
+		"webrtc:offer=fast:10:10",
+		"nonsense",
+	})
+
+	if got := limits.policy(TypeCandidate); got != (MessagePolicy{Rate: 50, Burst: 100, MaxSize: 4096}) {
+		t.Errorf("candidate policy = %+v", got)
+	}
+	if got := limits.policy("chat:message"); got != (MessagePolicy{Rate: 5, Burst: 5, MaxSize: 1024}) {
+		t.Errorf("default policy = %+v", got)
+	}
+	if got := limits.policy(TypeOffer); got != DefaultLimits().Policies[TypeOffer] {
+		t.Errorf("malformed entry changed offer policy to %+v", got)
+	}
+	if limits.ViolationWindow != time.Minute {
+		t.Errorf("violation window = %v", limits.ViolationWindow)
+	}
+}
@@ -12,26 +12,93 @@ const (
 	TypeDeviceOnline  = "device:online"
 	TypeDeviceOffline = "device:offline"
 	TypeDeviceList    = "device:list"
+	TypeDeviceUpdated = "device:updated"
+	TypeDeviceRemoved = "device:removed"
 
-	// Stream events
-	TypeStreamStart = "stream:start"
-	TypeStreamEnd   = "stream:end"
+	// Presence: the server broadcasts device:presence on state changes,
+	// clients report foreground/background with device:visibility
+	TypeDevicePresence = "device:presence"
+	TypeVisibility     = "device:visibility"
+
+	// Stream events. Clients may also send stream:start and stream:end to
+	// start and end streams.
+	TypeStreamStart   = "stream:start"
+	TypeStreamStatus  = "stream:status"
+	TypeStreamLatency = "stream:latency"
+	TypeStreamEnd     = "stream:end"
+
+	// Chat between a user's devices: clients send chat:message and mark
+	// messages read with chat:read
+	TypeChatMessage = "chat:message"
+	TypeChatRead    = "chat:read"
+
+	// File transfers: the receiver gets transfer:offer and answers with
+	// transfer:accept, which is passed on to the sender; both follow the
+	// upload and download with transfer:progress
+	TypeTransferOffer    = "transfer:offer"
+	TypeTransferAccept   = "transfer:accept"
+	TypeTransferProgress = "transfer:progress"
 
 	// WebRTC signaling
 	TypeOffer     = "webrtc:offer"
 	TypeAnswer    = "webrtc:answer"
 	TypeCandidate = "webrtc:candidate"
 
+	// Remote camera control: sources advertise control:capabilities,
+	// monitors send the commands
+	TypeControlCapabilities = "control:capabilities"
+	TypeControlCamera       = "control:camera"
+	TypeControlTorch        = "control:torch"
+	TypeControlZoom         = "control:zoom"
+	TypeControlMic          = "control:mic"
+	TypeControlExposure     = "control:exposure"
+
+	// Device health: sources report telemetry periodically, the server
+	// raises telemetry:alert when a threshold is crossed
+	TypeTelemetry      = "telemetry"
+	TypeTelemetryAlert = "telemetry:alert"
+
+	// Authentication: the server warns with auth:expiring before the
+	// connection's access token expires, the client answers with auth:refresh
+	TypeAuthExpiring = "auth:expiring"
+	TypeAuthRefresh  = "auth:refresh"
+
 	// Control
 	TypeError = "error"
 	TypePing  = "ping"
 	TypePong  = "pong"
+	TypeAck   = "ack"
+	TypeNack  = "nack"
+
+	// Session: a client opens with hello, answered by welcome, then
+	// every connection gets session
+	TypeHello   = "hello"
+	TypeWelcome = "welcome"
+	TypeSession = "session"
 )
 
-// Message is the base WebSocket message envelope
+// Presence states. A device is away while its client reports being hidden,
+// and reconnecting while its session waits out the resume grace window.
+const (
+	PresenceOnline       = "online"
+	PresenceAway         = "away"
+	PresenceReconnecting = "reconnecting"
+	PresenceOffline      = "offline"
+)
+
+// Message is the base WebSocket message envelope.
+// ID is optional and chosen by the client; when set, the server answers the
+// request with an ack (or nack on failure) carrying the same ID, and any
+// error caused by the request is tagged with it too.
+// Seq is set on server events that can be replayed after a resume.
 type Message struct {
+	ID      string          `json:"id,omitempty"`
+	Seq     uint64          `json:"seq,omitempty"`
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Payload before marshaling, for codecs other than JSON
+	value interface{}
 }
 
 // DeviceInfo represents device information in events
@@ -43,6 +110,13 @@ type DeviceInfo struct {
 	HasCamera     bool      `json:"has_camera"`
 	HasMicrophone bool      `json:"has_microphone"`
 	IsOnline      bool      `json:"is_online"`
+	Presence      string    `json:"presence"`
+
+	// Remote controls advertised by the device, if any
+	Controls *ControlCapabilities `json:"controls,omitempty"`
+
+	// Latest telemetry reported by the device, if any
+	Telemetry *Telemetry `json:"telemetry,omitempty"`
 }
 
 // DeviceOnlinePayload is sent when a device comes online
@@ -55,79 +129,215 @@ type DeviceOfflinePayload struct {
 	DeviceID uuid.UUID `json:"device_id"`
 }
 
-// DeviceListPayload is sent when client first connects
+// DeviceUpdatedPayload is sent when a device is renamed or its capabilities change
+type DeviceUpdatedPayload struct {
+	DeviceID      uuid.UUID `json:"device_id"`
+	DeviceName    string    `json:"device_name"`
+	HasCamera     bool      `json:"has_camera"`
+	HasMicrophone bool      `json:"has_microphone"`
+}
+
+// DeviceRemovedPayload is sent when a device is deleted from the account
+type DeviceRemovedPayload struct {
+	DeviceID uuid.UUID `json:"device_id"`
+}
+
+// DevicePresencePayload is sent when a connected device's presence changes
+type DevicePresencePayload struct {
+	DeviceID uuid.UUID `json:"device_id"`
+	Presence string    `json:"presence"`
+}
+
+// VisibilityPayload is sent by a client when it moves to the background or back
+type VisibilityPayload struct {
+	Visible bool `json:"visible" binding:"required"`
+}
+
+// DeviceListPayload is sent when client first connects. Unread counts the
+// client's unread chat messages by sending device.
 type DeviceListPayload struct {
-	Devices []DeviceInfo `json:"devices"`
+	Devices []DeviceInfo      `json:"devices"`
+	Unread  map[uuid.UUID]int `json:"unread,omitempty"`
+}
+
+// SessionPayload is sent first on every connection. Reconnect with
+// ?resume=<resume_token>&last_seq=<last seq received> within resume_window
+// seconds to have missed events replayed instead of starting over.
+type SessionPayload struct {
+	ResumeToken  string `json:"resume_token"`
+	Resumed      bool   `json:"resumed"`
+	Seq          uint64 `json:"seq"`
+	ResumeWindow int    `json:"resume_window"`
 }
 
-// StreamStartPayload is sent when a device starts streaming
+// StreamStartPayload is sent when a device starts streaming. An sfu stream
+// is watched by subscribing to it on the server rather than from the source.
 type StreamStartPayload struct {
 	StreamID       uuid.UUID `json:"stream_id"`
 	SourceDeviceID uuid.UUID `json:"source_device_id"`
 	StreamType     string    `json:"stream_type"`
 	Quality        string    `json:"quality"`
+	SFU            bool      `json:"sfu,omitempty"`
+}
+
+// StreamStatusPayload is sent when a stream's status changes
+type StreamStatusPayload struct {
+	StreamID uuid.UUID `json:"stream_id"`
+	Status   string    `json:"status"`
+}
+
+// StreamLatencyPayload is sent when a stream reports its latency
+type StreamLatencyPayload struct {
+	StreamID  uuid.UUID `json:"stream_id"`
+	LatencyMs int       `json:"latency_ms"`
 }
 
-// StreamEndPayload is sent when a stream ends
+// StreamEndPayload is sent when a stream ends, and by a client to end one
 type StreamEndPayload struct {
+	StreamID uuid.UUID `json:"stream_id" binding:"required"`
+}
+
+// StreamStartRequest is sent by a client to start a stream. The source
+// defaults to the sending device; with sfu set it publishes to the server.
+type StreamStartRequest struct {
+	SourceDeviceID uuid.UUID `json:"source_device_id"`
+	TargetDeviceID uuid.UUID `json:"target_device_id"`
+	StreamType     string    `json:"stream_type" binding:"required,oneof=video audio both"`
+	Quality        string    `json:"quality" binding:"omitempty,oneof=low medium high auto"`
+	SFU            bool      `json:"sfu"`
+}
+
+// StreamStartedPayload is the ack payload of a stream:start request
+type StreamStartedPayload struct {
 	StreamID uuid.UUID `json:"stream_id"`
 }
 
-// WebRTC signaling payloads
+// ChatMessageRequest is sent by a client. Without to_device_id the message
+// goes to all of the user's other devices.
+type ChatMessageRequest struct {
+	ToDeviceID *uuid.UUID `json:"to_device_id,omitempty"`
+	StreamID   *uuid.UUID `json:"stream_id,omitempty"`
+	Body       string     `json:"body" binding:"required,min=1,max=2000"`
+}
+
+// ChatMessagePayload delivers a stored message; sent_at is Unix milliseconds
+type ChatMessagePayload struct {
+	MessageID    uuid.UUID  `json:"message_id"`
+	FromDeviceID uuid.UUID  `json:"from_device_id"`
+	ToDeviceID   *uuid.UUID `json:"to_device_id,omitempty"`
+	StreamID     *uuid.UUID `json:"stream_id,omitempty"`
+	Body         string     `json:"body"`
+	SentAt       int64      `json:"sent_at"`
+}
+
+// ChatSentPayload is the ack payload of a chat:message request
+type ChatSentPayload struct {
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+// ChatReadPayload marks messages up to message_id as read on the sending device
+type ChatReadPayload struct {
+	MessageID uuid.UUID `json:"message_id" binding:"required"`
+}
+
+// AuthExpiringPayload warns that the connection's access token expires at
+// expires_at (Unix seconds)
+type AuthExpiringPayload struct {
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// AuthRefreshPayload is sent by a client with a new access token
+type AuthRefreshPayload struct {
+	AccessToken string `json:"access_token" binding:"required"`
+}
+
+// WebRTC signaling payloads. from_device_id is set by the server. With
+// stream_id instead of to_device_id they're exchanged with the server's SFU
+// for that stream; the SFU's own messages carry the nil UUID as
+// from_device_id.
 
 type OfferPayload struct {
-	FromDeviceID uuid.UUID `json:"from_device_id"`
-	ToDeviceID   uuid.UUID `json:"to_device_id"`
-	SDP          string    `json:"sdp"`
+	FromDeviceID uuid.UUID  `json:"from_device_id"`
+	ToDeviceID   uuid.UUID  `json:"to_device_id" binding:"required_without=StreamID"`
+	StreamID     *uuid.UUID `json:"stream_id,omitempty"`
+	SDP          string     `json:"sdp" binding:"required"`
 }
 
 type AnswerPayload struct {
-	FromDeviceID uuid.UUID `json:"from_device_id"`
-	ToDeviceID   uuid.UUID `json:"to_device_id"`
-	SDP          string    `json:"sdp"`
+	FromDeviceID uuid.UUID  `json:"from_device_id"`
+	ToDeviceID   uuid.UUID  `json:"to_device_id" binding:"required_without=StreamID"`
+	StreamID     *uuid.UUID `json:"stream_id,omitempty"`
+	SDP          string     `json:"sdp" binding:"required"`
 }
 
+// CandidatePayload carries an ICE candidate; an empty or missing candidate
+// marks the end of gathering
 type CandidatePayload struct {
-	FromDeviceID  uuid.UUID `json:"from_device_id"`
-	ToDeviceID    uuid.UUID `json:"to_device_id"`
-	Candidate     string    `json:"candidate"`
-	SDPMLineIndex *uint16   `json:"sdp_mline_index,omitempty"`
-	SDPMid        *string   `json:"sdp_mid,omitempty"`
+	FromDeviceID  uuid.UUID  `json:"from_device_id"`
+	ToDeviceID    uuid.UUID  `json:"to_device_id" binding:"required_without=StreamID"`
+	StreamID      *uuid.UUID `json:"stream_id,omitempty"`
+	Candidate     string     `json:"candidate"`
+	SDPMLineIndex *uint16    `json:"sdp_mline_index,omitempty"`
+	SDPMid        *string    `json:"sdp_mid,omitempty"`
 }
 
-// ErrorPayload is sent when an error occurs
+// ErrorPayload is sent when an error occurs, and as the payload of a nack
 type ErrorPayload struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
 }
 
-// Helper functions to create messages
+// Helper functions to create messages. The payload is marshaled to JSON once
+// here; each client's codec encodes the envelope when it is sent.
+
+func NewMessage(msgType string, payload interface{}) (Message, error) {
+	return newMessage("", msgType, payload)
+}
+
+func newMessage(id, msgType string, payload interface{}) (Message, error) {
+	msg := Message{
+		ID:    id,
+		Type:  msgType,
+		value: payload,
+	}
 
-func NewMessage(msgType string, payload interface{}) ([]byte, error) {
-	var payloadBytes json.RawMessage
 	if payload != nil {
-		var err error
-		payloadBytes, err = json.Marshal(payload)
+		data, err := json.Marshal(payload)
 		if err != nil {
-			return nil, err
+			return Message{}, err
 		}
+		msg.Payload = data
 	}
 
-	msg := Message{
-		Type:    msgType,
-		Payload: payloadBytes,
-	}
+	return msg, nil
+}
+
+// NewErrorMessage creates an error, tagged with the ID of the request that caused it (if any)
+func NewErrorMessage(id, code, message string) (Message, error) {
+	return newMessage(id, TypeError, ErrorPayload{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// NewAckMessage acknowledges the request with the given ID
+func NewAckMessage(id string) (Message, error) {
+	return newMessage(id, TypeAck, nil)
+}
 
-	return json.Marshal(msg)
+// NewAckMessageWith acknowledges a request whose result the client needs
+func NewAckMessageWith(id string, payload interface{}) (Message, error) {
+	return newMessage(id, TypeAck, payload)
 }
 
-func NewErrorMessage(code, message string) ([]byte, error) {
-	return NewMessage(TypeError, ErrorPayload{
+// NewNackMessage rejects the request with the given ID
+func NewNackMessage(id, code, message string) (Message, error) {
+	return newMessage(id, TypeNack, ErrorPayload{
 		Code:    code,
 		Message: message,
 	})
 }
 
-func NewPongMessage() ([]byte, error) {
-	return NewMessage(TypePong, nil)
+func NewPongMessage(id string) (Message, error) {
+	return newMessage(id, TypePong, nil)
 }
@@ -0,0 +1,204 @@
+package ws
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// CloseSlowConsumer is sent to a connection that dropped too many messages
+// without catching up. Clients should reconnect and resume their session.
+const CloseSlowConsumer = 4004
+
+// Outbound lanes. A client's writer always empties the control lane before
+// the signaling lane, and that before the events lane, so a pong, ack or
+// WebRTC offer isn't stuck behind a backlog of events. Every sequenced event
+// goes through the events lane, in seq order: a client resumes from the
+// highest seq it has seen, so an event overtaking older ones would get those
+// skipped on resume. Signaling is never sequenced for that reason.
+const (
+	laneControl = iota
+	laneSignaling
+	laneEvents
+	laneCount
+)
+
+// Messages each lane holds before new ones are dropped
+var laneSize = [laneCount]int{
+	laneControl:   256,
+	laneSignaling: 256,
+	laneEvents:    256,
+}
+
+// laneFor picks the lane of an outbound message: unsequenced replies and
+// connection frames go first, then signaling, and everything else keeps its
+// order
+func laneFor(msg Message) int {
+	if msg.Seq != 0 {
+		return laneEvents
+	}
+	switch {
+	case msg.Type == TypeAck, msg.Type == TypeNack, msg.Type == TypeError, msg.Type == TypePong,
+		msg.Type == TypeWelcome, msg.Type == TypeSession, msg.Type == TypeAuthExpiring:
+		return laneControl
+	case isSignaling(msg.Type):
+		return laneSignaling
+	default:
+		return laneEvents
+	}
+}
+
+// isSignaling reports whether a message type is WebRTC signaling. Signaling
+// is passed to the connection unsequenced and isn't replayed on resume; a
+// peer that gets a PEER_OFFLINE nack re-sends it once the device is back.
+func isSignaling(msgType string) bool {
+	switch msgType {
+	case TypeOffer, TypeAnswer, TypeCandidate:
+		return true
+	default:
+		return false
+	}
+}
+
+// coalesceKey identifies messages that supersede each other while queued:
+// only a device's latest presence and a transfer's latest progress matter.
+// The newer message is queued at the back, so seq stays in order and only
+// skips the superseded one. Empty means never coalesced.
+func coalesceKey(msg Message) string {
+	switch msg.Type {
+	case TypeDevicePresence:
+		p, ok := msg.value.(DevicePresencePayload)
+		if !ok {
+			// Relayed through the backplane, only the JSON is left
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				return ""
+			}
+		}
+		return msg.Type + "/" + p.DeviceID.String()
+
+	case TypeTransferProgress:
+		p, ok := msg.value.(TransferProgressPayload)
+		if !ok {
+			if err := json.Unmarshal(msg.Payload, &p); err != nil {
+				return ""
+			}
+		}
+		return msg.Type + "/" + p.TransferID.String()
+
+	default:
+		return ""
+	}
+}
+
+// outboundMessage is an encoded message waiting for the writer
+type outboundMessage struct {
+	data []byte
+	key  string
+}
+
+// outbox queues a client's outbound messages. Unlike a channel it is safe to
+// push to after it has been closed, so the hub, forwarded messages and
+// request replies never need to know whether the client is still there.
+type outbox struct {
+	mu     sync.Mutex
+	lanes  [laneCount][]outboundMessage
+	closed bool
+
+	// Messages dropped since the client last emptied its queue, and how
+	// many it may drop before it's disconnected (0 means never)
+	drops    int
+	maxDrops int
+
+	// Signalled when a message is queued or the outbox is closed
+	ready chan struct{}
+}
+
+func newOutbox(maxDrops int) *outbox {
+	return &outbox{
+		maxDrops: maxDrops,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push queues a message, replacing a queued one with the same non-empty key.
+// If the lane is full the message is dropped and push returns how many have
+// been dropped since the client last caught up. Messages pushed after close
+// are discarded without counting.
+func (o *outbox) push(lane int, key string, data []byte) (queued bool, drops int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return false, 0
+	}
+
+	if key != "" {
+		o.removeLocked(lane, key)
+	}
+
+	if len(o.lanes[lane]) >= laneSize[lane] {
+		o.drops++
+		return false, o.drops
+	}
+
+	o.lanes[lane] = append(o.lanes[lane], outboundMessage{data: data, key: key})
+	o.signal()
+	return true, 0
+}
+
+// tooSlow reports whether a client that has dropped this many messages
+// should be disconnected; true only once per backlog
+func (o *outbox) tooSlow(drops int) bool {
+	return o.maxDrops > 0 && drops == o.maxDrops
+}
+
+// removeLocked drops a queued message with the given key (caller must hold lock)
+func (o *outbox) removeLocked(lane int, key string) {
+	queue := o.lanes[lane]
+	for i, m := range queue {
+		if m.key == key {
+			o.lanes[lane] = append(queue[:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// next takes the oldest message of the most urgent non-empty lane. It
+// returns nil if nothing is queued, and done once the outbox is closed and
+// every message queued before has been taken.
+func (o *outbox) next() (data []byte, done bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for lane := range o.lanes {
+		if queue := o.lanes[lane]; len(queue) > 0 {
+			data = queue[0].data
+			queue[0] = outboundMessage{}
+			o.lanes[lane] = queue[1:]
+			return data, false
+		}
+	}
+
+	// Caught up
+	o.drops = 0
+	return nil, o.closed
+}
+
+// close stops the outbox taking messages; the writer still gets the ones
+// already queued. Closing more than once is harmless.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.closed {
+		o.closed = true
+		o.signal()
+	}
+}
+
+// signal wakes the writer (caller must hold lock)
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,229 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestOutboxLanes(t *testing.T) {
+	c := newTestClient(uuid.New(), uuid.New())
+	peer := uuid.New()
+
+	presence := func(seq uint64, p string) Message {
+		msg, _ := NewMessage(TypeDevicePresence, DevicePresencePayload{DeviceID: peer, Presence: p})
+		msg.Seq = seq
+		return msg
+	}
+	c.Send(presence(1, PresenceAway))
+	c.Send(Message{Seq: 2, Type: TypeStreamStart})
+	c.Send(presence(3, PresenceReconnecting))
+	c.Send(Message{Type: TypeAnswer})
+	c.Send(Message{ID: "1", Type: TypePong})
+	c.Send(presence(4, PresenceOnline))
+
+	// Replies first, then signaling, then events in seq order with only the
+	// last presence
+	got := drain(t, c)
+	want := []struct {
+		seq     uint64
+		msgType string
+	}{
+		{0, TypePong},
+		{0, TypeAnswer},
+		{2, TypeStreamStart},
+		{4, TypeDevicePresence},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for i, msg := range got {
+		if msg.Seq != want[i].seq || msg.Type != want[i].msgType {
+			t.Errorf("message %d = %s seq %d, want %s seq %d", i, msg.Type, msg.Seq, want[i].msgType, want[i].seq)
+		}
+	}
+	if p := got[3].Payload; string(p) != string(presence(4, PresenceOnline).Payload) {
+		t.Errorf("presence = %s, want the latest", p)
+	}
+}
+
+// An offer forwarded behind a full lane of events is written first, and the
+// events keep their seqs so the device can still resume
+func TestSignalingOvertakesEvents(t *testing.T) {
+	h := newTestHub(t, Config{ReplayBufferSize: laneSize[laneEvents] + 8, ResumeGrace: time.Minute})
+	userID := uuid.New()
+	phone := h.device(userID)
+	mac := h.device(userID)
+	h.connect(t, phone, mac)
+
+	for i := 0; i < laneSize[laneEvents]; i++ {
+		h.broadcastToUser(userID, phone.deviceID, TypeDevicePresence, DevicePresencePayload{DeviceID: uuid.New(), Presence: PresenceAway})
+	}
+	offer := OfferPayload{FromDeviceID: phone.deviceID, ToDeviceID: mac.deviceID, SDP: "v=0"}
+	if err := h.ForwardToDevice(userID, mac.deviceID, TypeOffer, offer); err != nil {
+		t.Fatalf("offer behind a full events lane: %v", err)
+	}
+
+	got := drain(t, mac)
+	if len(got) != laneSize[laneEvents]+1 {
+		t.Fatalf("got %d messages, want %d", len(got), laneSize[laneEvents]+1)
+	}
+	if got[0].Type != TypeOffer || got[0].Seq != 0 {
+		t.Fatalf("first message = %s seq %d, want an unsequenced offer", got[0].Type, got[0].Seq)
+	}
+	for i, msg := range got[2:] {
+		if msg.Seq != got[1].Seq+uint64(i)+1 {
+			t.Fatalf("event %d has seq %d after %d", i+1, msg.Seq, got[1].Seq)
+		}
+	}
+
+	// Resuming from the last event replays nothing, the offer included
+	s := h.session(mac)
+	if !s.canResume(resumeRequest{token: s.token, lastSeq: got[len(got)-1].Seq}) {
+		t.Fatal("session not resumable from the last event")
+	}
+	for _, ev := range s.buffer {
+		if ev.Type == TypeOffer {
+			t.Fatal("offer buffered for replay")
+		}
+	}
+
+	// A full signaling lane is reported to the sender
+	for i := 0; i < laneSize[laneSignaling]; i++ {
+		if err := h.ForwardToDevice(userID, mac.deviceID, TypeCandidate, CandidatePayload{}); err != nil {
+			t.Fatalf("candidate %d: %v", i, err)
+		}
+	}
+	if err := h.ForwardToDevice(userID, mac.deviceID, TypeCandidate, CandidatePayload{}); err != ErrPeerBusy {
+		t.Fatalf("candidate past a full lane: got %v, want %v", err, ErrPeerBusy)
+	}
+}
+
+// With a device's events lane full, each feature's messages to it fail or
+// are dropped without taking a seq, while replies and signaling still get
+// through
+func TestFullEventsLane(t *testing.T) {
+	h := newTestHub(t, Config{ReplayBufferSize: laneSize[laneEvents] + 8, ResumeGrace: time.Minute})
+	userID := uuid.New()
+	phone := h.device(userID)
+	mac := h.device(userID)
+	mac.device.HasCamera = true
+	h.connect(t, phone, mac)
+	h.SetControls(mac, ControlCapabilities{Torch: true})
+	drain(t, phone)
+
+	for i := 0; i < laneSize[laneEvents]; i++ {
+		h.broadcastToUser(userID, phone.deviceID, TypeDevicePresence, DevicePresencePayload{DeviceID: uuid.New(), Presence: PresenceAway})
+	}
+	s := h.session(mac)
+	full := s.seq
+
+	if err := h.ForwardControl(userID, TypeControlTorch, &ControlTorchPayload{ToDeviceID: mac.deviceID, On: true}); err != ErrPeerBusy {
+		t.Errorf("control: got %v, want %v", err, ErrPeerBusy)
+	}
+	if err := h.ForwardToDevice(userID, mac.deviceID, TypeChatMessage, ChatMessagePayload{Body: "hi"}); err != ErrPeerBusy {
+		t.Errorf("chat message: got %v, want %v", err, ErrPeerBusy)
+	}
+	h.DeliverTransferOffer(userID, uuid.New(), phone.deviceID, mac.deviceID, "clip.mov", "video/quicktime", 1, time.Now().Add(time.Hour))
+	h.BroadcastStreamStart(userID, uuid.New(), phone.deviceID, "video", "high", false)
+	h.SetTelemetry(phone, Telemetry{BatteryLevel: 80, ThermalState: ThermalNominal, FreeStorageMB: 20000, NetworkType: NetworkWifi})
+	if s.seq != full {
+		t.Fatalf("seq = %d after dropped events, want %d", s.seq, full)
+	}
+
+	if err := h.ForwardToDevice(userID, mac.deviceID, TypeAnswer, AnswerPayload{FromDeviceID: phone.deviceID, ToDeviceID: mac.deviceID}); err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	mac.handleMessage([]byte(`{"id":"1","type":"ping"}`))
+
+	got := drain(t, mac)
+	if len(got) != laneSize[laneEvents]+2 || got[0].Type != TypePong || got[1].Type != TypeAnswer {
+		t.Fatalf("got %d messages starting %s, %s; want a pong and the answer first", len(got), got[0].Type, got[1].Type)
+	}
+
+	// Once caught up, events carry on from the last seq it was sent
+	h.BroadcastStreamStart(userID, uuid.New(), phone.deviceID, "video", "high", false)
+	if msg := waitFor(t, mac, TypeStreamStart); msg.Seq != full+1 {
+		t.Fatalf("next event seq = %d, want %d", msg.Seq, full+1)
+	}
+}
+
+func TestOutboxSlowConsumer(t *testing.T) {
+	h := NewHub(Config{SlowClientDrops: 3})
+	c := NewClient(h, nil, uuid.New(), uuid.New(), &DeviceInfo{})
+	c.closing = make(chan closeFrame, 1)
+
+	for i := 0; i < laneSize[laneEvents]; i++ {
+		if !c.Send(Message{Type: TypeStreamStatus}) {
+			t.Fatalf("message %d dropped before the lane was full", i)
+		}
+	}
+
+	// Replies still get through a full events lane
+	if !c.Send(Message{ID: "1", Type: TypeAck}) {
+		t.Error("ack dropped while only events were backed up")
+	}
+
+	for i := 0; i < 2; i++ {
+		if c.Send(Message{Type: TypeStreamStatus}) {
+			t.Fatal("message queued past the lane size")
+		}
+	}
+	select {
+	case f := <-c.closing:
+		t.Fatalf("closed with %d before the threshold", f.Code)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.Send(Message{Type: TypeStreamStatus})
+	select {
+	case f := <-c.closing:
+		if f.Code != CloseSlowConsumer {
+			t.Errorf("close code = %d, want %d", f.Code, CloseSlowConsumer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow client was not closed")
+	}
+}
+
+func TestOutboxDropsResetWhenCaughtUp(t *testing.T) {
+	o := newOutbox(2)
+	for i := 0; i < laneSize[laneControl]; i++ {
+		o.push(laneControl, "", []byte("x"))
+	}
+	if _, drops := o.push(laneControl, "", []byte("x")); drops != 1 {
+		t.Fatalf("drops = %d, want 1", drops)
+	}
+
+	for data, _ := o.next(); data != nil; data, _ = o.next() {
+	}
+	for i := 0; i < laneSize[laneControl]; i++ {
+		o.push(laneControl, "", []byte("x"))
+	}
+	if _, drops := o.push(laneControl, "", []byte("x")); drops != 1 {
+		t.Errorf("drops after catching up = %d, want 1", drops)
+	}
+}
+
+// Replies can race the hub closing the client; they must not panic or block
+func TestSendAfterClose(t *testing.T) {
+	c := newTestClient(uuid.New(), uuid.New())
+	c.Send(Message{Type: TypeStreamStart})
+	c.out.close()
+	c.out.close()
+
+	c.handleMessage([]byte(`{"id":"1","type":"ping"}`))
+	c.handleMessage([]byte(`{"type":"bogus"}`))
+	if c.Send(Message{Type: TypeAck}) {
+		t.Error("Send reported success on a closed client")
+	}
+
+	// What was queued before the close is still written
+	if data, done := c.out.next(); data == nil || done {
+		t.Fatal("queued message lost on close")
+	}
+	if data, done := c.out.next(); data != nil || !done {
+		t.Errorf("next = %q, %v after draining a closed outbox, want done", data, done)
+	}
+}
@@ -0,0 +1,295 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+)
+
+// messageSpec documents one message type. Inbound is the payload a client
+// sends and Outbound the payload the server sends; nil means the type isn't
+// sent in that direction, noPayload that it's sent without one.
+type messageSpec struct {
+	Type     string
+	Summary  string
+	Inbound  interface{}
+	Outbound interface{}
+}
+
+// noPayload marks a direction whose messages carry no payload
+type noPayload struct{}
+
+// protocol lists every message type. The AsyncAPI document served at
+// /api/v1/ws/spec and inbound payload validation are both generated from it,
+// so a new type or payload field only needs adding here and to its struct.
+var protocol = []messageSpec{
+	{TypeHello, "First message of a connection: protocol version and wanted features", HelloPayload{}, nil},
+	{TypeWelcome, "Reply to hello with the negotiated version and features", nil, WelcomePayload{}},
+	{TypeSession, "Sent on every connection, after welcome, with the resume token", nil, SessionPayload{}},
+	{TypeDeviceList, "The user's online devices, sent after session", nil, DeviceListPayload{}},
+	{TypeDeviceOnline, "A device of the user connected", nil, DeviceOnlinePayload{}},
+	{TypeDeviceOffline, "A device of the user disconnected for good", nil, DeviceOfflinePayload{}},
+	{TypeDeviceUpdated, "A device was renamed or its capabilities changed", nil, DeviceUpdatedPayload{}},
+	{TypeDeviceRemoved, "A device was deleted from the account", nil, DeviceRemovedPayload{}},
+	{TypeDevicePresence, "A connected device's presence changed", nil, DevicePresencePayload{}},
+	{TypeVisibility, "The client moved to the background or back", VisibilityPayload{}, nil},
+
+	{TypeStreamStart, "Start a stream, or a stream started", StreamStartRequest{}, StreamStartPayload{}},
+	{TypeStreamStatus, "A stream's status changed", nil, StreamStatusPayload{}},
+	{TypeStreamLatency, "A stream reported its latency", nil, StreamLatencyPayload{}},
+	{TypeStreamEnd, "End a stream, or a stream ended", StreamEndPayload{}, StreamEndPayload{}},
+
+	{TypeChatMessage, "Send a chat message, or one was received", ChatMessageRequest{}, ChatMessagePayload{}},
+	{TypeChatRead, "Mark chat messages read up to message_id", ChatReadPayload{}, nil},
+
+	{TypeTransferOffer, "A device of the user offers a file", nil, TransferOfferPayload{}},
+	{TypeTransferAccept, "Accept or decline a file, or the receiver answered", TransferAcceptPayload{}, TransferAcceptPayload{}},
+	{TypeTransferProgress, "A transfer's upload progressed or it finished", nil, TransferProgressPayload{}},
+
+	{TypeOffer, "WebRTC offer for another device of the user or a stream's SFU", OfferPayload{}, OfferPayload{}},
+	{TypeAnswer, "WebRTC answer for another device of the user or a stream's SFU", AnswerPayload{}, AnswerPayload{}},
+	{TypeCandidate, "ICE candidate for another device of the user or a stream's SFU", CandidatePayload{}, CandidatePayload{}},
+
+	{TypeControlCapabilities, "Remote controls a source supports", ControlCapabilities{}, ControlCapabilitiesPayload{}},
+	{TypeControlCamera, "Switch a source's camera", ControlCameraPayload{}, ControlCameraPayload{}},
+	{TypeControlTorch, "Turn a source's torch on or off", ControlTorchPayload{}, ControlTorchPayload{}},
+	{TypeControlZoom, "Set a source's zoom", ControlZoomPayload{}, ControlZoomPayload{}},
+	{TypeControlMic, "Mute or unmute a source's microphone", ControlMicPayload{}, ControlMicPayload{}},
+	{TypeControlExposure, "Lock or unlock a source's exposure", ControlExposurePayload{}, ControlExposurePayload{}},
+
+	{TypeTelemetry, "Device health snapshot", Telemetry{}, TelemetryPayload{}},
+	{TypeTelemetryAlert, "A device's telemetry crossed a threshold", nil, TelemetryAlertPayload{}},
+
+	{TypeAuthExpiring, "The connection's access token expires soon", nil, AuthExpiringPayload{}},
+	{TypeAuthRefresh, "A new access token for the connection", AuthRefreshPayload{}, nil},
+
+	{TypePing, "Application-level ping", noPayload{}, nil},
+	{TypePong, "Reply to ping", nil, noPayload{}},
+	{TypeAck, "A request with an id succeeded; some carry a result", nil, ackResult{}},
+	{TypeNack, "A request with an id failed", nil, ErrorPayload{}},
+	{TypeError, "A request without an id failed, or a message couldn't be parsed", nil, ErrorPayload{}},
+}
+
+// ackResult stands in for the payloads an ack can carry
+type ackResult struct{}
+
+// protocolTypes is the set of message types in protocol
+var protocolTypes = func() map[string]bool {
+	types := make(map[string]bool, len(protocol))
+	for _, m := range protocol {
+		types[m.Type] = true
+	}
+	return types
+}()
+
+var (
+	inboundSchemas map[string]*Schema
+	schemasErr     error
+	schemasOnce    sync.Once
+)
+
+// inboundSchema returns the payload schema of a message type clients may
+// send, or nil if there's none
+func inboundSchema(msgType string) (*Schema, error) {
+	schemasOnce.Do(func() {
+		inboundSchemas = make(map[string]*Schema)
+		for _, m := range protocol {
+			if m.Inbound == nil {
+				continue
+			}
+			schema, err := payloadSchema(m.Inbound)
+			if err != nil {
+				schemasErr = fmt.Errorf("%s: %w", m.Type, err)
+				return
+			}
+			inboundSchemas[m.Type] = schema.allowUnknown()
+		}
+	})
+	return inboundSchemas[msgType], schemasErr
+}
+
+// payloadSchema returns the schema of a payload, nil meaning no payload
+func payloadSchema(v interface{}) (*Schema, error) {
+	switch v.(type) {
+	case noPayload:
+		return nil, nil
+	case ackResult:
+		started, err := schemaOf(StreamStartedPayload{})
+		if err != nil {
+			return nil, err
+		}
+		sent, err := schemaOf(ChatSentPayload{})
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{
+			Description: "Present on acks of stream:start and chat:message",
+			OneOf:       []*Schema{started, sent},
+		}, nil
+	default:
+		return schemaOf(v)
+	}
+}
+
+// validatePayload checks an inbound message's payload against its type's
+// schema, reporting every problem with its path, e.g.
+// "payload.sdp_mline_index: expected integer, got string"
+func (c *Client) validatePayload(msg Message) error {
+	schema, err := inboundSchema(msg.Type)
+	if err != nil {
+		slog.Error("invalid message schema", "error", err)
+		return apperr.Wrap(apperr.ErrInternal, "internal error")
+	}
+	if schema == nil {
+		return nil
+	}
+	if len(msg.Payload) == 0 {
+		return &schemaError{problems: []string{"payload: required"}}
+	}
+
+	var payload interface{}
+	if err := c.codec.DecodePayload(msg.Payload, &payload); err != nil {
+		return &schemaError{problems: []string{"payload: " + err.Error()}}
+	}
+	if problems := schema.validate("payload", payload); len(problems) > 0 {
+		return &schemaError{problems: problems}
+	}
+	return nil
+}
+
+// schemaError lists what's wrong with a payload
+type schemaError struct {
+	problems []string
+}
+
+func (e *schemaError) Error() string { return strings.Join(e.problems, "; ") }
+func (e *schemaError) Unwrap() error { return ErrPayloadInvalid }
+
+// AsyncAPI document for the WebSocket protocol, built once from protocol
+var (
+	specJSON []byte
+	specErr  error
+	specOnce sync.Once
+)
+
+// Spec serves the AsyncAPI document describing the WebSocket protocol
+func (h *Handler) Spec(c *gin.Context) {
+	specOnce.Do(func() {
+		var spec map[string]interface{}
+		if spec, specErr = asyncAPISpec(); specErr == nil {
+			specJSON, specErr = json.MarshalIndent(spec, "", "  ")
+		}
+	})
+	if specErr != nil {
+		slog.Error("failed to build websocket spec", "error", specErr)
+		apperr.Response(c, apperr.Wrap(apperr.ErrInternal, "internal error"))
+		return
+	}
+	c.Data(http.StatusOK, "application/json", specJSON)
+}
+
+// asyncAPISpec builds an AsyncAPI 2.6 document. Messages the client sends
+// are the channel's publish operation, messages it receives subscribe.
+func asyncAPISpec() (map[string]interface{}, error) {
+	messages := make(map[string]interface{})
+	var publish, subscribe []interface{}
+
+	for _, m := range protocol {
+		if m.Inbound != nil {
+			key := "client." + strings.ReplaceAll(m.Type, ":", ".")
+			msg, err := specMessage(m, m.Inbound, false)
+			if err != nil {
+				return nil, err
+			}
+			messages[key] = msg
+			publish = append(publish, map[string]string{"$ref": "#/components/messages/" + key})
+		}
+		if m.Outbound != nil {
+			key := "server." + strings.ReplaceAll(m.Type, ":", ".")
+			msg, err := specMessage(m, m.Outbound, true)
+			if err != nil {
+				return nil, err
+			}
+			messages[key] = msg
+			subscribe = append(subscribe, map[string]string{"$ref": "#/components/messages/" + key})
+		}
+	}
+
+	return map[string]interface{}{
+		"asyncapi": "2.6.0",
+		"info": map[string]interface{}{
+			"title":   "streamz WebSocket API",
+			"version": "1.0.0",
+			"description": "Signaling and device events between a user's devices. Connect to /ws " +
+				"with ?device_id= and a ticket, bearer token or bearer subprotocol. Frames are " +
+				"JSON (" + ProtocolJSON + ") or MessagePack (" + ProtocolMsgpack + ") envelopes " +
+				"with the same keys. Connect with ?hello=1 and open with hello; connections " +
+				"without the flag, or that don't send hello within a couple of seconds, get " +
+				"protocol version 1 and every event. The same " +
+				"messages are available as Server-Sent Events from /api/v1/events.",
+		},
+		"defaultContentType": "application/json",
+		"channels": map[string]interface{}{
+			"/ws": map[string]interface{}{
+				"publish": map[string]interface{}{
+					"operationId": "sendMessage",
+					"summary":     "Messages a client sends",
+					"message":     map[string]interface{}{"oneOf": publish},
+				},
+				"subscribe": map[string]interface{}{
+					"operationId": "receiveMessage",
+					"summary":     "Messages the server sends",
+					"message":     map[string]interface{}{"oneOf": subscribe},
+				},
+			},
+		},
+		"components": map[string]interface{}{
+			"messages": messages,
+		},
+	}, nil
+}
+
+// specMessage describes one message type in one direction. Its payload is
+// the whole envelope, with the type fixed.
+func specMessage(m messageSpec, payload interface{}, outbound bool) (map[string]interface{}, error) {
+	envelope := &Schema{
+		Type: schemaType{"object"},
+		Properties: map[string]*Schema{
+			"id":   {Type: schemaType{"string"}, Description: "Request ID, echoed in the ack, nack or error"},
+			"type": {Type: schemaType{"string"}, Const: m.Type},
+		},
+		Required: []string{"type"},
+	}
+	if outbound {
+		envelope.AdditionalProperties = false
+		envelope.Properties["seq"] = &Schema{
+			Type:        schemaType{"integer"},
+			Minimum:     float(1),
+			Description: "Set on events that are replayed after a resume",
+		}
+	}
+	schema, err := payloadSchema(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", m.Type, err)
+	}
+	if schema != nil {
+		if !outbound {
+			// Unknown fields from clients are ignored, not rejected
+			schema.allowUnknown()
+			envelope.Required = append(envelope.Required, "payload")
+		}
+		envelope.Properties["payload"] = schema
+	}
+
+	return map[string]interface{}{
+		"name":    m.Type,
+		"summary": m.Summary,
+		"payload": envelope,
+	}, nil
+}
@@ -0,0 +1,217 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestValidatePayload(t *testing.T) {
+	c := newTestClient(uuid.New(), uuid.New())
+	peer := uuid.New().String()
+
+	tests := []struct {
+		name    string
+		msg     string
+		problem string
+	}{
+		{
+			name: "valid candidate",
+			msg:  `{"type":"webrtc:candidate","payload":{"to_device_id":"` + peer + `","candidate":"","sdp_mline_index":0,"sdp_mid":null}}`,
+		},
+		{
+			// End of gathering
+			name: "no candidate",
+			msg:  `{"type":"webrtc:candidate","payload":{"to_device_id":"` + peer + `"}}`,
+		},
+		{
+			name:    "index as string",
+			msg:     `{"type":"webrtc:candidate","payload":{"to_device_id":"` + peer + `","candidate":"c","sdp_mline_index":"0"}}`,
+			problem: "payload.sdp_mline_index: expected integer, got string",
+		},
+		{
+			// Fields the server doesn't know are ignored
+			name: "unknown field",
+			msg:  `{"type":"webrtc:candidate","payload":{"to_device_id":"` + peer + `","candidate":"c","sdp_mline_index":0,"usernameFragment":"a1"}}`,
+		},
+		{
+			name:    "index out of range",
+			msg:     `{"type":"webrtc:candidate","payload":{"to_device_id":"` + peer + `","candidate":"c","sdp_mline_index":70000}}`,
+			problem: "payload.sdp_mline_index: must be at most 65535",
+		},
+		{
+			name:    "missing target",
+			msg:     `{"type":"webrtc:offer","payload":{"sdp":"v=0"}}`,
+			problem: "payload.to_device_id: required",
+		},
+		{
+			// required_without: a stream's SFU stands in for the target
+			name: "stream instead of target",
+			msg:  `{"type":"webrtc:offer","payload":{"stream_id":"` + peer + `","sdp":"v=0"}}`,
+		},
+		{
+			name:    "bad uuid",
+			msg:     `{"type":"webrtc:offer","payload":{"to_device_id":"phone","sdp":"v=0"}}`,
+			problem: "payload.to_device_id: must be a UUID",
+		},
+		{
+			name:    "no payload",
+			msg:     `{"type":"webrtc:answer"}`,
+			problem: "payload: required",
+		},
+		{
+			name:    "enum",
+			msg:     `{"type":"control:capabilities","payload":{"cameras":["front","side"]}}`,
+			problem: "payload.cameras[1]: must be one of front, back",
+		},
+		{
+			// omitempty skips the rules after it for a zero value
+			name: "empty optional enum",
+			msg:  `{"type":"stream:start","payload":{"stream_type":"video","quality":""}}`,
+		},
+		{
+			name:    "optional enum",
+			msg:     `{"type":"stream:start","payload":{"stream_type":"video","quality":"4k"}}`,
+			problem: "payload.quality: must be one of low, medium, high, auto",
+		},
+		{
+			name: "empty optional list",
+			msg:  `{"type":"control:capabilities","payload":{"cameras":[],"min_zoom":0,"max_zoom":0}}`,
+		},
+		{
+			name:    "every problem",
+			msg:     `{"type":"telemetry","payload":{"battery_level":120,"charging":"yes","thermal_state":"hot","free_storage_mb":10,"network_type":"wifi"}}`,
+			problem: "payload.battery_level: must be at most 100; payload.charging: expected boolean, got string; payload.thermal_state: must be one of nominal, fair, serious, critical",
+		},
+		{
+			name: "no schema",
+			msg:  `{"type":"ping"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := c.codec.Decode([]byte(tt.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.validatePayload(msg)
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.problem != "" && (err == nil || err.Error() != tt.problem):
+				t.Errorf("error = %v, want %q", err, tt.problem)
+			case err != nil && errorCode(err) != CodeInvalidPayload:
+				t.Errorf("code = %s, want %s", errorCode(err), CodeInvalidPayload)
+			}
+		})
+	}
+}
+
+// Every payload in the protocol has a schema, so no binding tag fails at
+// runtime
+func TestProtocolSchemas(t *testing.T) {
+	for _, m := range protocol {
+		for _, payload := range []interface{}{m.Inbound, m.Outbound} {
+			if payload == nil {
+				continue
+			}
+			if _, err := payloadSchema(payload); err != nil {
+				t.Errorf("%s: %v", m.Type, err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		v    interface{}
+	}{
+		{"bad number", struct {
+			N int `json:"n" binding:"min=one"`
+		}{}},
+		{"dive on a scalar", struct {
+			S string `json:"s" binding:"dive,oneof=a b"`
+		}{}},
+		{"unsupported rule", struct {
+			S string `json:"s" binding:"email"`
+		}{}},
+		{"nested", struct {
+			L []struct {
+				N int `json:"n" binding:"max=x"`
+			} `json:"l"`
+		}{}},
+	}
+	for _, tt := range tests {
+		if _, err := schemaOf(tt.v); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestValidatePayloadMsgpack(t *testing.T) {
+	c := newTestClient(uuid.New(), uuid.New())
+	c.codec = msgpackCodec{}
+
+	index := uint16(1)
+	valid, _ := NewMessage(TypeCandidate, CandidatePayload{ToDeviceID: uuid.New(), Candidate: "c", SDPMLineIndex: &index})
+	data, _ := c.codec.Encode(valid)
+	msg, _ := c.codec.Decode(data)
+	if err := c.validatePayload(msg); err != nil {
+		t.Errorf("valid msgpack payload rejected: %v", err)
+	}
+
+	invalid, _ := NewMessage(TypeCandidate, map[string]interface{}{"to_device_id": uuid.NewString(), "candidate": 5})
+	data, _ = c.codec.Encode(invalid)
+	msg, _ = c.codec.Decode(data)
+	if err := c.validatePayload(msg); err == nil || err.Error() != "payload.candidate: expected string, got integer" {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestSpec(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/api/v1/ws/spec", nil)
+	(&Handler{}).Spec(ctx)
+
+	var spec struct {
+		AsyncAPI   string `json:"asyncapi"`
+		Components struct {
+			Messages map[string]struct {
+				Name    string          `json:"name"`
+				Payload json.RawMessage `json:"payload"`
+			} `json:"messages"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("spec is not JSON: %v", err)
+	}
+	if spec.AsyncAPI != "2.6.0" {
+		t.Errorf("asyncapi = %q", spec.AsyncAPI)
+	}
+
+	// Every type is described in each direction it's sent
+	for _, m := range protocol {
+		for prefix, payload := range map[string]interface{}{"client.": m.Inbound, "server.": m.Outbound} {
+			key := prefix + strings.ReplaceAll(m.Type, ":", ".")
+			got, ok := spec.Components.Messages[key]
+			if ok != (payload != nil) {
+				t.Errorf("message %s present = %v", key, ok)
+			}
+			if ok && got.Name != m.Type {
+				t.Errorf("message %s name = %q, want %q", key, got.Name, m.Type)
+			}
+		}
+	}
+
+	candidate := string(spec.Components.Messages["client.webrtc.candidate"].Payload)
+	if !strings.Contains(candidate, `"sdp_mline_index"`) || !strings.Contains(candidate, `"maximum": 65535`) {
+		t.Errorf("candidate schema missing sdp_mline_index: %s", candidate)
+	}
+}
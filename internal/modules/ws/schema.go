@@ -0,0 +1,434 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Schema is the subset of JSON Schema used to describe message payloads.
+// Schemas are generated from the payload structs: json tags name the
+// properties and binding tags, in the same syntax as the REST DTOs, add
+// constraints ("required" here means the field must be present,
+// "required_without=Field" that it must be unless Field is, and "omitempty"
+// skips the rules after it when the value is zero).
+type Schema struct {
+	Type                 schemaType         `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Const                string             `json:"const,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+
+	// Set by omitempty: a zero value ("", 0, false or []) is valid whatever
+	// the other constraints say
+	omitEmpty bool
+
+	// Set by required_without: the Go name of the field that may stand in
+	// for this one
+	requiredWithout string
+}
+
+// schemaType is one JSON type, or several (e.g. a nullable field)
+type schemaType []string
+
+func (t schemaType) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+func (t schemaType) allows(name string) bool {
+	for _, n := range t {
+		if n == name || (n == "number" && name == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+var uuidType = reflect.TypeOf(uuid.UUID{})
+
+// schemaOf generates the schema of a payload value's type. It fails if a
+// binding tag can't be expressed as a schema.
+func schemaOf(v interface{}) (*Schema, error) {
+	return schemaFor(reflect.TypeOf(v))
+}
+
+// allowUnknown lets every object in the schema carry properties it doesn't
+// list. Inbound payloads are validated this way so a client can send fields
+// that only newer servers understand.
+func (s *Schema) allowUnknown() *Schema {
+	if s == nil {
+		return nil
+	}
+	switch extra := s.AdditionalProperties.(type) {
+	case bool:
+		s.AdditionalProperties = nil
+	case *Schema:
+		extra.allowUnknown()
+	}
+	for _, prop := range s.Properties {
+		prop.allowUnknown()
+	}
+	for _, alt := range s.OneOf {
+		alt.allowUnknown()
+	}
+	for _, alt := range s.AnyOf {
+		alt.allowUnknown()
+	}
+	s.Items.allowUnknown()
+	return s
+}
+
+func schemaFor(t reflect.Type) (*Schema, error) {
+	if t == uuidType {
+		return &Schema{Type: schemaType{"string"}, Format: "uuid"}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s, err := schemaFor(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		s.Type = append(s.Type, "null")
+		return s, nil
+
+	case reflect.Struct:
+		s := &Schema{
+			Type:                 schemaType{"object"},
+			Properties:           make(map[string]*Schema),
+			AdditionalProperties: false,
+		}
+		names := make(map[string]string) // Go field name -> property
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+
+			prop, err := schemaFor(f.Type)
+			if err != nil {
+				return nil, err
+			}
+			required, err := applyBinding(prop, f.Tag.Get("binding"))
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+			}
+			if required {
+				s.Required = append(s.Required, name)
+			}
+			s.Properties[name] = prop
+			names[f.Name] = name
+		}
+
+		for name, prop := range s.Properties {
+			if prop.requiredWithout == "" {
+				continue
+			}
+			other, ok := names[prop.requiredWithout]
+			if !ok || s.AnyOf != nil {
+				return nil, fmt.Errorf("%s.%s: bad binding required_without=%s", t.Name(), name, prop.requiredWithout)
+			}
+			s.AnyOf = []*Schema{{Required: []string{name}}, {Required: []string{other}}}
+		}
+		return s, nil
+
+	case reflect.Slice, reflect.Array:
+		items, err := schemaFor(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: schemaType{"array"}, Items: items}, nil
+
+	case reflect.Map:
+		values, err := schemaFor(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: schemaType{"object"}, AdditionalProperties: values}, nil
+
+	case reflect.String:
+		return &Schema{Type: schemaType{"string"}}, nil
+
+	case reflect.Bool:
+		return &Schema{Type: schemaType{"boolean"}}, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: schemaType{"integer"}}, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s := &Schema{Type: schemaType{"integer"}, Minimum: float(0)}
+		if t.Bits() < 64 {
+			s.Maximum = float(float64(uint64(1)<<t.Bits() - 1))
+		}
+		return s, nil
+
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: schemaType{"number"}}, nil
+
+	default:
+		// interface{} and raw payloads take anything
+		return &Schema{}, nil
+	}
+}
+
+// applyBinding adds the constraints of a binding tag to a field's schema and
+// reports whether the field is required
+func applyBinding(s *Schema, tag string) (required bool, err error) {
+	if tag == "" {
+		return false, nil
+	}
+
+	// Rules after "dive" apply to the elements of a slice
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = true
+		case "required_without":
+			s.requiredWithout = arg
+		case "omitempty":
+			s.omitEmpty = true
+		case "dive":
+			if s.Items == nil {
+				return false, fmt.Errorf("dive on a field that isn't a slice: %q", tag)
+			}
+			_, elements, _ := strings.Cut(tag, "dive,")
+			if _, err := applyBinding(s.Items, elements); err != nil {
+				return false, err
+			}
+			return required, nil
+		case "oneof":
+			s.Enum = strings.Fields(arg)
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return false, fmt.Errorf("bad binding %q", rule)
+			}
+			if s.Type.allows("string") {
+				length := int(n)
+				if name == "min" {
+					s.MinLength = &length
+				} else {
+					s.MaxLength = &length
+				}
+			} else if name == "min" {
+				s.Minimum = &n
+			} else {
+				s.Maximum = &n
+			}
+		default:
+			return false, fmt.Errorf("unsupported binding %q", rule)
+		}
+	}
+	return required, nil
+}
+
+func float(f float64) *float64 {
+	return &f
+}
+
+// validate checks a decoded payload against the schema. Values are as
+// decoded into interface{} by either codec. It returns one problem per
+// offending field, prefixed with its path.
+func (s *Schema) validate(path string, v interface{}) []string {
+	if v == nil {
+		if s.Type == nil || s.Type.allows("null") {
+			return nil
+		}
+		return []string{path + ": must not be null"}
+	}
+
+	actual := jsonType(v)
+	if s.Type != nil && !s.Type.allows(actual) {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", path, s.Type[0], actual)}
+	}
+	if s.omitEmpty && isZero(v) {
+		return nil
+	}
+
+	switch actual {
+	case "object":
+		return s.validateObject(path, v.(map[string]interface{}))
+
+	case "array":
+		var problems []string
+		if s.Items != nil {
+			for i, item := range v.([]interface{}) {
+				problems = append(problems, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+		return problems
+
+	case "string":
+		return s.validateString(path, v.(string))
+
+	case "integer", "number":
+		n, _ := number(v)
+		if s.Minimum != nil && n < *s.Minimum {
+			return []string{fmt.Sprintf("%s: must be at least %v", path, *s.Minimum)}
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return []string{fmt.Sprintf("%s: must be at most %v", path, *s.Maximum)}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(path string, obj map[string]interface{}) []string {
+	var problems []string
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			problems = append(problems, path+"."+name+": required")
+		}
+	}
+	problems = append(problems, s.validateAnyOf(path, obj)...)
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prop, ok := s.Properties[name]
+		if !ok {
+			switch extra := s.AdditionalProperties.(type) {
+			case *Schema:
+				prop = extra
+			case bool:
+				if !extra {
+					problems = append(problems, path+"."+name+": unknown field")
+					continue
+				}
+			}
+		}
+		if prop != nil {
+			problems = append(problems, prop.validate(path+"."+name, obj[name])...)
+		}
+	}
+	return problems
+}
+
+// validateAnyOf passes if any alternative does, and otherwise reports what's
+// wrong with the first
+func (s *Schema) validateAnyOf(path string, obj map[string]interface{}) []string {
+	if len(s.AnyOf) == 0 {
+		return nil
+	}
+	var first []string
+	for i, alt := range s.AnyOf {
+		problems := alt.validateObject(path, obj)
+		if len(problems) == 0 {
+			return nil
+		}
+		if i == 0 {
+			first = problems
+		}
+	}
+	return first
+}
+
+func (s *Schema) validateString(path, v string) []string {
+	if s.Format == "uuid" {
+		if _, err := uuid.Parse(v); err != nil {
+			return []string{path + ": must be a UUID"}
+		}
+	}
+	if len(s.Enum) > 0 {
+		for _, allowed := range s.Enum {
+			if v == allowed {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("%s: must be one of %s", path, strings.Join(s.Enum, ", "))}
+	}
+
+	length := len([]rune(v))
+	if s.MinLength != nil && length < *s.MinLength {
+		return []string{fmt.Sprintf("%s: must be at least %d characters", path, *s.MinLength)}
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		return []string{fmt.Sprintf("%s: must be at most %d characters", path, *s.MaxLength)}
+	}
+	return nil
+}
+
+// isZero reports whether a decoded value is its type's zero value, as
+// omitempty sees it
+func isZero(v interface{}) bool {
+	switch t := v.(type) {
+	case string:
+		return t == ""
+	case bool:
+		return !t
+	case []interface{}:
+		return len(t) == 0
+	case map[string]interface{}:
+		return false
+	default:
+		n, ok := number(t)
+		return ok && n == 0
+	}
+}
+
+// jsonType names the JSON type of a decoded value. Whole numbers count as
+// integers, like in JSON Schema.
+func jsonType(v interface{}) string {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	default:
+		n, ok := number(t)
+		if !ok {
+			return fmt.Sprintf("%T", v)
+		}
+		if n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	}
+}
+
+// number converts any numeric value either codec decodes to a float64
+func number(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,165 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// session tracks a device's event stream across reconnects. It outlives its
+// connection for the resume grace window, buffering sequenced events so a
+// client that resumes can have the ones it missed replayed.
+type session struct {
+	userID   uuid.UUID
+	deviceID uuid.UUID
+	device   *DeviceInfo
+
+	// Identifies the session in welcome; kept across resumes
+	id string
+
+	// Token the client presents to resume this session (rotated on every connect)
+	token string
+
+	// Current connection; nil while the device is in the grace window
+	client *Client
+
+	// Epoch of the latest connection attached to the session
+	epoch int64
+
+	// Set when the server closed the connection for good (device deleted,
+	// session revoked); the session ends as soon as the connection is gone
+	terminated bool
+
+	// How long the session survives a disconnect, and the timer that ends it
+	grace  time.Duration
+	expiry *time.Timer
+
+	// Last sequence number assigned and the most recent sequenced events
+	seq    uint64
+	buffer []Message
+	size   int
+
+	mu sync.Mutex
+}
+
+// resumeRequest is what a reconnecting client presents to pick up its session
+type resumeRequest struct {
+	token   string
+	lastSeq uint64
+}
+
+func newSession(client *Client, grace time.Duration, bufferSize int) *session {
+	return &session{
+		userID:   client.userID,
+		deviceID: client.deviceID,
+		device:   client.device,
+		id:       uuid.NewString(),
+		token:    newResumeToken(),
+		client:   client,
+
+		epoch: client.epoch,
+		grace: grace,
+		size:  bufferSize,
+	}
+}
+
+// deliver assigns the next sequence number to an event, buffers it for
+// replay and sends it to the current connection. While the device is
+// disconnected the event is only buffered. Returns false if the connected
+// client could not take the message; no sequence number is consumed then.
+func (s *session) deliver(msg Message) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg.Seq = s.seq + 1
+	if s.client != nil && !s.client.Send(msg) {
+		return false
+	}
+
+	s.seq = msg.Seq
+	s.buffer = append(s.buffer, msg)
+	if len(s.buffer) > s.size {
+		s.buffer = s.buffer[len(s.buffer)-s.size:]
+	}
+	return true
+}
+
+// send passes an unsequenced message to the current connection without
+// buffering it. It fails with ErrPeerOffline while the device is
+// disconnected and ErrPeerBusy if the client could not take the message.
+func (s *session) send(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return ErrPeerOffline
+	}
+	if !s.client.Send(msg) {
+		return ErrPeerBusy
+	}
+	return nil
+}
+
+// canResume reports whether every event after lastSeq is still buffered
+func (s *session) canResume(req resumeRequest) bool {
+	if req.token == "" || req.token != s.token || req.lastSeq > s.seq {
+		return false
+	}
+	oldest := s.seq - uint64(len(s.buffer)) + 1
+	return req.lastSeq+1 >= oldest
+}
+
+// attach makes client the session's connection and replays the events it missed
+func (s *session) attach(client *Client, lastSeq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Controls and telemetry are reported over the connection, so the new
+	// one starts without them until the device reports again
+	if client.device.Controls == nil {
+		client.device.Controls = s.device.Controls
+	}
+	if client.device.Telemetry == nil {
+		client.device.Telemetry = s.device.Telemetry
+	}
+
+	s.client = client
+	s.epoch = client.epoch
+	s.device = client.device
+	s.token = newResumeToken()
+
+	s.sendSessionInfo(true)
+	for _, ev := range s.buffer {
+		if ev.Seq > lastSeq {
+			client.Send(ev)
+		}
+	}
+}
+
+// sendSessionInfo tells the client how to resume this session (caller must hold s.mu)
+func (s *session) sendSessionInfo(resumed bool) {
+	msg, err := NewMessage(TypeSession, SessionPayload{
+		ResumeToken:  s.token,
+		Resumed:      resumed,
+		Seq:          s.seq,
+		ResumeWindow: int(s.grace.Seconds()),
+	})
+	if err != nil {
+		slog.Error("failed to create session message", "error", err)
+		return
+	}
+	s.client.Send(msg)
+}
+
+func newResumeToken() string {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		// Unresumable, the client falls back to a fresh session
+		return ""
+	}
+	return hex.EncodeToString(bytes)
+}
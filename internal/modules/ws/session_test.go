@@ -0,0 +1,161 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSessionResumeReplaysMissedEvents(t *testing.T) {
+	userID, deviceID := uuid.New(), uuid.New()
+	first := newTestClient(userID, deviceID)
+	s := newSession(first, time.Minute, 4)
+
+	for i := 0; i < 3; i++ {
+		s.deliver(Message{Type: TypeStreamStart})
+	}
+	received := drain(t, first)
+	lastSeq := received[len(received)-1].Seq
+
+	// Connection drops, two events arrive during the gap
+	s.client = nil
+	s.deliver(Message{Type: TypeStreamStatus})
+	s.deliver(Message{Type: TypeStreamStatus})
+
+	req := resumeRequest{token: s.token, lastSeq: lastSeq}
+	if !s.canResume(req) {
+		t.Fatalf("expected session to be resumable from seq %d", lastSeq)
+	}
+
+	second := newTestClient(userID, deviceID)
+	s.attach(second, lastSeq)
+
+	msgs := drain(t, second)
+	if len(msgs) != 3 {
+		t.Fatalf("got %d messages, want session + 2 replayed", len(msgs))
+	}
+	if msgs[0].Type != TypeSession {
+		t.Errorf("first message type = %q, want %q", msgs[0].Type, TypeSession)
+	}
+	if msgs[1].Seq != 4 || msgs[2].Seq != 5 {
+		t.Errorf("replayed seqs = %d, %d, want 4, 5", msgs[1].Seq, msgs[2].Seq)
+	}
+}
+
+func TestSessionResumeKeepsReportedState(t *testing.T) {
+	userID, deviceID := uuid.New(), uuid.New()
+	s := newSession(newTestClient(userID, deviceID), time.Minute, 4)
+	s.device.Controls = &ControlCapabilities{Torch: true}
+	s.device.Telemetry = &Telemetry{BatteryLevel: 42}
+
+	second := newTestClient(userID, deviceID)
+	s.attach(second, 0)
+
+	if s.device.Controls == nil || !s.device.Controls.Torch {
+		t.Errorf("controls = %+v after resume, want torch", s.device.Controls)
+	}
+	if s.device.Telemetry == nil || s.device.Telemetry.BatteryLevel != 42 {
+		t.Errorf("telemetry = %+v after resume, want battery 42", s.device.Telemetry)
+	}
+}
+
+func TestSessionCannotResume(t *testing.T) {
+	s := newSession(newTestClient(uuid.New(), uuid.New()), time.Minute, 2)
+	for i := 0; i < 5; i++ {
+		s.deliver(Message{Type: TypeStreamStatus})
+	}
+
+	tests := []struct {
+		name string
+		req  resumeRequest
+	}{
+		{name: "wrong token", req: resumeRequest{token: "nope", lastSeq: 5}},
+		{name: "missing token", req: resumeRequest{lastSeq: 5}},
+		{name: "events evicted from buffer", req: resumeRequest{token: s.token, lastSeq: 2}},
+		{name: "seq from the future", req: resumeRequest{token: s.token, lastSeq: 9}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if s.canResume(tt.req) {
+				t.Errorf("expected resume to be refused")
+			}
+		})
+	}
+}
+
+// Every feature's events sent while a device is reconnecting are replayed
+// in order when it resumes; signaling is refused instead
+func TestResumeReplaysFeatureEvents(t *testing.T) {
+	h := newTestHub(t, Config{ResumeGrace: time.Minute, ReplayBufferSize: 64})
+	userID := uuid.New()
+	mac := h.device(userID)
+	mac.device.HasCamera = true
+	phone := h.device(userID)
+	tablet := h.device(userID)
+	h.connect(t, mac, phone, tablet)
+	h.SetControls(mac, ControlCapabilities{Torch: true})
+	drain(t, phone)
+
+	req := h.drop(t, mac)
+	streamID, transferID := uuid.New(), uuid.New()
+
+	events := []struct {
+		msgType string
+		send    func()
+	}{
+		{TypeStreamStart, func() { h.BroadcastStreamStart(userID, streamID, phone.deviceID, "video", "high", false) }},
+		{TypeStreamStatus, func() { h.BroadcastStreamStatus(userID, streamID, "live") }},
+		{TypeStreamLatency, func() { h.BroadcastStreamLatency(userID, streamID, 120) }},
+		{TypeControlTorch, func() {
+			if err := h.ForwardControl(userID, TypeControlTorch, &ControlTorchPayload{FromDeviceID: phone.deviceID, ToDeviceID: mac.deviceID, On: true}); err != nil {
+				t.Fatalf("control while reconnecting: %v", err)
+			}
+		}},
+		{TypeControlCapabilities, func() { h.SetControls(phone, ControlCapabilities{Torch: true}) }},
+		{TypeDeviceUpdated, func() { h.UpdateDevice(userID, phone.deviceID, "Kitchen", true, false) }},
+		{TypeTelemetry, func() {
+			h.SetTelemetry(phone, Telemetry{BatteryLevel: 80, ThermalState: ThermalNominal, FreeStorageMB: 20000, NetworkType: NetworkWifi})
+		}},
+		{TypeChatMessage, func() { h.DeliverChatMessage(userID, uuid.New(), phone.deviceID, &mac.deviceID, nil, "hi", time.Now()) }},
+		{TypeTransferOffer, func() {
+			h.DeliverTransferOffer(userID, transferID, phone.deviceID, mac.deviceID, "clip.mov", "video/quicktime", 8, time.Now().Add(time.Hour))
+		}},
+		{TypeTransferProgress, func() { h.DeliverTransferProgress(userID, transferID, phone.deviceID, mac.deviceID, "ready", 8, 8) }},
+		{TypeTransferAccept, func() { h.DeliverTransferAccept(userID, uuid.New(), mac.deviceID, phone.deviceID, true) }},
+		{TypeDeviceRemoved, func() {
+			// Dropped first, so there's no connection to close
+			h.drop(t, tablet)
+			h.RemoveDevice(userID, tablet.deviceID)
+		}},
+		{TypeStreamEnd, func() { h.BroadcastStreamEnd(userID, streamID) }},
+	}
+	for _, ev := range events {
+		ev.send()
+	}
+
+	if err := h.ForwardToDevice(userID, mac.deviceID, TypeOffer, OfferPayload{FromDeviceID: phone.deviceID, ToDeviceID: mac.deviceID}); err != ErrPeerOffline {
+		t.Fatalf("offer while reconnecting: got %v, want %v", err, ErrPeerOffline)
+	}
+
+	resumed := h.resume(t, mac, req)
+	replayed := drain(t, resumed)
+
+	// Presence of the other devices comes along in between
+	next := 0
+	for i, msg := range replayed {
+		if msg.Seq != req.lastSeq+uint64(i)+1 {
+			t.Fatalf("replayed %s with seq %d, want %d", msg.Type, msg.Seq, req.lastSeq+uint64(i)+1)
+		}
+		if msg.Type == TypeOffer {
+			t.Fatal("offer replayed")
+		}
+		if next < len(events) && msg.Type == events[next].msgType {
+			next++
+		}
+	}
+	if next != len(events) {
+		t.Fatalf("replay missing %s", events[next].msgType)
+	}
+}
@@ -0,0 +1,89 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How long the SFU may take over a device's offer, answer or candidate
+const sfuRequestTimeout = 10 * time.Second
+
+// Signaling errors: it goes to a device or, with a stream_id, to the SFU
+var (
+	errNoTarget = fmt.Errorf("%w: needs to_device_id or stream_id", ErrPayloadInvalid)
+	errNoSFU    = fmt.Errorf("%w: streams aren't forwarded by this server", ErrPayloadInvalid)
+)
+
+// SFU takes the signaling of streams the server forwards: a device
+// publishes or subscribes by sending webrtc:offer with the stream's ID. The
+// webrtc module implements it and signals back through the hub.
+type SFU interface {
+	Offer(ctx context.Context, userID, deviceID, streamID uuid.UUID, sdp string) error
+	Answer(ctx context.Context, userID, deviceID, streamID uuid.UUID, sdp string) error
+	Candidate(ctx context.Context, userID, deviceID, streamID uuid.UUID, candidate string, sdpMid *string, sdpMLineIndex *uint16) error
+}
+
+// SetSFU enables signaling with a stream_id. Call it before clients connect.
+func (h *Hub) SetSFU(sfu SFU) {
+	h.sfu = sfu
+}
+
+// SignalOffer sends the SFU's offer for a stream to a device, which answers
+// with webrtc:answer and the same stream_id
+func (h *Hub) SignalOffer(userID, deviceID, streamID uuid.UUID, sdp string) error {
+	return h.ForwardToDevice(userID, deviceID, TypeOffer, OfferPayload{
+		ToDeviceID: deviceID,
+		StreamID:   &streamID,
+		SDP:        sdp,
+	})
+}
+
+// SignalAnswer sends the SFU's answer to a device's offer for a stream.
+// The SFU's descriptions hold all of its candidates, so it sends no
+// webrtc:candidate of its own.
+func (h *Hub) SignalAnswer(userID, deviceID, streamID uuid.UUID, sdp string) error {
+	return h.ForwardToDevice(userID, deviceID, TypeAnswer, AnswerPayload{
+		ToDeviceID: deviceID,
+		StreamID:   &streamID,
+		SDP:        sdp,
+	})
+}
+
+func (c *Client) handleSFUOffer(msg Message, streamID uuid.UUID, sdp string) {
+	if c.hub.sfu == nil {
+		c.reply(msg.ID, errNoSFU)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sfuRequestTimeout)
+	defer cancel()
+
+	c.reply(msg.ID, c.hub.sfu.Offer(ctx, c.userID, c.deviceID, streamID, sdp))
+}
+
+func (c *Client) handleSFUAnswer(msg Message, streamID uuid.UUID, sdp string) {
+	if c.hub.sfu == nil {
+		c.reply(msg.ID, errNoSFU)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sfuRequestTimeout)
+	defer cancel()
+
+	c.reply(msg.ID, c.hub.sfu.Answer(ctx, c.userID, c.deviceID, streamID, sdp))
+}
+
+func (c *Client) handleSFUCandidate(msg Message, candidate CandidatePayload) {
+	if c.hub.sfu == nil {
+		c.reply(msg.ID, errNoSFU)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sfuRequestTimeout)
+	defer cancel()
+
+	c.reply(msg.ID, c.hub.sfu.Candidate(ctx, c.userID, c.deviceID, *candidate.StreamID, candidate.Candidate, candidate.SDPMid, candidate.SDPMLineIndex))
+}
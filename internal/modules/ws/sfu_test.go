@@ -0,0 +1,75 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// fakeSFU answers every offer and records what devices sent it
+type fakeSFU struct {
+	hub        *Hub
+	candidates chan string
+}
+
+func (f *fakeSFU) Offer(ctx context.Context, userID, deviceID, streamID uuid.UUID, sdp string) error {
+	return f.hub.SignalAnswer(userID, deviceID, streamID, "answer to "+sdp)
+}
+
+func (f *fakeSFU) Answer(ctx context.Context, userID, deviceID, streamID uuid.UUID, sdp string) error {
+	return nil
+}
+
+func (f *fakeSFU) Candidate(ctx context.Context, userID, deviceID, streamID uuid.UUID, candidate string, sdpMid *string, sdpMLineIndex *uint16) error {
+	f.candidates <- candidate
+	return nil
+}
+
+func TestSFUSignaling(t *testing.T) {
+	sfu := &fakeSFU{candidates: make(chan string, 1)}
+	h := newTestHub(t, Config{}, func(h *Hub) {
+		sfu.hub = h
+		h.SetSFU(sfu)
+	})
+	userID := uuid.New()
+	phone := h.device(userID)
+	monitor := h.device(userID)
+	h.connect(t, phone, monitor)
+	streamID := uuid.New()
+
+	// Signaling with a stream_id goes to the SFU, not another device
+	monitor.handleMessage([]byte(`{"id":"1","type":"webrtc:offer","payload":{"stream_id":"` + streamID.String() + `","sdp":"v=0"}}`))
+	if ack := waitFor(t, monitor, TypeAck); ack.ID != "1" {
+		t.Fatalf("ack id = %q, want 1", ack.ID)
+	}
+	var answer AnswerPayload
+	if err := json.Unmarshal(waitFor(t, monitor, TypeAnswer).Payload, &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.StreamID == nil || *answer.StreamID != streamID || answer.FromDeviceID != uuid.Nil || answer.SDP != "answer to v=0" {
+		t.Fatalf("answer = %+v, want the SFU's for stream %s", answer, streamID)
+	}
+
+	monitor.handleMessage([]byte(`{"type":"webrtc:candidate","payload":{"stream_id":"` + streamID.String() + `","candidate":"candidate:1"}}`))
+	if c := <-sfu.candidates; c != "candidate:1" {
+		t.Fatalf("candidate = %q", c)
+	}
+	if msgs := drain(t, phone); len(msgs) != 0 {
+		t.Fatalf("phone got %+v, want nothing", msgs)
+	}
+
+	// Device-to-device signaling still needs a target
+	monitor.handleMessage([]byte(`{"id":"2","type":"webrtc:offer","payload":{"sdp":"v=0"}}`))
+	assertNack(t, waitFor(t, monitor, TypeNack), "2", CodeInvalidPayload)
+}
+
+func TestSFUSignalingWithoutSFU(t *testing.T) {
+	h := newTestHub(t, Config{})
+	monitor := h.device(uuid.New())
+	h.connect(t, monitor)
+
+	monitor.handleMessage([]byte(`{"id":"1","type":"webrtc:offer","payload":{"stream_id":"` + uuid.NewString() + `","sdp":"v=0"}}`))
+	assertNack(t, waitFor(t, monitor, TypeNack), "1", CodeInvalidPayload)
+}
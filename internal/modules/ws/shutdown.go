@@ -0,0 +1,127 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// CloseServiceRestart is sent to every connection when the server shuts
+// down. The reason carries a reconnect hint, e.g.
+// "service restart; retry_after_ms=2150".
+const CloseServiceRestart = websocket.CloseServiceRestart
+
+// Clients are told to wait a random delay in this range before reconnecting,
+// so a restarting replica's clients don't all reconnect at once
+const (
+	restartRetryMin    = time.Second
+	restartRetryJitter = 4 * time.Second
+)
+
+// How often Shutdown checks whether every client has gone
+const drainPoll = 50 * time.Millisecond
+
+// Draining reports whether Shutdown has been called; new connections are
+// refused from then on
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// Shutdown closes every connection with 1012 (service restart) and ends its
+// session without a resume window, since sessions don't outlive the process.
+// It waits until the clients are gone and their presence has been written,
+// or until ctx is done, in which case remaining sessions are ended anyway.
+// Run must keep running until Shutdown returns.
+func (h *Hub) Shutdown(ctx context.Context) {
+	h.draining.Store(true)
+
+	h.mu.Lock()
+	count := 0
+	for _, devices := range h.sessions {
+		for _, s := range devices {
+			h.terminateLocked(s, CloseServiceRestart, restartReason())
+			count++
+		}
+	}
+	h.mu.Unlock()
+
+	slog.Info("hub draining", "sessions", count)
+
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+
+drain:
+	for h.sessionCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break drain
+		}
+	}
+
+	h.mu.Lock()
+	remaining := 0
+	for _, devices := range h.sessions {
+		for _, s := range devices {
+			if s.expiry != nil {
+				s.expiry.Stop()
+			}
+			h.endSessionLocked(s)
+			remaining++
+		}
+	}
+	h.mu.Unlock()
+
+	if remaining > 0 {
+		slog.Warn("hub drain timed out, ended remaining sessions", "sessions", remaining)
+	}
+
+	if h.backplane != nil {
+		h.backplane.Flush(ctx)
+	}
+
+	// Wait for the offline writes, so devices don't stay online in the DB
+	written := make(chan struct{})
+	go func() {
+		h.writes.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+		slog.Info("hub drained")
+	case <-ctx.Done():
+		slog.Warn("hub shutdown timed out waiting for presence writes")
+	}
+}
+
+// sessionCount returns how many sessions this instance holds
+func (h *Hub) sessionCount() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	n := 0
+	for _, devices := range h.sessions {
+		n += len(devices)
+	}
+	return n
+}
+
+// restartReason is the close reason sent on shutdown, with a jittered
+// reconnect delay
+func restartReason() string {
+	retry := restartRetryMin + rand.N(restartRetryJitter)
+	return fmt.Sprintf("service restart; retry_after_ms=%d", retry.Milliseconds())
+}
+
+// background runs a presence or telemetry write that Shutdown waits for
+func (h *Hub) background(fn func()) {
+	h.writes.Add(1)
+	go func() {
+		defer h.writes.Done()
+		fn()
+	}()
+}
@@ -0,0 +1,102 @@
+package ws
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := NewHub(Config{ReplayBufferSize: 8, ResumeGrace: time.Minute})
+
+	var mu sync.Mutex
+	offline := map[uuid.UUID]bool{}
+	h.onOffline = func(_, deviceID uuid.UUID, _ int64) {
+		time.Sleep(20 * time.Millisecond) // a slow DB write
+		mu.Lock()
+		offline[deviceID] = true
+		mu.Unlock()
+	}
+	go h.Run(ctx)
+
+	userID := uuid.New()
+	connected := newTestClient(userID, uuid.New())
+	connected.closing = make(chan closeFrame, 1)
+	h.register <- connected
+
+	// A device waiting out its resume window
+	dropped := newTestClient(userID, uuid.New())
+	h.register <- dropped
+	h.unregister <- dropped
+	waitUntil(t, func() bool { return h.sessionCount() == 2 })
+
+	done := make(chan struct{})
+	go func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer shutdownCancel()
+		h.Shutdown(shutdownCtx)
+		close(done)
+	}()
+
+	select {
+	case f := <-connected.closing:
+		if f.Code != CloseServiceRestart || !strings.HasPrefix(f.Reason, "service restart; retry_after_ms=") {
+			t.Errorf("close = %d %q, want %d with a retry hint", f.Code, f.Reason, CloseServiceRestart)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("connected client was not closed")
+	}
+	if !h.Draining() {
+		t.Error("hub not draining during shutdown")
+	}
+
+	// The closed connection goes away, as ReadPump would report
+	h.unregister <- connected
+	<-done
+
+	mu.Lock()
+	if !offline[connected.deviceID] || !offline[dropped.deviceID] {
+		t.Errorf("offline writes = %v, want both devices", offline)
+	}
+	mu.Unlock()
+	if n := h.sessionCount(); n != 0 {
+		t.Errorf("sessions after shutdown = %d", n)
+	}
+
+	// Connections that race the upgrade check are turned away
+	late := newTestClient(userID, uuid.New())
+	late.closing = make(chan closeFrame, 1)
+	h.register <- late
+	if f := <-late.closing; f.Code != CloseServiceRestart {
+		t.Errorf("late client close = %d, want %d", f.Code, CloseServiceRestart)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := NewHub(Config{ReplayBufferSize: 8})
+	go h.Run(ctx)
+
+	// Never unregisters after being closed
+	stuck := newTestClient(uuid.New(), uuid.New())
+	stuck.closing = make(chan closeFrame, 1)
+	h.register <- stuck
+	waitUntil(t, func() bool { return h.sessionCount() == 1 })
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shutdownCancel()
+	h.Shutdown(shutdownCtx)
+
+	if n := h.sessionCount(); n != 0 {
+		t.Errorf("sessions after timed out shutdown = %d", n)
+	}
+}
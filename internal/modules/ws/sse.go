@@ -0,0 +1,254 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+	"github.com/vkrishna03/streamz/internal/middleware"
+)
+
+// closeFrame ends a Server-Sent Events stream the way a close frame ends a
+// WebSocket. It is sent as a "close" event so clients know not to reconnect.
+type closeFrame struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// HandleEvents streams the device's hub events as Server-Sent Events, for
+// networks that block WebSocket upgrades. It authenticates like /ws. Event
+// IDs are "<resume token>:<seq>", so a client reconnecting with fresh
+// credentials resumes the session through Last-Event-ID.
+func (h *Handler) HandleEvents(c *gin.Context) {
+	if h.hub.Draining() {
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is restarting"})
+		return
+	}
+
+	// The resume token only picks the session to resume; it is never taken
+	// from the URL, where it would end up in logs
+	resume := parseLastEventID(c.GetHeader("Last-Event-ID"))
+
+	userID, deviceID, authExpiry, err := h.authenticate(c)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	deviceInfo, err := h.loadDevice(c.Request.Context(), userID, deviceID)
+	if err != nil {
+		apperr.Response(c, err)
+		return
+	}
+
+	client := NewClient(h.hub, nil, userID, deviceID, deviceInfo)
+	client.closing = make(chan closeFrame, 1)
+	client.limiter = newMessageLimiter(h.cfg.Limits)
+	client.authExpiry = authExpiry
+	client.resume = resume
+
+	if err := h.prepareClient(c.Request.Context(), client); err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrInternal, "internal error"))
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	h.hub.register <- client
+	client.streamEvents(c.Request.Context(), c.Writer)
+	h.hub.unregister <- client
+}
+
+// PostEvent hands a message from a Server-Sent Events client to the hub, as
+// if it had arrived over a WebSocket. The device must have an event stream
+// open; acks, nacks and errors are delivered on it.
+func (h *Handler) PostEvent(c *gin.Context) {
+	userID, ok := middleware.GetUserID(c)
+	if !ok {
+		apperr.Response(c, apperr.ErrUnauthorized)
+		return
+	}
+
+	deviceID, err := uuid.Parse(c.Query("device_id"))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "invalid device_id"))
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxMessageSize+1))
+	if err != nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "failed to read message"))
+		return
+	}
+	if len(data) > maxMessageSize {
+		apperr.Response(c, apperr.Wrap(apperr.ErrValidation, "message too large"))
+		return
+	}
+
+	client := h.hub.eventClient(userID, deviceID)
+	if client == nil {
+		apperr.Response(c, apperr.Wrap(apperr.ErrNotFound, "no event stream open for device"))
+		return
+	}
+
+	// Keep posted messages in order, as a WebSocket would
+	client.mu.Lock()
+	client.handleMessage(data)
+	client.mu.Unlock()
+
+	c.Status(http.StatusAccepted)
+}
+
+// eventClient returns the device's connected Server-Sent Events client, or
+// nil if it has none
+func (h *Hub) eventClient(userID, deviceID uuid.UUID) *Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s, ok := h.sessions[userID][deviceID]
+	if !ok || s.client == nil || s.client.closing == nil {
+		return nil
+	}
+	return s.client
+}
+
+// parseLastEventID splits an event ID into the session's resume token and
+// the last seq the client saw
+func parseLastEventID(id string) resumeRequest {
+	i := strings.LastIndex(id, ":")
+	if i <= 0 {
+		return resumeRequest{}
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return resumeRequest{}
+	}
+	return resumeRequest{token: id[:i], lastSeq: seq}
+}
+
+// streamEvents writes the client's messages as Server-Sent Events until the
+// request ends, the hub drops the client or the connection is closed. Like
+// WritePump it warns before the access token expires and closes at expiry.
+func (c *Client) streamEvents(ctx context.Context, w http.ResponseWriter) {
+	stream := &eventStream{w: w, rc: http.NewResponseController(w)}
+	ticker := time.NewTicker(pingPeriod)
+	auth := newAuthTimer(c.authExpiry)
+	defer func() {
+		ticker.Stop()
+		auth.stop()
+	}()
+
+	// Send the headers right away so the client knows it's connected
+	stream.flush()
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-c.out.ready:
+			for {
+				message, done := c.out.next()
+				if done {
+					// Hub closed the outbox
+					return
+				}
+				if message == nil {
+					break
+				}
+				if err = stream.message(message); err != nil {
+					break
+				}
+			}
+
+		case <-ticker.C:
+			// Comment line to keep proxies from timing out the request
+			_, err = io.WriteString(w, ": ping\n\n")
+
+		case f := <-c.closing:
+			stream.close(f)
+			return
+
+		case expiresAt := <-c.reauth:
+			auth.reset(expiresAt)
+			continue
+
+		case <-auth.C():
+			if auth.fired() {
+				slog.Info("event stream token expired", "user_id", c.userID, "device_id", c.deviceID)
+				stream.close(closeFrame{Code: CloseAuthExpired, Reason: "token expired"})
+				return
+			}
+
+			warning, _ := NewMessage(TypeAuthExpiring, AuthExpiringPayload{ExpiresAt: auth.expiresAt.Unix()})
+			data, _ := c.codec.Encode(warning)
+			err = stream.message(data)
+		}
+
+		if err != nil {
+			slog.Debug("event stream write error", "error", err, "user_id", c.userID)
+			return
+		}
+		stream.flush()
+	}
+}
+
+// eventStream writes Server-Sent Events for one client
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	// Resume token of the current session, from the last session message
+	token string
+}
+
+// message writes an encoded JSON message as an unnamed event. Messages that
+// can be replayed carry an ID; EventSource remembers the last one.
+func (s *eventStream) message(data []byte) error {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+
+	seq := msg.Seq
+	if msg.Type == TypeSession {
+		var session SessionPayload
+		if err := json.Unmarshal(msg.Payload, &session); err == nil {
+			s.token = session.ResumeToken
+			seq = session.Seq
+		}
+	}
+
+	if s.token != "" && (seq > 0 || msg.Type == TypeSession) {
+		if _, err := fmt.Fprintf(s.w, "id: %s:%d\n", s.token, seq); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(s.w, "data: %s\n\n", data)
+	return err
+}
+
+func (s *eventStream) close(f closeFrame) {
+	data, _ := json.Marshal(f)
+	fmt.Fprintf(s.w, "event: close\ndata: %s\n\n", data)
+	s.flush()
+}
+
+func (s *eventStream) flush() {
+	_ = s.rc.Flush()
+}
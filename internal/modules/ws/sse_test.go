@@ -0,0 +1,237 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// pipeResponse is a ResponseWriter the test reads events from
+type pipeResponse struct {
+	header http.Header
+	*io.PipeWriter
+}
+
+func (p pipeResponse) Header() http.Header { return p.header }
+func (p pipeResponse) WriteHeader(int)     {}
+
+type sseEvent struct {
+	id    string
+	event string
+	msg   Message
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.msg.Type != "":
+			return ev
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			if ev.event == "close" {
+				ev.msg.Type = "close"
+				ev.msg.Payload = json.RawMessage(data)
+			} else if err := json.Unmarshal([]byte(data), &ev.msg); err != nil {
+				t.Fatalf("unmarshal %q: %v", data, err)
+			}
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := NewHub(Config{ReplayBufferSize: 8, ResumeGrace: time.Minute})
+	go h.Run(ctx)
+
+	userID := uuid.New()
+	phone := newTestClient(userID, uuid.New())
+	h.register <- phone
+
+	browser := newTestClient(userID, uuid.New())
+	browser.closing = make(chan closeFrame, 1)
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	h.register <- browser
+	go func() {
+		browser.streamEvents(ctx, pipeResponse{header: http.Header{}, PipeWriter: pw})
+		pw.Close()
+		close(done)
+	}()
+	r := bufio.NewReader(pr)
+
+	session := readEvent(t, r)
+	if session.msg.Type != TypeSession || !strings.HasSuffix(session.id, ":0") {
+		t.Fatalf("first event = %s id %q, want session with id <token>:0", session.msg.Type, session.id)
+	}
+	token := strings.TrimSuffix(session.id, ":0")
+
+	// Events routed through the hub reach the stream with resumable IDs
+	if eventClient := h.eventClient(userID, browser.deviceID); eventClient != browser {
+		t.Fatalf("eventClient = %p, want the stream client", eventClient)
+	}
+	h.BroadcastStreamStart(userID, uuid.New(), phone.deviceID, "camera", "high", false)
+	var start sseEvent
+	for start.msg.Type != TypeStreamStart {
+		start = readEvent(t, r)
+	}
+	if got := parseLastEventID(start.id); got.token != token || got.lastSeq != start.msg.Seq {
+		t.Errorf("stream:start id %q, want %s:%d", start.id, token, start.msg.Seq)
+	}
+
+	// Signaling isn't replayed, so it carries no ID
+	if err := h.ForwardToDevice(userID, browser.deviceID, TypeOffer, OfferPayload{FromDeviceID: phone.deviceID, SDP: "v=0"}); err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+	if offer := readEvent(t, r); offer.msg.Type != TypeOffer || offer.id != "" {
+		t.Errorf("got %s id %q, want an offer without an ID", offer.msg.Type, offer.id)
+	}
+
+	// Messages handled for the stream client are answered on the stream
+	browser.handleMessage([]byte(`{"id":"1","type":"ping"}`))
+	if ev := readEvent(t, r); ev.msg.Type != TypePong || ev.msg.ID != "1" {
+		t.Errorf("reply = %s %q, want pong 1", ev.msg.Type, ev.msg.ID)
+	}
+
+	// Closing the client ends the stream with a close event
+	browser.closeWith(CloseDeviceRemoved, "device removed")
+	ev := readEvent(t, r)
+	var f closeFrame
+	_ = json.Unmarshal(ev.msg.Payload, &f)
+	if ev.event != "close" || f.Code != CloseDeviceRemoved {
+		t.Errorf("close event = %q %+v", ev.event, f)
+	}
+	<-done
+}
+
+func TestParseLastEventID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want resumeRequest
+	}{
+		{"abc:12", resumeRequest{token: "abc", lastSeq: 12}},
+		{"abc:0", resumeRequest{token: "abc"}},
+		{"", resumeRequest{}},
+		{"abc", resumeRequest{}},
+		{":5", resumeRequest{}},
+		{"abc:x", resumeRequest{}},
+	}
+	for _, tt := range tests {
+		if got := parseLastEventID(tt.id); got != tt.want {
+			t.Errorf("parseLastEventID(%q) = %+v, want %+v", tt.id, got, tt.want)
+		}
+	}
+}
+
+// openEvents opens /events; the stream ends when the returned cancel is called
+func (s *testServer) openEvents(t *testing.T, query, lastEventID string) (*http.Response, *bufio.Reader, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/events?"+query, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewReader(resp.Body), cancel
+}
+
+func TestEventStreamReconnect(t *testing.T) {
+	s := newTestServer(t)
+	userID := uuid.New()
+	browser := s.q.addDevice(userID)
+	phone := s.q.addDevice(userID)
+
+	ticket, _ := s.issueTicket(t, userID, browser)
+	query := "ticket=" + ticket + "&device_id=" + browser.String()
+	resp, r, disconnect := s.openEvents(t, query, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("open stream: status %d", resp.StatusCode)
+	}
+	session := readEvent(t, r)
+	if session.msg.Type != TypeSession {
+		t.Fatalf("first event = %s, want session", session.msg.Type)
+	}
+
+	// The connection drops and an event arrives in the gap. Signaling isn't
+	// buffered; the sender is told to retry.
+	disconnect()
+	waitUntil(t, func() bool { return s.hub.eventClient(userID, browser) == nil })
+	streamID := uuid.New()
+	s.hub.BroadcastStreamStart(userID, streamID, phone, "camera", "high", false)
+	if err := s.hub.ForwardToDevice(userID, browser, TypeOffer, OfferPayload{FromDeviceID: phone, SDP: "v=0"}); err != ErrPeerOffline {
+		t.Fatalf("offer while reconnecting: got %v, want %v", err, ErrPeerOffline)
+	}
+
+	// The resume token isn't a credential: a spent ticket is refused with it
+	if resp, _, _ := s.openEvents(t, query, session.id); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("spent ticket with resume token: status %d, want 401", resp.StatusCode)
+	}
+
+	// Nor is it read from the URL, where it would be logged
+	phoneTicket, _ := s.issueTicket(t, userID, phone)
+	resp, r, disconnectPhone := s.openEvents(t, "ticket="+phoneTicket+"&device_id="+phone.String()+"&last_event_id="+session.id, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("open phone stream: status %d", resp.StatusCode)
+	}
+	var info SessionPayload
+	first := readEvent(t, r)
+	_ = json.Unmarshal(first.msg.Payload, &info)
+	if first.msg.Type != TypeSession || info.Resumed {
+		t.Fatalf("resume token in the URL got %s %+v, want a new session", first.msg.Type, info)
+	}
+	disconnectPhone()
+
+	// A client reconnecting with a new ticket and Last-Event-ID resumes
+	ticket, _ = s.issueTicket(t, userID, browser)
+	query = "ticket=" + ticket + "&device_id=" + browser.String()
+	resp, r, _ = s.openEvents(t, query, session.id)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reconnect: status %d, want 200", resp.StatusCode)
+	}
+	resumed := readEvent(t, r)
+	_ = json.Unmarshal(resumed.msg.Payload, &info)
+	if resumed.msg.Type != TypeSession || !info.Resumed {
+		t.Fatalf("reconnect got %s %+v, want resumed session", resumed.msg.Type, info)
+	}
+	if start := readEvent(t, r); start.msg.Type != TypeStreamStart {
+		t.Fatalf("replayed %s, want the stream:start sent while disconnected", start.msg.Type)
+	}
+
+	// The old resume token was rotated out
+	ticket, _ = s.issueTicket(t, userID, browser)
+	resp, r, _ = s.openEvents(t, "ticket="+ticket+"&device_id="+browser.String(), session.id)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("reconnect with rotated token: status %d", resp.StatusCode)
+	}
+	first = readEvent(t, r)
+	_ = json.Unmarshal(first.msg.Payload, &info)
+	if first.msg.Type != TypeSession || info.Resumed {
+		t.Fatalf("rotated resume token got %s %+v, want a new session", first.msg.Type, info)
+	}
+}
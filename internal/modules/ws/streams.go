@@ -0,0 +1,72 @@
+package ws
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// How long a stream or chat request from a client may take
+const streamRequestTimeout = 10 * time.Second
+
+// Streams starts and ends streams for WebSocket clients. The stream service
+// implements it and publishes the resulting events back through the hub.
+type Streams interface {
+	StartStream(ctx context.Context, userID, sourceDeviceID, targetDeviceID uuid.UUID, streamType, quality string, sfu bool) (uuid.UUID, error)
+	EndStream(ctx context.Context, userID, streamID uuid.UUID) error
+}
+
+// SetStreams enables stream:start and stream:end requests. Call it before
+// clients connect.
+func (h *Hub) SetStreams(streams Streams) {
+	h.streams = streams
+}
+
+func (c *Client) handleStreamStart(msg Message) {
+	if c.hub.streams == nil {
+		c.sendError(msg.ID, CodeUnknownType, "unknown message type: "+msg.Type)
+		return
+	}
+
+	var req StreamStartRequest
+	if err := c.codec.DecodePayload(msg.Payload, &req); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid stream start payload")
+		return
+	}
+	if req.SourceDeviceID == uuid.Nil {
+		req.SourceDeviceID = c.deviceID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamRequestTimeout)
+	defer cancel()
+
+	streamID, err := c.hub.streams.StartStream(ctx, c.userID, req.SourceDeviceID, req.TargetDeviceID, req.StreamType, req.Quality, req.SFU)
+	if err != nil || msg.ID == "" {
+		c.reply(msg.ID, err)
+		return
+	}
+
+	// The stream:start event reaches every device; the ack tells the
+	// requester which stream is theirs
+	ack, _ := NewAckMessageWith(msg.ID, StreamStartedPayload{StreamID: streamID})
+	c.Send(ack)
+}
+
+func (c *Client) handleStreamEnd(msg Message) {
+	if c.hub.streams == nil {
+		c.sendError(msg.ID, CodeUnknownType, "unknown message type: "+msg.Type)
+		return
+	}
+
+	var req StreamEndPayload
+	if err := c.codec.DecodePayload(msg.Payload, &req); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid stream end payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamRequestTimeout)
+	defer cancel()
+
+	c.reply(msg.ID, c.hub.streams.EndStream(ctx, c.userID, req.StreamID))
+}
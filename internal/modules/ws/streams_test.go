@@ -0,0 +1,76 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	apperr "github.com/vkrishna03/streamz/internal/errors"
+)
+
+// fakeStreams records started streams and publishes events like the stream service
+type fakeStreams struct {
+	hub     *Hub
+	started map[uuid.UUID]uuid.UUID // stream ID -> source device
+}
+
+func (f *fakeStreams) StartStream(ctx context.Context, userID, sourceDeviceID, targetDeviceID uuid.UUID, streamType, quality string, sfu bool) (uuid.UUID, error) {
+	if streamType != "video" {
+		return uuid.Nil, apperr.Wrap(apperr.ErrValidation, "invalid stream type")
+	}
+	id := uuid.New()
+	f.started[id] = sourceDeviceID
+	f.hub.BroadcastStreamStart(userID, id, sourceDeviceID, streamType, quality, sfu)
+	return id, nil
+}
+
+func (f *fakeStreams) EndStream(ctx context.Context, userID, streamID uuid.UUID) error {
+	if _, ok := f.started[streamID]; !ok {
+		return apperr.Wrap(apperr.ErrNotFound, "stream not found")
+	}
+	delete(f.started, streamID)
+	f.hub.BroadcastStreamEnd(userID, streamID)
+	return nil
+}
+
+func TestStreamRequests(t *testing.T) {
+	h := newTestHub(t, Config{ReplayBufferSize: 8}, func(h *Hub) {
+		h.SetStreams(&fakeStreams{hub: h, started: make(map[uuid.UUID]uuid.UUID)})
+	})
+	userID := uuid.New()
+	phone := h.device(userID)
+	monitor := h.device(userID)
+	h.connect(t, phone, monitor)
+
+	phone.handleMessage([]byte(`{"id":"1","type":"stream:start","payload":{"stream_type":"video"}}`))
+
+	var started StreamStartPayload
+	if err := json.Unmarshal(waitFor(t, monitor, TypeStreamStart).Payload, &started); err != nil {
+		t.Fatal(err)
+	}
+	if started.SourceDeviceID != phone.deviceID {
+		t.Fatalf("source = %s, want sender %s", started.SourceDeviceID, phone.deviceID)
+	}
+
+	ack := waitFor(t, phone, TypeAck)
+	var result StreamStartedPayload
+	if err := json.Unmarshal(ack.Payload, &result); err != nil {
+		t.Fatal(err)
+	}
+	if ack.ID != "1" || result.StreamID != started.StreamID {
+		t.Fatalf("ack = %+v, want id 1 for stream %s", ack, started.StreamID)
+	}
+
+	phone.handleMessage([]byte(`{"id":"2","type":"stream:start","payload":{"stream_type":"hologram"}}`))
+	assertNack(t, waitFor(t, phone, TypeNack), "2", CodeInvalidPayload)
+
+	phone.handleMessage([]byte(`{"id":"3","type":"stream:end","payload":{"stream_id":"` + started.StreamID.String() + `"}}`))
+	waitFor(t, monitor, TypeStreamEnd)
+	if ack := waitFor(t, phone, TypeAck); ack.ID != "3" {
+		t.Fatalf("ack id = %q, want 3", ack.ID)
+	}
+
+	phone.handleMessage([]byte(`{"id":"4","type":"stream:end","payload":{"stream_id":"` + started.StreamID.String() + `"}}`))
+	assertNack(t, waitFor(t, phone, TypeNack), "4", "NOT_FOUND")
+}
@@ -0,0 +1,226 @@
+package ws
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Thermal states, mirroring the platform APIs
+const (
+	ThermalNominal  = "nominal"
+	ThermalFair     = "fair"
+	ThermalSerious  = "serious"
+	ThermalCritical = "critical"
+)
+
+// Network types a device can report
+const (
+	NetworkWifi     = "wifi"
+	NetworkCellular = "cellular"
+	NetworkEthernet = "ethernet"
+	NetworkNone     = "none"
+	NetworkUnknown  = "unknown"
+)
+
+// Alerts raised when a telemetry sample crosses a threshold
+const (
+	AlertBatteryLow  = "battery_low"
+	AlertThermal     = "thermal"
+	AlertStorageLow  = "storage_low"
+	AlertNetworkLost = "network_lost"
+)
+
+// Alert thresholds
+const (
+	batteryLowLevel   = 15   // percent, while not charging
+	storageLowMB      = 1024 // free megabytes
+	telemetryRetained = 7 * 24 * time.Hour
+
+	// How often samples past telemetryRetained are deleted
+	telemetryPruneInterval = time.Hour
+)
+
+// Telemetry is the latest health snapshot reported by a device
+type Telemetry struct {
+	BatteryLevel  int    `json:"battery_level" binding:"required,min=0,max=100"`
+	Charging      bool   `json:"charging" binding:"required"`
+	ThermalState  string `json:"thermal_state" binding:"required,oneof=nominal fair serious critical"`
+	FreeStorageMB int64  `json:"free_storage_mb" binding:"required,min=0"`
+	NetworkType   string `json:"network_type" binding:"required,oneof=wifi cellular ethernet none unknown"`
+
+	// Set by the server when the sample arrives (unix ms)
+	ReportedAt int64 `json:"reported_at"`
+}
+
+// TelemetryPayload is broadcast when a device reports telemetry
+type TelemetryPayload struct {
+	DeviceID  uuid.UUID `json:"device_id"`
+	Telemetry Telemetry `json:"telemetry"`
+}
+
+// TelemetryAlertPayload is broadcast when a device's telemetry crosses a
+// threshold it wasn't already past
+type TelemetryAlertPayload struct {
+	DeviceID  uuid.UUID `json:"device_id"`
+	Alert     string    `json:"alert"`
+	Telemetry Telemetry `json:"telemetry"`
+}
+
+func (t Telemetry) validate() error {
+	if t.BatteryLevel < 0 || t.BatteryLevel > 100 || t.FreeStorageMB < 0 {
+		return ErrTelemetryInvalid
+	}
+	switch t.ThermalState {
+	case ThermalNominal, ThermalFair, ThermalSerious, ThermalCritical:
+	default:
+		return ErrTelemetryInvalid
+	}
+	switch t.NetworkType {
+	case NetworkWifi, NetworkCellular, NetworkEthernet, NetworkNone, NetworkUnknown:
+	default:
+		return ErrTelemetryInvalid
+	}
+	return nil
+}
+
+// alerts returns the thresholds the sample is past
+func (t Telemetry) alerts() []string {
+	var alerts []string
+	if t.BatteryLevel <= batteryLowLevel && !t.Charging {
+		alerts = append(alerts, AlertBatteryLow)
+	}
+	if t.ThermalState == ThermalSerious || t.ThermalState == ThermalCritical {
+		alerts = append(alerts, AlertThermal)
+	}
+	if t.FreeStorageMB < storageLowMB {
+		alerts = append(alerts, AlertStorageLow)
+	}
+	if t.NetworkType == NetworkNone {
+		alerts = append(alerts, AlertNetworkLost)
+	}
+	return alerts
+}
+
+// newAlerts returns the alerts next raises that prev didn't
+func newAlerts(prev *Telemetry, next Telemetry) []string {
+	var raised []string
+	for _, alert := range next.alerts() {
+		if prev == nil || !contains(prev.alerts(), alert) {
+			raised = append(raised, alert)
+		}
+	}
+	return raised
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTelemetry records the latest telemetry of a connected device, tells the
+// user's other devices and alerts them about thresholds it newly crossed
+func (h *Hub) SetTelemetry(client *Client, t Telemetry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sessions[client.userID][client.deviceID]
+	if !ok || s.client != client {
+		return
+	}
+
+	t.ReportedAt = time.Now().UnixMilli()
+	raised := newAlerts(s.device.Telemetry, t)
+
+	// Replace rather than mutate; device list snapshots share the pointer
+	s.device.Telemetry = &t
+
+	h.notifyUserLocked(s.userID, s.deviceID, TypeTelemetry, TelemetryPayload{
+		DeviceID:  s.deviceID,
+		Telemetry: t,
+	})
+	for _, alert := range raised {
+		slog.Info("device telemetry alert", "user_id", s.userID, "device_id", s.deviceID, "alert", alert)
+		h.notifyUserLocked(s.userID, s.deviceID, TypeTelemetryAlert, TelemetryAlertPayload{
+			DeviceID:  s.deviceID,
+			Alert:     alert,
+			Telemetry: t,
+		})
+	}
+
+	if h.backplane != nil {
+		_ = h.backplane.Publish(BackplaneEvent{
+			Kind:     eventTelemetry,
+			UserID:   s.userID,
+			DeviceID: s.deviceID,
+			Epoch:    s.epoch,
+			Device:   s.device,
+			Alerts:   raised,
+		})
+	}
+
+	if h.onTelemetry != nil {
+		deviceID := s.deviceID
+		h.background(func() { h.onTelemetry(deviceID, t, raised) })
+	}
+}
+
+// applyTelemetryLocked records telemetry published by another instance
+// (caller must hold h.mu)
+func (h *Hub) applyTelemetryLocked(ev BackplaneEvent) {
+	rd, ok := h.remote[ev.UserID][ev.DeviceID]
+	if !ok || rd.epoch > ev.Epoch {
+		return
+	}
+
+	t := *ev.Device.Telemetry
+	rd.device.Telemetry = &t
+
+	h.notifyUserLocked(ev.UserID, ev.DeviceID, TypeTelemetry, TelemetryPayload{
+		DeviceID:  ev.DeviceID,
+		Telemetry: t,
+	})
+	for _, alert := range ev.Alerts {
+		h.notifyUserLocked(ev.UserID, ev.DeviceID, TypeTelemetryAlert, TelemetryAlertPayload{
+			DeviceID:  ev.DeviceID,
+			Alert:     alert,
+			Telemetry: t,
+		})
+	}
+}
+
+func (c *Client) handleTelemetry(msg Message) {
+	var t Telemetry
+	if err := c.codec.DecodePayload(msg.Payload, &t); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid telemetry payload")
+		return
+	}
+	if err := t.validate(); err != nil {
+		c.reply(msg.ID, err)
+		return
+	}
+
+	c.hub.SetTelemetry(c, t)
+	c.reply(msg.ID, nil)
+}
+
+// runTelemetryPrune deletes samples past retention until ctx is cancelled
+func (h *Hub) runTelemetryPrune(ctx context.Context) {
+	ticker := time.NewTicker(telemetryPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.onPruneTelemetry(ctx, time.Now().Add(-telemetryRetained))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
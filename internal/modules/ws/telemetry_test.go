@@ -0,0 +1,79 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSetTelemetry(t *testing.T) {
+	saved := make(chan []string, 4)
+	h := newTestHub(t, Config{ReplayBufferSize: 8}, func(h *Hub) {
+		h.onTelemetry = func(deviceID uuid.UUID, _ Telemetry, alerts []string) { saved <- alerts }
+	})
+	userID := uuid.New()
+	monitor := h.device(userID)
+	phone := h.device(userID)
+	h.connect(t, monitor, phone)
+
+	healthy := Telemetry{BatteryLevel: 80, ThermalState: ThermalNominal, FreeStorageMB: 20000, NetworkType: NetworkWifi}
+	h.SetTelemetry(phone, healthy)
+	waitFor(t, monitor, TypeTelemetry)
+	if alerts := <-saved; len(alerts) != 0 {
+		t.Fatalf("healthy sample raised %v", alerts)
+	}
+
+	// Crossing thresholds alerts once per threshold
+	hot := healthy
+	hot.BatteryLevel = 10
+	hot.ThermalState = ThermalSerious
+	h.SetTelemetry(phone, hot)
+	h.SetTelemetry(phone, hot)
+
+	var raised []string
+	for _, msg := range drain(t, monitor) {
+		if msg.Type != TypeTelemetryAlert {
+			continue
+		}
+		var p TelemetryAlertPayload
+		_ = json.Unmarshal(msg.Payload, &p)
+		raised = append(raised, p.Alert)
+	}
+	if len(raised) != 2 || raised[0] != AlertBatteryLow || raised[1] != AlertThermal {
+		t.Errorf("alerts = %v, want [%s %s]", raised, AlertBatteryLow, AlertThermal)
+	}
+
+	// The latest snapshot shows up in the device list
+	for _, d := range h.GetOnlineDevices(userID) {
+		if d.ID == phone.deviceID && (d.Telemetry == nil || d.Telemetry.BatteryLevel != 10) {
+			t.Errorf("device list telemetry = %+v", d.Telemetry)
+		}
+	}
+
+	// Charging clears the battery alert
+	hot.Charging = true
+	if got := hot.alerts(); len(got) != 1 || got[0] != AlertThermal {
+		t.Errorf("charging alerts = %v, want [%s]", got, AlertThermal)
+	}
+}
+
+func TestTelemetryValidate(t *testing.T) {
+	valid := Telemetry{BatteryLevel: 50, ThermalState: ThermalFair, FreeStorageMB: 1, NetworkType: NetworkCellular}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("valid telemetry: %v", err)
+	}
+
+	for name, mutate := range map[string]func(*Telemetry){
+		"battery over 100": func(t *Telemetry) { t.BatteryLevel = 101 },
+		"negative storage": func(t *Telemetry) { t.FreeStorageMB = -1 },
+		"unknown thermal":  func(t *Telemetry) { t.ThermalState = "melting" },
+		"missing network":  func(t *Telemetry) { t.NetworkType = "" },
+	} {
+		tel := valid
+		mutate(&tel)
+		if err := tel.validate(); err != ErrTelemetryInvalid {
+			t.Errorf("%s: got %v, want %v", name, err, ErrTelemetryInvalid)
+		}
+	}
+}
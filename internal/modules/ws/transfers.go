@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Transfers handles answers to file transfer offers. The transfer service
+// implements it and tells the devices through the hub.
+type Transfers interface {
+	AcceptTransfer(ctx context.Context, userID, deviceID, transferID uuid.UUID, accepted bool) error
+}
+
+// TransferOfferPayload offers a file to the receiving device. Accept it
+// with transfer:accept, then download it from the transfers API once
+// transfer:progress reports it ready. expires_at is Unix seconds.
+type TransferOfferPayload struct {
+	TransferID   uuid.UUID `json:"transfer_id"`
+	FromDeviceID uuid.UUID `json:"from_device_id"`
+	FileName     string    `json:"file_name"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	ExpiresAt    int64     `json:"expires_at"`
+}
+
+// TransferAcceptPayload is the receiving device's answer to an offer, passed
+// on to the sending device
+type TransferAcceptPayload struct {
+	TransferID uuid.UUID `json:"transfer_id" binding:"required"`
+	Accepted   bool      `json:"accepted"`
+}
+
+// TransferProgressPayload reports a transfer's upload progress or final
+// status (completed, declined, cancelled or expired)
+type TransferProgressPayload struct {
+	TransferID    uuid.UUID `json:"transfer_id"`
+	Status        string    `json:"status"`
+	ReceivedBytes int64     `json:"received_bytes"`
+	Size          int64     `json:"size"`
+}
+
+// SetTransfers enables transfer:accept. Call it before clients connect.
+func (h *Hub) SetTransfers(transfers Transfers) {
+	h.transfers = transfers
+}
+
+// DeliverTransferOffer offers a new transfer to its receiving device. A
+// device that's offline finds it in the transfers API when it connects.
+func (h *Hub) DeliverTransferOffer(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, fileName, contentType string, size int64, expiresAt time.Time) {
+	payload := TransferOfferPayload{
+		TransferID:   transferID,
+		FromDeviceID: fromDeviceID,
+		FileName:     fileName,
+		ContentType:  contentType,
+		Size:         size,
+		ExpiresAt:    expiresAt.Unix(),
+	}
+	h.deliverTransferEvent(toDeviceID, userID, TypeTransferOffer, transferID, payload)
+}
+
+// DeliverTransferAccept tells the sending device whether its offer was accepted
+func (h *Hub) DeliverTransferAccept(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, accepted bool) {
+	payload := TransferAcceptPayload{TransferID: transferID, Accepted: accepted}
+	h.deliverTransferEvent(fromDeviceID, userID, TypeTransferAccept, transferID, payload)
+}
+
+// DeliverTransferProgress tells both devices how far a transfer has got
+func (h *Hub) DeliverTransferProgress(userID, transferID, fromDeviceID, toDeviceID uuid.UUID, status string, receivedBytes, size int64) {
+	payload := TransferProgressPayload{
+		TransferID:    transferID,
+		Status:        status,
+		ReceivedBytes: receivedBytes,
+		Size:          size,
+	}
+	h.deliverTransferEvent(fromDeviceID, userID, TypeTransferProgress, transferID, payload)
+	h.deliverTransferEvent(toDeviceID, userID, TypeTransferProgress, transferID, payload)
+}
+
+func (h *Hub) deliverTransferEvent(deviceID, userID uuid.UUID, msgType string, transferID uuid.UUID, payload interface{}) {
+	if err := h.ForwardToDevice(userID, deviceID, msgType, payload); err != nil && err != ErrPeerOffline {
+		slog.Warn("failed to deliver transfer event", "error", err, "type", msgType, "transfer_id", transferID, "device_id", deviceID)
+	}
+}
+
+func (c *Client) handleTransferAccept(msg Message) {
+	if c.hub.transfers == nil {
+		c.sendError(msg.ID, CodeUnknownType, "unknown message type: "+msg.Type)
+		return
+	}
+
+	var req TransferAcceptPayload
+	if err := c.codec.DecodePayload(msg.Payload, &req); err != nil {
+		c.sendError(msg.ID, CodeInvalidPayload, "invalid transfer accept payload")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamRequestTimeout)
+	defer cancel()
+
+	c.reply(msg.ID, c.hub.transfers.AcceptTransfer(ctx, c.userID, c.deviceID, req.TransferID, req.Accepted))
+}
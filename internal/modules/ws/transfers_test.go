@@ -0,0 +1,92 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fakeTransfers answers offers through the hub like the transfer service
+type fakeTransfers struct {
+	hub    *Hub
+	sender uuid.UUID
+}
+
+func (f *fakeTransfers) AcceptTransfer(ctx context.Context, userID, deviceID, transferID uuid.UUID, accepted bool) error {
+	f.hub.DeliverTransferAccept(userID, transferID, f.sender, deviceID, accepted)
+	return nil
+}
+
+func TestTransfers(t *testing.T) {
+	transfers := &fakeTransfers{}
+	h := newTestHub(t, Config{ReplayBufferSize: 8}, func(h *Hub) {
+		transfers.hub = h
+		h.SetTransfers(transfers)
+	})
+	userID := uuid.New()
+	phone := h.device(userID)
+	mac := h.device(userID)
+	tablet := h.device(userID)
+	transfers.sender = phone.deviceID
+	h.connect(t, phone, mac, tablet)
+
+	// The offer reaches only the receiving device
+	transferID := uuid.New()
+	h.DeliverTransferOffer(userID, transferID, phone.deviceID, mac.deviceID, "clip.mov", "video/quicktime", 1<<20, time.Now().Add(time.Hour))
+
+	var offer TransferOfferPayload
+	if err := json.Unmarshal(waitFor(t, mac, TypeTransferOffer).Payload, &offer); err != nil {
+		t.Fatal(err)
+	}
+	if offer.TransferID != transferID || offer.FromDeviceID != phone.deviceID || offer.FileName != "clip.mov" {
+		t.Fatalf("transfer:offer = %+v", offer)
+	}
+	if msgs := drain(t, tablet); len(msgs) != 0 {
+		t.Fatalf("offer leaked to another device: %+v", msgs)
+	}
+
+	// A decline is passed on to the sender
+	mac.handleMessage([]byte(`{"id":"1","type":"transfer:accept","payload":{"transfer_id":"` + transferID.String() + `","accepted":false}}`))
+	waitFor(t, mac, TypeAck)
+
+	var answer TransferAcceptPayload
+	if err := json.Unmarshal(waitFor(t, phone, TypeTransferAccept).Payload, &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.TransferID != transferID || answer.Accepted {
+		t.Fatalf("transfer:accept = %+v, want declined", answer)
+	}
+}
+
+func TestTransferProgressCoalesced(t *testing.T) {
+	c := newTestClient(uuid.New(), uuid.New())
+	first, second := uuid.New(), uuid.New()
+
+	progress := func(id uuid.UUID, received int64) Message {
+		msg, _ := NewMessage(TypeTransferProgress, TransferProgressPayload{TransferID: id, Status: "uploading", ReceivedBytes: received, Size: 300})
+		return msg
+	}
+	c.Send(progress(first, 100))
+	c.Send(progress(second, 100))
+	c.Send(progress(first, 200))
+	c.Send(progress(first, 300))
+
+	// Only the latest progress of each transfer is left
+	got := drain(t, c)
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want 2", len(got))
+	}
+	want := map[uuid.UUID]int64{first: 300, second: 100}
+	for _, msg := range got {
+		var p TransferProgressPayload
+		if err := json.Unmarshal(msg.Payload, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.ReceivedBytes != want[p.TransferID] {
+			t.Errorf("transfer %s progress = %d, want %d", p.TransferID, p.ReceivedBytes, want[p.TransferID])
+		}
+	}
+}
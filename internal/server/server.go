@@ -19,6 +19,9 @@ type Server struct {
 	router *gin.Engine
 	http   *http.Server
 	cfg    *config.Config
+
+	// Run before the HTTP server stops, in registration order
+	onShutdown []func()
 }
 
 func New(cfg *config.Config) *Server {
@@ -28,7 +31,7 @@ func New(cfg *config.Config) *Server {
 	r.Use(gin.Recovery())
 	r.Use(middleware.RequestID())
 	r.Use(middleware.Logger())
-	r.Use(middleware.CORS())
+	r.Use(middleware.CORS(middleware.NewOrigins(cfg.Server.AllowedOrigins)))
 
 	// Health endpoints
 	r.GET("/ping", func(c *gin.Context) {
@@ -49,6 +52,12 @@ func (s *Server) Router() *gin.Engine {
 	return s.router
 }
 
+// OnShutdown registers fn to run when the server receives SIGINT or SIGTERM,
+// before it stops accepting requests. fn bounds its own duration.
+func (s *Server) OnShutdown(fn func()) {
+	s.onShutdown = append(s.onShutdown, fn)
+}
+
 func (s *Server) Run() error {
 	s.http = &http.Server{
 		Addr:    ":" + s.cfg.Server.Port,
@@ -68,6 +77,10 @@ func (s *Server) Run() error {
 
 	slog.Info("shutting down server...")
 
+	for _, fn := range s.onShutdown {
+		fn()
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -0,0 +1,130 @@
+package turn
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// allocation is a client's relay, as far as usage goes
+type allocation struct {
+	user      string
+	usage     *userState
+	relay     *relayConn
+	createdAt time.Time
+}
+
+// relayAllocator opens relay sockets for pion, as its RelayAddressGenerator
+type relayAllocator struct {
+	s *Server
+}
+
+func (r *relayAllocator) Validate() error {
+	return nil
+}
+
+func (r *relayAllocator) AllocatePacketConn(_ string, port int) (net.PacketConn, net.Addr, error) {
+	conn, err := r.s.listenRelay(port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	port = conn.LocalAddr().(*net.UDPAddr).Port
+	relay := &relayConn{PacketConn: conn, s: r.s, port: port, permissions: make(map[string]bool)}
+	r.s.mu.Lock()
+	r.s.relays[port] = relay
+	r.s.mu.Unlock()
+	return relay, &net.UDPAddr{IP: r.s.cfg.PublicIP, Port: port}, nil
+}
+
+func (r *relayAllocator) AllocateConn(string, int) (net.Conn, net.Addr, error) {
+	return nil, nil, errors.New("turn: TCP relays aren't offered")
+}
+
+// relayConn is an allocation's relay socket. Data crosses it only to and
+// from peers the client has given permission, counted against the user's
+// bandwidth; packets over it are dropped.
+type relayConn struct {
+	net.PacketConn
+	s       *Server
+	port    int
+	relayed atomic.Uint64
+
+	mu          sync.Mutex
+	usage       *userState      // nil until the allocation is created
+	permissions map[string]bool // by peer IP, as pion holds them
+}
+
+// ReadFrom returns the next packet from a peer the client may hear from
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.admit(addr, n) {
+			return n, addr, err
+		}
+	}
+}
+
+// WriteTo relays the client's data to a peer. A dropped packet is reported
+// as sent, as it would be had the network lost it.
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.admit(addr, len(p)) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *relayConn) Close() error {
+	c.s.mu.Lock()
+	if c.s.relays[c.port] == c {
+		delete(c.s.relays, c.port)
+	}
+	c.s.mu.Unlock()
+	return c.PacketConn.Close()
+}
+
+func (c *relayConn) bind(u *userState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usage = u
+}
+
+func (c *relayConn) permit(peer net.IP, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok {
+		c.permissions[peer.String()] = true
+	} else {
+		delete(c.permissions, peer.String())
+	}
+}
+
+// admit takes n bytes of a packet to or from addr out of the user's
+// bandwidth
+func (c *relayConn) admit(addr net.Addr, n int) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	c.mu.Lock()
+	u, permitted := c.usage, c.permissions[udp.IP.String()]
+	c.mu.Unlock()
+
+	if u == nil || !permitted || !u.allow(n) {
+		return false
+	}
+	c.relayed.Add(uint64(n))
+	return true
+}
+
+// allow takes n bytes from the user's bandwidth, counting them as relayed
+func (u *userState) allow(n int) bool {
+	if !u.limiter.AllowN(time.Now(), n) {
+		return false
+	}
+	u.relayed.Add(uint64(n))
+	return true
+}
@@ -0,0 +1,41 @@
+package turn
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Credentials returns time-limited TURN credentials in the TURN REST API
+// format that coturn checks with use-auth-secret: the username is the expiry
+// as a Unix timestamp followed by the user it was issued to, and the
+// password is the base64 HMAC-SHA1 of the username keyed with the secret
+// shared with the TURN server.
+func Credentials(secret, user string, expiresAt time.Time) (username, password string) {
+	username = strconv.FormatInt(expiresAt.Unix(), 10) + ":" + user
+	return username, sign(secret, username)
+}
+
+// sign returns the password for a username
+func sign(secret, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkUsername returns the user a Credentials username was issued to, if
+// it hasn't expired
+func checkUsername(username string, now time.Time) (string, bool) {
+	ts, user, ok := strings.Cut(username, ":")
+	if !ok || user == "" {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || now.Unix() > expires {
+		return "", false
+	}
+	return user, true
+}
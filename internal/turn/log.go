@@ -0,0 +1,31 @@
+package turn
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/pion/logging"
+)
+
+// pionLoggers sends pion's logs to slog: warnings and errors as warnings,
+// the rest as debug
+type pionLoggers struct{}
+
+func (pionLoggers) NewLogger(scope string) logging.LeveledLogger {
+	return pionLogger{log: slog.With("scope", "pion/"+scope)}
+}
+
+type pionLogger struct {
+	log *slog.Logger
+}
+
+func (l pionLogger) Trace(msg string)                  {}
+func (l pionLogger) Tracef(format string, args ...any) {}
+func (l pionLogger) Debug(msg string)                  { l.log.Debug(msg) }
+func (l pionLogger) Debugf(format string, args ...any) { l.log.Debug(fmt.Sprintf(format, args...)) }
+func (l pionLogger) Info(msg string)                   { l.log.Debug(msg) }
+func (l pionLogger) Infof(format string, args ...any)  { l.log.Debug(fmt.Sprintf(format, args...)) }
+func (l pionLogger) Warn(msg string)                   { l.log.Warn(msg) }
+func (l pionLogger) Warnf(format string, args ...any)  { l.log.Warn(fmt.Sprintf(format, args...)) }
+func (l pionLogger) Error(msg string)                  { l.log.Warn(msg) }
+func (l pionLogger) Errorf(format string, args ...any) { l.log.Warn(fmt.Sprintf(format, args...)) }
@@ -0,0 +1,508 @@
+// Package turn runs a STUN and TURN server (RFC 5389, RFC 5766) for
+// relaying WebRTC media over UDP when peers can't connect directly. The
+// protocol is pion/turn's; this package adds the time-limited credentials
+// from Credentials, per-user quotas and bandwidth, usage accounting and the
+// peer filter. Clients reach it over UDP, TCP or TLS.
+package turn
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pionturn "github.com/pion/turn/v4"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// How often users without allocations are checked for retention
+	sweepInterval = 30 * time.Second
+
+	// How long a user's usage is kept after their last allocation closes
+	usageRetention = 24 * time.Hour
+
+	// Largest UDP payload
+	maxPacketSize = 65535
+)
+
+// Config holds the server's settings
+type Config struct {
+	// UDP address to listen on, e.g. ":3478"
+	Listen string
+
+	// TCP and TLS addresses to accept clients on as well, e.g. ":3478" and
+	// ":5349"; empty for none. TLS needs a certificate in TLS. Relays are
+	// UDP whichever way the client connects.
+	ListenTCP string
+	ListenTLS string
+	TLS       *tls.Config
+
+	// Address clients are given for their relays; the server must be
+	// reachable on it
+	PublicIP net.IP
+
+	Realm string
+
+	// Secret that signs client credentials, see Credentials
+	Secret string
+
+	// Relay ports to choose from; 0 for any
+	MinPort int
+	MaxPort int
+
+	// Per user: allocations held at once, and bytes relayed per second in
+	// both directions together (0 for no limit)
+	MaxAllocations int
+	Bandwidth      int
+
+	// CIDRs of private or shared addresses peers may be relayed to anyway,
+	// e.g. a media server on the internal network
+	AllowedPeers []string
+}
+
+// Usage is a user's use of the relay
+type Usage struct {
+	// Allocations held now
+	Allocations int `json:"allocations"`
+	// Bytes relayed since the server started, or since the user last went
+	// a day without an allocation
+	RelayedBytes uint64 `json:"relayed_bytes"`
+}
+
+// Server is a STUN and TURN server on a UDP socket and, optionally, TCP
+// and TLS listeners
+type Server struct {
+	cfg      Config
+	conn     net.PacketConn
+	tcp, tls net.Listener
+	done     chan struct{}
+
+	// Whether peers at an address may be relayed to
+	allowPeer func(net.IP) bool
+
+	mu          sync.Mutex
+	allocations map[string]*allocation // by client transport and address
+	pending     map[string]*userState  // quota held for allocations being made
+	relays      map[int]*relayConn     // open relay sockets by port
+	users       map[string]*userState
+	streams     map[net.Conn]struct{}
+	closed      bool
+}
+
+type userState struct {
+	// Allocations held, and being made
+	allocations int
+	relayed     atomic.Uint64
+	limiter     *rate.Limiter
+
+	// When the last allocation closed, while there are none
+	idleSince time.Time
+}
+
+// Listen opens the server's socket and listeners; Serve handles requests
+func Listen(cfg Config) (*Server, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("turn: secret required")
+	}
+	if cfg.PublicIP == nil {
+		return nil, errors.New("turn: public IP required")
+	}
+	if cfg.ListenTLS != "" && cfg.TLS == nil {
+		return nil, errors.New("turn: TLS listener needs a certificate")
+	}
+	if cfg.MinPort > cfg.MaxPort {
+		return nil, fmt.Errorf("turn: invalid relay port range %d-%d", cfg.MinPort, cfg.MaxPort)
+	}
+
+	var allowed []*net.IPNet
+	for _, cidr := range cfg.AllowedPeers {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("turn: invalid allowed peer range: %w", err)
+		}
+		allowed = append(allowed, ipNet)
+	}
+
+	conn, err := net.ListenPacket("udp", cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("turn: %w", err)
+	}
+
+	s := &Server{
+		cfg:         cfg,
+		conn:        conn,
+		done:        make(chan struct{}),
+		allowPeer:   peerFilter(allowed),
+		allocations: make(map[string]*allocation),
+		pending:     make(map[string]*userState),
+		relays:      make(map[int]*relayConn),
+		users:       make(map[string]*userState),
+		streams:     make(map[net.Conn]struct{}),
+	}
+
+	if cfg.ListenTCP != "" {
+		l, err := net.Listen("tcp", cfg.ListenTCP)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("turn: %w", err)
+		}
+		s.tcp = &streamListener{Listener: l, s: s}
+	}
+	if cfg.ListenTLS != "" {
+		l, err := tls.Listen("tcp", cfg.ListenTLS, cfg.TLS)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("turn: %w", err)
+		}
+		s.tls = &streamListener{Listener: l, s: s}
+	}
+	return s, nil
+}
+
+// Addr is the address the server listens on
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// TCPAddr is the address TCP clients connect to, or nil if not listening
+func (s *Server) TCPAddr() *net.TCPAddr {
+	if s.tcp == nil {
+		return nil
+	}
+	return s.tcp.Addr().(*net.TCPAddr)
+}
+
+// TLSAddr is the address TLS clients connect to, or nil if not listening
+func (s *Server) TLSAddr() *net.TCPAddr {
+	if s.tls == nil {
+		return nil
+	}
+	return s.tls.Addr().(*net.TCPAddr)
+}
+
+// Serve handles requests until ctx is cancelled or the server is closed
+func (s *Server) Serve(ctx context.Context) {
+	relays := &relayAllocator{s: s}
+	cfg := pionturn.ServerConfig{
+		PacketConnConfigs: []pionturn.PacketConnConfig{{
+			PacketConn:            s.conn,
+			RelayAddressGenerator: relays,
+			PermissionHandler:     s.permitPeer,
+		}},
+		LoggerFactory: pionLoggers{},
+		Realm:         s.cfg.Realm,
+		AuthHandler:   s.authenticate,
+		QuotaHandler:  s.reserve,
+		EventHandler: pionturn.EventHandler{
+			OnAllocationCreated: s.allocationCreated,
+			OnAllocationDeleted: s.allocationDeleted,
+			OnAllocationError:   s.allocationFailed,
+			OnPermissionCreated: s.permissionCreated,
+			OnPermissionDeleted: s.permissionDeleted,
+		},
+	}
+	for _, l := range []net.Listener{s.tcp, s.tls} {
+		if l != nil {
+			cfg.ListenerConfigs = append(cfg.ListenerConfigs, pionturn.ListenerConfig{
+				Listener:              l,
+				RelayAddressGenerator: relays,
+				PermissionHandler:     s.permitPeer,
+			})
+		}
+	}
+
+	// pion's server runs until the sockets it was given are closed
+	if _, err := pionturn.NewServer(cfg); err != nil {
+		slog.Error("turn server failed to start", "error", err)
+		s.Close()
+		return
+	}
+
+	go s.sweep(ctx)
+	select {
+	case <-ctx.Done():
+	case <-s.done:
+	}
+	s.Close()
+}
+
+// Close stops the server and releases every allocation
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	streams := make([]net.Conn, 0, len(s.streams))
+	for conn := range s.streams {
+		streams = append(streams, conn)
+	}
+	s.mu.Unlock()
+
+	// Closing the sockets ends pion's loops, which release the allocations
+	s.conn.Close()
+	for _, l := range []net.Listener{s.tcp, s.tls} {
+		if l != nil {
+			l.Close()
+		}
+	}
+	for _, conn := range streams {
+		conn.Close()
+	}
+}
+
+// Usage reports a user's allocations and relayed bytes
+func (s *Server) Usage(user string) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[user]
+	if !ok {
+		return Usage{}
+	}
+	return Usage{Allocations: u.allocations, RelayedBytes: u.relayed.Load()}
+}
+
+// authenticate returns the long-term key for a Credentials username that
+// hasn't expired. An allocation is only managed by the user who made it.
+func (s *Server) authenticate(username, realm string, client net.Addr) ([]byte, bool) {
+	user, ok := checkUsername(username, time.Now())
+	if !ok || realm != s.cfg.Realm {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	a, held := s.allocations[clientKey(client)]
+	s.mu.Unlock()
+	if held && a.user != user {
+		return nil, false
+	}
+	return pionturn.GenerateAuthKey(username, s.cfg.Realm, sign(s.cfg.Secret, username)), true
+}
+
+// reserve takes one of the user's allocations for a client about to make
+// one, if they have any left. pion then either creates the allocation or
+// reports the failure.
+func (s *Server) reserve(username, realm string, client net.Addr) bool {
+	user, ok := checkUsername(username, time.Now())
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u := s.user(user)
+	if s.cfg.MaxAllocations > 0 && u.allocations >= s.cfg.MaxAllocations {
+		return false
+	}
+	u.allocations++
+	s.pending[clientKey(client)] = u
+	return true
+}
+
+func (s *Server) allocationCreated(client, _ net.Addr, _, username, _ string, relayAddr net.Addr, _ int) {
+	// Checked when the quota was reserved
+	_, user, _ := strings.Cut(username, ":")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := clientKey(client)
+	u, ok := s.pending[key]
+	if !ok {
+		u = s.user(user)
+		u.allocations++
+	}
+	delete(s.pending, key)
+
+	relay := s.relays[relayAddr.(*net.UDPAddr).Port]
+	relay.bind(u)
+	s.allocations[key] = &allocation{user: user, usage: u, relay: relay, createdAt: time.Now()}
+
+	slog.Info("turn allocation created", "user", user, "client", key, "relay", relayAddr)
+}
+
+func (s *Server) allocationDeleted(client, _ net.Addr, _, _, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := clientKey(client)
+	a, ok := s.allocations[key]
+	if !ok {
+		return
+	}
+	delete(s.allocations, key)
+	s.release(a.usage)
+
+	slog.Info("turn allocation closed",
+		"user", a.user,
+		"client", key,
+		"duration", time.Since(a.createdAt).Round(time.Second),
+		"relayed_bytes", a.relay.relayed.Load(),
+	)
+}
+
+// allocationFailed gives back the quota reserved for an allocation that
+// couldn't be made. pion handles a client's requests one at a time, so an
+// error while a reservation is held is the allocation's.
+func (s *Server) allocationFailed(client, _ net.Addr, _, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := clientKey(client)
+	if u, ok := s.pending[key]; ok {
+		delete(s.pending, key)
+		s.release(u)
+	}
+}
+
+func (s *Server) permissionCreated(_, _ net.Addr, _, _, _ string, relayAddr net.Addr, peer net.IP) {
+	if relay := s.relay(relayAddr); relay != nil {
+		relay.permit(peer, true)
+	}
+}
+
+func (s *Server) permissionDeleted(_, _ net.Addr, _, _, _ string, relayAddr net.Addr, peer net.IP) {
+	if relay := s.relay(relayAddr); relay != nil {
+		relay.permit(peer, false)
+	}
+}
+
+func (s *Server) relay(addr net.Addr) *relayConn {
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.relays[udp.Port]
+}
+
+// permitPeer decides whether a client may relay to a peer: one in the
+// relay's address family that the peer filter allows
+func (s *Server) permitPeer(_ net.Addr, peer net.IP) bool {
+	if (peer.To4() == nil) != (s.cfg.PublicIP.To4() == nil) {
+		return false
+	}
+	return s.allowPeer(peer)
+}
+
+// sweep forgets idle users until ctx is cancelled
+func (s *Server) sweep(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expire(time.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for user, u := range s.users {
+		if u.allocations == 0 && now.Sub(u.idleSince) >= usageRetention {
+			delete(s.users, user)
+		}
+	}
+}
+
+// release gives back one of a user's allocations. Called with s.mu held.
+func (s *Server) release(u *userState) {
+	u.allocations--
+	if u.allocations == 0 {
+		u.idleSince = time.Now()
+	}
+}
+
+// user returns a user's state, creating it. Called with s.mu held.
+func (s *Server) user(user string) *userState {
+	u, ok := s.users[user]
+	if !ok {
+		limit, burst := rate.Inf, 0
+		if s.cfg.Bandwidth > 0 {
+			limit, burst = rate.Limit(s.cfg.Bandwidth), max(s.cfg.Bandwidth, maxPacketSize)
+		}
+		u = &userState{limiter: rate.NewLimiter(limit, burst)}
+		s.users[user] = u
+	}
+	return u
+}
+
+// listenRelay opens a relay socket on the port asked for, or a free one in
+// the configured range
+func (s *Server) listenRelay(port int) (*net.UDPConn, error) {
+	network := "udp4"
+	if s.cfg.PublicIP.To4() == nil {
+		network = "udp6"
+	}
+
+	if port != 0 && s.cfg.MaxPort != 0 && (port < s.cfg.MinPort || port > s.cfg.MaxPort) {
+		return nil, fmt.Errorf("port %d outside the relay range", port)
+	}
+	if port != 0 || s.cfg.MaxPort == 0 {
+		return net.ListenUDP(network, &net.UDPAddr{Port: port})
+	}
+
+	// Start somewhere random so ports aren't reused right away
+	n := s.cfg.MaxPort - s.cfg.MinPort + 1
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	start := int(binary.BigEndian.Uint32(b[:]) % uint32(n))
+
+	var err error
+	for i := 0; i < n; i++ {
+		port := s.cfg.MinPort + (start+i)%n
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP(network, &net.UDPAddr{Port: port}); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// clientKey identifies a client by its transport and address
+func clientKey(addr net.Addr) string {
+	return addr.Network() + "/" + addr.String()
+}
+
+// Shared address space (RFC 6598), used by carrier-grade NAT
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// publicPeer keeps the relay from reaching the server's own host and
+// private networks
+func publicPeer(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsUnspecified() && !ip.IsMulticast() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// peerFilter allows public peers and those in the allowed ranges
+func peerFilter(allowed []*net.IPNet) func(net.IP) bool {
+	return func(ip net.IP) bool {
+		for _, ipNet := range allowed {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return publicPeer(ip)
+	}
+}
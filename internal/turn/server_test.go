@@ -0,0 +1,611 @@
+package turn
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+const (
+	testSecret = "test-secret"
+	testRealm  = "streamz.test"
+
+	protoUDP = 17
+)
+
+func startServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	cfg.Listen = "127.0.0.1:0"
+	cfg.PublicIP = net.IPv4(127, 0, 0, 1)
+	cfg.Realm = testRealm
+	cfg.Secret = testSecret
+
+	s, err := Listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Peers in tests are on loopback
+	s.allowPeer = func(net.IP) bool { return true }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Serve(ctx)
+	t.Cleanup(cancel)
+	return s
+}
+
+// testClient speaks just enough TURN to exercise the server, over UDP or,
+// if stream is set, TCP or TLS
+type testClient struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	server *net.UDPAddr
+	stream net.Conn
+
+	username, password string
+	nonce              string
+}
+
+func newClient(t *testing.T, s *Server, user string, expiresAt time.Time) *testClient {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	username, password := Credentials(testSecret, user, expiresAt)
+	return &testClient{t: t, conn: conn, server: s.Addr(), username: username, password: password}
+}
+
+func (c *testClient) write(b []byte) {
+	c.t.Helper()
+	var err error
+	if c.stream != nil {
+		_, err = c.stream.Write(b)
+	} else {
+		_, err = c.conn.WriteToUDP(b, c.server)
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read returns the next message; over a stream, ChannelData comes with its
+// padding
+func (c *testClient) read() []byte {
+	c.t.Helper()
+	if c.stream != nil {
+		return c.readStream()
+	}
+
+	buf := make([]byte, maxPacketSize)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := c.conn.ReadFromUDP(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func (c *testClient) readStream() []byte {
+	c.t.Helper()
+	c.stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c.stream, b); err != nil {
+		c.t.Fatal(err)
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if isChannelData(b) {
+		length = (length + 3) &^ 3
+	} else {
+		length += 20 - 4
+	}
+	b = append(b, make([]byte, length)...)
+	if _, err := io.ReadFull(c.stream, b[4:]); err != nil {
+		c.t.Fatal(err)
+	}
+	return b
+}
+
+// request starts a request; attributes are added to it before do
+func (c *testClient) request(method stun.Method) *stun.Message {
+	return newMessage(method, stun.ClassRequest, stun.NewTransactionID())
+}
+
+// do sends a request, authenticated once the server has given a nonce, and
+// returns the response
+func (c *testClient) do(req *stun.Message) *stun.Message {
+	c.t.Helper()
+	var key stun.MessageIntegrity
+	if c.nonce != "" {
+		key = stun.NewLongTermIntegrity(c.username, testRealm, c.password)
+		for _, attr := range []stun.Setter{stun.NewUsername(c.username), stun.NewRealm(testRealm), stun.NewNonce(c.nonce), key} {
+			if err := attr.AddTo(req); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+	}
+	c.write(req.Raw)
+
+	resp := parse(c.t, c.read())
+	if resp.TransactionID != req.TransactionID {
+		c.t.Fatal("response to another transaction")
+	}
+	if key != nil && resp.Type.Class == stun.ClassSuccessResponse {
+		if err := key.Check(resp); err != nil {
+			c.t.Fatalf("response integrity check failed: %v", err)
+		}
+	}
+	return resp
+}
+
+func (c *testClient) allocateRequest(proto byte) *stun.Message {
+	req := c.request(stun.MethodAllocate)
+	req.Add(stun.AttrRequestedTransport, []byte{proto, 0, 0, 0})
+	return req
+}
+
+// sendTo relays data to a peer with a Send indication
+func (c *testClient) sendTo(peer *net.UDPAddr, data string) {
+	ind := newMessage(stun.MethodSend, stun.ClassIndication, stun.NewTransactionID())
+	addPeer(c.t, ind, peer)
+	ind.Add(stun.AttrData, []byte(data))
+	c.write(ind.Raw)
+}
+
+// authenticate gets a nonce from the server's challenge
+func (c *testClient) authenticate() {
+	c.t.Helper()
+	c.nonce = ""
+	resp := c.do(c.allocateRequest(protoUDP))
+	if code(resp) != stun.CodeUnauthorized {
+		c.t.Fatalf("unauthenticated allocate: code %d, want 401", code(resp))
+	}
+	var nonce stun.Nonce
+	if err := nonce.GetFrom(resp); err != nil {
+		c.t.Fatal(err)
+	}
+	c.nonce = nonce.String()
+}
+
+// allocate authenticates and allocates a relay, returning its address
+func (c *testClient) allocate() *net.UDPAddr {
+	c.t.Helper()
+	c.authenticate()
+
+	resp := c.do(c.allocateRequest(protoUDP))
+	if resp.Type.Class != stun.ClassSuccessResponse {
+		c.t.Fatalf("allocate: code %d", code(resp))
+	}
+	return xorAddr(c.t, resp, stun.AttrXORRelayedAddress)
+}
+
+// release ends the client's allocation with a zero lifetime refresh
+func (c *testClient) release() {
+	c.t.Helper()
+	req := c.request(stun.MethodRefresh)
+	req.Add(stun.AttrLifetime, []byte{0, 0, 0, 0})
+	if resp := c.do(req); resp.Type.Class != stun.ClassSuccessResponse {
+		c.t.Fatalf("release: code %d", code(resp))
+	}
+}
+
+func newMessage(method stun.Method, class stun.MessageClass, txID [stun.TransactionIDSize]byte) *stun.Message {
+	m := stun.New()
+	m.Type = stun.NewType(method, class)
+	m.TransactionID = txID
+	m.WriteHeader()
+	return m
+}
+
+func parse(t *testing.T, b []byte) *stun.Message {
+	t.Helper()
+	m := &stun.Message{Raw: append([]byte(nil), b...)}
+	if err := m.Decode(); err != nil {
+		t.Fatalf("decode %x: %v", b, err)
+	}
+	return m
+}
+
+func addPeer(t *testing.T, m *stun.Message, peer *net.UDPAddr) {
+	t.Helper()
+	if err := (stun.XORMappedAddress{IP: peer.IP, Port: peer.Port}).AddToAs(m, stun.AttrXORPeerAddress); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func xorAddr(t *testing.T, m *stun.Message, attr stun.AttrType) *net.UDPAddr {
+	t.Helper()
+	var addr stun.XORMappedAddress
+	if err := addr.GetFromAs(m, attr); err != nil {
+		t.Fatal(err)
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+}
+
+func isChannelData(b []byte) bool {
+	return len(b) >= 4 && b[0]&0xC0 == 0x40
+}
+
+func code(m *stun.Message) stun.ErrorCode {
+	var attr stun.ErrorCodeAttribute
+	if err := attr.GetFrom(m); err != nil {
+		return 0
+	}
+	return attr.Code
+}
+
+func listenPeer(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readFrom(t *testing.T, conn *net.UDPConn) []byte {
+	t.Helper()
+	buf := make([]byte, maxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestBinding(t *testing.T) {
+	s := startServer(t, Config{})
+	c := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+
+	resp := c.do(c.request(stun.MethodBinding))
+	if resp.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("binding: class %s", resp.Type.Class)
+	}
+	if mapped := xorAddr(t, resp, stun.AttrXORMappedAddress); mapped.String() != c.conn.LocalAddr().String() {
+		t.Fatalf("mapped address = %s, want %s", mapped, c.conn.LocalAddr())
+	}
+}
+
+func TestRelay(t *testing.T) {
+	s := startServer(t, Config{})
+	c := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+	relay := c.allocate()
+	peer := listenPeer(t)
+	peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+	// Nothing gets through before a permission, nor counts as relayed
+	c.sendTo(peerAddr, "too early")
+	peer.WriteToUDP([]byte("unasked"), relay)
+
+	if resp := c.do(c.request(stun.MethodCreatePermission)); resp.Type.Class != stun.ClassErrorResponse {
+		t.Fatal("permission without a peer granted")
+	}
+	req := c.request(stun.MethodCreatePermission)
+	addPeer(t, req, peerAddr)
+	if resp := c.do(req); resp.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("create permission: code %d", code(resp))
+	}
+
+	// Send indication out, Data indication back
+	c.sendTo(peerAddr, "hello peer")
+	if got := string(readFrom(t, peer)); got != "hello peer" {
+		t.Fatalf("peer got %q", got)
+	}
+
+	peer.WriteToUDP([]byte("hello client"), relay)
+	data := parse(t, c.read())
+	if v, _ := data.Get(stun.AttrData); data.Type.Method != stun.MethodData || string(v) != "hello client" {
+		t.Fatalf("data indication = %s %q", data.Type, v)
+	}
+
+	// Channels carry data without STUN framing
+	number := uint16(0x4001)
+	req = c.request(stun.MethodChannelBind)
+	req.Add(stun.AttrChannelNumber, []byte{0x40, 0x01, 0, 0})
+	addPeer(t, req, peerAddr)
+	if resp := c.do(req); resp.Type.Class != stun.ClassSuccessResponse {
+		t.Fatalf("channel bind: code %d", code(resp))
+	}
+
+	frame := binary.BigEndian.AppendUint16(nil, number)
+	frame = binary.BigEndian.AppendUint16(frame, 4)
+	frame = append(frame, "ping"...)
+	c.write(frame)
+	if got := string(readFrom(t, peer)); got != "ping" {
+		t.Fatalf("peer got %q over channel", got)
+	}
+
+	peer.WriteToUDP([]byte("pong"), relay)
+	got := c.read()
+	if !isChannelData(got) || binary.BigEndian.Uint16(got) != number || string(got[4:]) != "pong" {
+		t.Fatalf("client got %q, want pong on channel %#x", got, number)
+	}
+
+	usage := s.Usage("user-1")
+	if want := uint64(len("hello peer") + len("hello client") + len("ping") + len("pong")); usage.Allocations != 1 || usage.RelayedBytes != want {
+		t.Fatalf("usage = %+v, want 1 allocation and %d bytes", usage, want)
+	}
+
+	c.release()
+	if usage := s.Usage("user-1"); usage.Allocations != 0 {
+		t.Fatalf("allocations = %d after release", usage.Allocations)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := startServer(t, Config{})
+
+	// Expired credentials
+	expired := newClient(t, s, "user-1", time.Now().Add(-time.Minute))
+	expired.authenticate()
+	if resp := expired.do(expired.allocateRequest(protoUDP)); resp.Type.Class != stun.ClassErrorResponse {
+		t.Fatal("expired credentials accepted")
+	}
+
+	// Wrong password
+	forged := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+	forged.password = "guess"
+	forged.authenticate()
+	if resp := forged.do(forged.allocateRequest(protoUDP)); resp.Type.Class != stun.ClassErrorResponse {
+		t.Fatal("wrong password accepted")
+	}
+
+	// A nonce the server didn't issue
+	c := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+	c.nonce = "0123456789abcdef"
+	if resp := c.do(c.allocateRequest(protoUDP)); code(resp) != stun.CodeStaleNonce {
+		t.Fatalf("forged nonce: code %d, want 438", code(resp))
+	}
+	if usage := s.Usage("user-1"); usage.Allocations != 0 {
+		t.Fatalf("allocations = %d without valid credentials", usage.Allocations)
+	}
+}
+
+func TestAllocationQuota(t *testing.T) {
+	s := startServer(t, Config{MaxAllocations: 1})
+
+	first := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+	first.allocate()
+
+	// A second allocation from the same client is a mismatch
+	if resp := first.do(first.allocateRequest(protoUDP)); code(resp) != stun.CodeAllocMismatch {
+		t.Fatalf("second allocate: code %d, want 437", code(resp))
+	}
+
+	second := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+	second.authenticate()
+	if resp := second.do(second.allocateRequest(protoUDP)); code(resp) != stun.CodeAllocQuotaReached {
+		t.Fatalf("over quota: code %d, want 486", code(resp))
+	}
+
+	// Other users have their own quota
+	other := newClient(t, s, "user-2", time.Now().Add(time.Hour))
+	other.allocate()
+
+	// Released allocations free the quota
+	first.release()
+	if usage := s.Usage("user-1"); usage.Allocations != 0 {
+		t.Fatalf("allocations = %d after release", usage.Allocations)
+	}
+	second.allocate()
+}
+
+func TestAllocationFailure(t *testing.T) {
+	// The only relay port is taken
+	taken := listenPeer(t)
+	port := taken.LocalAddr().(*net.UDPAddr).Port
+	s := startServer(t, Config{MinPort: port, MaxPort: port, MaxAllocations: 1})
+
+	c := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+	c.authenticate()
+	if resp := c.do(c.allocateRequest(protoUDP)); code(resp) != stun.CodeInsufficientCapacity {
+		t.Fatalf("allocate without a free port: code %d, want 508", code(resp))
+	}
+
+	// The quota reserved for it is given back
+	if usage := s.Usage("user-1"); usage.Allocations != 0 {
+		t.Fatalf("allocations = %d after a failed allocate", usage.Allocations)
+	}
+	taken.Close()
+	c.allocate()
+}
+
+func TestUsageRetention(t *testing.T) {
+	s := startServer(t, Config{})
+	c := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+	c.allocate()
+
+	// Usage outlives the allocation for a while, then is forgotten
+	c.release()
+	s.expire(time.Now())
+	s.mu.Lock()
+	_, kept := s.users["user-1"]
+	s.mu.Unlock()
+	if !kept {
+		t.Fatal("usage dropped with the last allocation")
+	}
+
+	s.expire(time.Now().Add(usageRetention + time.Minute))
+	s.mu.Lock()
+	left := len(s.users)
+	s.mu.Unlock()
+	if left != 0 {
+		t.Fatalf("%d users kept past the retention", left)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	s := &Server{cfg: Config{Bandwidth: 100_000}, users: make(map[string]*userState)}
+	u := s.user("user-1")
+
+	// The burst covers one full packet, then the rate applies
+	if !u.allow(maxPacketSize) {
+		t.Fatal("first packet dropped")
+	}
+	if u.allow(maxPacketSize) {
+		t.Fatal("second packet allowed over the limit")
+	}
+	if u.relayed.Load() != maxPacketSize {
+		t.Fatalf("relayed = %d, want only the allowed packet", u.relayed.Load())
+	}
+}
+
+func TestPeerFilter(t *testing.T) {
+	s, err := Listen(Config{
+		Listen:       "127.0.0.1:0",
+		PublicIP:     net.IPv4(127, 0, 0, 1),
+		Secret:       testSecret,
+		AllowedPeers: []string{"10.0.5.0/24", " fd00:5::/64"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"203.0.113.10", true},
+		{"2001:db8::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"169.254.169.254", false},
+		{"224.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd12::1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"10.0.5.7", true},
+		{"fd00:5::7", true},
+	}
+	for _, tt := range tests {
+		if got := s.allowPeer(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("peer %s allowed = %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+
+	// Peers in another address family than the relay's are refused too
+	if s.permitPeer(nil, net.ParseIP("2001:db8::1")) {
+		t.Error("IPv6 peer permitted on an IPv4 relay")
+	}
+
+	if _, err := Listen(Config{Listen: "127.0.0.1:0", PublicIP: net.IPv4(127, 0, 0, 1), Secret: testSecret, AllowedPeers: []string{"10.0.5.0"}}); err == nil {
+		t.Fatal("invalid allowed peer range accepted")
+	}
+}
+
+// TestConformance checks error handling required by RFC 5766
+func TestConformance(t *testing.T) {
+	s := startServer(t, Config{})
+	peer := listenPeer(t).LocalAddr().(*net.UDPAddr)
+	other := listenPeer(t).LocalAddr().(*net.UDPAddr)
+
+	t.Run("retransmitted allocate", func(t *testing.T) {
+		c := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+		c.authenticate()
+
+		req := c.allocateRequest(protoUDP)
+		first := c.do(req)
+		if first.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("allocate: code %d", code(first))
+		}
+
+		// The same transaction again, as after a lost response
+		retry := newMessage(stun.MethodAllocate, stun.ClassRequest, req.TransactionID)
+		retry.Add(stun.AttrRequestedTransport, []byte{protoUDP, 0, 0, 0})
+		second := c.do(retry)
+		if second.Type.Class != stun.ClassSuccessResponse {
+			t.Fatalf("retransmission: code %d", code(second))
+		}
+		a := xorAddr(t, first, stun.AttrXORRelayedAddress)
+		if b := xorAddr(t, second, stun.AttrXORRelayedAddress); a.String() != b.String() {
+			t.Fatalf("retransmission relay = %s, want %s", b, a)
+		}
+		if usage := s.Usage("user-1"); usage.Allocations != 1 {
+			t.Fatalf("allocations = %d after a retransmission, want 1", usage.Allocations)
+		}
+
+		if resp := c.do(c.allocateRequest(protoUDP)); code(resp) != stun.CodeAllocMismatch {
+			t.Fatalf("new allocate over an allocation: code %d, want 437", code(resp))
+		}
+
+		c.release()
+		if usage := s.Usage("user-1"); usage.Allocations != 0 {
+			t.Fatalf("allocations = %d after release", usage.Allocations)
+		}
+	})
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		c := newClient(t, s, "user-3", time.Now().Add(time.Hour))
+		c.allocate()
+
+		// Valid credentials for someone else on the same 5-tuple
+		c.username, c.password = Credentials(testSecret, "user-4", time.Now().Add(time.Hour))
+		if resp := c.do(c.request(stun.MethodRefresh)); resp.Type.Class != stun.ClassErrorResponse {
+			t.Fatal("refresh as another user accepted")
+		}
+		if usage := s.Usage("user-3"); usage.Allocations != 1 {
+			t.Fatalf("allocations = %d, want the allocation kept", usage.Allocations)
+		}
+	})
+
+	t.Run("channel bind", func(t *testing.T) {
+		c := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+		c.allocate()
+
+		bind := func(number uint16, peer *net.UDPAddr) stun.ErrorCode {
+			req := c.request(stun.MethodChannelBind)
+			req.Add(stun.AttrChannelNumber, []byte{byte(number >> 8), byte(number), 0, 0})
+			addPeer(t, req, peer)
+			resp := c.do(req)
+			if resp.Type.Class == stun.ClassSuccessResponse {
+				return 0
+			}
+			return code(resp)
+		}
+
+		if got := bind(0x4000, peer); got != 0 {
+			t.Fatalf("bind: code %d", got)
+		}
+		// Refreshing the same binding is fine
+		if got := bind(0x4000, peer); got != 0 {
+			t.Fatalf("rebind: code %d", got)
+		}
+		if got := bind(0x4000, other); got != stun.CodeBadRequest {
+			t.Fatalf("channel moved to another peer: code %d, want 400", got)
+		}
+		if got := bind(0x4001, peer); got != stun.CodeBadRequest {
+			t.Fatalf("peer bound to a second channel: code %d, want 400", got)
+		}
+
+		req := c.request(stun.MethodChannelBind)
+		addPeer(t, req, peer)
+		if resp := c.do(req); code(resp) != stun.CodeBadRequest {
+			t.Fatalf("bind without a channel number: code %d, want 400", code(resp))
+		}
+	})
+
+	t.Run("address family", func(t *testing.T) {
+		c := newClient(t, s, "user-1", time.Now().Add(time.Hour))
+		c.allocate()
+
+		req := c.request(stun.MethodCreatePermission)
+		addPeer(t, req, &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000})
+		if resp := c.do(req); resp.Type.Class != stun.ClassErrorResponse {
+			t.Fatal("IPv6 peer permitted on an IPv4 relay")
+		}
+	})
+}
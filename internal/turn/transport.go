@@ -0,0 +1,62 @@
+package turn
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// A TCP or TLS connection is closed after this long without a message;
+	// a client keeping an allocation refreshes it sooner
+	streamIdleTimeout = time.Hour
+
+	streamWriteTimeout = 10 * time.Second
+)
+
+// streamListener hands pion TCP or TLS connections that time out when idle
+// or stuck, and that the server closes when it stops
+type streamListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	if l.s.closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	st := &streamConn{Conn: conn, s: l.s}
+	l.s.streams[st] = struct{}{}
+	return st, nil
+}
+
+type streamConn struct {
+	net.Conn
+	s *Server
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+	return c.Conn.Read(b)
+}
+
+// Write keeps a slow client from holding up the relay: pion writes from the
+// allocation's goroutine
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return c.Conn.Write(b)
+}
+
+func (c *streamConn) Close() error {
+	c.s.mu.Lock()
+	delete(c.s.streams, c)
+	c.s.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,206 @@
+package turn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+// testTLS returns a self-signed certificate for 127.0.0.1, and a client
+// config trusting it
+func testTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool}
+	return server, client
+}
+
+// newStreamClient connects to the server over TCP, or TLS if config is set
+func newStreamClient(t *testing.T, s *Server, user string, config *tls.Config) *testClient {
+	t.Helper()
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.Dial("tcp", s.TLSAddr().String(), config)
+	} else {
+		conn, err = net.Dial("tcp", s.TCPAddr().String())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	username, password := Credentials(testSecret, user, time.Now().Add(time.Hour))
+	return &testClient{t: t, stream: conn, username: username, password: password}
+}
+
+func TestStreamTransports(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	s := startServer(t, Config{ListenTCP: "127.0.0.1:0", ListenTLS: "127.0.0.1:0", TLS: serverTLS})
+
+	tests := []struct {
+		name   string
+		config *tls.Config
+	}{
+		{"tcp", nil},
+		{"tls", clientTLS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := "user-" + tt.name
+			c := newStreamClient(t, s, user, tt.config)
+
+			resp := c.do(c.request(stun.MethodBinding))
+			if mapped := xorAddr(t, resp, stun.AttrXORMappedAddress); mapped.String() != c.stream.LocalAddr().String() {
+				t.Fatalf("mapped address = %s, want %s", mapped, c.stream.LocalAddr())
+			}
+
+			// The relay is UDP whatever the client's transport
+			relay := c.allocate()
+			peer := listenPeer(t)
+			peerAddr := peer.LocalAddr().(*net.UDPAddr)
+
+			req := c.request(stun.MethodCreatePermission)
+			addPeer(t, req, peerAddr)
+			if resp := c.do(req); resp.Type.Class != stun.ClassSuccessResponse {
+				t.Fatalf("create permission: code %d", code(resp))
+			}
+
+			c.sendTo(peerAddr, "hello peer")
+			if got := string(readFrom(t, peer)); got != "hello peer" {
+				t.Fatalf("peer got %q", got)
+			}
+			peer.WriteToUDP([]byte("hello client"), relay)
+			data := parse(t, c.read())
+			if v, _ := data.Get(stun.AttrData); data.Type.Method != stun.MethodData || string(v) != "hello client" {
+				t.Fatalf("data indication = %s %q", data.Type, v)
+			}
+
+			// ChannelData is padded to 4 bytes over streams
+			number := uint16(0x4001)
+			req = c.request(stun.MethodChannelBind)
+			req.Add(stun.AttrChannelNumber, []byte{0x40, 0x01, 0, 0})
+			addPeer(t, req, peerAddr)
+			if resp := c.do(req); resp.Type.Class != stun.ClassSuccessResponse {
+				t.Fatalf("channel bind: code %d", code(resp))
+			}
+
+			frame := binary.BigEndian.AppendUint16(nil, number)
+			frame = binary.BigEndian.AppendUint16(frame, 5)
+			frame = append(frame, "hello\x00\x00\x00"...)
+			c.write(frame)
+			if got := string(readFrom(t, peer)); got != "hello" {
+				t.Fatalf("peer got %q over channel", got)
+			}
+
+			peer.WriteToUDP([]byte("xyz"), relay)
+			got := c.read()
+			if len(got) != 8 || binary.BigEndian.Uint16(got) != number || binary.BigEndian.Uint16(got[2:]) != 3 || string(got[4:7]) != "xyz" {
+				t.Fatalf("client got %q, want xyz padded on channel %#x", got, number)
+			}
+
+			// Still in step after the padding
+			if resp := c.do(c.request(stun.MethodRefresh)); resp.Type.Class != stun.ClassSuccessResponse {
+				t.Fatalf("refresh: code %d", code(resp))
+			}
+
+			// Closing the connection releases the allocation
+			c.stream.Close()
+			deadline := time.Now().Add(2 * time.Second)
+			for s.Usage(user).Allocations != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("allocation kept after the connection closed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestStreamFraming(t *testing.T) {
+	s := startServer(t, Config{ListenTCP: "127.0.0.1:0"})
+	c := newStreamClient(t, s, "user-1", nil)
+
+	// Two messages in one write, and one split across writes
+	a, b := c.request(stun.MethodBinding), c.request(stun.MethodBinding)
+	c.write(append(append([]byte(nil), a.Raw...), b.Raw...))
+	for _, req := range []*stun.Message{a, b} {
+		resp := parse(t, c.read())
+		if resp.TransactionID != req.TransactionID || resp.Type.Class != stun.ClassSuccessResponse {
+			t.Fatal("batched requests not answered in order")
+		}
+	}
+
+	req := c.request(stun.MethodBinding)
+	c.write(req.Raw[:7])
+	time.Sleep(20 * time.Millisecond)
+	c.write(req.Raw[7:])
+	if resp := parse(t, c.read()); resp.TransactionID != req.TransactionID {
+		t.Fatal("split request not answered")
+	}
+
+	// Bytes that are neither STUN nor ChannelData end the connection
+	c.write(append([]byte{0xFF, 0xFF, 0, 16}, make([]byte, 16)...))
+	c.stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.stream.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection kept after garbage: %v", err)
+	}
+}
+
+func TestStreamTLSRequired(t *testing.T) {
+	if _, err := Listen(Config{Listen: "127.0.0.1:0", PublicIP: net.IPv4(127, 0, 0, 1), Secret: testSecret, ListenTLS: "127.0.0.1:0"}); err == nil {
+		t.Fatal("TLS listener without a certificate accepted")
+	}
+
+	// Closing the server closes its stream clients
+	s, err := Listen(Config{Listen: "127.0.0.1:0", PublicIP: net.IPv4(127, 0, 0, 1), Secret: testSecret, ListenTCP: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go s.Serve(ctx)
+	c := newStreamClient(t, s, "user-1", nil)
+	c.do(c.request(stun.MethodBinding))
+
+	cancel()
+	c.stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.stream.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("stream kept open after the server closed: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vkrishna03/streamz/internal/middleware"
+)
+
+func TestOriginsAllowed(t *testing.T) {
+	origins := middleware.NewOrigins([]string{
+		"http://localhost:5173",
+		"https://*.streamz.app",
+	})
+
+	tests := []struct {
+		name   string
+		origin string
+		want   bool
+	}{
+		{name: "no origin header", origin: "", want: true},
+		{name: "exact match", origin: "http://localhost:5173", want: true},
+		{name: "exact match is case insensitive", origin: "HTTP://LOCALHOST:5173", want: true},
+		{name: "different port", origin: "http://localhost:3001", want: false},
+		{name: "wildcard subdomain", origin: "https://app.streamz.app", want: true},
+		{name: "nested wildcard subdomain", origin: "https://eu.app.streamz.app", want: true},
+		{name: "wildcard does not match apex", origin: "https://streamz.app", want: false},
+		{name: "wildcard requires scheme", origin: "http://app.streamz.app", want: false},
+		{name: "suffix lookalike", origin: "https://evilstreamz.app", want: false},
+		{name: "malformed origin", origin: "null", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := origins.Allowed(tt.origin); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSCredentialedResponse(t *testing.T) {
+	r := gin.New()
+	r.Use(middleware.CORS(middleware.NewOrigins([]string{"https://*.streamz.app"})))
+	r.GET("/ping", func(c *gin.Context) {
+		c.String(http.StatusOK, "pong")
+	})
+
+	tests := []struct {
+		name            string
+		method          string
+		origin          string
+		wantStatus      int
+		wantAllowOrigin string
+	}{
+		{
+			name:            "allowed origin is echoed",
+			method:          http.MethodGet,
+			origin:          "https://app.streamz.app",
+			wantStatus:      http.StatusOK,
+			wantAllowOrigin: "https://app.streamz.app",
+		},
+		{
+			name:            "rejected origin gets no CORS headers",
+			method:          http.MethodGet,
+			origin:          "https://evil.example.com",
+			wantStatus:      http.StatusOK,
+			wantAllowOrigin: "",
+		},
+		{
+			name:            "rejected preflight is forbidden",
+			method:          http.MethodOptions,
+			origin:          "https://evil.example.com",
+			wantStatus:      http.StatusForbidden,
+			wantAllowOrigin: "",
+		},
+		{
+			name:            "allowed preflight",
+			method:          http.MethodOptions,
+			origin:          "https://app.streamz.app",
+			wantStatus:      http.StatusNoContent,
+			wantAllowOrigin: "https://app.streamz.app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/ping", nil)
+			req.Header.Set("Origin", tt.origin)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllowOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.wantAllowOrigin)
+			}
+			if tt.wantAllowOrigin != "" && w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("expected credentialed CORS response")
+			}
+		})
+	}
+}
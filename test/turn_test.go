@@ -0,0 +1,26 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vkrishna03/streamz/internal/turn"
+)
+
+func TestTURNCredentials(t *testing.T) {
+	expiresAt := time.Unix(1760000000, 0)
+	user := "3f2504e0-4f89-11d3-9a0c-0305e82c3301"
+
+	username, credential := turn.Credentials("north-relay-secret", user, expiresAt)
+	if want := "1760000000:" + user; username != want {
+		t.Errorf("username = %q, want %q", username, want)
+	}
+	// base64(HMAC-SHA1(secret, username)), as coturn computes it
+	if want := "z5RvehPhPx5karhlfyw9VtxmXM8="; credential != want {
+		t.Errorf("credential = %q, want %q", credential, want)
+	}
+
+	if _, other := turn.Credentials("another-secret", user, expiresAt); other == credential {
+		t.Error("credential does not depend on the secret")
+	}
+}